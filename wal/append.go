@@ -0,0 +1,223 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OpenMode determines where a WAL opened on an existing directory continues
+// writing.
+type OpenMode int
+
+const (
+	// OpenNewSegment starts a new segment after the last one, leaving the
+	// existing segments untouched. It's the default.
+	OpenNewSegment OpenMode = iota
+	// OpenAppend continues writing in the last segment after its last valid
+	// record, see ContinueFrom.
+	OpenAppend
+)
+
+// WithOpenMode sets where the WAL continues writing when opened on a directory
+// that already holds segments. The default is OpenNewSegment.
+func WithOpenMode(m OpenMode) Option {
+	return func(w *WAL) {
+		w.openMode = m
+	}
+}
+
+// ContinueFrom makes the WAL continue writing in the last segment before the
+// active one, directly after its last valid record, and returns the location
+// of the end of that record. The empty active segment created when opening
+// the WAL is removed. Records logged afterwards get locations following the
+// existing records of the segment. Opening the WAL with OpenAppend does the
+// same.
+//
+// A torn record at the end of the segment, e.g. after a crash, is truncated
+// along with everything after the last valid record. Any other corruption is
+// returned as a CorruptionErr without modifying the segment, see Repair.
+//
+// The segment is only continued if it was written in the format the WAL
+// writes, with the same page size and without encryption, as the nonces used
+// in it aren't known, and if it wasn't finalized. Otherwise writing continues
+// in the active segment and its start is returned. It's an error to call
+// ContinueFrom once records were logged to the active segment.
+//
+// Continuing a segment modifies it, so callers shipping complete segments,
+// e.g. with Seal, must not have shipped it yet.
+func (w *WAL) ContinueFrom() (LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return LogLocation{}, ErrWALClosed
+	}
+	start := w.segmentStart()
+	if w.donePages*w.pageSize+w.page.alloc > start.alloc {
+		return LogLocation{}, errors.New("records were logged to the active segment")
+	}
+	cur := LogLocation{Segment: w.segment.Index(), Offset: start.alloc}
+	prev := w.segment.Index() - 1
+	if prev < 0 {
+		return cur, nil
+	}
+	if _, err := os.Stat(segmentFile(w.Dir(), prev)); os.IsNotExist(err) {
+		return cur, nil
+	}
+	s, end, hdr, err := w.openAppendSegment(prev)
+	if err != nil || s == nil {
+		return cur, err
+	}
+
+	// Replace the empty active segment.
+	active := w.segment
+	fn := active.Name()
+	if err := active.Close(); err != nil {
+		s.Close()
+		return LogLocation{}, errors.Wrap(err, "close active segment")
+	}
+	if err := os.Remove(fn); err != nil {
+		s.Close()
+		return LogLocation{}, errors.Wrap(err, "remove active segment")
+	}
+	removeEmptyDir(w.Dir(), fn)
+	w.size -= int64(start.flushed)
+	w.page.reset()
+
+	return w.continueSegment(s, end, hdr)
+}
+
+// continueLast continues writing in the last segment when opening the WAL
+// with OpenAppend. It returns false if the segment can't be continued.
+func (w *WAL) continueLast(last int) (bool, error) {
+	s, end, hdr, err := w.openAppendSegment(last)
+	if err != nil || s == nil {
+		return false, err
+	}
+	if _, err := w.continueSegment(s, end, hdr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// openAppendSegment opens segment i for appending after truncating it at the
+// end of its last valid record, which is returned along with the size of its
+// header. The returned segment is nil if it can't be continued, see
+// ContinueFrom.
+func (w *WAL) openAppendSegment(i int) (*Segment, int64, int, error) {
+	fn := segmentFile(w.Dir(), i)
+	if strings.HasSuffix(fn, finalSegmentSuffix) {
+		w.logger.Info().Int("segment", i).Msg("Not continuing finalized segment")
+		return nil, 0, 0, nil
+	}
+	end, hdr, ok, err := w.lastRecordEnd(i, fn)
+	if err != nil || !ok {
+		return nil, 0, 0, err
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, 0, 0, errors.Wrapf(err, "open segment %d", i)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, errors.Wrapf(err, "stat segment %d", i)
+	}
+	if fi.Size() > end {
+		w.logger.Info().Int("segment", i).Int64("offset", end).Int64("size", fi.Size()).Msg("Truncating segment after its last valid record")
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, 0, 0, errors.Wrapf(err, "truncate segment %d", i)
+		}
+		w.size -= fi.Size() - end
+	}
+	return &Segment{File: f, i: i, dir: w.Dir()}, end, hdr, nil
+}
+
+// lastRecordEnd reads the segment i in the file fn and returns the end of its
+// last valid record, or of its header if it has no records, and the size of
+// its header. It returns false if the segment wasn't written in the format of
+// w.
+func (w *WAL) lastRecordEnd(i int, fn string) (int64, int, bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "open segment %d", i)
+	}
+	defer f.Close()
+
+	hdr, err := readHeaderSize(f)
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "read segment %d", i)
+	}
+	// Unlike segmentBufReader, the file isn't padded to a full page, so that
+	// a fragment cut short by a crash is reported as torn rather than failing
+	// its checksum.
+	r := NewReader(bufio.NewReader(f), w.readerOptions()...)
+	end := int64(hdr)
+	for r.Next() {
+		end = r.Offset()
+	}
+	if err := r.Err(); err != nil {
+		var cerr *CorruptionErr
+		if !errors.As(err, &cerr) || cerr.Kind != CorruptionTorn {
+			if cerr != nil {
+				cerr.Dir, cerr.Segment = w.Dir(), i
+			}
+			return 0, 0, false, err
+		}
+	}
+	if hdr == 0 && end == 0 {
+		// Empty segments get the header of the WAL's format when continued.
+		return 0, 0, true, nil
+	}
+	if r.version != w.formatVersion() || r.pageSize != w.pageSize || r.nonceBase != nil {
+		w.logger.Info().Int("segment", i).Int("version", r.version).Int("page_size", r.pageSize).Msg("Not continuing segment written in another format")
+		return 0, 0, false, nil
+	}
+	return end, hdr, true, nil
+}
+
+// readHeaderSize returns the size of the segment header at the start of f, or
+// 0 if there is none.
+func readHeaderSize(f io.ReaderAt) (int, error) {
+	var hdr [3]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if recTypeFromHeader(hdr[0]) != recSegmentHeader {
+		return 0, nil
+	}
+	return recordHeaderSize + int(binary.BigEndian.Uint16(hdr[1:])), nil
+}
+
+// continueSegment makes s, whose valid data ends at end after a header of
+// size hdr, the active segment.
+func (w *WAL) continueSegment(s *Segment, end int64, hdr int) (LogLocation, error) {
+	if end == 0 {
+		// Empty segments are started like new ones.
+		if err := w.setSegment(s); err != nil {
+			return LogLocation{}, err
+		}
+		end = int64(w.segmentStart().alloc)
+	} else {
+		w.segment = s
+		w.headerSize = hdr
+		w.donePages = int(end) / w.pageSize
+		w.page.alloc = int(end) % w.pageSize
+		w.page.flushed = w.page.alloc
+		w.metrics.currentSegment.Set(float64(s.Index()))
+	}
+	loc := LogLocation{Segment: s.Index(), Offset: int(end)}
+	w.synced = loc
+	w.broadcast()
+	return loc, nil
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_OpenAppend(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts    []Option
+		corrupt func(t *testing.T, fn string)
+	}{
+		"clean": {
+			corrupt: func(*testing.T, string) {},
+		},
+		"segment_header": {
+			opts:    []Option{WithSegmentIDs(true)},
+			corrupt: func(*testing.T, string) {},
+		},
+		"torn_fragment": {
+			corrupt: func(t *testing.T, fn string) {
+				appendFile(t, fn, []byte{byte(recFull), 0, 100, 1, 2, 3, 4, 5})
+			},
+		},
+		"torn_record": {
+			corrupt: func(t *testing.T, fn string) {
+				var b [recordHeaderSize + 10]byte
+				b[0] = byte(recFirst)
+				b[2] = 10
+				binary.BigEndian.PutUint32(b[3:], crc32.Checksum(b[recordHeaderSize:], castagnoliTable))
+				appendFile(t, fn, b[:])
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_open_append")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, tc.opts...)
+			require.NoError(t, err)
+			_, err = w.Log([]byte("a"), make([]byte, pageSize))
+			require.NoError(t, err)
+			locs, err := w.Log([]byte("b"))
+			require.NoError(t, err)
+			end := locs[0].Offset + recordHeaderSize + 1
+			require.NoError(t, w.Close())
+			tc.corrupt(t, SegmentName(dir, 0))
+
+			w, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, append(tc.opts, WithOpenMode(OpenAppend))...)
+			require.NoError(t, err)
+			locs, err = w.Log([]byte("c"))
+			require.NoError(t, err)
+			require.Equal(t, LogLocation{Segment: 0, Offset: end}, locs[0])
+			require.NoError(t, w.Close())
+
+			_, last, err := Segments(dir)
+			require.NoError(t, err)
+			require.Equal(t, 0, last)
+			require.Equal(t, [][]byte{[]byte("a"), make([]byte, pageSize), []byte("b"), []byte("c")}, readAll(t, dir))
+		})
+	}
+}
+
+func TestWAL_ContinueFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_continue_from")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	loc, err := w.ContinueFrom()
+	require.NoError(t, err)
+	require.Equal(t, LogLocation{}, loc)
+	locs, err := w.Log([]byte("a"))
+	require.NoError(t, err)
+	_, err = w.ContinueFrom()
+	require.Error(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, w.segment.Index())
+	size, err := w.Size()
+	require.NoError(t, err)
+	loc, err = w.ContinueFrom()
+	require.NoError(t, err)
+	require.Equal(t, LogLocation{Segment: 0, Offset: locs[0].Offset + recordHeaderSize + 1}, loc)
+	_, err = os.Stat(SegmentName(dir, 1))
+	require.True(t, os.IsNotExist(err))
+	locs, err = w.Log([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, loc, locs[0])
+	newSize, err := w.Size()
+	require.NoError(t, err)
+	require.Less(t, newSize, size)
+	require.NoError(t, w.Close())
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, readAll(t, dir))
+
+	// Segments written in another format aren't continued.
+	w, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithPageSize(4096), WithOpenMode(OpenAppend))
+	require.NoError(t, err)
+	require.Equal(t, 1, w.segment.Index())
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_OpenAppendCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_open_append")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	_, err = w.Log([]byte("a"), []byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	writeSegmentAt(t, dir, 0, recordHeaderSize, 'x')
+
+	_, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithOpenMode(OpenAppend))
+	var cerr *CorruptionErr
+	require.True(t, errors.As(err, &cerr), "%v", err)
+	require.Equal(t, CorruptionChecksum, cerr.Kind)
+	require.Equal(t, 0, cerr.Segment)
+}
+
+// appendFile appends b to the file fn.
+func appendFile(t *testing.T, fn string, b []byte) {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
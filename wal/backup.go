@@ -0,0 +1,272 @@
+package wal
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// backupFile is a file captured for a backup along with its size at the time.
+type backupFile struct {
+	name string // Slash-separated path relative to the WAL directory.
+	info os.FileInfo
+	f    *os.File
+	size int64
+}
+
+// Backup writes a tar archive of the WAL in dir to out, containing its
+// segments, checkpoints, pending compactions and marker file. Incomplete
+// temporary files and directories are left out. The archive can be unpacked
+// with Restore.
+//
+// Files are captured with their size when Backup starts, so data appended
+// afterwards is ignored. If a WAL is writing to dir concurrently, the active
+// segment may end in a partially written batch, which readers report like a
+// record torn by a crash. Use WAL.Backup instead to back up a WAL in use.
+func Backup(dir string, out io.Writer) error {
+	files, err := openBackupFiles(dir)
+	if err != nil {
+		return err
+	}
+	return writeBackup(files, out)
+}
+
+// Backup writes a tar archive of the WAL to out like the package level Backup.
+// The files are captured while no records are being written, so the archive
+// holds complete batches only. Records logged while the archive is being
+// written aren't part of it. The WAL is only blocked while capturing the
+// files, not while writing the archive.
+func (w *WAL) Backup(out io.Writer) error {
+	w.mtx.Lock()
+	if w.closed {
+		w.mtx.Unlock()
+		return ErrWALClosed
+	}
+	files, err := openBackupFiles(w.Dir())
+	w.mtx.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return writeBackup(files, out)
+}
+
+// openBackupFiles opens all files of the WAL in dir. Open files remain
+// readable even if they're removed by a later truncation.
+func openBackupFiles(dir string) (files []backupFile, err error) {
+	defer func() {
+		if err != nil {
+			closeBackupFiles(files)
+		}
+	}()
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, backupFile{name: filepath.ToSlash(rel), info: info, f: f, size: info.Size()})
+		return nil
+	})
+	return files, errors.Wrap(err, "capture files")
+}
+
+func closeBackupFiles(files []backupFile) {
+	for _, bf := range files {
+		bf.f.Close()
+	}
+}
+
+// writeBackup writes files to a tar archive in out and closes them.
+func writeBackup(files []backupFile, out io.Writer) error {
+	defer closeBackupFiles(files)
+
+	tw := tar.NewWriter(out)
+	for _, bf := range files {
+		hdr, err := tar.FileInfoHeader(bf.info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = bf.name
+		hdr.Size = bf.size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header of %s", bf.name)
+		}
+		if _, err := io.Copy(tw, io.NewSectionReader(bf.f, 0, bf.size)); err != nil {
+			return errors.Wrapf(err, "write %s", bf.name)
+		}
+	}
+	return tw.Close()
+}
+
+// Restore unpacks a tar archive written by Backup into dir, which is created
+// if it doesn't exist and must be empty otherwise. The files are synced before
+// Restore returns. If it fails, dir may hold a partial restore, which must be
+// removed before trying again.
+func Restore(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return errors.Errorf("restore into non-empty dir %s", dir)
+	}
+
+	dirs := map[string]struct{}{dir: {}}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read archive")
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("invalid file name %q in archive", hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return errors.Errorf("unexpected entry %q of type %c in archive", hdr.Name, hdr.Typeflag)
+		}
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			return errors.Wrap(err, "create dir")
+		}
+		dirs[filepath.Dir(fn)] = struct{}{}
+		if err := restoreFile(fn, os.FileMode(hdr.Mode).Perm(), tr); err != nil {
+			return errors.Wrapf(err, "restore %s", hdr.Name)
+		}
+	}
+	for d := range dirs {
+		if err := syncDir(d); err != nil {
+			return errors.Wrapf(err, "sync dir %s", d)
+		}
+	}
+	return nil
+}
+
+// restoreFile writes the contents of r to a new file fn and syncs it.
+func restoreFile(fn string, perm os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SegmentRef refers to a segment along with its size when it was listed.
+type SegmentRef struct {
+	Dir   string
+	Index int
+	Size  int64
+}
+
+// SegmentsSince returns the segments in dir with an index greater than after,
+// sorted by index, for shipping them in an incremental backup. The last one
+// is typically the active segment, which keeps growing after it was listed.
+// Each segment's size is captured once, so shipping the bytes up to it with
+// SegmentWriterTo, and the bytes from there on in the next backup, neither
+// misses nor duplicates data.
+//
+// The position reached by a backup is the LogLocation made of the index and
+// size of the last segment shipped. As that segment may still grow, the next
+// backup must start with it: call SegmentsSince with the position's segment
+// minus one, and ship the first segment from the position's offset if it's the
+// same segment, or segments in full otherwise.
+//
+// If a WAL is writing to dir concurrently, the last segment may end in a
+// partially written batch, which the next backup completes. Use
+// WAL.SegmentsSince to capture sizes at the end of a batch instead.
+func SegmentsSince(dir string, after int) ([]SegmentRef, error) {
+	refs, err := readSegmentRefs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	var segs []SegmentRef
+	for _, r := range refs {
+		if r.index <= after {
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(dir, r.name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat segment %d", r.index)
+		}
+		segs = append(segs, SegmentRef{Dir: dir, Index: r.index, Size: stat.Size()})
+	}
+	return segs, nil
+}
+
+// SegmentsSince returns the segments of the WAL after the given index like the
+// package level SegmentsSince. The sizes are captured while no records are
+// being written, so each segment ends at the end of a batch.
+func (w *WAL) SegmentsSince(after int) ([]SegmentRef, error) {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	return SegmentsSince(w.Dir(), after)
+}
+
+// SegmentWriterTo returns a writer of the bytes of the segment from offset up
+// to its size in ref. Bytes appended to the segment after ref was listed
+// aren't written.
+func SegmentWriterTo(ref SegmentRef, offset int64) io.WriterTo {
+	return &segmentWriterTo{ref: ref, offset: offset}
+}
+
+type segmentWriterTo struct {
+	ref    SegmentRef
+	offset int64
+}
+
+func (s *segmentWriterTo) WriteTo(out io.Writer) (int64, error) {
+	if s.offset < 0 || s.offset > s.ref.Size {
+		return 0, errors.Errorf("offset %d out of segment %d of size %d", s.offset, s.ref.Index, s.ref.Size)
+	}
+	f, err := os.Open(segmentFile(s.ref.Dir, s.ref.Index))
+	if err != nil {
+		return 0, errors.Wrapf(err, "open segment %d", s.ref.Index)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(out, io.NewSectionReader(f, s.offset, s.ref.Size-s.offset))
+	if err == nil && s.offset+n < s.ref.Size {
+		err = errors.Errorf("segment %d shrank below %d bytes", s.ref.Index, s.ref.Size)
+	}
+	return n, errors.Wrapf(err, "write segment %d", s.ref.Index)
+}
@@ -0,0 +1,189 @@
+package wal
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_backup")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	read := func(dir string) []byte {
+		r, err := NewCheckpointedReader(dir)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, r.Close())
+		}()
+		var recs []byte
+		for r.Next() {
+			recs = append(recs, r.Record()[0])
+		}
+		require.NoError(t, r.Err())
+		return recs
+	}
+	restore := func(archive []byte) string {
+		restored := filepath.Join(dir, "restored")
+		require.NoError(t, os.RemoveAll(restored))
+		require.NoError(t, Restore(bytes.NewReader(archive), restored))
+		return restored
+	}
+
+	walDir := filepath.Join(dir, "wal")
+	w, err := NewSize(zerolog.Nop(), nil, walDir, pageSize*4, true)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		if i > 0 {
+			require.NoError(t, w.NextSegment())
+		}
+		_, err := w.Log([]byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, pageSize))
+		require.NoError(t, err)
+	}
+	_, err = w.CheckpointAndTruncate(LogLocation{Segment: 3}, func(rec []byte) bool { return len(rec) == 1 })
+	require.NoError(t, err)
+	expected := read(walDir)
+
+	// Records logged after the backup aren't part of it.
+	var buf bytes.Buffer
+	require.NoError(t, w.Backup(&buf))
+	_, err = w.Log([]byte{6})
+	require.NoError(t, err)
+
+	restored := restore(buf.Bytes())
+	require.Equal(t, expected, read(restored))
+
+	// The restored WAL can be written to.
+	rw, err := New(zerolog.Nop(), nil, restored, true)
+	require.NoError(t, err)
+	_, err = rw.Log([]byte{7})
+	require.NoError(t, err)
+	require.NoError(t, rw.Close())
+	require.Equal(t, append(expected, 7), read(restored))
+
+	// Backing up a closed WAL from its directory captures everything.
+	require.NoError(t, w.Close())
+	require.Equal(t, ErrWALClosed, w.Backup(&buf))
+	buf.Reset()
+	require.NoError(t, Backup(walDir, &buf))
+	require.Equal(t, read(walDir), read(restore(buf.Bytes())))
+
+	// Restoring requires an empty directory.
+	require.Error(t, Restore(bytes.NewReader(buf.Bytes()), walDir))
+}
+
+func TestRestore_InvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_restore")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../escaped", Mode: 0666, Size: 1, Typeflag: tar.TypeReg}))
+	_, err = tw.Write([]byte{1})
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	require.Error(t, Restore(&buf, filepath.Join(dir, "restored")))
+	_, err = os.Stat(filepath.Join(dir, "escaped"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSegmentsSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_segments_since")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	require.NoError(t, os.Mkdir(dst, 0777))
+
+	w, err := NewSize(zerolog.Nop(), nil, src, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// ship appends the data written since pos to the segments in dst and
+	// returns the new position.
+	ship := func(pos LogLocation) LogLocation {
+		segs, err := w.SegmentsSince(pos.Segment - 1)
+		require.NoError(t, err)
+		for _, seg := range segs {
+			var offset int64
+			if seg.Index == pos.Segment {
+				offset = int64(pos.Offset)
+			}
+			f, err := os.OpenFile(SegmentName(dst, seg.Index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+			require.NoError(t, err)
+			n, err := SegmentWriterTo(seg, offset).WriteTo(f)
+			require.NoError(t, err)
+			require.Equal(t, seg.Size-offset, n)
+			require.NoError(t, f.Close())
+			pos = LogLocation{Segment: seg.Index, Offset: int(seg.Size)}
+		}
+		return pos
+	}
+	read := func(dir string) [][]byte {
+		sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+		require.NoError(t, err)
+		defer sr.Close()
+		r := NewReader(sr)
+		var recs [][]byte
+		for r.Next() {
+			recs = append(recs, append([]byte{}, r.Record()...))
+		}
+		require.NoError(t, r.Err())
+		return recs
+	}
+
+	var (
+		recs [][]byte
+		pos  LogLocation
+	)
+	for i := 0; i < 10; i++ {
+		// Grow the active segment between backups and move on to new ones.
+		for j := 0; j < 3; j++ {
+			rec := bytes.Repeat([]byte{byte(i), byte(j)}, 100+i*1000)
+			_, err := w.Log(rec)
+			require.NoError(t, err)
+			recs = append(recs, rec)
+		}
+		pos = ship(pos)
+		require.Equal(t, recs, read(dst))
+	}
+	require.Greater(t, pos.Segment, 0)
+
+	// Nothing is shipped without new writes.
+	require.Equal(t, pos, ship(pos))
+
+	first, last, err := Segments(src)
+	require.NoError(t, err)
+	for i := first; i <= last; i++ {
+		want, err := ioutil.ReadFile(SegmentName(src, i))
+		require.NoError(t, err)
+		got, err := ioutil.ReadFile(SegmentName(dst, i))
+		require.NoError(t, err)
+		require.Equal(t, want, got, "segment %d", i)
+	}
+
+	segs, err := SegmentsSince(src, last-1)
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+	require.Equal(t, last, segs[0].Index)
+	_, err = SegmentWriterTo(segs[0], segs[0].Size+1).WriteTo(ioutil.Discard)
+	require.Error(t, err)
+
+	require.NoError(t, w.Close())
+	_, err = w.SegmentsSince(-1)
+	require.Equal(t, ErrWALClosed, err)
+}
@@ -0,0 +1,305 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/onflow/wal/fileutil"
+)
+
+// checkpointPrefix is the name prefix of checkpoint directories. A checkpoint
+// directory holds segments with the state of all main segments up to and
+// including the index in its name, e.g. checkpoint.00000005.
+const checkpointPrefix = "checkpoint."
+
+// lastCheckpoint returns the directory name and index of the most recent
+// checkpoint in dir. The index is -1 if there is no checkpoint.
+func lastCheckpoint(dir string) (string, int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", -1, err
+	}
+	name, last := "", -1
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasPrefix(f.Name(), checkpointPrefix) {
+			continue
+		}
+		// Incomplete checkpoints have a suffix and are skipped.
+		idx, err := strconv.Atoi(strings.TrimPrefix(f.Name(), checkpointPrefix))
+		if err != nil {
+			continue
+		}
+		if idx > last {
+			name, last = f.Name(), idx
+		}
+	}
+	return name, last, nil
+}
+
+// segmentRangesEmpty returns whether none of ranges contains a segment.
+func segmentRangesEmpty(ranges []SegmentRange) (bool, error) {
+	for _, sr := range ranges {
+		first, last, err := Segments(sr.Dir)
+		if err != nil {
+			return false, errors.Wrapf(err, "list segments in dir:%v", sr.Dir)
+		}
+		if last >= 0 && (sr.First < 0 || last >= sr.First) && (sr.Last < 0 || first <= sr.Last) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// NewCheckpointedReader returns a reader over the most recent checkpoint in
+// dir followed by the main segments after the range it covers, so a WAL can be
+// replayed as a single stream. Without a checkpoint it reads all main segments.
+// The reader must be closed to release the segments. The options configure
+// the reader, e.g. WithDecryption for an encrypted WAL.
+func NewCheckpointedReader(dir string, opts ...ReaderOption) (*Reader, error) {
+	name, idx, err := lastCheckpoint(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "find last checkpoint")
+	}
+	var ranges []SegmentRange
+	if idx >= 0 {
+		ranges = append(ranges, SegmentRange{Dir: filepath.Join(dir, name), First: -1, Last: -1})
+	}
+	ranges = append(ranges, SegmentRange{Dir: dir, First: idx + 1, Last: -1})
+
+	empty, err := segmentRangesEmpty(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return NewReader(bytes.NewReader(nil), opts...), nil
+	}
+
+	sr, err := NewSegmentsRangeReader(zerolog.Nop(), ranges...)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReader(sr, opts...)
+	r.closer = sr
+	return r, nil
+}
+
+// CheckpointResult describes a checkpoint created by CheckpointAndTruncate.
+type CheckpointResult struct {
+	Dir     string // Directory of the checkpoint.
+	Last    int    // Index of the last segment covered by the checkpoint.
+	Kept    int    // Number of records written to the checkpoint.
+	Dropped int    // Number of records dropped from the checkpoint.
+}
+
+// CheckpointAndTruncate writes the records of the previous checkpoint and of
+// all segments before upTo for which keep returns true into a new checkpoint
+// and then removes the superseded checkpoints and segments. Checkpoints cover
+// whole segments, so upTo must point to the start of a segment, at most the
+// active one. The record passed to keep is only valid until keep returns.
+//
+// The checkpoint is written to a temporary directory, synced and then renamed,
+// which makes it visible atomically. Only after that are older checkpoints and
+// the covered segments removed. After a crash at any point, the directory
+// holds either the previous or the new checkpoint along with all segments it
+// doesn't cover, possibly with some already superseded ones, which
+// NewCheckpointedReader reads correctly. Leftover temporary directories are
+// ignored and removed by the next successful checkpoint.
+func (w *WAL) CheckpointAndTruncate(upTo LogLocation, keep func([]byte) bool) (*CheckpointResult, error) {
+	w.mtx.RLock()
+	closed, active := w.closed, w.segment.Index()
+	w.mtx.RUnlock()
+
+	if closed {
+		return nil, ErrWALClosed
+	}
+	if upTo.Offset != 0 || upTo.Segment > active {
+		return nil, errors.Errorf("checkpoint must end at the start of a segment up to %d, got %+v", active, upTo)
+	}
+	prevName, prevIdx, err := lastCheckpoint(w.Dir())
+	if err != nil {
+		return nil, errors.Wrap(err, "find last checkpoint")
+	}
+	last := upTo.Segment - 1
+	if last <= prevIdx {
+		return nil, errors.Errorf("segments up to %d are already checkpointed", prevIdx)
+	}
+	res := &CheckpointResult{
+		Dir:  filepath.Join(w.Dir(), fmt.Sprintf("%s%08d", checkpointPrefix, last)),
+		Last: last,
+	}
+
+	// Write the checkpoint.
+	tmpDir := res.Dir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, errors.Wrap(err, "remove stale checkpoint")
+	}
+	var ranges []SegmentRange
+	if prevIdx >= 0 {
+		ranges = append(ranges, SegmentRange{Dir: filepath.Join(w.Dir(), prevName), First: -1, Last: -1})
+	}
+	ranges = append(ranges, SegmentRange{Dir: w.Dir(), First: prevIdx + 1, Last: last})
+
+	if err := w.writeCheckpoint(tmpDir, ranges, keep, res); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "write checkpoint")
+	}
+	if err := w.checkpointStep("written"); err != nil {
+		return nil, err
+	}
+	if err := fileutil.Rename(tmpDir, res.Dir); err != nil {
+		return nil, errors.Wrap(err, "commit checkpoint")
+	}
+	if err := w.checkpointStep("committed"); err != nil {
+		return nil, err
+	}
+
+	// Remove what the checkpoint supersedes, including checkpoints left behind
+	// by an earlier interrupted call.
+	if err := deleteCheckpoints(w.Dir(), last); err != nil {
+		return nil, errors.Wrap(err, "remove previous checkpoints")
+	}
+	if err := w.checkpointStep("cleaned"); err != nil {
+		return nil, err
+	}
+	if err := w.Truncate(upTo.Segment); err != nil {
+		return nil, errors.Wrap(err, "truncate segments")
+	}
+
+	w.mtx.Lock()
+	w.lastCheckpoint, w.lastCheckpointTime = upTo, time.Now()
+	w.mtx.Unlock()
+	return res, nil
+}
+
+// LastCheckpoint returns the end of the last checkpoint created by the WAL
+// since it was opened, which is the start of the first segment it doesn't
+// cover, and the time it completed. The time is zero if there was none.
+func (w *WAL) LastCheckpoint() (LogLocation, time.Time) {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	return w.lastCheckpoint, w.lastCheckpointTime
+}
+
+// maybeAutoCheckpoint starts an automatic checkpoint if one is due, see
+// WithAutoCheckpoint. It must be called with w.mtx held.
+func (w *WAL) maybeAutoCheckpoint() {
+	upTo := LogLocation{Segment: w.segment.Index()}
+	if w.sinceCheckpoint < w.autoCheckpointBytes || w.checkpointing || w.closed || upTo.Segment <= w.autoCheckpointSeg {
+		return
+	}
+	w.sinceCheckpoint = 0
+	w.autoCheckpointSeg = upTo.Segment
+	w.checkpointing = true
+	w.checkpoints.Add(1)
+
+	go func() {
+		defer w.checkpoints.Done()
+		defer func() {
+			w.mtx.Lock()
+			w.checkpointing = false
+			w.mtx.Unlock()
+		}()
+
+		// Segments may have been checkpointed by hand in the meantime.
+		_, prevIdx, err := lastCheckpoint(w.Dir())
+		if err != nil {
+			w.logger.Error().Err(err).Msg("find last checkpoint")
+			return
+		}
+		if prevIdx >= upTo.Segment-1 {
+			return
+		}
+		res, err := w.CheckpointAndTruncate(upTo, w.autoCheckpointKeep)
+		if errors.Is(err, ErrWALClosed) {
+			return
+		}
+		if err != nil {
+			w.logger.Error().Err(err).Int("segment", upTo.Segment).Msg("automatic checkpoint")
+			return
+		}
+		w.logger.Debug().Str("dir", res.Dir).Int("kept", res.Kept).Int("dropped", res.Dropped).Msg("automatic checkpoint")
+	}()
+}
+
+// writeCheckpoint writes the records in ranges for which keep returns true to
+// a new WAL in dir.
+func (w *WAL) writeCheckpoint(dir string, ranges []SegmentRange, keep func([]byte) bool, res *CheckpointResult) error {
+	cw, err := NewSize(w.logger, nil, dir, w.segmentSize, w.compress, w.formatOptions()...)
+	if err != nil {
+		return errors.Wrap(err, "create checkpoint WAL")
+	}
+	if err := copyRecords(cw, ranges, keep, res, w.readerOptions()...); err != nil {
+		cw.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// copyRecords logs the records in ranges for which keep returns true to cw.
+func copyRecords(cw *WAL, ranges []SegmentRange, keep func([]byte) bool, res *CheckpointResult, opts ...ReaderOption) error {
+	empty, err := segmentRangesEmpty(ranges)
+	if err != nil || empty {
+		return err
+	}
+	sr, err := NewSegmentsRangeReader(zerolog.Nop(), ranges...)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+
+	r := NewReader(sr, opts...)
+	for r.Next() {
+		if !keep(r.Record()) {
+			res.Dropped++
+			continue
+		}
+		if _, err := cw.log(r.Record(), r.extBuf, false, 0); err != nil {
+			return err
+		}
+		res.Kept++
+	}
+	return r.Err()
+}
+
+// deleteCheckpoints removes all checkpoints in dir older than the one with
+// the given index as well as all incomplete ones.
+func deleteCheckpoints(dir string, index int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasPrefix(f.Name(), checkpointPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(f.Name(), checkpointPrefix)
+		idx, err := strconv.Atoi(strings.TrimSuffix(name, ".tmp"))
+		if err != nil || (idx >= index && !strings.HasSuffix(name, ".tmp")) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointStep calls the checkpoint hook, if any, after the given step.
+func (w *WAL) checkpointStep(step string) error {
+	if w.checkpointHook == nil {
+		return nil
+	}
+	return w.checkpointHook(step)
+}
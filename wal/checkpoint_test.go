@@ -0,0 +1,246 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCheckpointedReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_checkpointed_reader")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	read := func() [][]byte {
+		r, err := NewCheckpointedReader(dir)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, r.Close())
+		}()
+		recs := [][]byte{}
+		for r.Next() {
+			recs = append(recs, append([]byte{}, r.Record()...))
+		}
+		require.NoError(t, r.Err())
+		return recs
+	}
+	// writeSegments writes a segment with one record for each of recs to dir.
+	writeSegments := func(dir string, recs ...string) {
+		w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+		require.NoError(t, err)
+		for i, rec := range recs {
+			if i > 0 {
+				require.NoError(t, w.NextSegment())
+			}
+			_, err := w.Log([]byte(rec))
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+	}
+
+	require.Equal(t, [][]byte{}, read())
+
+	writeSegments(dir, "0", "1", "2", "3")
+	require.Equal(t, [][]byte{[]byte("0"), []byte("1"), []byte("2"), []byte("3")}, read())
+
+	writeSegments(filepath.Join(dir, fmt.Sprintf("%s%08d", checkpointPrefix, 1)), "cp1")
+	require.Equal(t, [][]byte{[]byte("cp1"), []byte("2"), []byte("3")}, read())
+
+	// Only the latest complete checkpoint is read.
+	writeSegments(filepath.Join(dir, fmt.Sprintf("%s%08d", checkpointPrefix, 2)), "cp2a", "cp2b")
+	writeSegments(filepath.Join(dir, fmt.Sprintf("%s%08d.tmp", checkpointPrefix, 3)), "cp3")
+	require.Equal(t, [][]byte{[]byte("cp2a"), []byte("cp2b"), []byte("3")}, read())
+
+	// A checkpoint covering all segments.
+	writeSegments(filepath.Join(dir, fmt.Sprintf("%s%08d", checkpointPrefix, 4)), "cp4")
+	require.Equal(t, [][]byte{[]byte("cp4")}, read())
+}
+
+func TestCheckpointAndTruncate(t *testing.T) {
+	// keep drops records with odd values.
+	keep := func(rec []byte) bool { return rec[0]%2 == 0 }
+
+	// logSegments logs one record to each of n new segments, starting with the active one.
+	logSegments := func(w *WAL, from, n int) {
+		for i := from; i < from+n; i++ {
+			if i > from {
+				require.NoError(t, w.NextSegment())
+			}
+			_, err := w.Log([]byte{byte(i)})
+			require.NoError(t, err)
+		}
+	}
+	read := func(dir string) []byte {
+		r, err := NewCheckpointedReader(dir)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, r.Close())
+		}()
+		var recs []byte
+		for r.Next() {
+			recs = append(recs, r.Record()[0])
+		}
+		require.NoError(t, r.Err())
+		return recs
+	}
+
+	for _, crashAfter := range []string{"", "written", "committed", "cleaned"} {
+		t.Run(crashAfter, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_checkpoint")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+			require.NoError(t, err)
+			logSegments(w, 0, 6)
+
+			_, err = w.CheckpointAndTruncate(LogLocation{Segment: 2, Offset: 1}, keep)
+			require.Error(t, err)
+
+			res, err := w.CheckpointAndTruncate(LogLocation{Segment: 2}, keep)
+			require.NoError(t, err)
+			require.Equal(t, &CheckpointResult{
+				Dir:     filepath.Join(dir, fmt.Sprintf("%s%08d", checkpointPrefix, 1)),
+				Last:    1,
+				Kept:    1,
+				Dropped: 1,
+			}, res)
+			require.Equal(t, []byte{0, 2, 3, 4, 5}, read(dir))
+
+			_, err = w.CheckpointAndTruncate(LogLocation{Segment: 2}, keep)
+			require.Error(t, err)
+
+			// Crash while creating the next checkpoint.
+			errCrash := errors.New("crash")
+			w.checkpointHook = func(step string) error {
+				if step == crashAfter {
+					return errCrash
+				}
+				return nil
+			}
+			_, err = w.CheckpointAndTruncate(LogLocation{Segment: 5}, keep)
+			if crashAfter == "" {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, errCrash, err)
+			}
+			require.NoError(t, w.Close())
+
+			switch crashAfter {
+			case "written":
+				require.Equal(t, []byte{0, 2, 3, 4, 5}, read(dir))
+			default:
+				require.Equal(t, []byte{0, 2, 4, 5}, read(dir))
+			}
+
+			// Checkpointing after a restart cleans up.
+			w, err = NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+			require.NoError(t, err)
+			logSegments(w, 6, 2)
+			_, err = w.CheckpointAndTruncate(LogLocation{Segment: 7}, keep)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			require.Equal(t, []byte{0, 2, 4, 6, 7}, read(dir))
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			require.Equal(t, []string{"00000007", cleanShutdownFile, markerFile, fmt.Sprintf("%s%08d", checkpointPrefix, 6)}, names)
+		})
+	}
+}
+
+func TestAutoCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_auto_checkpoint")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	var (
+		blocked = make(chan struct{})
+		release = make(chan struct{})
+		once    sync.Once
+	)
+	// The first checkpoint blocks until released to show that writes go on.
+	keep := func(rec []byte) bool {
+		once.Do(func() {
+			close(blocked)
+			<-release
+		})
+		return rec[0]%2 == 0
+	}
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, WithAutoCheckpoint(4*pageSize, keep))
+	require.NoError(t, err)
+
+	loc, tm := w.LastCheckpoint()
+	require.Equal(t, LogLocation{}, loc)
+	require.True(t, tm.IsZero())
+
+	type logged struct {
+		rec []byte
+		loc LogLocation
+	}
+	var recs []logged
+	logRecs := func(n int) {
+		for i := 0; i < n; i++ {
+			rec := make([]byte, pageSize/2)
+			rec[0] = byte(len(recs))
+			locs, err := w.Log(rec)
+			require.NoError(t, err)
+			recs = append(recs, logged{rec: rec, loc: locs[0]})
+		}
+	}
+	logRecs(20)
+	<-blocked
+	logRecs(40)
+	w.mtx.RLock()
+	require.True(t, w.checkpointing)
+	w.mtx.RUnlock()
+	close(release)
+
+	require.Eventually(t, func() bool {
+		loc, _ := w.LastCheckpoint()
+		// A later checkpoint covers the records logged while blocked.
+		logRecs(1)
+		return loc.Segment > recs[40].loc.Segment
+	}, 10*time.Second, time.Millisecond)
+	require.NoError(t, w.Close())
+
+	last, tm := w.LastCheckpoint()
+	require.False(t, tm.IsZero())
+	first, _, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, last.Segment, first)
+
+	var want [][]byte
+	for _, l := range recs {
+		if l.loc.Segment >= last.Segment || l.rec[0]%2 == 0 {
+			want = append(want, l.rec)
+		}
+	}
+	r, err := NewCheckpointedReader(dir)
+	require.NoError(t, err)
+	defer r.Close()
+	var got [][]byte
+	for r.Next() {
+		got = append(got, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, want, got)
+}
@@ -0,0 +1,299 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/onflow/wal/fileutil"
+)
+
+const (
+	compactTmpDir    = "compact.tmp"
+	compactDirPrefix = "compact."
+)
+
+// CompactByKey rewrites the WAL so that only the latest record for each key
+// remains, with keys extracted from records by keyOf. Records for which keyOf
+// returns nil are always kept. Surviving records keep their relative order.
+//
+// It returns a mapping from the old location of each surviving record to its
+// new one. Locations of records obtained before compaction are invalid
+// afterwards. See rewrite for the crash-safety guarantees.
+func (w *WAL) CompactByKey(keyOf func([]byte) []byte) (map[LogLocation]LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	start, end, err := w.completeSegments()
+	if err != nil {
+		return nil, err
+	}
+	// Find the latest record for each key first.
+	latest := map[string]LogLocation{}
+	err = w.scanAll(start, end, func(r *Reader, loc LogLocation) error {
+		if k := keyOf(r.Record()); k != nil {
+			latest[string(k)] = loc
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "find latest records")
+	}
+	return w.rewrite(filepath.Join(w.Dir(), compactTmpDir), start, end, func(rec []byte, loc LogLocation) ([]byte, bool, error) {
+		k := keyOf(rec)
+		return rec, k == nil || latest[string(k)] == loc, nil
+	})
+}
+
+// Transform rewrites the WAL by passing each record to fn, which returns the
+// record to write in its place and whether to keep it at all. An error from fn
+// aborts the rewrite and leaves the WAL unchanged. The record passed to fn is
+// only valid until fn returns.
+//
+// It returns a mapping from the old location of each kept record to its new
+// one. Locations of records obtained before the transformation are invalid
+// afterwards. See rewrite for the crash-safety guarantees.
+func (w *WAL) Transform(fn func(record []byte) ([]byte, bool, error)) (map[LogLocation]LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	start, end, err := w.completeSegments()
+	if err != nil {
+		return nil, err
+	}
+	return w.rewrite(filepath.Join(w.Dir(), compactTmpDir), start, end, func(rec []byte, _ LogLocation) ([]byte, bool, error) {
+		return fn(rec)
+	})
+}
+
+// Compact rewrites all valid records of the WAL in order into densely packed
+// segments, reclaiming the space left at the end of segments, e.g. by large
+// records that didn't fit into the rest of a segment, and speeding up
+// sequential reads.
+//
+// The records are written to a fresh WAL in destDir, which must not exist or
+// be empty, and must be on the same file system as the WAL's directory. An
+// empty destDir uses a temporary directory within it. Renaming destDir into
+// the WAL's directory is the commit point, after which it's gone and the new
+// segments replace the old ones. If Compact fails before, the WAL is
+// unchanged, though a crash may leave destDir behind for the caller to remove.
+//
+// It returns a mapping from the old location of each record to its new one,
+// for callers maintaining external indexes. Locations of records obtained
+// before compaction are invalid afterwards.
+func (w *WAL) Compact(destDir string) (map[LogLocation]LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	if destDir == "" {
+		destDir = filepath.Join(w.Dir(), compactTmpDir)
+	} else if files, err := ioutil.ReadDir(destDir); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read destination dir")
+	} else if len(files) > 0 {
+		return nil, errors.Errorf("destination dir %s is not empty", destDir)
+	}
+	start, end, err := w.completeSegments()
+	if err != nil {
+		return nil, err
+	}
+	return w.rewrite(destDir, start, end, func(rec []byte, _ LogLocation) ([]byte, bool, error) {
+		return rec, true, nil
+	})
+}
+
+// completeSegments flushes and completes the active page and returns the range
+// of all records in the WAL.
+// It must be called with w.mtx held.
+func (w *WAL) completeSegments() (start, end LogLocation, err error) {
+	if w.page.alloc > 0 {
+		if err := w.flushPage(true); err != nil {
+			return start, end, errors.Wrap(err, "flush page")
+		}
+	}
+	first, _, err := Segments(w.Dir())
+	if err != nil {
+		return start, end, err
+	}
+	return LogLocation{Segment: first}, LogLocation{Segment: w.segment.Index(), Offset: w.donePages * w.pageSize}, nil
+}
+
+// rewrite replaces the records in [start, end) with the ones returned by fn,
+// dropping those for which fn doesn't return true, and returns the mapping of
+// old to new locations of the remaining records. The new segments are written
+// to tmpDir, whose contents are removed first. The extension header of each
+// record is retained. Writing continues in a new segment afterwards.
+// It must be called with w.mtx held.
+//
+// The new segments are written to the temporary directory first. Renaming it is
+// the commit point, after which the old segments are replaced. A crash before
+// that leaves the WAL untouched. A crash after it is rolled forward the next
+// time the WAL is opened.
+func (w *WAL) rewrite(tmpDir string, start, end LogLocation, fn func(rec []byte, loc LogLocation) ([]byte, bool, error)) (map[LogLocation]LogLocation, error) {
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	cw, err := NewSize(w.logger, nil, tmpDir, w.segmentSize, w.compress, w.formatOptions()...)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compaction WAL")
+	}
+	mapping := map[LogLocation]LogLocation{}
+
+	err = w.scanAll(start, end, func(r *Reader, loc LogLocation) error {
+		rec, keep, err := fn(r.Record(), loc)
+		if err != nil || !keep {
+			return err
+		}
+		newLoc, err := cw.log(rec, r.extBuf, false, 0)
+		if err != nil {
+			return err
+		}
+		mapping[loc] = newLoc
+		return nil
+	})
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(tmpDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "write compacted segments")
+	}
+
+	// Commit. New segments are numbered after the existing ones.
+	first := w.segment.Index() + 1
+	if err := fileutil.Rename(tmpDir, compactDir(w.Dir(), first)); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "commit compaction")
+	}
+	// The active segment is about to be removed, close it first (Windows!).
+	if err := w.segment.Close(); err != nil {
+		return nil, errors.Wrap(err, "close active segment")
+	}
+	n, err := finishCompaction(w.Dir(), first, w.segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	for old, loc := range mapping {
+		mapping[old] = LogLocation{Segment: first + loc.Segment, Offset: loc.Offset}
+	}
+
+	s, err := w.createSegment(first + n)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.setSegment(s); err != nil {
+		return nil, err
+	}
+	if w.size, err = segmentsSize(w.Dir()); err != nil {
+		return nil, errors.Wrap(err, "get segments size")
+	}
+	w.synced = LogLocation{Segment: s.Index()}
+	w.broadcast()
+
+	return mapping, nil
+}
+
+func compactDir(dir string, first int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%08d", compactDirPrefix, first))
+}
+
+// finishCompaction replaces all segments in dir with the ones of the committed
+// compaction starting at segment first. It returns the number of new segments.
+// It is idempotent so an interrupted compaction can be completed by calling
+// it again.
+func finishCompaction(dir string, first int, segmentPath func(int) string) (int, error) {
+	cdir := compactDir(dir, first)
+
+	refs, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range refs {
+		if r.index >= first {
+			break
+		}
+		fn := filepath.Join(dir, r.name)
+		if err := os.Remove(fn); err != nil {
+			return 0, errors.Wrapf(err, "delete segment:%v", r.index)
+		}
+		removeEmptyDir(dir, fn)
+	}
+	refs, err = listSegments(cdir)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range refs {
+		fn := segmentPath(first + r.index)
+		if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+			return 0, errors.Wrap(err, "create segment dir")
+		}
+		if err := os.Rename(filepath.Join(cdir, r.name), fn); err != nil {
+			return 0, errors.Wrapf(err, "move segment:%v", r.index)
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return 0, err
+	}
+	// Segments moved by an interrupted earlier attempt are not in cdir anymore.
+	_, last, err := Segments(dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.RemoveAll(cdir); err != nil {
+		return 0, err
+	}
+	return last - first + 1, nil
+}
+
+// recoverCompaction discards an uncommitted compaction in dir and completes a
+// committed one.
+func recoverCompaction(dir string, segmentPath func(int) string) error {
+	if err := os.RemoveAll(filepath.Join(dir, compactTmpDir)); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasPrefix(f.Name(), compactDirPrefix) {
+			continue
+		}
+		first, err := strconv.Atoi(strings.TrimPrefix(f.Name(), compactDirPrefix))
+		if err != nil {
+			continue
+		}
+		if _, err := finishCompaction(dir, first, segmentPath); err != nil {
+			return errors.Wrap(err, "finish compaction")
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	df, err := fileutil.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := df.Sync(); err != nil {
+		df.Close()
+		return err
+	}
+	return df.Close()
+}
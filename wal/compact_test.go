@@ -0,0 +1,299 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// readAll returns all records in dir.
+func readAll(t *testing.T, dir string) [][]byte {
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+
+	var recs [][]byte
+	r := NewReader(sr)
+	for r.Next() {
+		recs = append(recs, append([]byte(nil), r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	return recs
+}
+
+func keyOfTestRecord(rec []byte) []byte {
+	if i := bytes.IndexByte(rec, ':'); i >= 0 {
+		return rec[:i]
+	}
+	return nil
+}
+
+func TestCompactByKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_compact")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+
+	var (
+		recs   [][]byte
+		locs   []LogLocation
+		latest = map[string]int{}
+	)
+	for i := 0; i < 200; i++ {
+		// Later records of a key supersede earlier ones, unkeyed records are kept.
+		rec := []byte(fmt.Sprintf("k%d:%d:%s", i%10, i, bytes.Repeat([]byte{'x'}, i*40)))
+		if i%7 == 0 {
+			rec = []byte(fmt.Sprintf("unkeyed %d", i))
+		}
+		l, err := w.Log(rec)
+		require.NoError(t, err)
+		recs, locs = append(recs, rec), append(locs, l[0])
+		if k := keyOfTestRecord(rec); k != nil {
+			latest[string(k)] = i
+		}
+	}
+	l, err := w.LogKeyed([8]byte{1}, []byte("k9:last"))
+	require.NoError(t, err)
+	recs, locs = append(recs, []byte("k9:last")), append(locs, l)
+	latest["k9"] = len(recs) - 1
+
+	var (
+		expected [][]byte
+		expLocs  []LogLocation
+	)
+	for i, rec := range recs {
+		if k := keyOfTestRecord(rec); k == nil || latest[string(k)] == i {
+			expected = append(expected, rec)
+			expLocs = append(expLocs, locs[i])
+		}
+	}
+
+	first, last, err := Segments(dir)
+	require.NoError(t, err)
+	require.True(t, last-first > 5)
+
+	mapping, err := w.CompactByKey(keyOfTestRecord)
+	require.NoError(t, err)
+	require.Len(t, mapping, len(expected))
+	for _, loc := range expLocs {
+		_, ok := mapping[loc]
+		require.True(t, ok, "missing location %v", loc)
+	}
+
+	newFirst, newLast, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, last+1, newFirst)
+	require.True(t, newLast-newFirst < last-first)
+
+	// The WAL remains writable.
+	_, err = w.Log([]byte("k0:after"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.Equal(t, append(expected, []byte("k0:after")), readAll(t, dir))
+
+	// Mapped locations point to the same records, with extension headers intact.
+	for i, old := range expLocs {
+		loc := mapping[old]
+		segBytes, err := ioutil.ReadFile(SegmentName(dir, loc.Segment))
+		require.NoError(t, err)
+		r := NewReader(bytes.NewReader(segBytes[loc.Offset:]))
+		require.True(t, r.Next())
+		require.Equal(t, expected[i], r.Record())
+		if i == len(expLocs)-1 {
+			require.Equal(t, [8]byte{1}, r.Key())
+		}
+	}
+}
+
+func TestCompactByKey_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_compact")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := w.Log(make([]byte, pageSize/2))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	before := readAll(t, dir)
+
+	// An uncommitted compaction is discarded.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, compactTmpDir), 0777))
+	require.NoError(t, ioutil.WriteFile(SegmentName(filepath.Join(dir, compactTmpDir), 0), []byte{1}, 0666))
+
+	w, err = NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, err = os.Stat(filepath.Join(dir, compactTmpDir))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, before, readAll(t, dir))
+
+	// A committed compaction that was interrupted while moving segments is
+	// completed. Segment 0 of the compaction was already moved.
+	_, last, err := Segments(dir)
+	require.NoError(t, err)
+	first := last + 1
+	cw, err := NewSize(zerolog.Nop(), nil, compactDir(dir, first), pageSize, false)
+	require.NoError(t, err)
+	_, err = cw.Log([]byte("a"), make([]byte, pageSize), []byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, cw.Close())
+	require.NoError(t, os.Rename(SegmentName(compactDir(dir, first), 0), SegmentName(dir, first)))
+
+	w, err = NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	_, err = os.Stat(compactDir(dir, first))
+	require.True(t, os.IsNotExist(err))
+	segFirst, _, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, first, segFirst)
+	require.Equal(t, [][]byte{[]byte("a"), make([]byte, pageSize), []byte("b")}, readAll(t, dir))
+}
+
+func TestTransform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_transform")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, true)
+	require.NoError(t, err)
+	defer w.Close()
+
+	var recs [][]byte
+	for i := 0; i < 50; i++ {
+		recs = append(recs, []byte(fmt.Sprintf("v1:%d:%s", i, bytes.Repeat([]byte{'x'}, i*100))))
+	}
+	locs, err := w.Log(recs...)
+	require.NoError(t, err)
+
+	// A failing transformation leaves the WAL unchanged.
+	errFail := errors.New("fail")
+	_, err = w.Transform(func(rec []byte) ([]byte, bool, error) {
+		return nil, false, errFail
+	})
+	require.Equal(t, errFail, errors.Cause(err))
+	_, err = os.Stat(filepath.Join(dir, compactTmpDir))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, recs, readAll(t, dir))
+
+	// Upgrade records to v2, growing them, and drop every third one.
+	var expected [][]byte
+	for i, rec := range recs {
+		if i%3 != 0 {
+			expected = append(expected, append([]byte("v2:"), bytes.Repeat(rec[3:], 2)...))
+		}
+	}
+	mapping, err := w.Transform(func(rec []byte) ([]byte, bool, error) {
+		var i int
+		_, err := fmt.Sscanf(string(rec), "v1:%d:", &i)
+		if err != nil {
+			return nil, false, err
+		}
+		return append([]byte("v2:"), bytes.Repeat(rec[3:], 2)...), i%3 != 0, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, mapping, len(expected))
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr)
+	i := 0
+	for r.Next() {
+		require.Equal(t, expected[i], r.Record())
+		i++
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, len(expected), i)
+
+	for i, loc := range locs {
+		newLoc, ok := mapping[loc]
+		require.Equal(t, i%3 != 0, ok)
+		if ok {
+			require.True(t, newLoc.Segment > locs[len(locs)-1].Segment)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_compact")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Every record gets a segment of its own.
+	var (
+		recs [][]byte
+		locs []LogLocation
+	)
+	for i := 0; i < 6; i++ {
+		rec := bytes.Repeat([]byte{byte('a' + i)}, 1+i*1000)
+		l, err := w.Log(rec)
+		require.NoError(t, err)
+		require.NoError(t, w.NextSegment())
+		recs = append(recs, rec)
+		locs = append(locs, l...)
+	}
+	size, err := w.Size()
+	require.NoError(t, err)
+
+	// The destination must be empty.
+	dest, err := ioutil.TempDir(dir, "dest")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "x"), nil, 0666))
+	_, err = w.Compact(dest)
+	require.Error(t, err)
+	require.NoError(t, os.RemoveAll(dest))
+
+	mapping, err := w.Compact(dest)
+	require.NoError(t, err)
+	_, err = os.Stat(dest)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, recs, readAll(t, dir))
+	require.Len(t, mapping, len(locs))
+	for i, loc := range locs {
+		// All records fit into a single segment.
+		require.Equal(t, locs[len(locs)-1].Segment+2, mapping[loc].Segment)
+		r, err := w.ReadAt(mapping[loc])
+		require.NoError(t, err)
+		require.Equal(t, recs[i], r)
+	}
+	newSize, err := w.Size()
+	require.NoError(t, err)
+	require.Less(t, newSize, size)
+
+	// Writing continues after the compacted segment.
+	l, err := w.Log([]byte("z"))
+	require.NoError(t, err)
+	require.Equal(t, locs[len(locs)-1].Segment+3, l[0].Segment)
+
+	// Without a destination, a directory within the WAL's is used.
+	_, err = w.Compact("")
+	require.NoError(t, err)
+	require.Equal(t, append(recs, []byte("z")), readAll(t, dir))
+}
@@ -0,0 +1,122 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Compression identifies the codec records are compressed with. It's stored
+// as the compression flag in the header of each compressed record, so readers
+// pick the codec per record and segments remain readable when the compression
+// of a WAL is changed, even if they mix codecs.
+type Compression uint8
+
+const (
+	// CompressionNone stores records uncompressed.
+	CompressionNone Compression = 0
+	// CompressionSnappy compresses records with snappy, as New and NewSize do
+	// if compress is true. It's built in.
+	CompressionSnappy Compression = compressionSnappy
+	// CompressionZstd compresses records with zstd. It isn't built in, so the
+	// package doesn't depend on a zstd implementation. Register one with
+	// RegisterCodec to write or read zstd compressed records.
+	CompressionZstd Compression = 2
+)
+
+// maxCompression is the largest compression flag, see the header format.
+const maxCompression = compressionMask >> compressionShift
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("compression(%d)", uint8(c))
+	}
+}
+
+// Codec compresses and decompresses records for a Compression.
+type Codec struct {
+	// Encode returns src compressed. It may use dst for the result if it's
+	// large enough, like snappy.Encode.
+	Encode func(dst, src []byte) []byte
+	// Decode returns src decompressed. It may use dst for the result if it's
+	// large enough, like snappy.Decode.
+	Decode func(dst, src []byte) ([]byte, error)
+}
+
+var (
+	codecsMtx sync.RWMutex
+	codecs    = map[Compression]Codec{}
+)
+
+// RegisterCodec registers codec for c, making all WALs and readers created
+// afterwards able to write and read records compressed with c. It's meant to
+// be called during initialization, e.g. to register a zstd codec based on
+// github.com/klauspost/compress/zstd:
+//
+//	enc, _ := zstd.NewWriter(nil)
+//	dec, _ := zstd.NewReader(nil)
+//	wal.RegisterCodec(wal.CompressionZstd, wal.Codec{
+//		Encode: func(dst, src []byte) []byte { return enc.EncodeAll(src, dst[:0]) },
+//		Decode: func(dst, src []byte) ([]byte, error) { return dec.DecodeAll(src, dst[:0]) },
+//	})
+//
+// Compressions other than the built-in ones may be used for custom codecs,
+// up to 15. It panics for CompressionNone, CompressionSnappy and compressions
+// above 15. Codecs must be safe for concurrent use. A decompressor set with
+// WithDecompressor takes precedence over the registered codec.
+func RegisterCodec(c Compression, codec Codec) {
+	if c == CompressionNone || c == CompressionSnappy || c > maxCompression {
+		panic(fmt.Sprintf("wal: can't register codec for %s", c))
+	}
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	codecs[c] = codec
+}
+
+// lookupCodec returns the codec registered for c.
+func lookupCodec(c Compression) (Codec, bool) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	codec, ok := codecs[c]
+	return codec, ok
+}
+
+// WithCompression sets the codec Log compresses records with, overriding the
+// compress argument of New and NewSize. Codecs other than the built-in ones
+// must be registered with RegisterCodec before the WAL is created. Records
+// that don't get smaller are stored uncompressed, as with snappy.
+func WithCompression(c Compression) Option {
+	return func(w *WAL) {
+		w.compression = c
+	}
+}
+
+// initCompression validates the compression set with WithCompression and
+// looks up its codec.
+func (w *WAL) initCompression() error {
+	switch w.compression {
+	case CompressionNone, CompressionSnappy:
+	default:
+		codec, ok := lookupCodec(w.compression)
+		if !ok {
+			return errors.Errorf("no codec registered for %s", w.compression)
+		}
+		w.codec = codec
+	}
+	w.compress = w.compression != CompressionNone
+	return nil
+}
+
+// Compression returns the codec the current record is compressed with, which
+// is CompressionNone if Compressed returns false.
+func (r *Reader) Compression() Compression {
+	return Compression(r.compression)
+}
@@ -0,0 +1,88 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// compressionFlate is a custom codec registered for tests.
+const compressionFlate Compression = 7
+
+func init() {
+	RegisterCodec(compressionFlate, Codec{
+		Encode: func(dst, src []byte) []byte {
+			buf := bytes.NewBuffer(dst[:0])
+			fw, err := flate.NewWriter(buf, flate.BestSpeed)
+			if err != nil {
+				panic(err)
+			}
+			fw.Write(src)
+			fw.Close()
+			return buf.Bytes()
+		},
+		Decode: func(dst, src []byte) ([]byte, error) {
+			buf := bytes.NewBuffer(dst[:0])
+			_, err := buf.ReadFrom(flate.NewReader(bytes.NewReader(src)))
+			return buf.Bytes(), err
+		},
+	})
+}
+
+func TestWithCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_compression")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Zstd isn't built in.
+	_, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithCompression(CompressionZstd))
+	require.EqualError(t, err, "no codec registered for zstd")
+
+	rec := bytes.Repeat([]byte("compressible "), 1000)
+	var want []Compression
+	for _, c := range []Compression{CompressionSnappy, compressionFlate, CompressionNone} {
+		w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, true, WithCompression(c))
+		require.NoError(t, err)
+		require.Equal(t, c, w.Config().Compression)
+		require.Equal(t, c != CompressionNone, w.CompressionEnabled())
+		// Records that don't get smaller are stored uncompressed.
+		_, err = w.Log(rec, []byte{1})
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		want = append(want, c, CompressionNone)
+	}
+
+	// The codec is detected per record, so segments written with different
+	// codecs are read in one go.
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+
+	var got []Compression
+	r := NewReader(sr)
+	for i := 0; r.Next(); i++ {
+		if i%2 == 0 {
+			require.Equal(t, rec, r.Record())
+		} else {
+			require.Equal(t, []byte{1}, r.Record())
+		}
+		require.Equal(t, r.Compression() != CompressionNone, r.Compressed())
+		got = append(got, r.Compression())
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, want, got)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, maxCompression + 1} {
+		require.Panics(t, func() { RegisterCodec(c, Codec{}) }, c.String())
+	}
+	require.Equal(t, "compression(7)", compressionFlate.String())
+}
@@ -0,0 +1,132 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Consume delivers every record at or after start to handler in log order,
+// including records logged while it is running. Records are handed out once
+// the Log call that wrote them has synced them to disk.
+// It blocks until ctx is done, the WAL is closed, or handler returns an error.
+//
+// Delivery is at-least-once: if handler fails, Consume returns its error
+// without advancing past the failed record, so the caller can call Consume
+// again with the location that was passed to the failed handler call.
+// The record passed to handler is only valid until handler returns.
+//
+// This covers replaying the log on startup and then tailing it: each pass
+// reads up to the position synced when it started and then waits for a
+// notification captured at the same time, so a record synced concurrently with
+// the end of a pass triggers another one, which continues right after the last
+// delivered record. Nothing is skipped or delivered twice at the handoff.
+//
+// A WAL returned by Open doesn't write records, so Consume returns an error
+// for it instead of waiting for records forever.
+func (w *WAL) Consume(ctx context.Context, start LogLocation, handler func(record []byte, loc LogLocation) error) error {
+	w.mtx.RLock()
+	writable := w.segment != nil
+	w.mtx.RUnlock()
+	if !writable {
+		return errors.New("consume requires a WAL that writes records")
+	}
+
+	loc := start
+	for {
+		w.mtx.RLock()
+		synced, notify, closed := w.synced, w.notify, w.closed
+		w.mtx.RUnlock()
+
+		next, err := w.scan(loc, synced, func(r *Reader, loc LogLocation) error {
+			return handler(r.Record(), loc)
+		})
+		if err != nil {
+			return err
+		}
+		if next != loc {
+			loc = next
+			continue
+		}
+		if closed {
+			return ErrWALClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// errStopScan can be returned from scan callbacks to stop scanning early.
+var errStopScan = errors.New("stop scan")
+
+// scanAll is like scan but continues across segments until end is reached.
+func (w *WAL) scanAll(loc, end LogLocation, fn func(r *Reader, loc LogLocation) error, opts ...ReaderOption) error {
+	for {
+		next, err := w.scan(loc, end, fn, opts...)
+		if err != nil {
+			return err
+		}
+		if next == loc {
+			return nil
+		}
+		loc = next
+	}
+}
+
+// scan passes a reader positioned at each record from loc onwards to fn,
+// stopping at the end of the segment loc points into or at end, whichever
+// comes first. It returns the location after the last record fn accepted.
+func (w *WAL) scan(loc, end LogLocation, fn func(r *Reader, loc LogLocation) error, opts ...ReaderOption) (LogLocation, error) {
+	if loc.Segment > end.Segment || (loc.Segment == end.Segment && loc.Offset >= end.Offset) {
+		return loc, nil
+	}
+	f, err := os.Open(segmentFile(w.Dir(), loc.Segment))
+	if err != nil {
+		return loc, errors.Wrapf(err, "open segment %d", loc.Segment)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(int64(loc.Offset), io.SeekStart); err != nil {
+		return loc, errors.Wrapf(err, "seek segment %d", loc.Segment)
+	}
+	var rdr io.Reader = f
+	if loc.Segment == end.Segment {
+		rdr = io.LimitReader(f, int64(end.Offset-loc.Offset))
+	}
+	r := NewReader(rdr, append(w.readerOptions(), opts...)...)
+	r.total = int64(loc.Offset)
+	if loc.Offset > 0 {
+		if err := r.readSegmentHeaderAt(f); err != nil {
+			return loc, errors.Wrapf(err, "read segment %d", loc.Segment)
+		}
+	}
+
+	for r.Next() {
+		rloc := LogLocation{Segment: loc.Segment, Offset: r.recStart.Offset, Sub: r.recStart.Sub}
+		if rloc.Offset == loc.Offset && rloc.Sub < loc.Sub {
+			// Packed records before loc were accepted before.
+			continue
+		}
+		if err := fn(r, rloc); err != nil {
+			return loc, err
+		}
+		if len(r.packed) > 0 {
+			loc = LogLocation{Segment: loc.Segment, Offset: rloc.Offset, Sub: rloc.Sub + 1}
+		} else {
+			loc = LogLocation{Segment: loc.Segment, Offset: int(r.total)}
+		}
+	}
+	if err := r.Err(); err != nil {
+		return loc, errors.Wrapf(err, "read segment %d", loc.Segment)
+	}
+	if loc.Segment < end.Segment {
+		// Segments are never written to again once the WAL moved on.
+		return LogLocation{Segment: loc.Segment + 1}, nil
+	}
+	return loc, nil
+}
@@ -0,0 +1,163 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+type consumed struct {
+	rec []byte
+	loc LogLocation
+}
+
+func TestConsume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_consume")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recc := make(chan consumed, 100)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- w.Consume(ctx, LogLocation{}, func(rec []byte, loc LogLocation) error {
+			recc <- consumed{append([]byte(nil), rec...), loc}
+			return nil
+		})
+	}()
+
+	// Records spanning pages and segments are delivered in order as they are logged.
+	for i := 0; i < 20; i++ {
+		rec := make([]byte, 1+(i*4000)%(pageSize+pageSize/2))
+		rec[0] = byte(i)
+		locs, err := w.Log(rec)
+		require.NoError(t, err)
+
+		c := <-recc
+		require.Equal(t, rec, c.rec)
+		require.Equal(t, locs[0], c.loc)
+	}
+	cancel()
+	require.Equal(t, context.Canceled, <-errc)
+}
+
+func TestConsume_HandlerError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_consume")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+
+	locs, err := w.Log([]byte{1}, []byte{2}, []byte{3})
+	require.NoError(t, err)
+
+	// Fail on the second record.
+	errFail := errors.New("fail")
+	var failedAt LogLocation
+	err = w.Consume(context.Background(), LogLocation{}, func(rec []byte, loc LogLocation) error {
+		if rec[0] == 2 {
+			failedAt = loc
+			return errFail
+		}
+		return nil
+	})
+	require.Equal(t, errFail, err)
+	require.Equal(t, locs[1], failedAt)
+
+	// Resuming from the failed location redelivers it. Closing the WAL stops
+	// consumption once everything was delivered.
+	require.NoError(t, w.Close())
+
+	var got []consumed
+	err = w.Consume(context.Background(), failedAt, func(rec []byte, loc LogLocation) error {
+		got = append(got, consumed{append([]byte(nil), rec...), loc})
+		return nil
+	})
+	require.Equal(t, ErrWALClosed, err)
+	require.Equal(t, []consumed{{[]byte{2}, locs[1]}, {[]byte{3}, locs[2]}}, got)
+}
+
+func TestConsumeReplayThenTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_replay_tail")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	var want []consumed
+	logRec := func(i int) error {
+		rec := make([]byte, 1+(i*1500)%pageSize)
+		rec[0] = byte(i)
+		locs, err := w.Log(rec)
+		if err == nil {
+			want = append(want, consumed{rec, locs[0]})
+		}
+		return err
+	}
+	for i := 0; i < 50; i++ {
+		require.NoError(t, logRec(i))
+	}
+	start := want[10].loc
+
+	// Keep logging while the replay is running, so records are written right
+	// at the handoff to tailing.
+	const total = 200
+	errc := make(chan error, 1)
+	go func() {
+		for i := 50; i < total; i++ {
+			if err := logRec(i); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []consumed
+	err = w.Consume(ctx, start, func(rec []byte, loc LogLocation) error {
+		got = append(got, consumed{append([]byte(nil), rec...), loc})
+		if len(got) == total-10 {
+			cancel()
+		}
+		return nil
+	})
+	require.Equal(t, context.Canceled, err)
+	require.NoError(t, <-errc)
+	require.Equal(t, want[10:], got)
+}
+
+func TestConsumeNotWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_consume_open")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := Open(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer w.Close()
+
+	err = w.Consume(context.Background(), LogLocation{}, func([]byte, LogLocation) error {
+		return nil
+	})
+	require.Error(t, err)
+}
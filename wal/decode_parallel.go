@@ -0,0 +1,194 @@
+package wal
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// DecodeOption configures DecodeSegmentParallel.
+type DecodeOption func(*decodeOptions)
+
+type decodeOptions struct {
+	inOrder bool
+}
+
+// DecodeInOrder makes DecodeSegmentParallel pass records to the callback one
+// at a time in the order they were written. Records are still verified and
+// decompressed in parallel, but a slow callback limits the throughput.
+func DecodeInOrder() DecodeOption {
+	return func(o *decodeOptions) {
+		o.inOrder = true
+	}
+}
+
+// decodeJob is a record read from a segment that's pending verification and
+// decompression.
+type decodeJob struct {
+	loc LogLocation
+	r   *Reader // Detached reader holding the record.
+
+	// Result of decoding, only used with DecodeInOrder.
+	rec   []byte
+	err   error
+	ready chan struct{} // Closed once rec and err are set.
+}
+
+func (j *decodeJob) decode() ([]byte, error) {
+	rec := j.r.Record()
+	if j.r.corrupt {
+		return nil, errors.Wrapf(j.r.err, "decode record at %+v", j.loc)
+	}
+	return rec, nil
+}
+
+// DecodeSegmentParallel reads the records of the segment with the given index
+// in dir and passes each to fn along with its location. The framing of the
+// records is read sequentially while verifying their checksums and
+// decompressing them is spread over the given number of workers, or one per
+// CPU if workers is <= 0. This speeds up reading segments of compressed
+// records when decoding them is the bottleneck.
+//
+// Without DecodeInOrder, fn is called concurrently from all workers and in no
+// particular order, so it must be safe for concurrent use. The record passed
+// to fn is owned by it. The first error returned by fn or encountered while
+// reading stops the decoding and is returned once all workers exited.
+func DecodeSegmentParallel(dir string, index, workers int, fn func([]byte, LogLocation) error, opts ...DecodeOption) error {
+	var o decodeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	seg, err := openReadSegmentIn(dir, segmentFile(dir, index))
+	if err != nil {
+		return errors.Wrapf(err, "open segment %d", index)
+	}
+	defer seg.Close()
+
+	var (
+		jobs    = make(chan *decodeJob, workers)
+		ordered = make(chan *decodeJob, workers)
+		done    = make(chan struct{})
+		wg      sync.WaitGroup
+
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+	stopped := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if stopped() {
+					continue
+				}
+				rec, err := j.decode()
+				if o.inOrder {
+					j.rec, j.err = rec, err
+					close(j.ready)
+					continue
+				}
+				if err == nil {
+					err = fn(rec, j.loc)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	if o.inOrder {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ordered {
+				select {
+				case <-j.ready:
+				case <-done:
+				}
+				if stopped() {
+					continue
+				}
+				err := j.err
+				if err == nil {
+					err = fn(j.rec, j.loc)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	r := NewReader(NewSegmentBufReader(zerolog.Nop(), seg), WithLazyChecksum(true))
+scan:
+	for r.Next() {
+		j := &decodeJob{loc: r.recStart, r: r.detach(), ready: make(chan struct{})}
+		if o.inOrder {
+			select {
+			case ordered <- j:
+			case <-done:
+				break scan
+			}
+		}
+		select {
+		case jobs <- j:
+		case <-done:
+			break scan
+		}
+	}
+	if err := r.Err(); err != nil {
+		fail(errors.Wrapf(err, "read segment %d", index))
+	}
+	close(jobs)
+	close(ordered)
+	wg.Wait()
+
+	return firstErr
+}
+
+// detach returns a reader holding a copy of the current record, whose Record
+// method verifies and decompresses it independently of r. The current record
+// must be pending verification, see WithLazyChecksum.
+func (r *Reader) detach() *Reader {
+	d := &Reader{
+		lazyChecksum:  true,
+		fragments:     append([]fragment(nil), r.fragments...),
+		compressed:    r.compressed,
+		compression:   r.compression,
+		unverified:    r.unverified,
+		undecoded:     r.undecoded,
+		ext:           r.ext,
+		extBuf:        append([]byte(nil), r.extBuf...),
+		decompressors: r.decompressors,
+		aead:          r.aead,
+		nonceBase:     r.nonceBase,
+		segmentID:     r.segmentID,
+		sealed:        r.sealed,
+	}
+	if r.compressed {
+		d.snappyBuf = append([]byte(nil), r.snappyBuf...)
+	} else {
+		d.rec = append([]byte{}, r.rec...)
+	}
+	return d
+}
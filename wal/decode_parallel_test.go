@@ -0,0 +1,129 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDecodeSegment writes n compressible records to segment 0 of a new WAL
+// in dir and returns them.
+func writeDecodeSegment(t testing.TB, dir string, n int) [][]byte {
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, true)
+	require.NoError(t, err)
+	var recs [][]byte
+	for i := 0; i < n; i++ {
+		rec := make([]byte, rand.Intn(4*pageSize))
+		for j := range rec {
+			rec[j] = byte(rand.Intn(4))
+		}
+		recs = append(recs, rec)
+	}
+	_, err = w.Log(recs...)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return recs
+}
+
+func TestDecodeSegmentParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_decode_parallel")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	recs := writeDecodeSegment(t, dir, 200)
+
+	// Out of order.
+	var (
+		mtx  sync.Mutex
+		locs []LogLocation
+		got  = map[LogLocation][]byte{}
+	)
+	err = DecodeSegmentParallel(dir, 0, 4, func(rec []byte, loc LogLocation) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		locs = append(locs, loc)
+		got[loc] = rec
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, got, len(recs))
+	sort.Slice(locs, func(i, j int) bool { return locs[i].Offset < locs[j].Offset })
+	for i, loc := range locs {
+		require.Equal(t, recs[i], got[loc])
+	}
+
+	// In order.
+	var ordered [][]byte
+	err = DecodeSegmentParallel(dir, 0, 4, func(rec []byte, loc LogLocation) error {
+		ordered = append(ordered, rec)
+		return nil
+	}, DecodeInOrder())
+	require.NoError(t, err)
+	require.Equal(t, recs, ordered)
+
+	// Errors from the callback stop decoding.
+	errStop := errors.New("stop")
+	for _, opts := range [][]DecodeOption{nil, {DecodeInOrder()}} {
+		n := 0
+		err = DecodeSegmentParallel(dir, 0, 1, func(rec []byte, loc LogLocation) error {
+			if n++; n == 10 {
+				return errStop
+			}
+			return nil
+		}, opts...)
+		require.Equal(t, errStop, err)
+		require.Equal(t, 10, n)
+	}
+
+	// Corruption is reported.
+	f, err := os.OpenFile(SegmentName(dir, 0), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 3*pageSize+100)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	for _, opts := range [][]DecodeOption{nil, {DecodeInOrder()}} {
+		err = DecodeSegmentParallel(dir, 0, 4, func(rec []byte, loc LogLocation) error { return nil }, opts...)
+		require.Error(t, err)
+	}
+
+	require.Error(t, DecodeSegmentParallel(dir, 1, 4, func(rec []byte, loc LogLocation) error { return nil }))
+}
+
+func BenchmarkDecodeSegmentParallel(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench_decode_parallel")
+	require.NoError(b, err)
+	defer func() {
+		require.NoError(b, os.RemoveAll(dir))
+	}()
+	writeDecodeSegment(b, dir, 300)
+	noop := func([]byte, LogLocation) error { return nil }
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(b, err)
+			r := NewReader(sr)
+			for r.Next() {
+				_ = noop(r.Record(), LogLocation{})
+			}
+			require.NoError(b, r.Err())
+			require.NoError(b, sr.Close())
+		}
+	})
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, DecodeSegmentParallel(dir, 0, workers, noop))
+			}
+		})
+	}
+}
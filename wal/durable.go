@@ -0,0 +1,58 @@
+package wal
+
+import "github.com/pkg/errors"
+
+// IsDurable returns whether the record at ll, as returned by Log, was synced
+// to durable storage, so it survives a crash of the machine, e.g. to only
+// acknowledge a write to a client once that's the case. With SyncOnLog, this
+// holds once Log returned, with other policies once a sync covered the record,
+// see WithSyncPolicy.
+//
+// Segments the WAL moved on from are synced in the background, so records at
+// their end are only durable once that completed. If syncing such a segment
+// failed, its records are never reported as durable. Neither are the records
+// of a WAL created with NewTmpfs.
+func (w *WAL) IsDurable(ll LogLocation) (bool, error) {
+	if ll.Segment < 0 || ll.Offset < 0 || ll.Sub < 0 {
+		return false, errors.Errorf("invalid location %+v", ll)
+	}
+	w.mtx.RLock()
+	closed, end := w.closed, w.synced
+	w.mtx.RUnlock()
+
+	if closed {
+		return false, ErrWALClosed
+	}
+	if w.tmpfs {
+		return false, nil
+	}
+	if ll.Segment > end.Segment || (ll.Segment == end.Segment && ll.Offset >= end.Offset) {
+		return false, nil
+	}
+	if ll.Segment == end.Segment {
+		return true, nil
+	}
+	w.unsyncedMtx.Lock()
+	defer w.unsyncedMtx.Unlock()
+	_, unsynced := w.unsynced[ll.Segment]
+	return !unsynced, nil
+}
+
+// markUnsynced records that the WAL moved on from segment i before it was
+// synced.
+func (w *WAL) markUnsynced(i int) {
+	w.unsyncedMtx.Lock()
+	defer w.unsyncedMtx.Unlock()
+	if w.unsynced == nil {
+		w.unsynced = map[int]struct{}{}
+	}
+	w.unsynced[i] = struct{}{}
+}
+
+// markSynced records that segment i was synced after the WAL moved on from
+// it.
+func (w *WAL) markSynced(i int) {
+	w.unsyncedMtx.Lock()
+	defer w.unsyncedMtx.Unlock()
+	delete(w.unsynced, i)
+}
@@ -0,0 +1,58 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_IsDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_is_durable")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithSyncPolicy(SyncNever))
+	require.NoError(t, err)
+
+	isDurable := func(loc LogLocation) bool {
+		ok, err := w.IsDurable(loc)
+		require.NoError(t, err)
+		return ok
+	}
+	a, err := w.Log([]byte("a"))
+	require.NoError(t, err)
+	require.False(t, isDurable(a[0]))
+	require.NoError(t, w.Sync())
+	require.True(t, isDurable(a[0]))
+
+	// The end of a segment the WAL moved on from becomes durable once it's
+	// synced in the background.
+	b, err := w.Log([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, isDurable(b[0]))
+	require.NoError(t, w.NextSegment())
+	c, err := w.Log([]byte("c"))
+	require.NoError(t, err)
+	require.NoError(t, w.Sync())
+	require.True(t, isDurable(c[0]))
+	require.Eventually(t, func() bool { return isDurable(b[0]) }, 5*time.Second, time.Millisecond)
+
+	// Segments whose sync didn't complete aren't durable.
+	w.markUnsynced(b[0].Segment)
+	require.False(t, isDurable(b[0]))
+	require.True(t, isDurable(c[0]))
+
+	require.False(t, isDurable(LogLocation{Segment: c[0].Segment + 1}))
+	_, err = w.IsDurable(LogLocation{Offset: -1})
+	require.Error(t, err)
+
+	require.NoError(t, w.Close())
+	_, err = w.IsDurable(a[0])
+	require.Equal(t, ErrWALClosed, err)
+}
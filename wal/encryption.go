@@ -0,0 +1,199 @@
+package wal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// nonceCounterSize is the size of the nonce counter stored at the start of
+// each encrypted record.
+const nonceCounterSize = 8
+
+// newNonceBase picks a random nonce base for a new segment.
+func (w *WAL) newNonceBase() error {
+	w.nonceBase = make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(w.nonceBase); err != nil {
+		return errors.Wrap(err, "generate nonce base")
+	}
+	w.nonceCounter = 0
+	return nil
+}
+
+// sealOverhead returns the number of bytes encryption adds to a record.
+func (w *WAL) sealOverhead() int {
+	if w.aead == nil {
+		return 0
+	}
+	return nonceCounterSize + w.aead.Overhead()
+}
+
+// sealRecord encrypts rec for the active segment, authenticating ext along
+// with it. The encrypted record consists of the counter of its nonce followed
+// by the ciphertext. The returned slice is valid until the next call.
+func (w *WAL) sealRecord(rec, ext []byte) []byte {
+	w.nonceCounter++
+	w.sealBuf = append(w.sealBuf[:0], make([]byte, nonceCounterSize)...)
+	binary.BigEndian.PutUint64(w.sealBuf, w.nonceCounter)
+
+	nonce := recordNonce(w.nonceBase, w.sealBuf[:nonceCounterSize])
+	w.sealBuf = w.aead.Seal(w.sealBuf, nonce, rec, ext)
+	return w.sealBuf
+}
+
+// recordNonce returns the nonce of a record in a segment with the given nonce
+// base, which is the base with the record's counter XORed into its last bytes.
+func recordNonce(base, counter []byte) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-nonceCounterSize:]
+	for i := range tail {
+		tail[i] ^= counter[i]
+	}
+	return nonce
+}
+
+// readerOptions returns the options readers of the WAL's own segments need.
+func (w *WAL) readerOptions() []ReaderOption {
+	if w.aead == nil {
+		return nil
+	}
+	return []ReaderOption{WithDecryption(w.aead)}
+}
+
+// decrypt decrypts the current record in place if it's pending decryption.
+func (r *Reader) decrypt() error {
+	if !r.sealed {
+		return nil
+	}
+	r.sealed = false
+
+	buf := r.rec
+	if r.compressed {
+		buf = r.snappyBuf
+	}
+	if len(buf) < nonceCounterSize {
+		return errors.Errorf("encrypted record of %d bytes too short", len(buf))
+	}
+	nonce := recordNonce(r.nonceBase, buf[:nonceCounterSize])
+	ciphertext := buf[nonceCounterSize:]
+	plain, err := r.aead.Open(ciphertext[:0], nonce, ciphertext, r.extBuf)
+	if err != nil {
+		return errors.Wrap(err, "decrypt record")
+	}
+	if r.compressed {
+		r.snappyBuf = plain
+	} else {
+		r.rec = plain
+	}
+	return nil
+}
+
+// sealOverhead returns the number of bytes encryption adds to the current
+// record while it's pending decryption.
+func (r *Reader) sealOverhead() int {
+	if !r.sealed {
+		return 0
+	}
+	return nonceCounterSize + r.aead.Overhead()
+}
+
+// readSegmentFields reads the fields of a segment header following the format
+// version.
+func (r *Reader) readSegmentFields(fields []byte) error {
+	f, err := decodeSegmentFields(r.version, fields)
+	if err != nil {
+		return err
+	}
+	nonceBase := f.nonceBase
+	r.nonceBase, r.segmentID = nil, f.id
+	r.pageSize = pageSize
+	if f.pageSize != 0 {
+		r.pageSize = f.pageSize
+	}
+	if nonceBase == nil {
+		return nil
+	}
+	if r.aead == nil {
+		return errors.New("segment is encrypted but no decryption is configured")
+	}
+	if n := r.aead.NonceSize(); n != len(nonceBase) {
+		return errors.Errorf("nonce size %d of segment doesn't match %d of decryption", len(nonceBase), n)
+	}
+	r.nonceBase = nonceBase
+	return nil
+}
+
+// decodeSegmentFields decodes the fields of a segment header of the given
+// format version. The returned slices don't alias fields.
+func decodeSegmentFields(version int, fields []byte) (f segmentFields, err error) {
+	if version < formatV3 {
+		if len(fields) != 0 {
+			return f, errors.Errorf("invalid segment header size %d", len(segmentMagic)+1+len(fields))
+		}
+		return f, nil
+	}
+	if len(fields) == 0 {
+		return f, errors.New("missing segment flags")
+	}
+	flags := fields[0]
+	fields = fields[1:]
+	if flags&^(segmentEncrypted|segmentHasID|segmentHasEpoch|segmentHasPageSize) != 0 {
+		return f, errors.Errorf("unknown segment flags %#x", flags)
+	}
+	if flags&segmentEncrypted != 0 {
+		if len(fields) == 0 || int(fields[0]) > len(fields)-1 || int(fields[0]) < nonceCounterSize {
+			return f, errors.New("invalid nonce base in segment header")
+		}
+		n := 1 + int(fields[0])
+		f.nonceBase = append([]byte(nil), fields[1:n]...)
+		fields = fields[n:]
+	}
+	if flags&segmentHasID != 0 {
+		if len(fields) < segmentIDSize {
+			return f, errors.New("invalid segment ID in segment header")
+		}
+		f.id = append([]byte(nil), fields[:segmentIDSize]...)
+		fields = fields[segmentIDSize:]
+	}
+	if flags&segmentHasEpoch != 0 {
+		if len(fields) < 8 {
+			return f, errors.New("invalid epoch in segment header")
+		}
+		f.epoch, f.hasEpoch = binary.BigEndian.Uint64(fields), true
+		fields = fields[8:]
+	}
+	if flags&segmentHasPageSize != 0 {
+		if len(fields) == 0 || fields[0] >= 32 || checkPageSize(1<<fields[0]) != nil {
+			return f, errors.New("invalid page size in segment header")
+		}
+		f.pageSize = 1 << fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) != 0 {
+		return f, errors.New("unexpected segment header fields")
+	}
+	return f, nil
+}
+
+// readSegmentHeaderAt prepares r to read a segment from the middle by reading
+// the segment header at the start of f, if there is one.
+func (r *Reader) readSegmentHeaderAt(f io.ReaderAt) error {
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], 0); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return errors.Wrap(err, "read segment header")
+	}
+	if recTypeFromHeader(b[0]) != recSegmentHeader {
+		return nil
+	}
+	hr := &Reader{rdr: io.NewSectionReader(f, 1, pageSize-1), buf: r.buf, aead: r.aead}
+	if err := hr.readSegmentHeader(); err != nil {
+		return err
+	}
+	r.version, r.nonceBase, r.segmentID, r.pageSize = hr.version, hr.nonceBase, hr.segmentID, hr.pageSize
+	return nil
+}
@@ -0,0 +1,231 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAEAD(t testing.TB) cipher.AEAD {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	return aead
+}
+
+// readEncrypted reads all records of the segments in dir with the given options.
+func readEncrypted(t testing.TB, dir string, opts ...ReaderOption) ([][]byte, error) {
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+
+	r := NewReader(sr, opts...)
+	var recs [][]byte
+	for r.Next() {
+		recs = append(recs, append([]byte{}, r.Record()...))
+	}
+	return recs, r.Err()
+}
+
+// encryptionRecords returns records of recognizable, compressible text of
+// up to n bytes, the first one being empty.
+func encryptionRecords(num, n int) [][]byte {
+	recs := [][]byte{{}}
+	for i := 1; i < num; i++ {
+		rec := bytes.Repeat([]byte(fmt.Sprintf("secret record %d ", i)), mrand.Intn(n)/16+1)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestEncryption(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		for _, lazy := range []bool{false, true} {
+			t.Run(fmt.Sprintf("compress=%t,lazy=%t", compress, lazy), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_encryption")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+				aead := newTestAEAD(t)
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, compress, WithEncryption(aead), WithWriteVerify(true))
+				require.NoError(t, err)
+				recs := encryptionRecords(50, 3*pageSize)
+				locs, err := w.Log(recs...)
+				require.NoError(t, err)
+				require.Greater(t, locs[len(locs)-1].Segment, locs[0].Segment)
+
+				key := [8]byte{1, 2, 3}
+				_, err = w.LogKeyed(key, []byte("keyed secret record"))
+				require.NoError(t, err)
+				_, rec, err := w.FindByKey(key)
+				require.NoError(t, err)
+				require.Equal(t, []byte("keyed secret record"), rec)
+				recs = append(recs, rec)
+
+				// Consuming from the middle of a segment picks up its nonce base.
+				ctx, cancel := context.WithCancel(context.Background())
+				var consumed [][]byte
+				err = w.Consume(ctx, locs[len(locs)-1], func(rec []byte, loc LogLocation) error {
+					consumed = append(consumed, append([]byte{}, rec...))
+					if len(consumed) == 2 {
+						cancel()
+					}
+					return nil
+				})
+				require.Equal(t, context.Canceled, err)
+				require.Equal(t, recs[len(recs)-2:], consumed)
+				require.NoError(t, w.Close())
+
+				got, err := readEncrypted(t, dir, WithDecryption(aead), WithLazyChecksum(lazy))
+				require.NoError(t, err)
+				require.Equal(t, recs, got)
+
+				// No plaintext ends up on disk.
+				first, last, err := Segments(dir)
+				require.NoError(t, err)
+				for i := first; i <= last; i++ {
+					b, err := ioutil.ReadFile(SegmentName(dir, i))
+					require.NoError(t, err)
+					require.False(t, bytes.Contains(b, []byte("secret record")), "segment %d", i)
+				}
+
+				// Reading without decryption or with another key fails.
+				_, err = readEncrypted(t, dir, WithLazyChecksum(lazy))
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no decryption")
+				_, err = readEncrypted(t, dir, WithDecryption(newTestAEAD(t)), WithLazyChecksum(lazy))
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "decrypt record")
+			})
+		}
+	}
+}
+
+func TestEncryption_Tampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_encryption")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	aead := newTestAEAD(t)
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false, WithEncryption(aead))
+	require.NoError(t, err)
+	locs, err := w.Log([]byte("first secret"), []byte("second secret"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Flip a bit of the second record and fix up its checksum, so that only
+	// the authentication of the record detects the change.
+	fn := SegmentName(dir, locs[1].Segment)
+	b, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	off := locs[1].Offset
+	length := int(binary.BigEndian.Uint16(b[off+1:]))
+	payload := b[off+recordHeaderSize : off+recordHeaderSize+length]
+	payload[len(payload)-1] ^= 1
+	binary.BigEndian.PutUint32(b[off+3:], crc32.Checksum(payload, castagnoliTable))
+	require.NoError(t, ioutil.WriteFile(fn, b, 0666))
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr, WithDecryption(aead))
+	require.True(t, r.Next())
+	require.Equal(t, []byte("first secret"), r.Record())
+	require.False(t, r.Next())
+	require.Contains(t, r.Err().Error(), "decrypt record")
+}
+
+func TestEncryption_Legacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_encryption")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	aead := newTestAEAD(t)
+
+	// Unencrypted segments written before enabling encryption stay readable.
+	var recs [][]byte
+	for _, opts := range [][]Option{nil, {WithSegmentHeader(true)}, {WithEncryption(aead)}} {
+		w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, true, opts...)
+		require.NoError(t, err)
+		batch := encryptionRecords(5, pageSize)
+		_, err = w.Log(batch...)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		recs = append(recs, batch...)
+	}
+	got, err := readEncrypted(t, dir, WithDecryption(aead))
+	require.NoError(t, err)
+	require.Equal(t, recs, got)
+
+	// Checkpoints of an encrypted WAL are encrypted as well.
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, true, WithEncryption(aead))
+	require.NoError(t, err)
+	defer w.Close()
+	_, last, err := Segments(dir)
+	require.NoError(t, err)
+	res, err := w.CheckpointAndTruncate(LogLocation{Segment: last}, func([]byte) bool { return true })
+	require.NoError(t, err)
+	require.Equal(t, len(recs), res.Kept)
+
+	cp, err := ioutil.ReadFile(SegmentName(res.Dir, 0))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(cp, []byte("secret record")))
+
+	r, err := NewCheckpointedReader(dir, WithDecryption(aead))
+	require.NoError(t, err)
+	defer r.Close()
+	got = nil
+	for r.Next() {
+		got = append(got, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, recs, got)
+}
+
+func BenchmarkWAL_LogEncrypted(b *testing.B) {
+	rec := bytes.Repeat([]byte("benchmark record "), 256)
+	for _, encrypt := range []bool{false, true} {
+		b.Run(fmt.Sprintf("encrypt=%t", encrypt), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench_encryption")
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, os.RemoveAll(dir))
+			}()
+			var opts []Option
+			if encrypt {
+				opts = append(opts, WithEncryption(newTestAEAD(b)))
+			}
+			w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false, opts...)
+			require.NoError(b, err)
+			defer w.Close()
+
+			b.SetBytes(int64(len(rec)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := w.Log(rec)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
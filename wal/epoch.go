@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// LogWithEpochs writes recs into the log like Log and additionally returns the
+// epochs assigned to them, see WithEpochs. The records of a batch get
+// consecutive epochs. Without epochs enabled, it fails without writing.
+func (w *WAL) LogWithEpochs(recs ...[]byte) ([]LogLocation, []uint64, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, nil, ErrWALClosed
+	}
+	if !w.epochs {
+		return nil, nil, errors.New("epochs are not enabled")
+	}
+	first := w.nextEpoch
+	locs, err := w.writeRecords(recs, nil, 0)
+	if err != nil {
+		return locs, nil, err
+	}
+	epochs := make([]uint64, len(recs))
+	for i := range epochs {
+		epochs[i] = first + uint64(i)
+	}
+	return locs, epochs, nil
+}
+
+// Epoch returns the epoch the current record was logged with if it has one,
+// see WithEpochs.
+func (r *Reader) Epoch() (uint64, bool) {
+	return r.ext.epoch, r.ext.flags&extEpoch != 0
+}
+
+// epochExtSize is the size of the epoch field of extension headers.
+const epochExtSize = 8
+
+// extFor returns the extension header of the next record written with the
+// extension header ext, adding the next epoch if epochs are enabled. Packed
+// records get packedExt instead of ext, and their epoch is that of the first
+// record they hold.
+func (w *WAL) extFor(ext []byte, packed bool) ([]byte, error) {
+	if packed {
+		ext = packedExt
+	}
+	if !w.epochs {
+		return ext, nil
+	}
+	var e recordExt
+	if ext != nil {
+		var err error
+		if e, _, err = decodeRecordExt(ext); err != nil {
+			return nil, err
+		}
+	}
+	e.flags |= extEpoch
+	e.epoch = w.nextEpoch
+	return e.encode(nil), nil
+}
+
+// extLenFor returns the size of the extension header extFor returns.
+func (w *WAL) extLenFor(ext []byte, packed bool) int {
+	if packed {
+		ext = packedExt
+	}
+	if !w.epochs {
+		return len(ext)
+	}
+	if ext == nil {
+		return 1 + epochExtSize
+	}
+	return len(ext) + epochExtSize
+}
+
+// recoverEpoch returns the epoch following the last one assigned in dir. It
+// starts at the last segment and goes back until it finds a segment whose
+// header holds the epoch counter, taking the maximum of that counter and the
+// epochs of the records after it plus one. Failures to read segment headers
+// and records are ignored, as the corrupted data is dropped by Repair anyway.
+func recoverEpoch(dir string, opts []ReaderOption) (uint64, error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	var next uint64
+	for i := len(refs) - 1; i >= 0; i-- {
+		f, _, err := readSegmentFieldsOf(dir, refs[i].index)
+		if err != nil {
+			// Corrupted segments are dropped by Repair.
+			f = segmentFields{}
+		}
+		if f.hasEpoch && f.epoch > next {
+			next = f.epoch
+		}
+		last, ok, err := lastEpochOfSegment(dir, refs[i].index, opts)
+		if err != nil {
+			return 0, err
+		}
+		if ok && last+1 > next {
+			next = last + 1
+		}
+		if f.hasEpoch {
+			break
+		}
+	}
+	return next, nil
+}
+
+// lastEpochOfSegment returns the highest epoch of the records in the segment
+// with the given index in dir and whether any record has one.
+func lastEpochOfSegment(dir string, index int, opts []ReaderOption) (last uint64, ok bool, err error) {
+	s, err := openReadSegmentIn(dir, segmentFile(dir, index))
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "open segment %d", index)
+	}
+	sr := NewSegmentBufReader(zerolog.Nop(), s)
+	defer sr.Close()
+
+	r := NewReader(sr, opts...)
+	for r.Next() {
+		if e, has := r.Epoch(); has && (!ok || e > last) {
+			last, ok = e, true
+		}
+	}
+	return last, ok, nil
+}
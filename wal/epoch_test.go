@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// readEpochs returns the records in dir along with their epochs.
+func readEpochs(t *testing.T, dir string, opts ...ReaderOption) ([][]byte, []uint64) {
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+
+	var (
+		recs   [][]byte
+		epochs []uint64
+	)
+	r := NewReader(sr, opts...)
+	for r.Next() {
+		e, ok := r.Epoch()
+		require.True(t, ok, "record %d has no epoch", len(recs))
+		recs = append(recs, append([]byte{}, r.Record()...))
+		epochs = append(epochs, e)
+	}
+	require.NoError(t, r.Err())
+	return recs, epochs
+}
+
+func TestWithEpochs(t *testing.T) {
+	aead := newTestAEAD(t)
+	configs := map[string]struct {
+		opts  []Option
+		ropts []ReaderOption
+	}{
+		"default":   {},
+		"packed":    {opts: []Option{WithPackedRecords(100)}},
+		"encrypted": {opts: []Option{WithEncryption(aead)}, ropts: []ReaderOption{WithDecryption(aead)}},
+	}
+	for name, c := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_epochs")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+			opts, ropts := append(c.opts, WithEpochs(true)), c.ropts
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+			require.NoError(t, err)
+			var want [][]byte
+			for i := 0; i < 50; i++ {
+				batch := [][]byte{[]byte(fmt.Sprintf("a%d", i)), make([]byte, i*500), []byte(fmt.Sprintf("b%d", i))}
+				_, epochs, err := w.LogWithEpochs(batch...)
+				require.NoError(t, err)
+				require.Equal(t, []uint64{uint64(len(want)), uint64(len(want) + 1), uint64(len(want) + 2)}, epochs)
+				want = append(want, batch...)
+			}
+			_, err = w.LogKeyed([8]byte{1}, []byte("keyed"))
+			require.NoError(t, err)
+			want = append(want, []byte("keyed"))
+			loc, err := w.Reserve(10)
+			require.NoError(t, err)
+			require.NoError(t, w.WriteReserved(loc, make([]byte, 10)))
+			want = append(want, make([]byte, 10))
+			require.NoError(t, w.Close())
+
+			recs, epochs := readEpochs(t, dir, ropts...)
+			require.Equal(t, want, recs)
+			for i, e := range epochs {
+				require.Equal(t, uint64(i), e)
+			}
+
+			// The counter is recovered on open, also if the last segment holds
+			// no records.
+			for i := 0; i < 2; i++ {
+				w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+				require.NoError(t, err)
+				require.Equal(t, uint64(len(want)), w.nextEpoch)
+				require.NoError(t, w.Close())
+			}
+			w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+			require.NoError(t, err)
+			_, epochs, err = w.LogWithEpochs([]byte("reopened"))
+			require.NoError(t, err)
+			require.Equal(t, []uint64{uint64(len(want))}, epochs)
+			want = append(want, []byte("reopened"))
+
+			// Epochs survive compaction, unlike locations.
+			mapping, err := w.Transform(func(rec []byte) ([]byte, bool, error) {
+				return rec, string(rec) == "reopened" || len(rec) != 0 && rec[0] == 'b', nil
+			})
+			require.NoError(t, err)
+			require.NotEmpty(t, mapping)
+			_, epochs, err = w.LogWithEpochs([]byte("compacted"))
+			require.NoError(t, err)
+			require.Equal(t, []uint64{uint64(len(want))}, epochs)
+			require.NoError(t, w.Close())
+
+			recs, epochs = readEpochs(t, dir, ropts...)
+			for i, rec := range recs[:len(recs)-2] {
+				require.Equal(t, byte('b'), rec[0])
+				require.Equal(t, want[epochs[i]], rec)
+			}
+			require.Equal(t, []byte("reopened"), recs[len(recs)-2])
+			require.Equal(t, []byte("compacted"), recs[len(recs)-1])
+			require.Equal(t, uint64(len(want)), epochs[len(epochs)-1])
+
+			// Compacted segments are scanned when the last segment has no counter.
+			_, _, err = w.LogWithEpochs()
+			require.Equal(t, ErrWALClosed, err)
+			w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(want)+1), w.nextEpoch)
+			require.NoError(t, w.Close())
+		})
+	}
+}
+
+func TestWithEpochs_Disabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_epochs_disabled")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := New(zerolog.Nop(), nil, dir, false, WithEpochs(true))
+	require.NoError(t, err)
+	_, err = w.Log(make([]byte, 10), make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Records logged without epochs have none and don't reset the counter.
+	w, err = New(zerolog.Nop(), nil, dir, false)
+	require.NoError(t, err)
+	_, _, err = w.LogWithEpochs(nil)
+	require.Error(t, err)
+	_, err = w.Log(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr)
+	var got []bool
+	for r.Next() {
+		_, ok := r.Epoch()
+		got = append(got, ok)
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, []bool{true, true, false}, got)
+
+	w, err = New(zerolog.Nop(), nil, dir, false, WithEpochs(true))
+	require.NoError(t, err)
+	_, epochs, err := w.LogWithEpochs(nil)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, epochs)
+	require.NoError(t, w.Close())
+}
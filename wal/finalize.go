@@ -0,0 +1,73 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/onflow/wal/fileutil"
+)
+
+// finalSegmentSuffix is appended to the name of the last segment of a WAL
+// finalized with renaming.
+const finalSegmentSuffix = ".final"
+
+// Finalize completes the WAL and closes it. The last page of the active
+// segment is terminated by padding it with zeros and any space beyond it, such
+// as a preallocated tail, is trimmed before the segment is synced. If rename is
+// true, the segment is then renamed to its segment name with the ".final"
+// suffix so consumers can recognize a completed WAL.
+//
+// Finalized segments are read like any other segment. Opening the directory
+// again starts a new segment after the finalized one.
+func (w *WAL) Finalize(rename bool) error {
+	defer w.syncLoop.Wait()
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	if w.page.alloc > 0 {
+		if err := w.flushPage(true); err != nil {
+			return errors.Wrap(err, "flush page")
+		}
+	}
+	donec := make(chan struct{})
+	w.stopc <- donec
+	<-donec
+
+	// Mark the WAL closed regardless of the outcome, the actor is stopped.
+	w.closed = true
+	w.broadcast()
+	w.stopSyncLoop()
+	defer w.stopSyncThread()
+
+	s := w.segment
+	end := int64(w.donePages * w.pageSize)
+	stat, err := s.Stat()
+	if err != nil {
+		s.Close()
+		return errors.Wrap(err, "stat segment")
+	}
+	if stat.Size() > end {
+		if err := s.Truncate(end); err != nil {
+			s.Close()
+			return errors.Wrap(err, "trim segment")
+		}
+		w.size -= stat.Size() - end
+	}
+	if err := w.fsync(s); err != nil {
+		s.Close()
+		return errors.Wrap(err, "sync segment")
+	}
+	if err := s.Close(); err != nil {
+		return errors.Wrap(err, "close segment")
+	}
+	if rename {
+		fn := s.Name()
+		if err := fileutil.Rename(fn, fn+finalSegmentSuffix); err != nil {
+			return errors.Wrap(err, "rename segment")
+		}
+	}
+	return markCleanShutdown(w.Dir())
+}
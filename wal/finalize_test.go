@@ -0,0 +1,54 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFinalize(t *testing.T) {
+	for _, rename := range []bool{false, true} {
+		t.Run("", func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_finalize")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+			require.NoError(t, err)
+			recs := [][]byte{make([]byte, 100), make([]byte, pageSize), make([]byte, 10)}
+			_, err = w.Log(recs...)
+			require.NoError(t, err)
+
+			// Simulate a preallocated segment.
+			require.NoError(t, w.segment.Truncate(4*pageSize))
+
+			require.NoError(t, w.Finalize(rename))
+			require.Equal(t, ErrWALClosed, w.Finalize(rename))
+
+			fn := SegmentName(dir, 0)
+			if rename {
+				_, err := os.Stat(fn)
+				require.True(t, os.IsNotExist(err))
+				fn += finalSegmentSuffix
+			}
+			stat, err := os.Stat(fn)
+			require.NoError(t, err)
+			require.Equal(t, int64(2*pageSize), stat.Size())
+			require.Equal(t, recs, readAll(t, dir))
+
+			// Reopening continues in a new segment.
+			w, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+			require.NoError(t, err)
+			require.Equal(t, 1, w.segment.Index())
+			_, err = w.Log([]byte{1})
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			require.Equal(t, append(recs, []byte{1}), readAll(t, dir))
+		})
+	}
+}
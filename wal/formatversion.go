@@ -0,0 +1,83 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// UnsupportedVersionError is returned when a segment header announces a format
+// version that can't be read, e.g. because the segment was written by a newer
+// version of the package. Readers stop with it instead of decoding records they
+// may not understand. Unlike corruption it isn't returned as a CorruptionErr,
+// as the segment may be intact, so Repair refuses to remove it.
+//
+// Segments without a header, as written unless WithSegmentHeader is enabled,
+// are always read in the version 1 format.
+type UnsupportedVersionError struct {
+	Segment int // -1 if unknown.
+	Version int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	if e.Segment < 0 {
+		return fmt.Sprintf("unsupported format version %d", e.Version)
+	}
+	return fmt.Sprintf("unsupported format version %d in segment %d", e.Version, e.Segment)
+}
+
+// isUnsupportedVersion returns whether err is caused by an unsupported format
+// version.
+func isUnsupportedVersion(err error) bool {
+	var verr *UnsupportedVersionError
+	return errors.As(err, &verr)
+}
+
+// CheckVersions reads the headers of the segments in dir and returns an
+// UnsupportedVersionError for the first one announcing a format version that
+// can't be read, so that such a WAL can be rejected before reading it. Only
+// the start of every segment is read. Headers that fail to decode otherwise
+// are left for readers to report as corruption. New and NewSize check the
+// segments of an existing directory this way.
+func CheckVersions(dir string) error {
+	refs, err := readSegmentRefs(dir)
+	if err != nil {
+		return errors.Wrap(err, "list segments")
+	}
+	for _, ref := range refs {
+		if err := checkSegmentVersion(dir, ref.index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSegmentVersion returns an UnsupportedVersionError if the header of the
+// segment with the given index in dir announces an unknown version.
+func checkSegmentVersion(dir string, index int) error {
+	f, err := os.Open(segmentFile(dir, index))
+	if err != nil {
+		return errors.Wrapf(err, "open segment %d", index)
+	}
+	defer f.Close()
+
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], 0); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return errors.Wrapf(err, "read segment %d", index)
+	}
+	if recTypeFromHeader(b[0]) != recSegmentHeader {
+		return nil
+	}
+	_, _, err = NewReader(io.NewSectionReader(f, 1, pageSize-1)).readSegmentHeaderRecord()
+	var verr *UnsupportedVersionError
+	if errors.As(err, &verr) {
+		verr.Segment = index
+		return verr
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_check_versions")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// A segment without header followed by ones with headers.
+	for _, header := range []bool{false, true} {
+		w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, WithSegmentHeader(header))
+		require.NoError(t, err)
+		_, err = w.Log([]byte("a"))
+		require.NoError(t, err)
+		require.NoError(t, w.NextSegment())
+		_, err = w.Log([]byte("b"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	require.NoError(t, CheckVersions(dir))
+
+	// Announce an unknown version in the header of segment 2.
+	f, err := os.OpenFile(SegmentName(dir, 2), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	hdr := make([]byte, pageSize)
+	_, err = f.WriteAt(hdr[:encodeSegmentHeader(hdr, formatVersion+1, segmentFields{})], 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	err = CheckVersions(dir)
+	require.Equal(t, &UnsupportedVersionError{Segment: 2, Version: formatVersion + 1}, err)
+	_, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.Equal(t, &UnsupportedVersionError{Segment: 2, Version: formatVersion + 1}, err)
+
+	// Readers stop at the segment without reporting corruption, which Repair
+	// would remove.
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr)
+	n := 0
+	for r.Next() {
+		n++
+	}
+	require.Equal(t, 2, n)
+	var verr *UnsupportedVersionError
+	require.True(t, errors.As(r.Err(), &verr), "%v", r.Err())
+	require.Equal(t, 2, verr.Segment)
+	var cerr *CorruptionErr
+	require.False(t, errors.As(r.Err(), &cerr))
+}
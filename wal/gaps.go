@@ -0,0 +1,50 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrSegmentGap is wrapped by the errors returned when segments are missing
+// between the first and the last one of a directory, e.g. by NewSize and
+// NewSegmentsReader. Segments are never removed from the middle of a WAL, so a
+// gap means records were lost. Use DetectGaps to find the missing segments.
+var ErrSegmentGap = errors.New("gap between segments")
+
+// SegmentsReaderOption configures a reader returned by NewSegmentsReader.
+type SegmentsReaderOption func(*segmentsReaderOptions)
+
+type segmentsReaderOptions struct {
+	skipGaps bool
+}
+
+// SkipSegmentGaps makes the reader skip over missing segments instead of
+// failing. Records never span segments, so the records in the remaining
+// segments are read intact, but those in the missing segments are lost.
+// Use DetectGaps to find out which segments are missing.
+func SkipSegmentGaps() SegmentsReaderOption {
+	return func(o *segmentsReaderOptions) {
+		o.skipGaps = true
+	}
+}
+
+// DetectGaps returns the indices of segments missing in dir between the first
+// and the last segment present, for example after segment files were removed
+// manually.
+func DetectGaps(dir string) ([]int, error) {
+	refs, err := readSegmentRefs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	return segmentGaps(refs), nil
+}
+
+// segmentGaps returns the indices missing between the sorted segments refs.
+func segmentGaps(refs []segmentRef) []int {
+	var gaps []int
+	for i := 0; i < len(refs)-1; i++ {
+		for k := refs[i].index + 1; k < refs[i+1].index; k++ {
+			gaps = append(gaps, k)
+		}
+	}
+	return gaps
+}
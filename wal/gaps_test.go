@@ -0,0 +1,63 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectGaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_gaps")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	gaps, err := DetectGaps(dir)
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		if i > 0 {
+			require.NoError(t, w.NextSegment())
+		}
+		_, err := w.Log([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	gaps, err = DetectGaps(dir)
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+
+	for _, i := range []int{0, 2, 4, 5} {
+		require.NoError(t, os.Remove(SegmentName(dir, i)))
+	}
+	gaps, err = DetectGaps(dir)
+	require.NoError(t, err)
+	require.Equal(t, []int{2, 4, 5}, gaps)
+
+	// Readers and opening the WAL fail on gaps by default.
+	_, err = NewSegmentsReader(zerolog.Nop(), dir)
+	require.True(t, errors.Is(err, ErrSegmentGap), "%v", err)
+	_, err = NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	require.True(t, errors.Is(err, ErrSegmentGap), "%v", err)
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir, SkipSegmentGaps())
+	require.NoError(t, err)
+	defer sr.Close()
+
+	r := NewReader(sr)
+	var recs [][]byte
+	for r.Next() {
+		recs = append(recs, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, [][]byte{{1}, {3}, {6}}, recs)
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrKeyNotFound is returned by FindByKey if no record has the given key.
+var ErrKeyNotFound = errors.New("key not found")
+
+// LogKeyed writes rec into the log along with key. The key is stored in the
+// header of the record's first fragment, so it can be read with Reader.Key
+// and searched for with FindByKey without decoding payloads.
+func (w *WAL) LogKeyed(key [8]byte, rec []byte) (LogLocation, error) {
+	ext := recordExt{flags: extKey, key: key}
+	locs, err := w.logRecords([][]byte{rec}, ext.encode(nil), 0)
+	if err != nil {
+		return LogLocation{}, err
+	}
+	return locs[0], nil
+}
+
+// WithKeyFilter makes the reader return only records logged with LogKeyed
+// whose key is accepted by filter, e.g. one backed by a bloom filter of the
+// keys of interest. The filter is evaluated on the key in the record header,
+// so the payload of skipped records is neither reassembled nor decompressed.
+// Records without a key are skipped as well. With WithLazyChecksum, skipped
+// records aren't verified either, see its documentation.
+func WithKeyFilter(filter func(key [8]byte) bool) ReaderOption {
+	return func(r *Reader) {
+		r.keyFilter = filter
+	}
+}
+
+// FindByKey scans the WAL from its first segment and returns the location and
+// contents of the first record logged with key.
+// Only the matching record is verified and decompressed.
+func (w *WAL) FindByKey(key [8]byte) (LogLocation, []byte, error) {
+	first, _, err := Segments(w.Dir())
+	if err != nil {
+		return LogLocation{}, nil, err
+	}
+	if first < 0 {
+		return LogLocation{}, nil, ErrKeyNotFound
+	}
+	w.mtx.RLock()
+	end := w.synced
+	w.mtx.RUnlock()
+
+	var (
+		found LogLocation
+		rec   []byte
+	)
+	err = w.scanAll(LogLocation{Segment: first}, end, func(r *Reader, loc LogLocation) error {
+		if r.Key() != key {
+			return nil
+		}
+		rec = append([]byte(nil), r.Record()...)
+		if err := r.Err(); err != nil {
+			return err
+		}
+		found = loc
+		return errStopScan
+	}, WithLazyChecksum(true), WithKeyFilter(func(k [8]byte) bool { return k == key }))
+	switch err {
+	case errStopScan:
+		return found, rec, nil
+	case nil:
+		return LogLocation{}, nil, ErrKeyNotFound
+	default:
+		return LogLocation{}, nil, err
+	}
+}
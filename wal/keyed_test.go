@@ -0,0 +1,214 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogKeyed(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_keyed")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, compress)
+			require.NoError(t, err)
+			defer w.Close()
+
+			type keyed struct {
+				key [8]byte
+				rec []byte
+				loc LogLocation
+			}
+			var recs []keyed
+			for i := 0; i < 20; i++ {
+				// Mix small and multi-page records as well as unkeyed ones.
+				rec := make([]byte, rand.Intn(2*pageSize))
+				_, err := rand.Read(rec[:len(rec)/2])
+				require.NoError(t, err)
+
+				k := keyed{rec: rec}
+				if i%3 == 0 {
+					locs, err := w.Log(rec)
+					require.NoError(t, err)
+					k.loc = locs[0]
+				} else {
+					k.key = [8]byte{byte(i), 1, 2, 3, 4, 5, 6, byte(i % 5)}
+					k.loc, err = w.LogKeyed(k.key, rec)
+					require.NoError(t, err)
+				}
+				recs = append(recs, k)
+			}
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(t, err)
+			defer sr.Close()
+
+			r := NewReader(sr)
+			for _, k := range recs {
+				require.True(t, r.Next(), "expected record: %v", r.Err())
+				require.Equal(t, k.key, r.Key())
+				require.Equal(t, k.rec, r.Record())
+			}
+			require.False(t, r.Next())
+			require.NoError(t, r.Err())
+
+			for _, k := range recs[1:] {
+				if k.key == ([8]byte{}) {
+					continue
+				}
+				loc, rec, err := w.FindByKey(k.key)
+				require.NoError(t, err)
+				require.Equal(t, k.loc, loc)
+				require.Equal(t, k.rec, rec)
+			}
+			_, _, err = w.FindByKey([8]byte{42})
+			require.Equal(t, ErrKeyNotFound, err)
+		})
+	}
+}
+
+// TestLogKeyed_PageEnd ensures the key is never split from its record's first
+// fragment when little space is left in a page.
+func TestLogKeyed_PageEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_keyed")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	var keys [][8]byte
+	for free := recordHeaderSize; free < 2*recordHeaderSize+9; free++ {
+		// Fill the page up to the desired amount of free space.
+		_, err := w.Log(make([]byte, pageSize-w.page.alloc-free-recordHeaderSize))
+		require.NoError(t, err)
+		keys = append(keys, [8]byte{})
+
+		key := [8]byte{byte(free)}
+		_, err = w.LogKeyed(key, []byte{byte(free)})
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+
+	r := NewReader(sr)
+	for _, key := range keys {
+		require.True(t, r.Next(), "expected record: %v", r.Err())
+		require.Equal(t, key, r.Key())
+	}
+	require.False(t, r.Next())
+	require.NoError(t, r.Err())
+}
+
+func TestWithKeyFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_key_filter")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, true)
+	require.NoError(t, err)
+	want := map[[8]byte][]byte{}
+	for i := 0; i < 100; i++ {
+		rec := bytes.Repeat([]byte{byte(i)}, rand.Intn(3*pageSize))
+		if i%4 == 0 {
+			_, err := w.Log(rec)
+			require.NoError(t, err)
+			continue
+		}
+		key := [8]byte{byte(i)}
+		_, err := w.LogKeyed(key, rec)
+		require.NoError(t, err)
+		if i%7 == 1 {
+			want[key] = rec
+		}
+	}
+	require.NoError(t, w.Close())
+
+	for _, lazy := range []bool{false, true} {
+		sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+		require.NoError(t, err)
+		reg := prometheus.NewRegistry()
+		r := NewReader(sr, WithLazyChecksum(lazy), WithReaderMetrics(reg), WithKeyFilter(func(key [8]byte) bool {
+			_, ok := want[key]
+			return ok
+		}))
+		got := map[[8]byte][]byte{}
+		var size int
+		for r.Next() {
+			got[r.Key()] = append([]byte{}, r.Record()...)
+			size += len(r.Record())
+		}
+		require.NoError(t, r.Err())
+		require.NoError(t, sr.Close())
+		require.Equal(t, want, got)
+
+		// Only the matching records were decompressed.
+		require.Equal(t, float64(len(want)), client_testutil.ToFloat64(r.metrics.recordsRead))
+		require.Equal(t, float64(size), client_testutil.ToFloat64(r.metrics.bytesDecompressed))
+	}
+}
+
+func BenchmarkReader_KeyFilter(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench_key_filter")
+	require.NoError(b, err)
+	defer func() {
+		require.NoError(b, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, true)
+	require.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		_, err := w.LogKeyed(key, bytes.Repeat([]byte(fmt.Sprintf("record %d ", i)), 100))
+		require.NoError(b, err)
+	}
+	require.NoError(b, w.Close())
+
+	// Every 100th key matches.
+	match := func(key [8]byte) bool { return binary.BigEndian.Uint64(key[:])%100 == 0 }
+	for _, filter := range []bool{false, true} {
+		b.Run(fmt.Sprintf("filter=%t", filter), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				require.NoError(b, err)
+				var opts []ReaderOption
+				if filter {
+					opts = append(opts, WithKeyFilter(match))
+				}
+				r := NewReader(sr, opts...)
+				n := 0
+				for r.Next() {
+					if filter || match(r.Key()) {
+						n++
+					}
+				}
+				require.NoError(b, r.Err())
+				require.Equal(b, 100, n)
+				require.NoError(b, sr.Close())
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// LiveReader reads the records of a WAL while another process is writing it,
+// e.g. for a follower replaying records as they're produced. Unlike Reader,
+// Next returns false without an error when it reaches the current end of the
+// log, and returns the records appended later when it's called again. It
+// follows the writer to new segments.
+//
+// Data at the end of the active segment is assumed to be incomplete rather
+// than corrupted, such as a record whose header or later fragments haven't
+// been written yet. Next returns false at such a record and returns it once it
+// was written completely. A segment is complete once the next one exists, so
+// incomplete data at its end is reported as corruption by Err. Corrupted
+// records are always reported, WithSkipCorrupt has no effect.
+type LiveReader struct {
+	logger zerolog.Logger
+	dir    string
+	opts   []ReaderOption
+	buf    *[pageSize]byte // Shared by the readers of rdr.
+
+	seg int          // Index of the segment being read.
+	f   *os.File     // File of seg.
+	pos LogLocation  // Location following the last record returned.
+	cur LogLocation  // Location of the last record returned.
+	rdr *Reader      // Reads seg from pos, nil after reaching its end.
+	src *liveSegment // Underlying reader of rdr.
+	err error
+}
+
+// liveSegment reads a segment file up to its current end.
+type liveSegment struct {
+	f   *os.File
+	off int64
+}
+
+func (s *liveSegment) Read(p []byte) (int, error) {
+	n, err := s.f.ReadAt(p, s.off)
+	s.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// NewLiveReader returns a live reader over the segments in dir starting at loc,
+// which must be a valid location as for NewReaderFrom. Use Segments to start at
+// the first segment. The options configure the readers used for each segment,
+// e.g. WithDecryption for an encrypted WAL. The live reader must be closed to
+// release the segment it's reading.
+func NewLiveReader(logger zerolog.Logger, dir string, loc LogLocation, opts ...ReaderOption) (*LiveReader, error) {
+	if loc.Segment < 0 || loc.Offset < 0 || loc.Sub < 0 {
+		return nil, errors.Wrapf(ErrNoRecordAt, "invalid location %+v", loc)
+	}
+	if err := checkResumeLocation(dir, loc); err != nil {
+		return nil, err
+	}
+	r := &LiveReader{
+		logger: logger,
+		dir:    dir,
+		opts:   opts,
+		buf:    new([pageSize]byte),
+		pos:    loc,
+	}
+	if err := r.openSegment(loc.Segment); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openSegment switches to segment i.
+func (r *LiveReader) openSegment(i int) error {
+	f, err := os.Open(segmentFile(r.dir, i))
+	if os.IsNotExist(err) {
+		return errors.Wrapf(ErrLocationGone, "segment %d not found", i)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "open segment %d", i)
+	}
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			r.logger.Warn().Err(err).Int("segment", r.seg).Msg("Closing segment failed")
+		}
+	}
+	r.seg, r.f = i, f
+	return nil
+}
+
+// Next advances the reader to the next record and returns true if it exists.
+// At the current end of the log it returns false and Err returns nil, and it
+// may be called again later to read the records written in the meantime.
+func (r *LiveReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.rdr != nil && r.rdr.err != nil {
+		// Record failed a lazy checksum or decompression.
+		r.err = r.corruption(r.rdr.err, int64(r.rdr.recStart.Offset))
+		return false
+	}
+	for {
+		if r.rdr == nil {
+			if err := r.resume(); err != nil {
+				r.err = err
+				return false
+			}
+		}
+		if r.rdr.Next() {
+			loc := r.rdr.recStart
+			if loc.Offset == r.pos.Offset && loc.Sub < r.pos.Sub {
+				continue // Returned before resuming.
+			}
+			r.cur = LogLocation{Segment: r.seg, Offset: loc.Offset, Sub: loc.Sub}
+			if len(r.rdr.packed) > 0 {
+				r.pos = LogLocation{Segment: r.seg, Offset: loc.Offset, Sub: loc.Sub + 1}
+			} else {
+				r.pos = LogLocation{Segment: r.seg, Offset: int(r.rdr.total)}
+			}
+			return true
+		}
+		done, err := r.segmentDone()
+		if err != nil {
+			r.err = err
+			return false
+		}
+		if !done {
+			return false
+		}
+		if err := r.openSegment(r.seg + 1); err != nil {
+			r.err = err
+			return false
+		}
+		r.pos = LogLocation{Segment: r.seg}
+		r.rdr = nil
+	}
+}
+
+// resume creates a reader for the current segment starting at pos.
+func (r *LiveReader) resume() error {
+	r.src = &liveSegment{f: r.f, off: int64(r.pos.Offset)}
+	r.rdr = newReader(r.src, r.buf, r.opts...)
+	r.rdr.total = int64(r.pos.Offset)
+	// Incomplete data at the tail must not be skipped as corrupted.
+	r.rdr.skipCorrupt = false
+	if r.pos.Offset > 0 {
+		if err := r.rdr.readSegmentHeaderAt(r.f); err != nil {
+			return errors.Wrapf(err, "read segment %d", r.seg)
+		}
+	}
+	return nil
+}
+
+// segmentDone is called once the reader of the current segment stopped at its
+// current end. It returns whether the segment is complete and all its records
+// were read, in which case the reader moves on to the next one, and an error if
+// the segment is complete but has corrupted data at its end.
+func (r *LiveReader) segmentDone() (bool, error) {
+	rdr, end := r.rdr, r.src.off
+	r.rdr = nil
+	if rdr.err != nil && !isIncomplete(rdr.err) {
+		return false, r.corruption(rdr.err, rdr.total)
+	}
+	// The writer finishes a segment before creating the next one, so it must
+	// be checked for data written in the meantime after the next one exists.
+	if ok, err := r.nextSegmentExists(); !ok || err != nil {
+		return false, err
+	}
+	fi, err := r.f.Stat()
+	if err != nil {
+		return false, errors.Wrapf(err, "stat segment %d", r.seg)
+	}
+	if fi.Size() > end {
+		return false, nil
+	}
+	// Segments ending in the middle of a page are implicitly padded, see
+	// segmentBufReader.
+	if rdr.err != nil && !(rdr.curRecTyp == recPageTerm && rdr.total%int64(rdr.pageSize) != 0) {
+		return false, r.corruption(rdr.err, rdr.total)
+	}
+	return true, nil
+}
+
+// nextSegmentExists returns whether the segment after the current one exists.
+// It's looked up next to the current one, so the directory isn't listed while
+// polling the active segment, unless segments are in subdirectories, see
+// WithSegmentNamer.
+func (r *LiveReader) nextSegmentExists() (bool, error) {
+	dir := filepath.Dir(r.f.Name())
+	fi, err := os.Stat(filepath.Join(dir, filepath.Base(SegmentName(r.dir, r.seg+1))))
+	if err == nil && !fi.IsDir() {
+		return true, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrapf(err, "stat segment %d", r.seg+1)
+	}
+	if dir == filepath.Clean(r.dir) && err != nil {
+		return false, nil
+	}
+	_, ok := findSegment(r.dir, r.seg+1)
+	return ok, nil
+}
+
+// isIncomplete returns whether err was caused by reaching the end of the data
+// written so far.
+func isIncomplete(err error) bool {
+	cause := errors.Cause(err)
+	return cause == io.EOF || cause == io.ErrUnexpectedEOF || err == errTornRecord
+}
+
+// corruption returns err as a corruption of the current segment at offset.
+func (r *LiveReader) corruption(err error, offset int64) error {
+	return &CorruptionErr{
+		Err:     err,
+		Dir:     r.dir,
+		Segment: r.seg,
+		Offset:  offset,
+		Kind:    corruptionKindOf(err),
+	}
+}
+
+// Err returns the error that made Next return false, if any. It's nil if Next
+// returned false at the current end of the log.
+func (r *LiveReader) Err() error {
+	return r.err
+}
+
+// Record returns the current record. The returned byte slice is only valid
+// until the next call to Next.
+func (r *LiveReader) Record() []byte {
+	if r.rdr == nil {
+		return nil
+	}
+	return r.rdr.Record()
+}
+
+// CurrentLocation returns the location of the record returned by the last
+// call to Next, see Reader.CurrentLocation.
+func (r *LiveReader) CurrentLocation() LogLocation {
+	return r.cur
+}
+
+// Location returns the location following the last record returned by Next,
+// from which a new live reader resumes reading, e.g. after a restart of the
+// follower.
+func (r *LiveReader) Location() LogLocation {
+	return r.pos
+}
+
+// Close releases the segment being read.
+func (r *LiveReader) Close() error {
+	var err error
+	if r.rdr != nil {
+		err = r.rdr.removeSpill()
+		r.rdr = nil
+	}
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// drainLive returns the records r returns until it reaches the current end.
+func drainLive(t *testing.T, r *LiveReader) [][]byte {
+	var recs [][]byte
+	for r.Next() {
+		recs = append(recs, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	return recs
+}
+
+func TestLiveReader(t *testing.T) {
+	configs := map[string][]Option{
+		"default":    nil,
+		"compressed": {WithCompression(CompressionSnappy)},
+		"packed":     {WithPackedRecords(100)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_live_reader")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 3*pageSize, false, opts...)
+			require.NoError(t, err)
+			defer w.Close()
+
+			r, err := NewLiveReader(zerolog.Nop(), dir, LogLocation{Segment: w.LastSegment()})
+			require.NoError(t, err)
+			defer r.Close()
+			require.Empty(t, drainLive(t, r))
+
+			var want, got [][]byte
+			for i := 0; i < 40; i++ {
+				batch := [][]byte{make([]byte, i*311), {byte(i)}}
+				rand.Read(batch[0])
+				locs, err := w.Log(batch...)
+				require.NoError(t, err)
+				want = append(want, batch...)
+				if i%7 == 0 {
+					require.NoError(t, w.NextSegment())
+				}
+				recs := drainLive(t, r)
+				require.Len(t, recs, len(batch))
+				require.Equal(t, locs[len(locs)-1], r.CurrentLocation())
+				got = append(got, recs...)
+			}
+			require.Equal(t, want, got)
+			require.Greater(t, r.Location().Segment, 2)
+
+			// A new live reader resumes where the previous one stopped.
+			_, err = w.Log([]byte("after"))
+			require.NoError(t, err)
+			r2, err := NewLiveReader(zerolog.Nop(), dir, r.Location())
+			require.NoError(t, err)
+			defer r2.Close()
+			require.Equal(t, [][]byte{[]byte("after")}, drainLive(t, r2))
+		})
+	}
+}
+
+func TestLiveReader_partialWrites(t *testing.T) {
+	src, err := ioutil.TempDir("", "wal_live_reader")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(src))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, src, 2*pageSize, false)
+	require.NoError(t, err)
+	var want [][]byte
+	for i := 0; i < 30; i++ {
+		rec := make([]byte, i*997%(pageSize+pageSize/2))
+		rand.Read(rec)
+		_, err := w.Log(rec)
+		require.NoError(t, err)
+		want = append(want, rec)
+	}
+	require.NoError(t, w.Close())
+	first, last, err := Segments(src)
+	require.NoError(t, err)
+	require.Greater(t, last, first)
+
+	// Copy the segments in small chunks, so the live reader sees records and
+	// headers cut at arbitrary positions.
+	for _, chunk := range []int{3, 500, 4096} {
+		t.Run(fmt.Sprintf("chunk=%d", chunk), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_live_reader")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+			require.NoError(t, ioutil.WriteFile(SegmentName(dir, first), nil, 0666))
+
+			r, err := NewLiveReader(zerolog.Nop(), dir, LogLocation{Segment: first})
+			require.NoError(t, err)
+			defer r.Close()
+
+			var got [][]byte
+			for i := first; i <= last; i++ {
+				b, err := ioutil.ReadFile(SegmentName(src, i))
+				require.NoError(t, err)
+				f, err := os.OpenFile(SegmentName(dir, i), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+				require.NoError(t, err)
+				for off := 0; off < len(b); off += chunk {
+					end := off + chunk
+					if end > len(b) {
+						end = len(b)
+					}
+					_, err := f.Write(b[off:end])
+					require.NoError(t, err)
+					got = append(got, drainLive(t, r)...)
+				}
+				require.NoError(t, f.Close())
+			}
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestLiveReader_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_live_reader")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	const n = 500
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := w.Log(make([]byte, i*37), []byte(fmt.Sprint(i))); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	r, err := NewLiveReader(zerolog.Nop(), dir, LogLocation{Segment: 0})
+	require.NoError(t, err)
+	defer r.Close()
+
+	var got int
+	deadline := time.Now().Add(10 * time.Second)
+	for got < 2*n && time.Now().Before(deadline) {
+		for r.Next() {
+			if got%2 == 1 {
+				require.Equal(t, fmt.Sprint(got/2), string(r.Record()))
+			} else {
+				require.Len(t, r.Record(), got/2*37)
+			}
+			got++
+		}
+		require.NoError(t, r.Err())
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, <-errc)
+	require.Equal(t, 2*n, got)
+}
+
+func TestLiveReader_tornSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_live_reader")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	locs, err := w.Log([]byte("a"), make([]byte, 2*pageSize))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, os.Truncate(SegmentName(dir, 0), int64(locs[1].Offset+pageSize)))
+
+	r, err := NewLiveReader(zerolog.Nop(), dir, LogLocation{Segment: 0})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The torn record is incomplete while the segment is active.
+	require.Equal(t, [][]byte{[]byte("a")}, drainLive(t, r))
+	require.Equal(t, locs[1], r.Location())
+
+	// It's corrupted once the writer moved on to the next segment.
+	require.NoError(t, ioutil.WriteFile(SegmentName(dir, 1), nil, 0666))
+	require.False(t, r.Next())
+	var cerr *CorruptionErr
+	require.True(t, errors.As(r.Err(), &cerr), "unexpected error %v", r.Err())
+	require.Equal(t, 0, cerr.Segment)
+}
@@ -0,0 +1,131 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_LogConcurrent(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_log_concurrent")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, compress)
+			require.NoError(t, err)
+
+			const (
+				writers = 8
+				calls   = 100
+				batch   = 3
+			)
+			// Records hold the writer, the call and the index within the
+			// call, followed by a varying amount of padding.
+			record := func(writer, call, i int) []byte {
+				rec := make([]byte, 12+(writer*calls+call)*i%5000)
+				binary.BigEndian.PutUint32(rec, uint32(writer))
+				binary.BigEndian.PutUint32(rec[4:], uint32(call))
+				binary.BigEndian.PutUint32(rec[8:], uint32(i))
+				return rec
+			}
+			locs := make([][]LogLocation, writers)
+
+			var wg sync.WaitGroup
+			for k := 0; k < writers; k++ {
+				wg.Add(1)
+				go func(k int) {
+					defer wg.Done()
+					for c := 0; c < calls; c++ {
+						var recs [][]byte
+						for i := 0; i < batch; i++ {
+							recs = append(recs, record(k, c, i))
+						}
+						l, err := w.Log(recs...)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						locs[k] = append(locs[k], l...)
+					}
+				}(k)
+			}
+			wg.Wait()
+			require.NoError(t, w.Close())
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(t, err)
+			defer sr.Close()
+
+			r := NewReader(sr)
+			next := make([]int, writers) // Next call expected per writer.
+			n := 0
+			for r.Next() {
+				rec := r.Record()
+				k := int(binary.BigEndian.Uint32(rec))
+				c := int(binary.BigEndian.Uint32(rec[4:]))
+				i := int(binary.BigEndian.Uint32(rec[8:]))
+
+				// Calls of a writer are in order and their records contiguous.
+				require.Equal(t, n%batch, i, "record %d", n)
+				require.Equal(t, next[k], c, "record %d of writer %d", n, k)
+				if i == batch-1 {
+					next[k]++
+				}
+				require.Equal(t, record(k, c, i), rec)
+				require.Equal(t, locs[k][c*batch+i], r.recStart, "record %d of call %d of writer %d", i, c, k)
+				n++
+			}
+			require.NoError(t, r.Err())
+			require.Equal(t, writers*calls*batch, n)
+		})
+	}
+}
+
+// BenchmarkWAL_LogConcurrent reports the throughput of Log with a single and
+// with multiple writers.
+func BenchmarkWAL_LogConcurrent(b *testing.B) {
+	for _, writers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench_log_concurrent")
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, os.RemoveAll(dir))
+			}()
+
+			w, err := New(zerolog.Nop(), nil, dir, false)
+			require.NoError(b, err)
+			defer w.Close()
+
+			var buf [2048]byte
+			b.SetBytes(2048)
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for k := 0; k < writers; k++ {
+				wg.Add(1)
+				go func(k int) {
+					defer wg.Done()
+					for i := k; i < b.N; i += writers {
+						if _, err := w.Log(buf[:]); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(k)
+			}
+			wg.Wait()
+			// Stop timer to not count fsync time on close, see BenchmarkWAL_Log.
+			b.StopTimer()
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package wal
+
+// BatchResult describes where LogBatch wrote a batch of records.
+type BatchResult struct {
+	// Locations holds the location of each record, as returned by Log.
+	Locations []LogLocation
+	// SegmentsCreated holds the indexes of the segments created while writing
+	// the batch, in ascending order.
+	SegmentsCreated []int
+	// FirstLocations holds the location of the first record of the batch in
+	// each segment of SegmentsCreated, in the same order.
+	FirstLocations []LogLocation
+}
+
+// LogBatch writes recs into the log like Log and additionally reports the
+// segments the WAL rolled over to while writing them, e.g. to schedule
+// checkpoints. If writing fails, the result covers the records written before
+// the failure, like the locations returned by Log.
+func (w *WAL) LogBatch(recs ...[]byte) (BatchResult, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return BatchResult{}, ErrWALClosed
+	}
+	if len(recs) == 0 && !w.syncOnEmpty {
+		return BatchResult{Locations: []LogLocation{}}, nil
+	}
+	prev := w.segment.Index()
+	locs, err := w.writeRecords(recs, nil, 0)
+	res := BatchResult{Locations: locs}
+	for i := prev + 1; i <= w.segment.Index(); i++ {
+		res.SegmentsCreated = append(res.SegmentsCreated, i)
+	}
+	for _, loc := range locs {
+		n := len(res.FirstLocations)
+		if loc.Segment > prev && (n == 0 || res.FirstLocations[n-1].Segment != loc.Segment) {
+			res.FirstLocations = append(res.FirstLocations, loc)
+		}
+	}
+	return res, err
+}
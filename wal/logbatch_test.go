@@ -0,0 +1,61 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_LogBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_log_batch")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// A batch fitting into the active segment creates none.
+	res, err := w.LogBatch([]byte("a"), []byte("b"))
+	require.NoError(t, err)
+	require.Len(t, res.Locations, 2)
+	require.Empty(t, res.SegmentsCreated)
+	require.Empty(t, res.FirstLocations)
+
+	var batch [][]byte
+	for i := 0; i < 10; i++ {
+		batch = append(batch, make([]byte, 20000))
+	}
+	res, err = w.LogBatch(batch...)
+	require.NoError(t, err)
+	require.Len(t, res.Locations, len(batch))
+	last := res.Locations[len(batch)-1].Segment
+	require.Greater(t, last, 1)
+	require.Len(t, res.SegmentsCreated, last)
+	require.Len(t, res.FirstLocations, last)
+	for i, seg := range res.SegmentsCreated {
+		require.Equal(t, i+1, seg)
+		loc := res.FirstLocations[i]
+		require.Equal(t, seg, loc.Segment)
+		for _, l := range res.Locations {
+			if l.Segment == seg {
+				require.Equal(t, l, loc)
+				break
+			}
+		}
+	}
+	require.Len(t, readAll(t, dir), len(batch)+2)
+
+	res, err = w.LogBatch()
+	require.NoError(t, err)
+	require.Equal(t, BatchResult{Locations: []LogLocation{}}, res)
+
+	require.NoError(t, w.Close())
+	_, err = w.LogBatch([]byte("c"))
+	require.Equal(t, ErrWALClosed, err)
+}
@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"context"
+)
+
+// abandonedWrite is a write started by LogContext, which may abandon it.
+type abandonedWrite struct {
+	done      chan struct{} // Closed once the write completed.
+	locs      []LogLocation
+	err       error
+	abandoned bool // Whether LogContext returned before the write completed.
+}
+
+// LogContext writes recs into the log like Log, but returns ctx.Err() once ctx
+// is done, e.g. when a stalled disk blocks the write or the fsync.
+//
+// Writes can't be interrupted, so the write is left to complete in the
+// background then. Like any Log call it either writes all records or is rolled
+// back if it fails, so the WAL stays consistent, but the records may be in the
+// log although ctx.Err() was returned. The outcome is logged once the write
+// completes. Later calls of LogContext wait for an abandoned write rather than
+// starting another one behind it, so that goroutines don't pile up while the
+// WAL is stalled, and also return ctx.Err() if ctx is done first.
+//
+// The records are copied before they're written, since the write may outlive
+// the call.
+func (w *WAL) LogContext(ctx context.Context, recs ...[]byte) ([]LogLocation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return w.Log(recs...)
+	}
+	w.abandonedMtx.Lock()
+	prev := w.abandoned
+	w.abandonedMtx.Unlock()
+	if prev != nil {
+		select {
+		case <-prev.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	cp := make([][]byte, len(recs))
+	for i, rec := range recs {
+		cp[i] = append([]byte(nil), rec...)
+	}
+	aw := &abandonedWrite{done: make(chan struct{})}
+	go w.logAbandonable(aw, cp)
+
+	select {
+	case <-aw.done:
+		return aw.locs, aw.err
+	case <-ctx.Done():
+	}
+	w.abandonedMtx.Lock()
+	defer w.abandonedMtx.Unlock()
+	select {
+	case <-aw.done:
+		return aw.locs, aw.err
+	default:
+	}
+	aw.abandoned = true
+	w.abandoned = aw
+	return nil, ctx.Err()
+}
+
+// logAbandonable writes recs for LogContext.
+func (w *WAL) logAbandonable(aw *abandonedWrite, recs [][]byte) {
+	locs, err := w.Log(recs...)
+
+	w.abandonedMtx.Lock()
+	defer w.abandonedMtx.Unlock()
+	aw.locs, aw.err = locs, err
+	close(aw.done)
+	if !aw.abandoned {
+		return
+	}
+	if w.abandoned == aw {
+		w.abandoned = nil
+	}
+	if err != nil {
+		w.logger.Error().Err(err).Int("records", len(recs)).Msg("Abandoned write failed")
+		return
+	}
+	ev := w.logger.Warn().Int("records", len(recs))
+	if len(locs) > 0 {
+		ev = ev.Int("segment", locs[0].Segment).Int("offset", locs[0].Offset)
+	}
+	ev.Msg("Abandoned write completed")
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_LogContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_log_context")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	locs, err := w.LogContext(context.Background(), []byte("a"))
+	require.NoError(t, err)
+	require.Len(t, locs, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = w.LogContext(ctx, []byte("canceled"))
+	require.Equal(t, context.Canceled, err)
+
+	// Stall the disk.
+	release := make(chan struct{})
+	w.writeHook = func(s *Segment, b []byte) (int, error) {
+		<-release
+		return s.Write(b)
+	}
+	rec := []byte("b")
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = w.LogContext(ctx, rec)
+	require.Equal(t, context.DeadlineExceeded, err)
+	// The caller may reuse its buffer.
+	rec[0] = 'x'
+
+	// Later calls wait for the abandoned write.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = w.LogContext(ctx, []byte("c"))
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	locs, err = w.LogContext(context.Background(), []byte("d"))
+	require.NoError(t, err)
+	require.Len(t, locs, 1)
+
+	require.Eventually(t, func() bool {
+		w.abandonedMtx.Lock()
+		defer w.abandonedMtx.Unlock()
+		return w.abandoned == nil
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("d")}, readAll(t, dir))
+}
@@ -0,0 +1,108 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Sizes of binary encoded LogLocations.
+const (
+	logLocationSize    = 12 // Without Sub.
+	logLocationSubSize = 16 // With Sub.
+)
+
+// MarshalBinary encodes l as the segment as a 4 byte and the offset as an
+// 8 byte unsigned integer, both big-endian. Locations of packed records with a
+// non-zero Sub are followed by Sub as a 4 byte big-endian unsigned integer, so
+// the encoding is 12 or 16 bytes long. Negative fields and segments or Subs
+// exceeding 32 bits can't be encoded.
+func (l LogLocation) MarshalBinary() ([]byte, error) {
+	if err := l.validate(); err != nil {
+		return nil, err
+	}
+	b := make([]byte, logLocationSize, logLocationSubSize)
+	binary.BigEndian.PutUint32(b, uint32(l.Segment))
+	binary.BigEndian.PutUint64(b[4:], uint64(l.Offset))
+	if l.Sub != 0 {
+		b = b[:logLocationSubSize]
+		binary.BigEndian.PutUint32(b[logLocationSize:], uint32(l.Sub))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a location encoded by MarshalBinary.
+func (l *LogLocation) UnmarshalBinary(b []byte) error {
+	if len(b) != logLocationSize && len(b) != logLocationSubSize {
+		return errors.Errorf("invalid encoded location size %d", len(b))
+	}
+	off := binary.BigEndian.Uint64(b[4:])
+	if off > math.MaxInt64 {
+		return errors.Errorf("encoded location offset %d out of range", off)
+	}
+	loc := LogLocation{
+		Segment: int(binary.BigEndian.Uint32(b)),
+		Offset:  int(off),
+	}
+	if len(b) == logLocationSubSize {
+		loc.Sub = int(binary.BigEndian.Uint32(b[logLocationSize:]))
+	}
+	if err := loc.validate(); err != nil {
+		return err
+	}
+	*l = loc
+	return nil
+}
+
+// logLocationJSON is the JSON encoding of LogLocation.
+type logLocationJSON struct {
+	Segment *int `json:"segment"`
+	Offset  *int `json:"offset"`
+	Sub     int  `json:"sub,omitempty"`
+}
+
+// MarshalJSON encodes l as an object with the fields "segment", "offset" and,
+// for packed records with a non-zero Sub, "sub", e.g.
+// {"segment":3,"offset":1024}. It fails for the same locations as
+// MarshalBinary, so that both encodings cover the same locations.
+func (l LogLocation) MarshalJSON() ([]byte, error) {
+	if err := l.validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(logLocationJSON{Segment: &l.Segment, Offset: &l.Offset, Sub: l.Sub})
+}
+
+// UnmarshalJSON decodes a location encoded by MarshalJSON. The fields
+// "segment" and "offset" are required and unknown fields are rejected. Like
+// for other types, decoding null leaves l unchanged.
+func (l *LogLocation) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var v logLocationJSON
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		return errors.Wrap(err, "decode location")
+	}
+	if v.Segment == nil || v.Offset == nil {
+		return errors.New("encoded location lacks segment or offset")
+	}
+	loc := LogLocation{Segment: *v.Segment, Offset: *v.Offset, Sub: v.Sub}
+	if err := loc.validate(); err != nil {
+		return err
+	}
+	*l = loc
+	return nil
+}
+
+// validate checks that l can be encoded.
+func (l LogLocation) validate() error {
+	if l.Segment < 0 || l.Offset < 0 || l.Sub < 0 || uint64(l.Segment) > math.MaxUint32 || uint64(l.Sub) > math.MaxUint32 {
+		return errors.Errorf("location %+v can't be encoded", l)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package wal
 
 import (
 	"bytes"
+	"encoding/json"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -70,3 +71,78 @@ func requireLogLocation(t *testing.T, record []byte, dir string, ll LogLocation)
 	require.True(t, reader.Next())
 	require.Equal(t, record, reader.Record())
 }
+
+func TestLogLocation_Encoding(t *testing.T) {
+	for _, loc := range []LogLocation{
+		{},
+		{Segment: 3, Offset: 1024},
+		{Segment: 1<<32 - 1, Offset: 1<<63 - 1},
+		{Segment: 7, Offset: 99, Sub: 12},
+	} {
+		b, err := loc.MarshalBinary()
+		require.NoError(t, err)
+		if loc.Sub == 0 {
+			require.Len(t, b, 12)
+		} else {
+			require.Len(t, b, 16)
+		}
+		var got LogLocation
+		require.NoError(t, got.UnmarshalBinary(b))
+		require.Equal(t, loc, got)
+
+		j, err := json.Marshal(loc)
+		require.NoError(t, err)
+		got = LogLocation{}
+		require.NoError(t, json.Unmarshal(j, &got))
+		require.Equal(t, loc, got)
+	}
+
+	b, err := LogLocation{Segment: 1, Offset: 2}.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2}, b)
+	j, err := json.Marshal(LogLocation{Segment: 1, Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, `{"segment":1,"offset":2}`, string(j))
+	j, err = json.Marshal(LogLocation{Segment: 1, Offset: 2, Sub: 3})
+	require.NoError(t, err)
+	require.Equal(t, `{"segment":1,"offset":2,"sub":3}`, string(j))
+
+	// Locations such as those of non-segment readers can't be encoded.
+	for _, loc := range []LogLocation{{Segment: -1}, {Offset: -1}, {Sub: -1}, {Segment: 1 << 32}} {
+		_, err := loc.MarshalBinary()
+		require.Error(t, err, "%+v", loc)
+		_, err = json.Marshal(loc)
+		require.Error(t, err, "%+v", loc)
+	}
+
+	// Malformed input is rejected and leaves the location untouched.
+	for _, b := range [][]byte{
+		nil,
+		make([]byte, 11),
+		make([]byte, 13),
+		make([]byte, 17),
+		{0, 0, 0, 1, 0x80, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		loc := LogLocation{Segment: 5}
+		require.Error(t, loc.UnmarshalBinary(b), "%x", b)
+		require.Equal(t, LogLocation{Segment: 5}, loc)
+	}
+	for _, j := range []string{
+		`{}`,
+		`{"segment":1}`,
+		`{"offset":1}`,
+		`{"segment":-1,"offset":1}`,
+		`{"segment":1,"offset":1,"sub":-1}`,
+		`{"segment":1,"offset":1,"extra":1}`,
+		`{"segment":"1","offset":1}`,
+		`{"segment":1.5,"offset":1}`,
+		`[1,2]`,
+	} {
+		loc := LogLocation{Segment: 5}
+		require.Error(t, json.Unmarshal([]byte(j), &loc), j)
+		require.Equal(t, LogLocation{Segment: 5}, loc)
+	}
+	loc := LogLocation{Segment: 5}
+	require.NoError(t, json.Unmarshal([]byte(`null`), &loc))
+	require.Equal(t, LogLocation{Segment: 5}, loc)
+}
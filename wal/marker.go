@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"github.com/onflow/wal/fileutil"
+)
+
+// markerFile is the name of the file identifying a WAL directory. It holds
+// markerMagic followed by the version byte of the directory layout.
+const (
+	markerFile    = "WAL"
+	markerMagic   = "WAL"
+	markerVersion = 1
+)
+
+// ErrNotWALDir is returned when opening a directory that isn't a WAL directory.
+var ErrNotWALDir = errors.New("not a WAL directory")
+
+// checkMarker verifies that dir is a WAL directory. A marker file is written
+// to new, empty directories. Directories created before markers were
+// introduced are recognized by their segments and get a marker as well, with a
+// warning logged once. Other non-empty directories are rejected with
+// ErrNotWALDir.
+func checkMarker(logger zerolog.Logger, dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, markerFile))
+	if err == nil {
+		if len(b) != len(markerMagic)+1 || !bytes.Equal(b[:len(markerMagic)], []byte(markerMagic)) {
+			return errors.Wrapf(ErrNotWALDir, "invalid marker in %s", dir)
+		}
+		if v := b[len(markerMagic)]; v != markerVersion {
+			return errors.Errorf("unsupported WAL directory version %d in %s", v, dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return errors.Wrap(err, "read marker")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// Ignore a marker left behind by an interrupted write.
+	if len(files) == 1 && files[0].Name() == markerFile+".tmp" {
+		files = nil
+	}
+	if len(files) > 0 {
+		refs, err := readSegmentRefs(dir)
+		if err != nil {
+			return err
+		}
+		if len(refs) == 0 {
+			return errors.Wrapf(ErrNotWALDir, "%s is not empty and has no marker or segments", dir)
+		}
+		logger.Warn().Str("dir", dir).Msg("WAL directory has no marker, adding one")
+	}
+	return writeMarker(dir)
+}
+
+// writeMarker atomically writes the marker file to dir.
+func writeMarker(dir string) error {
+	return errors.Wrap(writeFileAtomic(dir, markerFile, append([]byte(markerMagic), markerVersion)), "write marker")
+}
+
+// writeFileAtomic writes b to the file name in dir by writing and syncing a
+// temporary file first and renaming it, so the file either holds all of b or
+// keeps its previous state. The rename is synced as well.
+func writeFileAtomic(dir, name string, b []byte) error {
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, filepath.Join(dir, name))
+}
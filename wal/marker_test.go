@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMagicCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_magic")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	open := func(dir string, opts ...Option) error {
+		w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false, opts...)
+		if err != nil {
+			return err
+		}
+		_, err = w.Log([]byte{1})
+		require.NoError(t, err)
+		return w.Close()
+	}
+
+	// New directories get a marker.
+	walDir := filepath.Join(dir, "wal")
+	require.NoError(t, open(walDir))
+	b, err := ioutil.ReadFile(filepath.Join(walDir, markerFile))
+	require.NoError(t, err)
+	require.Equal(t, append([]byte(markerMagic), markerVersion), b)
+	require.NoError(t, open(walDir))
+
+	// Legacy directories get one on first open.
+	legacyDir := filepath.Join(dir, "legacy")
+	require.NoError(t, open(legacyDir, WithMagicCheck(false)))
+	_, err = os.Stat(filepath.Join(legacyDir, markerFile))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, open(legacyDir))
+	_, err = os.Stat(filepath.Join(legacyDir, markerFile))
+	require.NoError(t, err)
+
+	// Directories of other data are rejected and left untouched.
+	otherDir := filepath.Join(dir, "other")
+	require.NoError(t, os.MkdirAll(otherDir, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(otherDir, "data"), []byte("data"), 0666))
+	require.Equal(t, ErrNotWALDir, errors.Cause(open(otherDir)))
+	files, err := ioutil.ReadDir(otherDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(walDir, markerFile), []byte("XYZ\x01"), 0666))
+	require.Equal(t, ErrNotWALDir, errors.Cause(open(walDir)))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(walDir, markerFile), []byte("WAL\x02"), 0666))
+	require.Error(t, open(walDir))
+	require.NoError(t, open(walDir, WithMagicCheck(false)))
+}
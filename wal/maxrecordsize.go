@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// RecordTooLargeError is the error of a reader that stopped at a record
+// exceeding the size set with WithMaxRecordSize.
+type RecordTooLargeError struct {
+	Max  int // The maximum record size of the reader.
+	Size int // The size of the record read so far, or its decoded size.
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record of at least %d bytes exceeds maximum record size of %d", e.Size, e.Max)
+}
+
+// WithMaxRecordSize makes the reader fail on records larger than n bytes, to
+// protect against corrupted lengths when replaying damaged or untrusted files.
+// The size is checked as fragments are read, before their payload is read and
+// appended, and before compressed records are decoded if their decoded size is
+// known in advance, as with snappy. Records decoded by other codecs are
+// checked after decoding. The size is that of the record as stored, including
+// its extension header, and for packed records that of all records packed
+// with it, as well as its decoded size. A reader stopping at such a record
+// returns a *RecordTooLargeError wrapped in a CorruptionErr from Err. A size
+// <= 0 disables the limit, which is the default.
+func WithMaxRecordSize(n int) ReaderOption {
+	return func(r *Reader) {
+		r.maxRecordSize = n
+	}
+}
+
+// checkRecordSize returns an error if appending a fragment of the given length
+// to the current record exceeds the maximum record size.
+func (r *Reader) checkRecordSize(length int, compressed bool) error {
+	if r.maxRecordSize <= 0 {
+		return nil
+	}
+	size := length
+	switch {
+	case compressed:
+		size += len(r.snappyBuf)
+	case r.spill != nil:
+		size += r.spillLen
+	default:
+		size += len(r.rec)
+	}
+	if size > r.maxRecordSize {
+		return &RecordTooLargeError{Max: r.maxRecordSize, Size: size}
+	}
+	return nil
+}
+
+// checkDecodedSize returns an error if the current record exceeds the maximum
+// record size once decoded, or decoded would exceed it if it's snappy
+// compressed and not decoded yet.
+func (r *Reader) checkDecodedSize(decoded bool) error {
+	if r.maxRecordSize <= 0 {
+		return nil
+	}
+	size := len(r.rec)
+	if !decoded {
+		n, err := snappy.DecodedLen(r.snappyBuf)
+		if err != nil {
+			return err
+		}
+		size = n
+	}
+	if size > r.maxRecordSize {
+		return &RecordTooLargeError{Max: r.maxRecordSize, Size: size}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMaxRecordSize(t *testing.T) {
+	random := make([]byte, 3*pageSize)
+	rand.Read(random)
+
+	for name, tc := range map[string]struct {
+		compress bool
+		rec      []byte
+	}{
+		"multi_page":   {false, random},
+		"single_page":  {false, random[:2000]},
+		"decoded_size": {true, bytes.Repeat([]byte("a"), 5000)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_max_record_size")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 8*pageSize, tc.compress)
+			require.NoError(t, err)
+			_, err = w.Log(random[:1000], tc.rec, []byte("after"))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(t, err)
+			defer sr.Close()
+
+			r := NewReader(sr, WithMaxRecordSize(1000))
+			require.True(t, r.Next())
+			require.Equal(t, random[:1000], r.Record())
+			require.False(t, r.Next())
+
+			var cerr *CorruptionErr
+			require.True(t, errors.As(r.Err(), &cerr), "unexpected error %v", r.Err())
+			var terr *RecordTooLargeError
+			require.True(t, errors.As(cerr.Err, &terr), "unexpected error %v", cerr.Err)
+			require.Equal(t, 1000, terr.Max)
+			require.Greater(t, terr.Size, 1000)
+			// The record isn't assembled.
+			require.Less(t, r.PeakMemory(), int64(pageSize+2000))
+		})
+	}
+}
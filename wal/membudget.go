@@ -0,0 +1,122 @@
+package wal
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// MemoryBudgetError is returned by readers when reading a record would need
+// more memory than the budget set with WithMemoryBudget.
+type MemoryBudgetError struct {
+	Budget int64 // The memory budget of the reader.
+	Needed int64 // The memory the reader would have needed.
+}
+
+func (e *MemoryBudgetError) Error() string {
+	return fmt.Sprintf("reading record needs %d bytes of memory, exceeding budget of %d", e.Needed, e.Budget)
+}
+
+// WithMemoryBudget limits the memory the reader allocates for reading records
+// to bytes, protecting against records crafted to exhaust memory when reading
+// WALs of unknown provenance. This covers the page buffer, which takes 32KB,
+// and the buffers records are reassembled, decrypted and decompressed in, as
+// well as the records decoded ahead by a PrefetchReader. A record whose
+// buffers would exceed the budget isn't read. Instead, the reader stops with a
+// *MemoryBudgetError, which Err returns as is rather than as a CorruptionErr,
+// since the record may be intact.
+//
+// Records reassembled in a temporary file, see WithSpillThreshold, only count
+// with the fragments held in memory. Records decoded by decompressors
+// registered with WithDecompressor or by codecs registered with RegisterCodec
+// are checked after decoding, as their size isn't known in advance. A budget
+// <= 0 disables the limit, which is the default.
+func WithMemoryBudget(bytes int64) ReaderOption {
+	return func(r *Reader) {
+		r.memBudget = bytes
+	}
+}
+
+// PeakMemory returns the most memory the reader held in its buffers so far,
+// which is what WithMemoryBudget limits, excluding PrefetchReader buffers.
+func (r *Reader) PeakMemory() int64 {
+	return r.peakMem
+}
+
+// memory returns the memory held in the reader's buffers.
+func (r *Reader) memory() int64 {
+	n := cap(r.rec) + cap(r.snappyBuf) + cap(r.packBuf) + cap(r.extBuf) + cap(r.oversizedBuf)
+	if r.buf != nil {
+		n += len(r.buf)
+	}
+	return int64(n)
+}
+
+// trackMemory updates the peak memory of the reader and checks it against the
+// budget.
+func (r *Reader) trackMemory() error {
+	m := r.memory()
+	if m > r.peakMem {
+		r.peakMem = m
+	}
+	if r.memBudget > 0 && m > r.memBudget {
+		return &MemoryBudgetError{Budget: r.memBudget, Needed: m}
+	}
+	return nil
+}
+
+// grow returns buf with room for another n bytes. Within a memory budget, it
+// grows buf no further than the budget allows and fails if n bytes don't fit.
+func (r *Reader) grow(buf []byte, n int) ([]byte, error) {
+	need := len(buf) + n
+	if need <= cap(buf) {
+		return buf, nil
+	}
+	if r.memBudget <= 0 {
+		return buf, nil // Left to append.
+	}
+	avail := r.memBudget - (r.memory() - int64(cap(buf)))
+	if int64(need) > avail {
+		return buf, &MemoryBudgetError{Budget: r.memBudget, Needed: r.memBudget - avail + int64(need)}
+	}
+	size := 2 * cap(buf)
+	if size < need {
+		size = need
+	}
+	if int64(size) > avail {
+		size = int(avail)
+	}
+	b := make([]byte, len(buf), size)
+	copy(b, buf)
+	return b, nil
+}
+
+// appendBuf appends part to buf like append, within the memory budget.
+func (r *Reader) appendBuf(buf, part []byte) ([]byte, error) {
+	buf, err := r.grow(buf, len(part))
+	if err != nil {
+		return buf, err
+	}
+	return append(buf, part...), nil
+}
+
+// growDecoded makes room in r.rec for the decoded snappy record in
+// r.snappyBuf within the memory budget.
+func (r *Reader) growDecoded() error {
+	if r.memBudget <= 0 {
+		return nil
+	}
+	n, err := snappy.DecodedLen(r.snappyBuf)
+	if err != nil {
+		return err
+	}
+	r.rec, err = r.grow(r.rec[:0], n)
+	return err
+}
+
+// isMemoryBudgetExceeded returns whether err is a *MemoryBudgetError.
+func isMemoryBudgetExceeded(err error) bool {
+	var e *MemoryBudgetError
+	return errors.As(err, &e)
+}
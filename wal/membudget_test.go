@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMemoryBudget(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		for _, lazy := range []bool{false, true} {
+			t.Run(fmt.Sprintf("compress=%t,lazy=%t", compress, lazy), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_memory_budget")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, compress)
+				require.NoError(t, err)
+				var recs [][]byte
+				for i := 0; i < 10; i++ {
+					recs = append(recs, bytes.Repeat([]byte{byte(i)}, pageSize))
+				}
+				_, err = w.Log(recs...)
+				require.NoError(t, err)
+				_, err = w.Log(bytes.Repeat([]byte("large record"), 10*pageSize))
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+
+				read := func(opts ...ReaderOption) (*Reader, int) {
+					sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+					require.NoError(t, err)
+					defer sr.Close()
+					r := NewReader(sr, append(opts, WithLazyChecksum(lazy))...)
+					n := 0
+					// With lazy checksums, records are decompressed by Record.
+					for r.Next() && r.Record() != nil {
+						n++
+					}
+					return r, n
+				}
+
+				// Without a budget, the peak memory covers the large record.
+				r, n := read()
+				require.NoError(t, r.Err())
+				require.Equal(t, 11, n)
+				require.Greater(t, r.PeakMemory(), int64(10*pageSize))
+
+				// The large record exceeds the budget.
+				budget := int64(6 * pageSize)
+				r, n = read(WithMemoryBudget(budget), WithSkipCorrupt(true))
+				require.Equal(t, 10, n)
+				var merr *MemoryBudgetError
+				require.True(t, errors.As(r.Err(), &merr), "unexpected error %v", r.Err())
+				require.Equal(t, budget, merr.Budget)
+				require.Greater(t, merr.Needed, budget)
+				require.LessOrEqual(t, r.PeakMemory(), budget)
+
+				r, n = read(WithMemoryBudget(140 * pageSize))
+				require.NoError(t, r.Err())
+				require.Equal(t, 11, n)
+			})
+		}
+	}
+}
+
+func TestWithMemoryBudget_Prefetch(t *testing.T) {
+	var buf []byte
+	for i := 0; i < 50; i++ {
+		buf = append(buf, encodedRecord(recFull, bytes.Repeat([]byte{byte(i)}, pageSize/2))...)
+	}
+	budget := int64(4 * pageSize)
+
+	p := NewPrefetchReader(bytes.NewReader(buf), 20, WithMemoryBudget(budget))
+	defer p.Close()
+	for i := 0; i < 50; i++ {
+		require.True(t, p.Next(), "record %d: %v", i, p.Err())
+		require.Equal(t, bytes.Repeat([]byte{byte(i)}, pageSize/2), p.Record())
+		// The page buffer takes a page and the record another half.
+		require.LessOrEqual(t, atomic.LoadInt64(&p.held), budget-pageSize-pageSize/2)
+	}
+	require.False(t, p.Next())
+	require.NoError(t, p.Err())
+
+	// Records not fitting the budget along with the reader's buffers fail.
+	p = NewPrefetchReader(bytes.NewReader(buf), 20, WithMemoryBudget(pageSize+pageSize/2+100))
+	defer p.Close()
+	require.False(t, p.Next())
+	var merr *MemoryBudgetError
+	require.True(t, errors.As(p.Err(), &merr), "unexpected error %v", p.Err())
+}
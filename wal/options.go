@@ -0,0 +1,294 @@
+package wal
+
+import (
+	"crypto/cipher"
+	"os"
+	"time"
+)
+
+// Option configures optional behavior of a WAL created with New or NewSize.
+type Option func(*WAL)
+
+// WithMaxTotalSize limits the total number of bytes the WAL may occupy on disk
+// across all of its segments. Log rejects a batch with ErrWALFull when the
+// encoded size of its records, as returned by EncodedSize, doesn't fit into
+// the remaining capacity. A value <= 0 disables the limit.
+//
+// Zero padding written to complete a page or segment counts towards the limit
+// once it's on disk but is not anticipated by the check.
+func WithMaxTotalSize(n int64) Option {
+	return func(w *WAL) {
+		w.maxTotalSize = n
+	}
+}
+
+// FlushStrategy determines when records buffered in the active page are
+// written to the segment file.
+type FlushStrategy int
+
+const (
+	// FlushPerPage buffers records in the active page and writes them once the
+	// page is full or at the end of each Log call. Records are packed densely
+	// and a page is only padded with zeros when the next record doesn't fit.
+	// No records remain buffered in memory once Log returns: the partial page
+	// is written to the segment file, where readers find them before the page
+	// is completed. Syncing the file is left to the SyncPolicy, SyncInterval
+	// bounds how many records a machine crash may lose.
+	FlushPerPage FlushStrategy = iota
+	// FlushPerRecord writes and completes the active page after every record,
+	// padding the rest of the page with zeros. Each record reaches the file
+	// without waiting for the rest of its batch, at the cost of up to a page of
+	// wasted space per record.
+	FlushPerRecord
+)
+
+// WithFlushStrategy sets when the active page is written to the segment file.
+// The default is FlushPerPage.
+func WithFlushStrategy(s FlushStrategy) Option {
+	return func(w *WAL) {
+		w.flushStrategy = s
+	}
+}
+
+// WithSegmentHeader makes the WAL start new segments with a segment header
+// announcing their format version, see formatVersion. Readers use it to pick
+// the record format of the segment, so segments written by different versions
+// can be read side by side. Readers predating segment headers can't read
+// segments that have one, which is why it's disabled by default.
+func WithSegmentHeader(enabled bool) Option {
+	return func(w *WAL) {
+		w.segmentHeader = enabled
+	}
+}
+
+// WithMagicCheck sets whether the WAL verifies that it's opened on a WAL
+// directory, see checkMarker. It's enabled by default. Disabling it also skips
+// writing the marker file to new directories.
+func WithMagicCheck(enabled bool) Option {
+	return func(w *WAL) {
+		w.magicCheck = enabled
+	}
+}
+
+// WithSyncOnEmptyLog makes Log called without records sync the active segment
+// like a non-empty batch would, so it can be used to flush the WAL. Otherwise
+// it's a no-op, which is the default.
+func WithSyncOnEmptyLog(enabled bool) Option {
+	return func(w *WAL) {
+		w.syncOnEmpty = enabled
+	}
+}
+
+// WithWriteVerify makes Log read back every record it wrote from the segment
+// file and compare it with the original, returning an error if they differ.
+// Records are decoded like Reader does, so encoding bugs are caught as well as
+// data corrupted on its way to disk. This roughly doubles the I/O of every
+// write and is meant for tests and deployments where catching such bugs early
+// is worth the cost. It's disabled by default.
+func WithWriteVerify(enabled bool) Option {
+	return func(w *WAL) {
+		w.writeVerify = enabled
+	}
+}
+
+// WithTrimEmptyOnClose makes Close remove the active segment if no record was
+// written to it, such as after NextSegment, so the directory only holds
+// segments with data. The segment is kept if it's the only one. Reopening the
+// WAL creates the removed segment again. It's disabled by default.
+func WithTrimEmptyOnClose(enabled bool) Option {
+	return func(w *WAL) {
+		w.trimOnClose = enabled
+	}
+}
+
+// WithSlowLogCallback makes the WAL call fn for each successful Log call that
+// took at least threshold to write, flush and sync its records, with the
+// duration and the number of records. It's a lightweight way to detect disk
+// stalls. fn is called asynchronously in the order of the calls, so it doesn't
+// add to the latency of Log, but reports are dropped if it can't keep up.
+func WithSlowLogCallback(threshold time.Duration, fn func(d time.Duration, recs int)) Option {
+	return func(w *WAL) {
+		w.slowLogThreshold = threshold
+		w.slowLogFn = fn
+	}
+}
+
+// WithEncryption makes the WAL encrypt records with aead before writing them,
+// after compressing them. Each segment starts with a segment header holding a
+// random nonce base, and each record stores the counter its nonce is derived
+// from, so nonces are never reused within a segment, even for records rolled
+// back after a failed write. Encryption adds the counter and the AEAD's
+// overhead to every record. Extension headers, such as the keys of records
+// logged with LogKeyed, aren't encrypted but are authenticated along with the
+// record.
+//
+// Checksums of record fragments cover the stored ciphertext, so corruption is
+// detected before decrypting, while tampering is detected by the AEAD's
+// authentication when the record is decrypted.
+//
+// Readers need WithDecryption with the same key to read encrypted segments.
+// Segments written without encryption, including those of the same WAL
+// before encryption was enabled, remain readable. The AEAD's nonce size must
+// be at least 8 bytes. Encryption implies WithSegmentHeader. A nil aead
+// disables encryption, which is the default.
+func WithEncryption(aead cipher.AEAD) Option {
+	return func(w *WAL) {
+		w.aead = aead
+	}
+}
+
+// WithLockedSyncThread makes the WAL sync segments on a dedicated goroutine
+// locked to its own OS thread, see runtime.LockOSThread, instead of on the
+// goroutine calling Log. The blocking fsync calls then never occupy a thread
+// the Go scheduler runs other goroutines on, which can smooth the tail latency
+// of Log under heavy concurrency on some kernels, at the cost of a thread and
+// a handoff per sync. Whether it helps depends on the platform, so compare
+// with BenchmarkWAL_LogLockedSyncThread. It's disabled by default.
+func WithLockedSyncThread(enabled bool) Option {
+	return func(w *WAL) {
+		w.lockedSyncThread = enabled
+	}
+}
+
+// WithSegmentIDs makes the WAL store a random ID in the segment header of each
+// new segment, which identifies the segment independently of its index, see
+// SegmentID. It implies WithSegmentHeader and the version 3 format. It's
+// disabled by default.
+func WithSegmentIDs(enabled bool) Option {
+	return func(w *WAL) {
+		w.segmentIDs = enabled
+	}
+}
+
+// WithEpochs makes the WAL tag each record with an epoch, a counter that
+// increases with every record logged, so that records can be replayed in the
+// order they were logged even after compaction or checkpoints moved them.
+// Unlike LogLocation, the epoch of a record never changes, as it's stored in
+// the record's extension header, which is retained when records are
+// rewritten. Readers get it from Reader.Epoch, writers from LogWithEpochs.
+// Epochs are strictly increasing but may have gaps, e.g. for records removed
+// again by LogWithIndexUpdate. Packed records get consecutive epochs.
+//
+// The counter is persisted in the header of each new segment. On open, it's
+// recovered from the header of the last segment and the epochs of the records
+// in it. If that segment's header has no counter, e.g. because epochs were
+// disabled when it was created, the segments before it are scanned as well
+// until one with a counter is found. This reads the last segment once on
+// every open. Segments written by compaction carry no counter.
+//
+// It implies WithSegmentHeader and the version 3 format. Readers predating
+// epochs fail to read records with one. It's disabled by default.
+func WithEpochs(enabled bool) Option {
+	return func(w *WAL) {
+		w.epochs = enabled
+	}
+}
+
+// WithPackedRecords makes Log pack consecutive records of at most maxSize
+// bytes into a single physical record, saving the record header and padding
+// of each for workloads dominated by tiny records. Readers split packed
+// records up again transparently, so each record is still returned by its own
+// call to Reader.Next.
+//
+// Packed records share the segment and offset of their location, which are
+// those of the physical record, and are told apart by LogLocation.Sub, their
+// index within it. Only records of the same Log call are packed, and only if
+// there are at least two in a row. Records logged with LogKeyed, LogAligned
+// or WriteReserved are never packed. Readers predating packed records fail to
+// read them. A maxSize <= 0 disables packing, which is the default.
+func WithPackedRecords(maxSize int) Option {
+	return func(w *WAL) {
+		w.packMax = maxSize
+	}
+}
+
+// WithAutoCheckpoint makes the WAL call CheckpointAndTruncate with keep in
+// the background each time another everyBytes bytes of records were logged,
+// covering all segments before the active one. Writes aren't blocked while the
+// checkpoint is written. If a checkpoint is still running or there are no new
+// complete segments to cover, the next one is started by a later write. Errors
+// are logged. Close waits for a running checkpoint, which fails early once the
+// WAL is closed. Manual calls to CheckpointAndTruncate must not overlap with
+// automatic ones. An everyBytes <= 0 disables automatic checkpoints, which is
+// the default.
+func WithAutoCheckpoint(everyBytes int64, keep func([]byte) bool) Option {
+	return func(w *WAL) {
+		w.autoCheckpointBytes = everyBytes
+		w.autoCheckpointKeep = keep
+	}
+}
+
+// WALConfig is a snapshot of the effective configuration of a WAL.
+type WALConfig struct {
+	PageSize      int
+	SegmentSize   int
+	Compress      bool
+	Compression   Compression // Codec records are compressed with if Compress is set.
+	MaxTotalSize  int64       // <= 0 if the size is unlimited.
+	FlushStrategy FlushStrategy
+	SyncPolicy    SyncPolicy
+	FormatVersion int // Format version of the segments written.
+}
+
+// Config returns the configuration the WAL is running with.
+// Records are always checksummed with CRC32 (Castagnoli) so there's no
+// checksum setting. If the WAL continued an existing segment on opening, see
+// OpenAppend, the page size and format version are those read from its
+// header. Segments carry no other configuration of their own, so the other
+// values are those the WAL was created with.
+func (w *WAL) Config() WALConfig {
+	c := WALConfig{
+		PageSize:      w.pageSize,
+		SegmentSize:   w.segmentSize,
+		Compress:      w.compress,
+		Compression:   w.compression,
+		MaxTotalSize:  w.maxTotalSize,
+		FlushStrategy: w.flushStrategy,
+		SyncPolicy:    w.syncPolicy,
+		FormatVersion: w.formatVersion(),
+	}
+	if w.openedVersion > 0 {
+		c.PageSize, c.FormatVersion = w.openedPage, w.openedVersion
+	}
+	return c
+}
+
+// readOpenedFormat reads the format version and page size reported by Config
+// from the header of the active segment, which the WAL continued on opening.
+// Segments without a header are of version 1 with the default page size.
+func (w *WAL) readOpenedFormat() error {
+	f, err := os.Open(w.segment.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil || fi.Size() == 0 {
+		// Empty segments are continued with the WAL's own format.
+		return err
+	}
+	r := NewReader(nil, w.readerOptions()...)
+	if err := r.readSegmentHeaderAt(f); err != nil {
+		return err
+	}
+	w.openedVersion, w.openedPage = r.version, r.pageSize
+	return nil
+}
+
+// formatVersion returns the format version of the segments the WAL writes.
+func (w *WAL) formatVersion() int {
+	switch {
+	case w.aead != nil, w.segmentIDs, w.epochs, w.pageSize != pageSize:
+		return formatV3
+	case w.segmentHeader:
+		return formatV2
+	default:
+		return formatV1
+	}
+}
+
+// formatOptions returns the options making another WAL write segments in the
+// same format as w, e.g. for compaction.
+func (w *WAL) formatOptions() []Option {
+	return []Option{WithSegmentHeader(w.segmentHeader), WithEncryption(w.aead), WithSegmentIDs(w.segmentIDs), WithCompression(w.compression), WithPageSize(w.pageSize)}
+}
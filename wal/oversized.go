@@ -0,0 +1,68 @@
+package wal
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// maxFragmentSize is the largest payload of a record fragment written by the
+// WAL, which splits records at page boundaries.
+const maxFragmentSize = pageSize - recordHeaderSize
+
+// WithAllowOversizedFull makes the reader accept full records whose payload
+// exceeds a page, as a writer storing large records contiguously instead of
+// splitting them at page boundaries would produce. The WAL doesn't write such
+// records, so by default the reader fails on them, reporting the size and
+// location of the record.
+//
+// Even when allowed, oversized records are format errors where no writer could
+// have produced them: as first, middle or last fragments, which are split at
+// page boundaries by definition, and when crossing into the next segment,
+// since records never span segments. Oversized records are read into a
+// separate buffer of their size, which counts against WithMemoryBudget.
+func WithAllowOversizedFull(allow bool) ReaderOption {
+	return func(r *Reader) {
+		r.allowOversizedFull = allow
+	}
+}
+
+// oversizedBuffer returns a buffer to read the payload of an oversized
+// fragment of the given length into, or an error if the fragment isn't
+// allowed, see WithAllowOversizedFull.
+func (r *Reader) oversizedBuffer(length uint16) ([]byte, error) {
+	if !r.allowOversizedFull {
+		return nil, r.oversizedErr(length, "")
+	}
+	if r.curRecTyp != recFull {
+		return nil, r.oversizedErr(length, "only full records may exceed it")
+	}
+	buf, err := r.grow(r.oversizedBuf[:0], int(length))
+	if err != nil {
+		return nil, err
+	}
+	if cap(buf) < int(length) {
+		buf = make([]byte, length)
+	}
+	r.oversizedBuf = buf[:length]
+	return r.oversizedBuf, nil
+}
+
+// checkOversized fails if the payload of an oversized fragment that was just
+// read crossed into the next segment.
+func (r *Reader) checkOversized(length uint16) error {
+	if length > maxFragmentSize && r.Segment() != r.recStart.Segment {
+		return r.oversizedErr(length, "it crosses into the next segment")
+	}
+	return nil
+}
+
+// oversizedErr returns an error for a fragment of the given length exceeding
+// a page, with reason explaining why it's invalid if set.
+func (r *Reader) oversizedErr(length uint16, reason string) error {
+	msg := fmt.Sprintf("%s record at %+v has %d bytes, exceeding the %d bytes fitting a page", r.curRecTyp, r.recStart, length, maxFragmentSize)
+	if reason != "" {
+		msg += ": " + reason
+	}
+	return errors.New(msg)
+}
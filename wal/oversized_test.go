@@ -0,0 +1,91 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithAllowOversizedFull(t *testing.T) {
+	oversized := data[:pageSize+100]
+	var buf []byte
+	buf = append(buf, encodedRecord(recFull, data[:10])...)
+	buf = append(buf, encodedRecord(recFull, oversized)...)
+	buf = append(buf, encodedRecord(recFull, data[10:20])...)
+	// The page is terminated relative to the stream, not the oversized record.
+	buf = append(buf, make([]byte, pageSize-len(buf)%pageSize)...)
+	buf = append(buf, encodedRecord(recFull, data[20:30])...)
+
+	// Strict readers fail, telling where and why.
+	r := NewReader(bytes.NewReader(buf))
+	require.True(t, r.Next())
+	require.False(t, r.Next())
+	require.Error(t, r.Err())
+	require.Contains(t, r.Err().Error(), "full record at {Segment:-1 Offset:17 Sub:0} has 32868 bytes, exceeding the 32761 bytes fitting a page")
+
+	for _, lazy := range []bool{false, true} {
+		r = NewReader(bytes.NewReader(buf), WithAllowOversizedFull(true), WithLazyChecksum(lazy))
+		var got [][]byte
+		for r.Next() {
+			got = append(got, append([]byte(nil), r.Record()...))
+		}
+		require.NoError(t, r.Err())
+		require.Equal(t, [][]byte{data[:10], oversized, data[10:20], data[20:30]}, got)
+	}
+
+	// Corrupted oversized records are detected.
+	corrupted := append([]byte(nil), buf...)
+	corrupted[17+recordHeaderSize+pageSize] ^= 0xff
+	r = NewReader(bytes.NewReader(corrupted), WithAllowOversizedFull(true))
+	require.True(t, r.Next())
+	require.False(t, r.Next())
+	require.Error(t, r.Err())
+
+	// The buffer of oversized records counts against the memory budget.
+	r = NewReader(bytes.NewReader(buf), WithAllowOversizedFull(true), WithMemoryBudget(pageSize+pageSize/2))
+	require.True(t, r.Next())
+	require.False(t, r.Next())
+	require.True(t, isMemoryBudgetExceeded(r.Err()), "unexpected error %v", r.Err())
+
+	// Writers split other fragments at page boundaries.
+	for _, typ := range []recType{recFirst, recMiddle, recLast} {
+		var frag []byte
+		if typ != recFirst {
+			frag = encodedRecord(recFirst, data[:10])
+		}
+		frag = append(frag, encodedRecord(typ, oversized)...)
+		r = NewReader(bytes.NewReader(frag), WithAllowOversizedFull(true))
+		require.False(t, r.Next())
+		require.Error(t, r.Err())
+		require.Contains(t, r.Err().Error(), "only full records may exceed it")
+	}
+}
+
+func TestWithAllowOversizedFull_SegmentBoundary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_oversized")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Records never span segments.
+	rec := encodedRecord(recFull, data[:pageSize+100])
+	require.NoError(t, ioutil.WriteFile(SegmentName(dir, 0), rec[:pageSize], 0666))
+	require.NoError(t, ioutil.WriteFile(SegmentName(dir, 1), rec[pageSize:], 0666))
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr, WithAllowOversizedFull(true))
+	require.False(t, r.Next())
+	require.Error(t, r.Err())
+	require.Contains(t, r.Err().Error(), "crosses into the next segment")
+	var cerr *CorruptionErr
+	require.True(t, errors.As(r.Err(), &cerr), "unexpected error %v", r.Err())
+	require.Equal(t, 1, cerr.Segment)
+}
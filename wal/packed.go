@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// maxPackedSize is the maximum payload size of a packed record, which keeps
+// packed records within about a page.
+const maxPackedSize = pageSize
+
+// packedExt is the encoded extension header of packed records.
+var packedExt = recordExt{flags: extPacked}.encode(nil)
+
+// The payload of a packed record is the sequence of the records it packs, each
+// prefixed with its size as a uvarint.
+
+// packRun returns the number of records at the start of recs to pack into one
+// physical record. It returns 1 if the first record isn't to be packed.
+func (w *WAL) packRun(recs [][]byte) int {
+	if w.packMax <= 0 {
+		return 1
+	}
+	n, size := 0, 0
+	for _, rec := range recs {
+		if len(rec) > w.packMax {
+			break
+		}
+		size += binary.MaxVarintLen32 + len(rec)
+		if n > 0 && size > maxPackedSize {
+			break
+		}
+		n++
+	}
+	if n < 2 {
+		return 1
+	}
+	return n
+}
+
+// pack returns the payload of a packed record holding recs. The returned slice
+// is valid until the next call.
+func (w *WAL) pack(recs [][]byte) []byte {
+	w.packBuf = w.packBuf[:0]
+	for _, rec := range recs {
+		w.packBuf = binary.AppendUvarint(w.packBuf, uint64(len(rec)))
+		w.packBuf = append(w.packBuf, rec...)
+	}
+	return w.packBuf
+}
+
+// unpack makes the decoded packed record read by r the source of the following
+// records and advances to the first of them.
+func (r *Reader) unpack() error {
+	r.packBuf, r.rec = r.rec, r.packBuf
+	r.packed = r.packBuf
+	r.recStart.Sub = -1
+
+	// Packed records carry no extension fields of their own, apart from their
+	// epoch, which follows from that of the first one.
+	r.ext.flags &^= extPacked
+	r.extBuf = r.extBuf[:0]
+	if r.ext.flags != 0 {
+		r.extBuf = r.ext.encode(r.extBuf)
+	}
+	r.packedEpoch = r.ext.epoch
+	return r.nextPacked()
+}
+
+// nextPacked advances r to the next record of the current packed record.
+func (r *Reader) nextPacked() error {
+	size, n := binary.Uvarint(r.packed)
+	if n <= 0 || size > uint64(len(r.packed)-n) {
+		r.packed = nil
+		return errors.New("invalid packed record")
+	}
+	rec, err := r.appendBuf(r.rec[:0], r.packed[n:n+int(size)])
+	if err != nil {
+		return err
+	}
+	r.rec = rec
+	r.packed = r.packed[n+int(size):]
+	r.recStart.Sub++
+	if r.ext.flags&extEpoch != 0 {
+		r.ext.epoch = r.packedEpoch + uint64(r.recStart.Sub)
+		r.extBuf = r.ext.encode(r.extBuf[:0])
+	}
+
+	r.compressed = false
+	r.compression = 0
+	r.unverified = false
+	r.undecoded = false
+	r.corrupt = false
+	r.sealed = false
+	return nil
+}
@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// packedRecords returns a mix of tiny and large records.
+func packedRecords(n int) [][]byte {
+	var recs [][]byte
+	for i := 0; i < n; i++ {
+		size := rand.Intn(32)
+		if i%10 == 9 {
+			size = rand.Intn(3 * pageSize)
+		}
+		rec := make([]byte, size)
+		rand.Read(rec[:size/2])
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestPackedRecords(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_packed")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 8*pageSize, compress, WithPackedRecords(64), WithWriteVerify(true))
+			require.NoError(t, err)
+			defer w.Close()
+
+			var (
+				recs [][]byte
+				locs []LogLocation
+			)
+			for i := 0; i < 20; i++ {
+				batch := packedRecords(rand.Intn(100))
+				l, err := w.Log(batch...)
+				require.NoError(t, err)
+				recs = append(recs, batch...)
+				locs = append(locs, l...)
+			}
+			// Single records and keyed ones aren't packed.
+			l, err := w.Log([]byte("single"))
+			require.NoError(t, err)
+			loc, err := w.LogKeyed([8]byte{1}, []byte("keyed"))
+			require.NoError(t, err)
+			recs = append(recs, []byte("single"), []byte("keyed"))
+			locs = append(locs, l[0], loc)
+
+			// Tiny records of a batch share physical records.
+			subs := 0
+			for i, loc := range locs {
+				if loc.Sub > 0 {
+					subs++
+					prev := locs[i-1]
+					require.Equal(t, LogLocation{Segment: prev.Segment, Offset: prev.Offset, Sub: prev.Sub + 1}, loc)
+				}
+			}
+			require.Greater(t, subs, len(recs)/2)
+
+			for _, lazy := range []bool{false, true} {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				require.NoError(t, err)
+				r := NewReader(sr, WithLazyChecksum(lazy))
+				for i := range recs {
+					require.True(t, r.Next(), "expected record %d: %v", i, r.Err())
+					// Empty records may be returned as nil.
+					require.Equal(t, recs[i], append([]byte{}, r.Record()...))
+					require.Equal(t, locs[i].Sub, r.recStart.Sub)
+					if locs[i].Sub > 0 {
+						require.Empty(t, r.extBuf)
+					}
+				}
+				require.Equal(t, [8]byte{1}, r.Key())
+				require.False(t, r.Next())
+				require.NoError(t, r.Err())
+				require.NoError(t, sr.Close())
+			}
+
+			// Consuming resumes at the record of a packed record that failed.
+			var (
+				got    [][]byte
+				failed bool
+				start  LogLocation
+			)
+			errFail := errors.New("fail")
+			for {
+				ctx, cancel := context.WithCancel(context.Background())
+				err := w.Consume(ctx, start, func(rec []byte, loc LogLocation) error {
+					if loc.Sub == 3 && !failed {
+						failed = true
+						start = loc
+						return errFail
+					}
+					got = append(got, append([]byte{}, rec...))
+					if len(got) == len(recs) {
+						cancel()
+					}
+					return nil
+				})
+				cancel()
+				if err == errFail {
+					continue
+				}
+				require.Equal(t, context.Canceled, err)
+				break
+			}
+			require.True(t, failed)
+			require.Equal(t, recs, got)
+		})
+	}
+}
+
+func TestPackedRecords_Size(t *testing.T) {
+	var sizes [2]int64
+	for i, packMax := range []int{0, 64} {
+		dir, err := ioutil.TempDir("", "wal_packed")
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, os.RemoveAll(dir))
+		}()
+
+		w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false, WithPackedRecords(packMax))
+		require.NoError(t, err)
+		for j := 0; j < 1000; j++ {
+			batch := make([][]byte, 50)
+			for k := range batch {
+				batch[k] = []byte{byte(j), byte(k)}
+			}
+			_, err := w.Log(batch...)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		sizes[i], err = segmentsSize(dir)
+		require.NoError(t, err)
+	}
+	// Each record takes 9 bytes on its own and 3 bytes when packed.
+	require.Less(t, 2*sizes[1], sizes[0])
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// minPageSize is the smallest page size allowed by WithPageSize. It leaves
+// room for the largest segment header, which holds a nonce base of up to 255
+// bytes, in the first page of a segment.
+const minPageSize = 512
+
+// WithPageSize sets the size of the pages new segments are written in, which
+// must be a power of two between 512 bytes and the default of 32KB. Smaller
+// pages waste less space padding partially filled pages, e.g. when syncing
+// after every few tiny records, at the cost of more fragment headers for large
+// records. The segment size must be a multiple of the page size.
+//
+// Segments written with a non-default page size start with a formatV3 segment
+// header recording it, so readers pick it up without being configured. As
+// readers predating it can't read them, segments written with the default page
+// size are unchanged. The page size of a WAL can change between reopens, since
+// every segment records its own.
+func WithPageSize(n int) Option {
+	return func(w *WAL) {
+		w.pageSize = n
+	}
+}
+
+// checkPageSize returns an error if n isn't a valid page size.
+func checkPageSize(n int) error {
+	if n < minPageSize || n > pageSize || n&(n-1) != 0 {
+		return errors.Errorf("invalid page size %d, must be a power of two between %d and %d", n, minPageSize, pageSize)
+	}
+	return nil
+}
+
+// customPageSize returns the page size of new segments if it isn't the default
+// one, and 0 otherwise.
+func (w *WAL) customPageSize() int {
+	if w.pageSize == pageSize {
+		return 0
+	}
+	return w.pageSize
+}
+
+// segmentPageSize returns the page size of the segment read from f.
+func segmentPageSize(f io.ReaderAt) (int, error) {
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], 0); err != nil {
+		if err == io.EOF {
+			return pageSize, nil
+		}
+		return 0, errors.Wrap(err, "read segment header")
+	}
+	if recTypeFromHeader(b[0]) != recSegmentHeader {
+		return pageSize, nil
+	}
+	v, fields, err := NewReader(io.NewSectionReader(f, 1, pageSize-1)).readSegmentHeaderRecord()
+	if err != nil {
+		return 0, err
+	}
+	sf, err := decodeSegmentFields(v, fields)
+	if err != nil {
+		return 0, err
+	}
+	if sf.pageSize == 0 {
+		return pageSize, nil
+	}
+	return sf.pageSize, nil
+}
@@ -0,0 +1,91 @@
+package wal
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_PageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_page_size")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	const size = 4096
+	w, err := NewSize(zerolog.Nop(), nil, dir, 8*size, false, WithPageSize(size))
+	require.NoError(t, err)
+	require.Equal(t, size, w.Config().PageSize)
+
+	// Records spanning several of the small pages and filling some exactly.
+	var recs [][]byte
+	for _, n := range []int{10, 3 * size, size - 2*recordHeaderSize, 100, 5 * size, 1} {
+		rec := make([]byte, n)
+		rand.Read(rec)
+		recs = append(recs, rec)
+	}
+	var locs []LogLocation
+	for _, rec := range recs {
+		l, err := w.Log(rec)
+		require.NoError(t, err)
+		locs = append(locs, l...)
+	}
+	aligned, err := w.LogAligned([]byte("aligned"))
+	require.NoError(t, err)
+	require.Equal(t, 0, aligned.Offset%size)
+	require.NotEqual(t, 0, aligned.Offset%pageSize)
+	recs = append(recs, []byte("aligned"))
+	locs = append(locs, aligned)
+	require.NoError(t, w.Close())
+
+	// The page size is recorded in the segment headers.
+	require.Equal(t, recs, readAll(t, dir))
+	for i, loc := range locs {
+		r, err := NewReaderFrom(zerolog.Nop(), dir, loc)
+		require.NoError(t, err)
+		require.True(t, r.Next(), "record %d", i)
+		require.Equal(t, recs[i], r.Record())
+		require.NoError(t, r.Close())
+	}
+
+	// Reopening with the default page size writes segments as before, which
+	// are read along with the previous ones.
+	w, err = NewSize(zerolog.Nop(), nil, dir, 8*pageSize, false)
+	require.NoError(t, err)
+	require.Equal(t, pageSize, w.Config().PageSize)
+	_, err = w.Log([]byte("default"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, append(recs, []byte("default")), readAll(t, dir))
+
+	_, last, err := Segments(dir)
+	require.NoError(t, err)
+	f, err := os.Open(SegmentName(dir, last))
+	require.NoError(t, err)
+	defer f.Close()
+	b := make([]byte, 1)
+	_, err = f.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, recFull, recTypeFromHeader(b[0]), "default segments have no header")
+}
+
+func TestWAL_PageSizeInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_page_size")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	for _, size := range []int{0, -4096, 256, 3000, 2 * pageSize} {
+		_, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithPageSize(size))
+		require.Error(t, err, "page size %d", size)
+	}
+	// The segment size must be a multiple of the page size.
+	_, err = NewSize(zerolog.Nop(), nil, dir, 3*1024, false, WithPageSize(2048))
+	require.Error(t, err)
+}
@@ -0,0 +1,41 @@
+package wal
+
+// WithPageTermDetector makes the reader consult detect before decoding each
+// record header, to read WALs written by writers that terminate pages
+// differently, e.g. with a marker byte instead of zero padding. page holds the
+// bytes of the current page read so far and pos is the position of the first
+// header byte within it, which is always the last byte of page. For readers
+// starting in the middle of a page, the bytes before the start are zero.
+//
+// If detect returns true, the rest of the page is skipped without being
+// checked, like the zero padding of a page terminated by recPageTerm.
+// Otherwise the header is decoded as usual, so zero padding is still
+// recognized. detect must be deterministic and agree with how the page was
+// written, as misdetecting a record header loses the records in the rest of
+// the page, and misdetecting padding fails reading.
+func WithPageTermDetector(detect func(page []byte, pos int) bool) ReaderOption {
+	return func(r *Reader) {
+		r.pageTerm = detect
+	}
+}
+
+// observe records b, which was just read, as part of the current page for the
+// detector set with WithPageTermDetector.
+func (r *Reader) observe(b []byte) {
+	if r.pageTerm == nil {
+		return
+	}
+	n := int(r.total % int64(r.pageSize)) // Bytes of the current page read.
+	if n == 0 {
+		n = r.pageSize
+	}
+	if len(b) >= n {
+		r.page = append(r.page[:0], b[len(b)-n:]...)
+		return
+	}
+	if len(r.page)+len(b) != n {
+		// The reader started in the middle of the page.
+		r.page = append(r.page[:0], make([]byte, n-len(b))...)
+	}
+	r.page = append(r.page, b...)
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPageTermDetector(t *testing.T) {
+	const marker = 0xab
+
+	// A legacy page terminated by a marker followed by garbage, then a page
+	// terminated by zero padding and a final record.
+	first := encodedRecord(recFull, []byte("first"))
+	var buf []byte
+	buf = append(buf, first...)
+	buf = append(buf, encodedRecord(recFull, []byte("second"))...)
+	buf = append(buf, marker)
+	buf = append(buf, bytes.Repeat([]byte{0xff}, pageSize-len(buf))...)
+	buf = append(buf, encodedRecord(recFull, []byte("third"))...)
+	buf = append(buf, make([]byte, 2*pageSize-len(buf))...)
+	buf = append(buf, encodedRecord(recFull, []byte("fourth"))...)
+	want := [][]byte{[]byte("first"), []byte("second"), []byte("third"), []byte("fourth")}
+
+	r := NewReader(bytes.NewReader(buf))
+	for r.Next() {
+	}
+	require.Error(t, r.Err())
+
+	var checked int
+	detect := func(page []byte, pos int) bool {
+		checked++
+		require.Equal(t, len(page)-1, pos)
+		if checked <= 3 && pos > 0 {
+			// Within the legacy page.
+			require.Equal(t, first, page[:len(first)])
+		}
+		return page[pos] == marker
+	}
+	r = NewReader(bytes.NewReader(buf), WithPageTermDetector(detect))
+	var got [][]byte
+	for r.Next() {
+		got = append(got, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, want, got)
+	require.Equal(t, 6, checked)
+
+	// Bytes before the start of a reader starting mid-page read as zero.
+	checked = 0
+	r = NewReader(bytes.NewReader(buf[len(first):]), WithPageTermDetector(func(page []byte, pos int) bool {
+		if checked++; checked <= 2 {
+			require.Equal(t, make([]byte, len(first)), page[:len(first)])
+		}
+		return page[pos] == marker
+	}))
+	r.total = int64(len(first))
+	got = nil
+	for r.Next() {
+		got = append(got, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, want[1:], got)
+}
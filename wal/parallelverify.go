@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// segmentReport is the result of verifying a single segment for
+// ParallelVerify.
+type segmentReport struct {
+	records        int
+	lastValid      LogLocation
+	fragmentCounts map[string]int
+	corruption     *CorruptionErr
+	err            error
+}
+
+// ParallelVerify reports the integrity of the segments in dir like VerifyDir,
+// but verifies up to workers segments concurrently. A workers value <= 0 uses
+// one worker.
+//
+// The WAL never splits a record across segments: a record that doesn't fit
+// into the rest of the active segment is written to the next one, which
+// starts with a fresh page. Every segment therefore decodes on its own, and a
+// record missing fragments at the end of a segment is a torn record even if
+// more segments follow. VerifyDir reads such a segment along with the next
+// one and reports the start of the next one as a type transition instead, so
+// the kind of that corruption may differ between the two.
+//
+// The reports of the segments are aggregated in order, so the corruption
+// reported is the earliest one, and counts only cover the segments up to it.
+// Segments after a corruption that was already found aren't verified.
+func ParallelVerify(dir string, workers int) (VerifyReport, error) {
+	report := VerifyReport{FragmentCounts: map[string]int{}}
+	refs, err := readSegmentRefs(dir)
+	if err != nil {
+		return report, errors.Wrap(err, "list segments")
+	}
+	report.Segments = len(refs)
+	report.Gaps = segmentGaps(refs)
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var (
+		reports = make([]segmentReport, len(refs))
+		jobs    = make(chan int)
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		stop    = len(refs) // Position of the earliest corrupted segment found.
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := range jobs {
+				mtx.Lock()
+				skip := pos > stop
+				mtx.Unlock()
+				if skip {
+					continue
+				}
+				reports[pos] = verifySegment(dir, refs[pos].index)
+				if reports[pos].corruption != nil || reports[pos].err != nil {
+					mtx.Lock()
+					if pos < stop {
+						stop = pos
+					}
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for pos := range refs {
+		jobs <- pos
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, sr := range reports[:min(stop+1, len(reports))] {
+		if sr.err != nil {
+			return report, sr.err
+		}
+		report.Records += sr.records
+		if sr.records > 0 {
+			report.LastValid = sr.lastValid
+		}
+		for typ, n := range sr.fragmentCounts {
+			report.FragmentCounts[typ] += n
+		}
+		if sr.corruption != nil {
+			report.Corruption = sr.corruption
+			report.CorruptionKind = sr.corruption.Kind
+		}
+	}
+	return report, nil
+}
+
+// verifySegment reads the segment with the given index in dir for
+// ParallelVerify.
+func verifySegment(dir string, index int) segmentReport {
+	sr := segmentReport{fragmentCounts: map[string]int{}}
+	r, err := NewSegmentReader(dir, index)
+	if err != nil {
+		sr.err = err
+		return sr
+	}
+	defer r.Close()
+
+	r.onFragment = func(typ recType) {
+		sr.fragmentCounts[typ.String()]++
+	}
+	for r.Next() {
+		sr.records++
+		sr.lastValid = r.CurrentLocation()
+	}
+	if err := r.Err(); err != nil {
+		if !errors.As(err, &sr.corruption) {
+			sr.err = err
+		}
+	}
+	return sr
+}
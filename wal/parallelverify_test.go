@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_parallel_verify")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	var locs []LogLocation
+	for i := 0; i < 20; i++ {
+		l, err := w.Log(make([]byte, 100), make([]byte, pageSize))
+		require.NoError(t, err)
+		locs = append(locs, l...)
+	}
+	require.NoError(t, w.Close())
+
+	check := func(want VerifyReport) {
+		for _, workers := range []int{0, 1, 3, 16} {
+			report, err := ParallelVerify(dir, workers)
+			require.NoError(t, err)
+			require.Equal(t, want.Records, report.Records, "workers %d", workers)
+			require.Equal(t, want.LastValid, report.LastValid, "workers %d", workers)
+			require.Equal(t, want.FragmentCounts, report.FragmentCounts, "workers %d", workers)
+			require.Equal(t, want.CorruptionKind, report.CorruptionKind, "workers %d", workers)
+			if want.Corruption != nil {
+				require.NotNil(t, report.Corruption)
+				require.Equal(t, want.Corruption.Segment, report.Corruption.Segment)
+			}
+		}
+	}
+	want, err := VerifyDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, len(locs), want.Records)
+	check(want)
+
+	// Only the earliest corruption is reported.
+	writeSegmentAt(t, dir, locs[21].Segment, int64(locs[21].Offset+recordHeaderSize+10), 0xff)
+	writeSegmentAt(t, dir, locs[31].Segment, int64(locs[31].Offset+recordHeaderSize+10), 0xff)
+	want, err = VerifyDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 21, want.Records)
+	require.Equal(t, CorruptionChecksum, want.CorruptionKind)
+	check(want)
+
+	// An empty directory is intact.
+	empty, err := ioutil.TempDir("", "wal_parallel_verify")
+	require.NoError(t, err)
+	defer os.RemoveAll(empty)
+	report, err := ParallelVerify(empty, 4)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Segments)
+	require.Nil(t, report.Corruption)
+}
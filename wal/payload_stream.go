@@ -0,0 +1,70 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// payloadStream yields the records of a WAL, each prefixed by its length.
+type payloadStream struct {
+	sr  io.ReadCloser
+	r   *Reader
+	buf []byte // Encoded current record.
+	off int    // Offset of unread data in buf.
+}
+
+// NewPayloadStream returns a reader over the records of all segments in dir,
+// for piping records into tools unaware of the WAL format. Each record is
+// preceded by its length as a 4 byte big-endian unsigned integer.
+// Records are decoded while reading, one at a time.
+//
+// Reading fails with the error of the underlying WAL reader when a corruption
+// is encountered.
+func NewPayloadStream(dir string) (io.ReadCloser, error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	if len(refs) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadStream{sr: sr, r: NewReader(sr)}, nil
+}
+
+// Read implements io.Reader.
+func (s *payloadStream) Read(b []byte) (int, error) {
+	if s.off == len(s.buf) {
+		if !s.r.Next() {
+			if err := s.r.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		rec := s.r.Record()
+		if uint64(len(rec)) > math.MaxUint32 {
+			return 0, errors.Errorf("record of %d bytes too large", len(rec))
+		}
+		s.buf = append(s.buf[:0], 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(s.buf, uint32(len(rec)))
+		s.buf = append(s.buf, rec...)
+		s.off = 0
+	}
+	n := copy(b, s.buf[s.off:])
+	s.off += n
+	return n, nil
+}
+
+// Close implements io.Closer.
+func (s *payloadStream) Close() error {
+	return s.sr.Close()
+}
@@ -0,0 +1,51 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_payload_stream")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s, err := NewPayloadStream(dir)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Empty(t, b)
+	require.NoError(t, s.Close())
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, true)
+	require.NoError(t, err)
+	recs := [][]byte{{1, 2, 3}, {}, bytes.Repeat([]byte{4}, 3*pageSize), {5}}
+	_, err = w.Log(recs...)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	var expected bytes.Buffer
+	for _, rec := range recs {
+		require.NoError(t, binary.Write(&expected, binary.BigEndian, uint32(len(rec))))
+		expected.Write(rec)
+	}
+
+	s, err = NewPayloadStream(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Read in small chunks to exercise partial reads.
+	var got bytes.Buffer
+	_, err = io.CopyBuffer(&got, struct{ io.Reader }{s}, make([]byte, 5))
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes(), got.Bytes())
+}
@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// errPrefetchClosed is returned by PrefetchReader.buffer once the reader is
+// closed.
+var errPrefetchClosed = errors.New("prefetch reader closed")
+
+// PrefetchReader reads WAL records like Reader while decoding records ahead
+// of the consumer in a background goroutine.
+type PrefetchReader struct {
+	items  chan prefetchItem
+	free   chan []byte   // Buffers of consumed records for reuse.
+	done   chan struct{} // Closed by Close to stop the decoder.
+	exited chan struct{} // Closed once the decoder exited.
+	once   sync.Once
+	held   int64 // Capacity of the record buffers allocated and not dropped.
+
+	rec []byte
+	err error
+}
+
+// prefetchItem is a decoded record or the error that ended decoding.
+type prefetchItem struct {
+	rec []byte
+	err error
+}
+
+// NewPrefetchReader returns a reader over the records in r that decodes up to
+// depth records ahead of the consumer, so that reading and decoding overlap
+// with processing the records. Decoding starts right away. The reader must be
+// closed to stop the decoder. Records reassembled in a temporary file, see
+// WithSpillThreshold, aren't supported.
+func NewPrefetchReader(r io.Reader, depth int, opts ...ReaderOption) *PrefetchReader {
+	if depth < 1 {
+		depth = 1
+	}
+	p := &PrefetchReader{
+		items:  make(chan prefetchItem, depth),
+		free:   make(chan []byte, depth+1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go p.run(NewReader(r, opts...))
+	return p
+}
+
+func (p *PrefetchReader) run(r *Reader) {
+	defer close(p.exited)
+	defer close(p.items)
+
+	for r.Next() {
+		buf, err := p.buffer(r, len(r.Record()))
+		if err == errPrefetchClosed {
+			return
+		}
+		if err != nil {
+			select {
+			case p.items <- prefetchItem{err: err}:
+			case <-p.done:
+			}
+			return
+		}
+		select {
+		case p.items <- prefetchItem{rec: append(buf[:0], r.Record()...)}:
+		case <-p.done:
+			return
+		}
+	}
+	if err := r.Err(); err != nil {
+		select {
+		case p.items <- prefetchItem{err: err}:
+		case <-p.done:
+		}
+	}
+}
+
+// buffer returns a buffer for a record of n bytes decoded by r, preferably one
+// released by the consumer. Within the memory budget of r, see
+// WithMemoryBudget, it waits for the consumer to release buffers as long as
+// there isn't enough memory left for another one. It returns errPrefetchClosed
+// once the reader is closed.
+func (p *PrefetchReader) buffer(r *Reader, n int) ([]byte, error) {
+	var buf []byte
+	select {
+	case buf = <-p.free:
+	default:
+	}
+	for {
+		if cap(buf) >= n {
+			return buf, nil
+		}
+		held := atomic.AddInt64(&p.held, -int64(cap(buf)))
+		if r.memBudget <= 0 || r.memory()+held+int64(n) <= r.memBudget {
+			atomic.AddInt64(&p.held, int64(n))
+			return make([]byte, 0, n), nil
+		}
+		if held == 0 {
+			return nil, &MemoryBudgetError{Budget: r.memBudget, Needed: r.memory() + int64(n)}
+		}
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return nil, errPrefetchClosed
+		}
+	}
+}
+
+// Next advances the reader to the next record and returns true if it exists.
+// Once it returns false, Err reports the error that stopped reading, if any.
+func (p *PrefetchReader) Next() bool {
+	if p.rec != nil {
+		select {
+		case p.free <- p.rec:
+		default:
+			atomic.AddInt64(&p.held, -int64(cap(p.rec)))
+		}
+		p.rec = nil
+	}
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	item, ok := <-p.items
+	if !ok {
+		return false
+	}
+	if item.err != nil {
+		p.err = item.err
+		return false
+	}
+	p.rec = item.rec
+	return true
+}
+
+// Record returns the current record. The returned byte slice is only valid
+// until the next call to Next.
+func (p *PrefetchReader) Record() []byte {
+	return p.rec
+}
+
+// Err returns the error that stopped reading after all records before it were
+// returned, as reported by Reader.Err.
+func (p *PrefetchReader) Err() error {
+	return p.err
+}
+
+// Close stops the decoder and waits for it to exit, which requires a pending
+// read from the underlying reader to return. It doesn't close the underlying
+// reader. Next returns false after Close.
+func (p *PrefetchReader) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	<-p.exited
+	return nil
+}
@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchReader(t *testing.T) {
+	corrupted := encodedRecord(recFull, data[100:200])
+	corrupted[recordHeaderSize] ^= 0xff
+
+	var buf []byte
+	for i := 0; i < 10; i++ {
+		buf = append(buf, encodedRecord(recFull, []byte(fmt.Sprintf("record %d", i)))...)
+	}
+	valid := len(buf)
+	buf = append(buf, corrupted...)
+
+	for _, depth := range []int{0, 1, 4, 20} {
+		t.Run(fmt.Sprintf("depth=%d", depth), func(t *testing.T) {
+			// Records before the corruption are returned before the error.
+			p := NewPrefetchReader(bytes.NewReader(buf), depth)
+			for i := 0; i < 10; i++ {
+				require.True(t, p.Next())
+				require.Equal(t, []byte(fmt.Sprintf("record %d", i)), p.Record())
+			}
+			require.False(t, p.Next())
+			require.Error(t, p.Err())
+			require.NoError(t, p.Close())
+
+			p = NewPrefetchReader(bytes.NewReader(buf[:valid]), depth)
+			for p.Next() {
+			}
+			require.NoError(t, p.Err())
+			require.NoError(t, p.Close())
+
+			// Closing early stops the decoder.
+			p = NewPrefetchReader(bytes.NewReader(buf), depth)
+			require.True(t, p.Next())
+			require.NoError(t, p.Close())
+			require.False(t, p.Next())
+			require.NoError(t, p.Close())
+		})
+	}
+}
+
+// slowReader delays every read to model disk latency.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s slowReader) Read(b []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(b)
+}
+
+func BenchmarkPrefetchReader(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench_prefetch")
+	require.NoError(b, err)
+	defer func() {
+		require.NoError(b, os.RemoveAll(dir))
+	}()
+	writeDecodeSegment(b, dir, 50)
+
+	// consume simulates decode-heavy processing of a record.
+	consume := func(rec []byte) {
+		for i := 0; i < 4; i++ {
+			sha256.Sum256(rec)
+		}
+	}
+	for _, depth := range []int{0, 1, 8} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				require.NoError(b, err)
+				rdr := slowReader{r: sr, delay: 10 * time.Microsecond}
+
+				if depth == 0 {
+					r := NewReader(rdr)
+					for r.Next() {
+						consume(r.Record())
+					}
+					require.NoError(b, r.Err())
+				} else {
+					p := NewPrefetchReader(rdr, depth)
+					for p.Next() {
+						consume(p.Record())
+					}
+					require.NoError(b, p.Err())
+					require.NoError(b, p.Close())
+				}
+				require.NoError(b, sr.Close())
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoRecordAt is returned by ReadAt if no record starts at the location.
+var ErrNoRecordAt = errors.New("no record at location")
+
+// ReadAt returns the record at loc, as returned by Log, reassembling it from
+// its fragments and verifying their checksums. This allows using the WAL as a
+// store for records whose locations are kept elsewhere. The segment is opened
+// and read from its start for each call, so callers reading many records in
+// order should use a Reader instead.
+//
+// If loc is past the data synced so far or doesn't point to the start of a
+// record, e.g. into the middle of one, an error wrapping ErrNoRecordAt is
+// returned. Locations in segments that were removed fail with an error
+// satisfying os.IsNotExist.
+func (w *WAL) ReadAt(loc LogLocation) ([]byte, error) {
+	if loc.Segment < 0 || loc.Offset < 0 || loc.Sub < 0 {
+		return nil, errors.Wrapf(ErrNoRecordAt, "invalid location %+v", loc)
+	}
+	w.mtx.RLock()
+	end := w.synced
+	w.mtx.RUnlock()
+
+	if loc.Segment > end.Segment || (loc.Segment == end.Segment && loc.Offset >= end.Offset) {
+		return nil, errors.Wrapf(ErrNoRecordAt, "location %+v is past the end %+v", loc, end)
+	}
+	var rec []byte
+	err := w.findRecord(loc, end, func(r *Reader) error {
+		rec = append([]byte{}, r.Record()...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// findRecord passes a reader positioned at the record at loc to fn, if not
+// nil. The segment of loc is decoded from its start up to end, as payload
+// bytes can look like fragment headers, so record boundaries can only be told
+// apart by reading the fragments before them. An error wrapping ErrNoRecordAt
+// is returned if no record starts at loc.
+func (w *WAL) findRecord(loc, end LogLocation, fn func(r *Reader) error) error {
+	// Return errors of removed segments unwrapped, for os.IsNotExist.
+	if _, err := os.Stat(segmentFile(w.Dir(), loc.Segment)); err != nil {
+		return err
+	}
+	_, err := w.scan(LogLocation{Segment: loc.Segment}, end, func(r *Reader, rloc LogLocation) error {
+		switch {
+		case rloc.Offset < loc.Offset || (rloc.Offset == loc.Offset && rloc.Sub < loc.Sub):
+			return nil
+		case rloc != loc:
+			return errors.Wrapf(ErrNoRecordAt, "location %+v, next record at %+v", loc, rloc)
+		case fn != nil:
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return errStopScan
+	})
+	switch err {
+	case errStopScan:
+		return nil
+	case nil:
+		return errors.Wrapf(ErrNoRecordAt, "location %+v is past the end of its segment", loc)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_ReadAt(t *testing.T) {
+	configs := map[string][]Option{
+		"default":        nil,
+		"packed":         {WithPackedRecords(100)},
+		"segment_header": {WithSegmentHeader(true)},
+	}
+	for name, opts := range configs {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/compress=%t", name, compress), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_read_at")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, compress, opts...)
+				require.NoError(t, err)
+				defer w.Close()
+
+				rnd := rand.New(rand.NewSource(1))
+				var (
+					recs [][]byte
+					locs []LogLocation
+				)
+				for i := 0; i < 30; i++ {
+					batch := [][]byte{{}, make([]byte, rnd.Intn(3*pageSize)), []byte(fmt.Sprintf("record %d", i))}
+					rnd.Read(batch[1])
+					l, err := w.Log(batch...)
+					require.NoError(t, err)
+					recs = append(recs, batch...)
+					locs = append(locs, l...)
+				}
+				for i, loc := range locs {
+					rec, err := w.ReadAt(loc)
+					require.NoError(t, err, "record %d at %+v", i, loc)
+					require.Equal(t, recs[i], rec, "record %d at %+v", i, loc)
+				}
+
+				// Locations not pointing to the start of a record.
+				last := locs[len(locs)-1]
+				for _, loc := range []LogLocation{
+					{Segment: last.Segment, Offset: last.Offset + 1},
+					{Segment: last.Segment, Offset: last.Offset, Sub: 1000},
+					{Segment: last.Segment + 1},
+					{Segment: last.Segment, Offset: 1 << 30},
+					{Segment: -1},
+				} {
+					_, err := w.ReadAt(loc)
+					require.True(t, errors.Is(err, ErrNoRecordAt), "location %+v: %v", loc, err)
+				}
+				for i, rec := range recs {
+					if len(rec) > 2*pageSize && locs[i].Sub == 0 {
+						// The second page holds a middle or last fragment.
+						loc := locs[i]
+						loc.Offset += pageSize - loc.Offset%pageSize
+						_, err := w.ReadAt(loc)
+						require.True(t, errors.Is(err, ErrNoRecordAt), "location %+v: %v", loc, err)
+						break
+					}
+				}
+
+				// Removed segments.
+				require.NoError(t, w.Truncate(last.Segment))
+				_, err = w.ReadAt(locs[0])
+				require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+				rec, err := w.ReadAt(last)
+				require.NoError(t, err)
+				require.Equal(t, recs[len(recs)-1], rec)
+			})
+		}
+	}
+}
+
+func TestWAL_ReadAtMidRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_read_at_mid")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Payload bytes that look like the header of a full record.
+	rec := make([]byte, 100)
+	for i := range rec {
+		rec[i] = byte(recFull)
+	}
+	locs, err := w.Log([]byte{1}, rec, []byte{2})
+	require.NoError(t, err)
+
+	for off := locs[1].Offset + 1; off < locs[2].Offset; off++ {
+		loc := LogLocation{Segment: locs[1].Segment, Offset: off}
+		_, err := w.ReadAt(loc)
+		require.True(t, errors.Is(err, ErrNoRecordAt), "location %+v: %v", loc, err)
+	}
+	got, err := w.ReadAt(locs[2])
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, got)
+}
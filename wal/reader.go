@@ -15,12 +15,18 @@
 package wal
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/cipher"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"os"
+	"time"
 
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Reader reads WAL records from an io.Reader.
@@ -29,31 +35,298 @@ type Reader struct {
 	err       error
 	rec       []byte
 	snappyBuf []byte
-	buf       [pageSize]byte
-	total     int64   // Total bytes processed.
-	curRecTyp recType // Used for checking that the last record is not torn.
+	buf       *[pageSize]byte // Nil once returned to pool by Close.
+	pool      *ReaderPool     // Pool buf was taken from, if any.
+	total     int64           // Total bytes processed.
+	curRecTyp recType         // Used for checking that the last record is not torn.
+	recStart  LogLocation
+	ext       recordExt // Extension header of the current record.
+	extBuf    []byte    // Encoded extension header of the current record.
+
+	// In skip-corrupt mode corrupted data is recorded and skipped up to the
+	// next page boundary instead of stopping the reader.
+	skipCorrupt bool
+	resync      bool // Drop trailing fragments of a record lost to corruption.
+	corruptions []LogLocation
+
+	// With lazy checksums fragments are verified and decompressed on the first
+	// call to Record rather than in Next.
+	lazyChecksum bool
+	fragments    []fragment // Fragments of the current record pending verification.
+	compressed   bool       // Whether the current record is compressed.
+	compression  uint8      // Compression flag of the current record.
+	unverified   bool       // Whether the current record is pending verification.
+	undecoded    bool       // Whether the current record is pending decompression.
+	corrupt      bool       // Whether the current record failed lazy verification.
+
+	deadlineErr bool // Whether err is a failure to set the read deadline.
+
+	metrics *readerMetrics // Nil if metrics are disabled.
+
+	until *LogLocation // Location at which to stop reading, if any.
+
+	version  int // Format version of the segment being read.
+	pageSize int // Page size of the segment being read, see WithPageSize.
+
+	// Records larger than spillThreshold are reassembled in a temporary file
+	// in spillDir instead of memory.
+	spillThreshold int
+	spillDir       string
+	spill          *os.File // Temporary file holding the current record, if any.
+	spillLen       int      // Size of the record in spill.
+
+	closer io.Closer // Closed along with the reader if set.
+
+	decompressors map[uint8]func([]byte) ([]byte, error) // By compression flag.
+
+	aead      cipher.AEAD // Decrypts records of encrypted segments if set.
+	nonceBase []byte      // Nonce base of the segment being read if it's encrypted.
+	sealed    bool        // Whether the current record is pending decryption.
+
+	segmentID []byte // ID of the segment being read, if it has one.
+
+	packBuf     []byte // Decoded payload of the current packed record.
+	packed      []byte // Records of packBuf that are yet to be read.
+	packedEpoch uint64 // Epoch of the first record of packBuf, see WithEpochs.
+
+	keyFilter func([8]byte) bool // Selects the keyed records to return if set.
+	filtered  bool               // Whether the current record is skipped by keyFilter.
+
+	pageTerm func(page []byte, pos int) bool // Detects page terminations if set.
+	page     []byte                          // Bytes of the current page read so far, if pageTerm is set.
+
+	readRepair func(loc LogLocation) ([]byte, error) // Fetches corrupted records from a replica if set.
+
+	memBudget int64 // Limit for the memory held in buffers, disabled if <= 0.
+	peakMem   int64 // Most memory held in buffers so far.
+
+	maxRecordSize int // Largest record size accepted, unlimited if <= 0.
+
+	onFragment func(recType) // Called with the type of each fragment read, if set.
+
+	allowOversizedFull bool   // Whether full records may exceed a page.
+	oversizedBuf       []byte // Payload of the current oversized fragment.
+}
+
+// fragment locates a record fragment in the reassembly buffer along with its
+// expected checksum.
+type fragment struct {
+	start, end int
+	crc        uint32
+	ext        bool // Whether the checksum covers the extension header.
+}
+
+// ReaderOption configures optional behavior of a Reader.
+type ReaderOption func(*Reader)
+
+// WithLazyChecksum defers checksum verification and decompression of a
+// record until Record is called for it. Records that are skipped without
+// calling Record are never verified, so corruption in them goes undetected.
+// Use the default eager verification when every record must be checked.
+//
+// If verification fails, Record returns nil and the reader stops with the
+// corruption reported by Err. Packed records, see WithPackedRecords, are
+// always verified and decompressed by Next.
+func WithLazyChecksum(lazy bool) ReaderOption {
+	return func(r *Reader) {
+		r.lazyChecksum = lazy
+	}
+}
+
+// WithReaderMetrics records the number of records read, bytes decompressed,
+// checksum failures, skipped corruptions and read repairs into the metrics registered with
+// reg. Readers using the same registerer add to the same metrics.
+// Passing nil disables metrics, which is the default.
+func WithReaderMetrics(reg prometheus.Registerer) ReaderOption {
+	return func(r *Reader) {
+		if reg != nil {
+			r.metrics = newReaderMetrics(reg)
+		}
+	}
+}
+
+// WithReadUntil makes the reader stop before the first record starting at or
+// after end, so that Next returns false without an error once it's reached.
+// If the data ends before end, all records are read.
+//
+// For readers not reading from segments, see Segment, only end.Offset is
+// compared against the offset of records in the stream.
+func WithReadUntil(end LogLocation) ReaderOption {
+	return func(r *Reader) {
+		r.until = &end
+	}
+}
+
+// WithSpillThreshold makes the reader reassemble records larger than n bytes
+// in a temporary file in dir, or the default directory for temporary files if
+// dir is empty, instead of in memory. Such records are accessed through
+// RecordFile while Record returns nil for them. A threshold <= 0 disables
+// spilling, which is the default.
+//
+// Compressed records are always reassembled and decompressed in memory.
+// Records spilled to a file have their checksums verified as they are read,
+// even with WithLazyChecksum.
+func WithSpillThreshold(n int, dir string) ReaderOption {
+	return func(r *Reader) {
+		r.spillThreshold = n
+		r.spillDir = dir
+	}
+}
+
+// WithDecompressor makes the reader decompress records with the given
+// compression flag using fn, which must return the decompressed record. Flags
+// are 1 to 15, see the header format. This allows reading records compressed
+// with codecs the package doesn't know, see also RegisterCodec. A
+// decompressor registered for a built-in or registered codec replaces it. Records with a flag that has no decompressor
+// fail to read.
+func WithDecompressor(flag uint8, fn func([]byte) ([]byte, error)) ReaderOption {
+	return func(r *Reader) {
+		if r.decompressors == nil {
+			r.decompressors = map[uint8]func([]byte) ([]byte, error){}
+		}
+		r.decompressors[flag] = fn
+	}
 }
 
+// WithDecryption makes the reader decrypt the records of segments encrypted
+// with WithEncryption using aead, which must use the same key. Unencrypted
+// segments are read as usual. Reading an encrypted segment without it fails.
+// Encrypted records are always reassembled in memory, regardless of
+// WithSpillThreshold.
+func WithDecryption(aead cipher.AEAD) ReaderOption {
+	return func(r *Reader) {
+		r.aead = aead
+	}
+}
+
+// errReachedEnd is returned by next when the end set by WithReadUntil was reached.
+var errReachedEnd = errors.New("reached end")
+
+// errKeyFiltered is returned by next when the record was skipped by the filter
+// set with WithKeyFilter.
+var errKeyFiltered = errors.New("key filtered")
+
+// errTornRecord is the error of a reader that stopped in the middle of a record.
+var errTornRecord = &kindError{kind: CorruptionTorn, msg: "last record is torn"}
+
 // NewReader returns a new reader.
-func NewReader(r io.Reader) *Reader {
-	return &Reader{rdr: r}
+func NewReader(r io.Reader, opts ...ReaderOption) *Reader {
+	return newReader(r, new([pageSize]byte), opts...)
+}
+
+func newReader(r io.Reader, buf *[pageSize]byte, opts ...ReaderOption) *Reader {
+	rdr := &Reader{rdr: r, buf: buf, version: formatV1, pageSize: pageSize}
+	for _, opt := range opts {
+		opt(rdr)
+	}
+	return rdr
+}
+
+// SetDeadline sets the deadline for reads from the underlying reader if it
+// implements SetReadDeadline, as net.Conn and os.File do. A read blocking past
+// the deadline makes Next return false and Err return the timeout error, which
+// can be detected with errors.Is(err, os.ErrDeadlineExceeded). The reader can't
+// be resumed after a timeout since it may have stopped in the middle of a
+// record. A zero t means reads will not time out.
+//
+// For readers without deadline support the deadline is ignored and reads may
+// block indefinitely. If setting the deadline fails, Next returns false and
+// Err reports the failure.
+func (r *Reader) SetDeadline(t time.Time) {
+	d, ok := r.rdr.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return
+	}
+	if err := d.SetReadDeadline(t); err != nil && r.err == nil {
+		r.err = errors.Wrap(err, "set read deadline")
+		r.deadlineErr = true
+	}
+}
+
+// isTimeout returns whether err was caused by an exceeded read deadline.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
 }
 
 // Next advances the reader to the next records and returns true if it exists.
 // It must not be called again after it returned false.
 func (r *Reader) Next() bool {
-	err := r.next()
-	if errors.Cause(err) == io.EOF {
-		// The last WAL segment record shouldn't be torn(should be full or last).
-		// The last record would be torn after a crash just before
-		// the last record part could be persisted to disk.
-		if r.curRecTyp == recFirst || r.curRecTyp == recMiddle {
-			r.err = errors.New("last record is torn")
-		}
+	if r.err != nil || r.buf == nil {
 		return false
 	}
-	r.err = err
-	return r.err == nil
+	for {
+		err := r.next()
+		if err == errReachedEnd {
+			return false
+		}
+		if err == errKeyFiltered {
+			continue
+		}
+		if errors.Cause(err) == io.EOF {
+			// The last WAL segment record shouldn't be torn(should be full or last).
+			// The last record would be torn after a crash just before
+			// the last record part could be persisted to disk.
+			if r.curRecTyp == recFirst || r.curRecTyp == recMiddle {
+				if r.skipCorrupt {
+					r.addCorruption()
+					return false
+				}
+				r.err = errTornRecord
+			}
+			return false
+		}
+		if err == nil {
+			err = r.trackMemory()
+		}
+		if err != nil && r.skipCorrupt && !isTimeout(err) && !isMemoryBudgetExceeded(err) && !isUnsupportedVersion(err) {
+			r.addCorruption()
+			if r.skipPage() != nil {
+				return false
+			}
+			continue
+		}
+		r.err = err
+		if r.err == nil && r.metrics != nil {
+			r.metrics.recordsRead.Inc()
+		}
+		return r.err == nil
+	}
+}
+
+// addCorruption records corruption of the current record in skip-corrupt mode.
+func (r *Reader) addCorruption() {
+	r.corruptions = append(r.corruptions, r.recStart)
+	if r.metrics != nil {
+		r.metrics.corruptionsSkipped.Inc()
+	}
+}
+
+// checksumFailure returns an error for a checksum mismatch.
+func (r *Reader) checksumFailure(got, want uint32) error {
+	if r.metrics != nil {
+		r.metrics.checksumFailures.Inc()
+	}
+	return &kindError{kind: CorruptionChecksum, msg: fmt.Sprintf("unexpected checksum %x, expected %x", got, want)}
+}
+
+// skipPage discards the remainder of the current page and makes the reader
+// drop fragments belonging to a record that started before it.
+func (r *Reader) skipPage() error {
+	r.resync = true
+	r.curRecTyp = recPageTerm
+	return r.discardPage()
+}
+
+// discardPage discards the remainder of the current page.
+func (r *Reader) discardPage() error {
+	k := int64(r.pageSize) - (r.total % int64(r.pageSize))
+	if k == int64(r.pageSize) {
+		return nil
+	}
+	n, err := io.CopyN(ioutil.Discard, r.rdr, k)
+	r.total += n
+	return err
 }
 
 func (r *Reader) next() (err error) {
@@ -62,8 +335,24 @@ func (r *Reader) next() (err error) {
 	hdr := r.buf[:recordHeaderSize]
 	buf := r.buf[recordHeaderSize:]
 
+	if len(r.packed) > 0 {
+		return r.nextPacked()
+	}
 	r.rec = r.rec[:0]
 	r.snappyBuf = r.snappyBuf[:0]
+	r.fragments = r.fragments[:0]
+	r.unverified = false
+	r.undecoded = false
+	r.corrupt = false
+	r.compressed = false
+	r.compression = 0
+	r.sealed = false
+	r.filtered = false
+	r.ext = recordExt{}
+	r.extBuf = r.extBuf[:0]
+	if err := r.removeSpill(); err != nil {
+		return err
+	}
 
 	i := 0
 	for {
@@ -72,7 +361,45 @@ func (r *Reader) next() (err error) {
 		}
 		r.total++
 		r.curRecTyp = recTypeFromHeader(hdr[0])
-		compressed := hdr[0]&snappyMask != 0
+		if r.onFragment != nil {
+			r.onFragment(r.curRecTyp)
+		}
+		compression := (hdr[0] & compressionMask) >> compressionShift
+		compressed := compression != 0
+
+		if r.Offset() == 1 {
+			// Segments without a header are in the version 1 format.
+			r.version = formatV1
+			r.pageSize = pageSize
+			r.nonceBase = nil
+			r.segmentID = nil
+		}
+		if r.pageTerm != nil {
+			r.observe(hdr[:1])
+			if r.pageTerm(r.page, len(r.page)-1) {
+				r.curRecTyp = recPageTerm
+				if err := r.discardPage(); err != nil {
+					return errors.Wrap(err, "skip terminated page")
+				}
+				continue
+			}
+		}
+		if r.curRecTyp == recSegmentHeader {
+			if i != 0 {
+				return errors.New("unexpected segment header")
+			}
+			if err := r.readSegmentHeader(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i == 0 && r.curRecTyp != recPageTerm {
+			r.recStart = LogLocation{Segment: r.Segment(), Offset: int(r.Offset() - 1)}
+			if r.until != nil && r.reachedEnd() {
+				return errReachedEnd
+			}
+		}
 
 		// Gobble up zero bytes.
 		if r.curRecTyp == recPageTerm {
@@ -84,8 +411,8 @@ func (r *Reader) next() (err error) {
 			// We are pedantic and check whether the zeros are actually up
 			// to a page boundary.
 			// It's not strictly necessary but may catch sketchy state early.
-			k := pageSize - (r.total % pageSize)
-			if k == pageSize {
+			k := r.pageSize - int(r.total%int64(r.pageSize))
+			if k == r.pageSize {
 				continue // Initial 0 byte was last page byte.
 			}
 			n, err := io.ReadFull(r.rdr, buf[:k])
@@ -96,7 +423,7 @@ func (r *Reader) next() (err error) {
 
 			for _, c := range buf[:k] {
 				if c != 0 {
-					return errors.New("unexpected non-zero byte in padded page")
+					return &kindError{kind: CorruptionNonZeroPadding, msg: "unexpected non-zero byte in padded page"}
 				}
 			}
 			continue
@@ -106,46 +433,143 @@ func (r *Reader) next() (err error) {
 			return errors.Wrap(err, "read remaining header")
 		}
 		r.total += int64(n)
+		r.observe(hdr[1:])
 
-		var (
-			length = binary.BigEndian.Uint16(hdr[1:])
-			crc    = binary.BigEndian.Uint32(hdr[3:])
-		)
-
-		if length > pageSize-recordHeaderSize {
-			return errors.Errorf("invalid record size %d", length)
+		length, crc, err := decodeRecordHeader(r.version, hdr)
+		if err != nil {
+			return err
+		}
+		if r.curRecTyp != recPadding {
+			if err := r.checkRecordSize(int(length), compressed); err != nil {
+				return err
+			}
+		}
+		if length > maxFragmentSize {
+			if buf, err = r.oversizedBuffer(length); err != nil {
+				return err
+			}
 		}
 		n, err = io.ReadFull(r.rdr, buf[:length])
 		if err != nil {
 			return err
 		}
 		r.total += int64(n)
+		if err := r.checkOversized(length); err != nil {
+			return err
+		}
+		r.observe(buf[:length])
 
 		if n != int(length) {
 			return errors.Errorf("invalid size: expected %d, got %d", length, n)
 		}
-		if c := crc32.Checksum(buf[:length], castagnoliTable); c != crc {
-			return errors.Errorf("unexpected checksum %x, expected %x", c, crc)
+		if r.curRecTyp == recPadding {
+			// Padding in front of an aligned record, see LogAlignedTo.
+			if i != 0 {
+				return errors.New("unexpected padding record")
+			}
+			if c := crc32.Checksum(buf[:length], castagnoliTable); c != crc {
+				return r.checksumFailure(c, crc)
+			}
+			continue
+		}
+		if !r.lazyChecksum || r.readRepair != nil {
+			if c := crc32.Checksum(buf[:length], castagnoliTable); c != crc {
+				if r.readRepair == nil {
+					return r.checksumFailure(c, crc)
+				}
+				if err := r.repairFragment(hdr[0], buf[:length], c, crc); err != nil {
+					return err
+				}
+			}
+		}
+
+		part := buf[:length]
+		hasExt := hdr[0]&extMask != 0
+		if hasExt {
+			if i != 0 {
+				return errors.New("unexpected extension header")
+			}
+			ext, n, err := decodeRecordExt(part)
+			if err != nil {
+				return err
+			}
+			r.ext = ext
+			r.extBuf = append(r.extBuf, part[:n]...)
+			part = part[n:]
+		}
+		if i == 0 && r.keyFilter != nil {
+			r.filtered = r.ext.flags&extKey == 0 || !r.keyFilter(r.ext.key)
 		}
 
-		if compressed {
-			r.snappyBuf = append(r.snappyBuf, buf[:length]...)
-		} else {
-			r.rec = append(r.rec, buf[:length]...)
+		switch {
+		case r.filtered:
+			// The payload of skipped records isn't needed.
+		case compressed:
+			if r.snappyBuf, err = r.appendBuf(r.snappyBuf, part); err != nil {
+				return err
+			}
+		case r.spill != nil || (r.spillThreshold > 0 && r.nonceBase == nil && r.ext.flags&extPacked == 0 && len(r.rec)+len(part) > r.spillThreshold):
+			if err := r.spillFragment(part, crc, hasExt); err != nil {
+				return err
+			}
+		default:
+			if r.rec, err = r.appendBuf(r.rec, part); err != nil {
+				return err
+			}
+		}
+		if r.lazyChecksum && r.spill == nil && !r.filtered {
+			end := len(r.rec)
+			if compressed {
+				end = len(r.snappyBuf)
+			}
+			r.fragments = append(r.fragments, fragment{start: end - len(part), end: end, crc: crc, ext: hasExt})
 		}
 
+		if r.resync && i == 0 {
+			switch r.curRecTyp {
+			case recMiddle, recLast:
+				// Remainder of a record that was lost to corruption.
+				r.rec = r.rec[:0]
+				r.snappyBuf = r.snappyBuf[:0]
+				r.fragments = r.fragments[:0]
+				if err := r.removeSpill(); err != nil {
+					return err
+				}
+				continue
+			}
+			r.resync = false
+		}
 		if err := validateRecord(r.curRecTyp, i); err != nil {
 			return err
 		}
 		if r.curRecTyp == recLast || r.curRecTyp == recFull {
-			if compressed && len(r.snappyBuf) > 0 {
-				// The snappy library uses `len` to calculate if we need a new buffer.
-				// In order to allocate as few buffers as possible make the length
-				// equal to the capacity.
-				r.rec = r.rec[:cap(r.rec)]
-				r.rec, err = snappy.Decode(r.rec, r.snappyBuf)
+			if r.filtered {
+				return errKeyFiltered
+			}
+			r.compressed = compressed
+			r.compression = compression
+			r.sealed = r.nonceBase != nil
+			packed := r.ext.flags&extPacked != 0
+			if r.lazyChecksum {
+				if !packed {
+					r.unverified = true
+					r.undecoded = true
+					return nil
+				}
+				// Packed records are split up right away.
+				if err := r.verify(); err != nil {
+					return err
+				}
+			}
+			if err := r.decrypt(); err != nil {
 				return err
 			}
+			if err := r.decompress(); err != nil {
+				return err
+			}
+			if packed {
+				return r.unpack()
+			}
 			return nil
 		}
 
@@ -155,34 +579,382 @@ func (r *Reader) next() (err error) {
 	}
 }
 
+// readSegmentHeader reads the remainder of a segment header and switches to
+// the format version it announces.
+func (r *Reader) readSegmentHeader() error {
+	v, fields, err := r.readSegmentHeaderRecord()
+	if err != nil {
+		return err
+	}
+	r.version = v
+	return r.readSegmentFields(fields)
+}
+
+// readSegmentHeaderRecord reads the remainder of a segment header and returns
+// the format version it announces along with the fields following it.
+func (r *Reader) readSegmentHeaderRecord() (version int, fields []byte, err error) {
+	hdr := r.buf[:recordHeaderSize]
+	n, err := io.ReadFull(r.rdr, hdr[1:])
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read segment header")
+	}
+	r.total += int64(n)
+	r.observe(hdr[1:])
+
+	// Segment headers always use the version 1 record format.
+	length, crc, err := decodeRecordHeader(formatV1, hdr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if int(length) < len(segmentMagic)+1 || int(length) > pageSize-recordHeaderSize {
+		return 0, nil, errors.Errorf("invalid segment header size %d", length)
+	}
+	payload := r.buf[recordHeaderSize : recordHeaderSize+int(length)]
+	n, err = io.ReadFull(r.rdr, payload)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read segment header")
+	}
+	r.total += int64(n)
+	r.observe(payload)
+
+	if c := crc32.Checksum(payload, castagnoliTable); c != crc {
+		return 0, nil, r.checksumFailure(c, crc)
+	}
+	if !bytes.Equal(payload[:len(segmentMagic)], segmentMagic) {
+		return 0, nil, errors.New("invalid segment magic")
+	}
+	v := int(payload[len(segmentMagic)])
+	if v <= formatV1 || v > formatVersion {
+		return 0, nil, &UnsupportedVersionError{Segment: r.Segment(), Version: v}
+	}
+	return v, payload[len(segmentMagic)+1:], nil
+}
+
+// FormatVersion returns the format version of the segment being read.
+func (r *Reader) FormatVersion() int {
+	return r.version
+}
+
+// reachedEnd returns whether the current record starts at or after the end
+// set by WithReadUntil.
+func (r *Reader) reachedEnd() bool {
+	loc, end := r.recStart, *r.until
+	if loc.Segment >= 0 && loc.Segment != end.Segment {
+		return loc.Segment > end.Segment
+	}
+	return loc.Offset >= end.Offset
+}
+
+// verify checks the fragments of the current record against their checksums.
+func (r *Reader) verify() error {
+	buf := r.rec
+	if r.compressed {
+		buf = r.snappyBuf
+	}
+	for _, f := range r.fragments {
+		if err := r.verifyFragment(buf[f.start:f.end], f.crc, f.ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyFragment checks a fragment of the current record against its checksum,
+// which covers the extension header if ext is true.
+func (r *Reader) verifyFragment(part []byte, crc uint32, ext bool) error {
+	var c uint32
+	if ext {
+		c = crc32.Checksum(r.extBuf, castagnoliTable)
+	}
+	if c = crc32.Update(c, castagnoliTable, part); c != crc {
+		return r.checksumFailure(c, crc)
+	}
+	return nil
+}
+
+// spillFragment appends a fragment of the current record to its temporary
+// file, moving the fragments reassembled in memory so far there first.
+func (r *Reader) spillFragment(part []byte, crc uint32, ext bool) error {
+	if r.spill == nil {
+		if r.lazyChecksum {
+			// Verify fragments before they leave memory.
+			if err := r.verify(); err != nil {
+				return err
+			}
+			r.fragments = r.fragments[:0]
+		}
+		f, err := ioutil.TempFile(r.spillDir, "wal-record-")
+		if err != nil {
+			return errors.Wrap(err, "create temp file")
+		}
+		r.spill = f
+		if _, err := f.Write(r.rec); err != nil {
+			return errors.Wrap(err, "write temp file")
+		}
+		r.spillLen = len(r.rec)
+		r.rec = r.rec[:0]
+	}
+	if r.lazyChecksum {
+		if err := r.verifyFragment(part, crc, ext); err != nil {
+			return err
+		}
+	}
+	n, err := r.spill.Write(part)
+	r.spillLen += n
+	return errors.Wrap(err, "write temp file")
+}
+
+// removeSpill removes the temporary file of the current record, if any.
+func (r *Reader) removeSpill() error {
+	if r.spill == nil {
+		return nil
+	}
+	f := r.spill
+	r.spill = nil
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "close temp file")
+	}
+	return errors.Wrap(os.Remove(f.Name()), "remove temp file")
+}
+
+// RecordFile returns a file holding the current record if it was reassembled
+// in a temporary file, see WithSpillThreshold. It returns nil if the record is
+// held in memory and available through Record.
+//
+// The file is positioned at the start of the record. It's owned by the reader
+// and must not be closed by the caller. It's only valid until the next call to
+// Next or Close, which remove it.
+func (r *Reader) RecordFile() (*os.File, error) {
+	if r.spill == nil {
+		return nil, nil
+	}
+	if _, err := r.spill.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seek temp file")
+	}
+	return r.spill, nil
+}
+
+// Close releases resources held by the reader, such as the temporary file of
+// the current record or the buffer of a reader created with NewReaderPooled.
+// It doesn't close the underlying reader passed to
+// NewReader.
+func (r *Reader) Close() error {
+	if r.pool != nil && r.buf != nil {
+		r.pool.put(r.buf)
+		r.buf = nil
+	}
+	err := r.removeSpill()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// decompress decodes the current record if it's compressed.
+func (r *Reader) decompress() (err error) {
+	if !r.compressed || len(r.snappyBuf) == 0 {
+		return nil
+	}
+	if fn, ok := r.decompressors[r.compression]; ok {
+		if r.rec, err = fn(r.snappyBuf); err != nil {
+			return errors.Wrapf(err, "decompress record with compression flag %d", r.compression)
+		}
+	} else if r.compression == compressionSnappy {
+		if err := r.checkDecodedSize(false); err != nil {
+			return err
+		}
+		// The snappy library uses `len` to calculate if we need a new buffer.
+		// In order to allocate as few buffers as possible make the length
+		// equal to the capacity.
+		if err := r.growDecoded(); err != nil {
+			return err
+		}
+		r.rec = r.rec[:cap(r.rec)]
+		if r.rec, err = snappy.Decode(r.rec, r.snappyBuf); err != nil {
+			return err
+		}
+	} else if codec, ok := lookupCodec(Compression(r.compression)); ok {
+		if r.rec, err = codec.Decode(r.rec[:cap(r.rec)], r.snappyBuf); err != nil {
+			return errors.Wrapf(err, "decompress %s record", Compression(r.compression))
+		}
+	} else {
+		return errors.Errorf("no decompressor for compression flag %d", r.compression)
+	}
+	if err := r.checkDecodedSize(true); err != nil {
+		return err
+	}
+	if r.metrics != nil {
+		r.metrics.bytesDecompressed.Add(float64(len(r.rec)))
+	}
+	return r.trackMemory()
+}
+
 // Err returns the last encountered error wrapped in a corruption error.
 // If the reader does not allow to infer a segment index and offset, a total
 // offset in the reader stream will be provided.
+// Timeouts and failures to set a deadline are returned as is, see SetDeadline,
+// as are exceeded memory budgets, see WithMemoryBudget, and unsupported format
+// versions, see UnsupportedVersionError.
 func (r *Reader) Err() error {
 	if r.err == nil {
 		return nil
 	}
+	if isTimeout(r.err) || r.deadlineErr || isMemoryBudgetExceeded(r.err) || isUnsupportedVersion(r.err) {
+		return r.err
+	}
 	if b, ok := r.rdr.(*segmentBufReader); ok {
 		return &CorruptionErr{
 			Err:     r.err,
 			Dir:     b.segs[b.cur].Dir(),
 			Segment: b.segs[b.cur].Index(),
 			Offset:  int64(b.off),
+			Kind:    corruptionKindOf(r.err),
 		}
 	}
 	return &CorruptionErr{
 		Err:     r.err,
 		Segment: -1,
 		Offset:  r.total,
+		Kind:    corruptionKindOf(r.err),
 	}
 }
 
 // Record returns the current record. The returned byte slice is only
-// valid until the next call to Next.
+// valid until the next call to Next or Close, as the reader reuses its memory
+// for the following records, and must not be modified. Callers keeping records
+// must copy them, see RecordInto. It's nil for records reassembled in a
+// temporary file, see RecordFile.
 func (r *Reader) Record() []byte {
+	if r.spill != nil || !r.verified() {
+		return nil
+	}
+	if r.undecoded {
+		r.undecoded = false
+		if err := r.decrypt(); err != nil {
+			r.fail(err)
+			return nil
+		}
+		if err := r.decompress(); err != nil {
+			r.fail(err)
+			return nil
+		}
+	}
 	return r.rec
 }
 
+// RecordInto copies the current record into dst, reusing its memory if it's
+// large enough, and returns the copy. Unlike the slice returned by Record, the
+// copy remains valid after the next call to Next, so callers keeping records
+// can recycle their buffers instead of allocating one per record. Records
+// reassembled in a temporary file, see WithSpillThreshold, are read from it.
+// It returns nil if the record can't be read, see Err.
+func (r *Reader) RecordInto(dst []byte) []byte {
+	if r.spill != nil {
+		f, err := r.RecordFile()
+		if err == nil {
+			if cap(dst) < r.spillLen {
+				dst = make([]byte, r.spillLen)
+			}
+			_, err = io.ReadFull(f, dst[:r.spillLen])
+		}
+		if err != nil {
+			r.fail(errors.Wrap(err, "read temp file"))
+			return nil
+		}
+		return dst[:r.spillLen]
+	}
+	rec := r.Record()
+	if r.corrupt {
+		return nil
+	}
+	if dst == nil {
+		dst = []byte{} // Empty records aren't nil.
+	}
+	return append(dst[:0], rec...)
+}
+
+// RawRecord returns the current record as it's stored, which is compressed if
+// Compressed returns true. It allows forwarding compressed records without
+// compressing them again, and with WithLazyChecksum also without decompressing
+// them. Encrypted records are decrypted though. The returned byte slice is
+// only valid until the next call to Next. It's nil for records reassembled in a
+// temporary file, see RecordFile.
+func (r *Reader) RawRecord() []byte {
+	if r.spill != nil || !r.verified() {
+		return nil
+	}
+	if err := r.decrypt(); err != nil {
+		r.fail(err)
+		return nil
+	}
+	if r.compressed {
+		return r.snappyBuf
+	}
+	return r.rec
+}
+
+// Compressed returns whether the current record is stored compressed.
+func (r *Reader) Compressed() bool {
+	return r.compressed
+}
+
+// CompressedLen returns the size of the current record as it's stored,
+// excluding the overhead of encryption. It equals UncompressedLen for records
+// that aren't compressed.
+func (r *Reader) CompressedLen() int {
+	if !r.compressed {
+		return r.UncompressedLen()
+	}
+	return len(r.snappyBuf) - r.sealOverhead()
+}
+
+// UncompressedLen returns the size of the current record once decompressed,
+// which is the length of the slice returned by Record for records held in
+// memory. With WithLazyChecksum, compressed records are decoded to determine
+// it, and it's 0 if that fails.
+func (r *Reader) UncompressedLen() int {
+	switch {
+	case r.spill != nil:
+		return r.spillLen
+	case r.compressed:
+		return len(r.Record())
+	default:
+		return len(r.rec) - r.sealOverhead()
+	}
+}
+
+// verified verifies the current record if that's pending and returns whether
+// it's intact.
+func (r *Reader) verified() bool {
+	if r.unverified {
+		r.unverified = false
+		if err := r.verify(); err != nil {
+			r.fail(err)
+		}
+	}
+	return !r.corrupt
+}
+
+// fail records a corruption detected in the current record after Next
+// returned it.
+func (r *Reader) fail(err error) {
+	r.corrupt = true
+	if r.skipCorrupt {
+		r.addCorruption()
+	} else {
+		r.err = err
+	}
+}
+
+// Key returns the key the current record was logged with using LogKeyed.
+// It is zero for records without a key.
+func (r *Reader) Key() [8]byte {
+	return r.ext.key
+}
+
 // Segment returns the current segment being read.
 func (r *Reader) Segment() int {
 	if b, ok := r.rdr.(*segmentBufReader); ok {
@@ -199,6 +971,16 @@ func (r *Reader) Offset() int64 {
 	return r.total
 }
 
+// CurrentLocation returns the location of the record returned by the last
+// call to Next, which is the location Log returned for it, including Sub for
+// packed records. This allows building an index of the records in a single
+// pass. The segment is only known when reading segments through
+// NewSegmentsReader or NewReaderFrom. For other readers it's -1 and the offset
+// is that within the stream.
+func (r *Reader) CurrentLocation() LogLocation {
+	return r.recStart
+}
+
 // Returns an error if the recType and i indicate an invalid record sequence.
 // As an example, if i is > 0 because we've read some amount of a partial record
 // (recFirst, recMiddle, etc. but not recLast) and then we get another recFirst or recFull
@@ -207,22 +989,22 @@ func validateRecord(typ recType, i int) error {
 	switch typ {
 	case recFull:
 		if i != 0 {
-			return errors.New("unexpected full record")
+			return &kindError{kind: CorruptionTypeTransition, msg: "unexpected full record"}
 		}
 		return nil
 	case recFirst:
 		if i != 0 {
-			return errors.New("unexpected first record, dropping buffer")
+			return &kindError{kind: CorruptionTypeTransition, msg: "unexpected first record, dropping buffer"}
 		}
 		return nil
 	case recMiddle:
 		if i == 0 {
-			return errors.New("unexpected middle record, dropping buffer")
+			return &kindError{kind: CorruptionTypeTransition, msg: "unexpected middle record, dropping buffer"}
 		}
 		return nil
 	case recLast:
 		if i == 0 {
-			return errors.New("unexpected last record, dropping buffer")
+			return &kindError{kind: CorruptionTypeTransition, msg: "unexpected last record, dropping buffer"}
 		}
 		return nil
 	default:
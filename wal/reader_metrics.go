@@ -0,0 +1,54 @@
+package wal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type readerMetrics struct {
+	recordsRead        prometheus.Counter
+	bytesDecompressed  prometheus.Counter
+	checksumFailures   prometheus.Counter
+	corruptionsSkipped prometheus.Counter
+	readRepairs        prometheus.Counter
+}
+
+// newReaderMetrics returns the read-side metrics registered with r. Readers
+// sharing a registerer share their metrics.
+func newReaderMetrics(r prometheus.Registerer) *readerMetrics {
+	m := &readerMetrics{}
+
+	m.recordsRead = registerCounter(r, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_reader_records_read_total",
+		Help: "Total number of WAL records read.",
+	}))
+	m.bytesDecompressed = registerCounter(r, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_reader_decompressed_bytes_total",
+		Help: "Total number of bytes of WAL records after decompression.",
+	}))
+	m.checksumFailures = registerCounter(r, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_reader_checksum_failures_total",
+		Help: "Total number of WAL record fragments that failed checksum verification.",
+	}))
+	m.corruptionsSkipped = registerCounter(r, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_reader_corruptions_skipped_total",
+		Help: "Total number of corrupted WAL regions skipped by readers in skip-corrupt mode.",
+	}))
+	m.readRepairs = registerCounter(r, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_reader_read_repairs_total",
+		Help: "Total number of corrupted WAL record fragments repaired from a replica.",
+	}))
+
+	return m
+}
+
+// registerCounter registers c with r, returning the already registered counter
+// instead if there is one.
+func registerCounter(r prometheus.Registerer, c prometheus.Counter) prometheus.Counter {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Counter)
+		}
+		panic(err)
+	}
+	return c
+}
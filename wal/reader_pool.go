@@ -0,0 +1,38 @@
+package wal
+
+import (
+	"io"
+	"sync"
+)
+
+// ReaderPool holds page buffers to be reused by readers created with
+// NewReaderPooled. It's safe for concurrent use.
+type ReaderPool struct {
+	p sync.Pool
+}
+
+// NewReaderPool returns an empty reader pool.
+func NewReaderPool() *ReaderPool {
+	return &ReaderPool{p: sync.Pool{
+		New: func() interface{} { return new([pageSize]byte) },
+	}}
+}
+
+func (p *ReaderPool) get() *[pageSize]byte {
+	return p.p.Get().(*[pageSize]byte)
+}
+
+func (p *ReaderPool) put(buf *[pageSize]byte) {
+	p.p.Put(buf)
+}
+
+// NewReaderPooled returns a new reader like NewReader that takes its page
+// buffer from pool rather than allocating one. This reduces allocations when
+// many short-lived readers are created. The buffer is returned to the pool by
+// Close, after which Next returns false. Readers that aren't closed don't
+// return their buffer, which is then garbage collected as usual.
+func NewReaderPooled(r io.Reader, pool *ReaderPool, opts ...ReaderOption) *Reader {
+	rdr := newReader(r, pool.get(), opts...)
+	rdr.pool = pool
+	return rdr
+}
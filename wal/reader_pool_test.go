@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReaderPooled(t *testing.T) {
+	var buf []byte
+	for i := 0; i < 3; i++ {
+		buf = append(buf, encodedRecord(recFull, data[i*100:(i+1)*100])...)
+	}
+	pool := NewReaderPool()
+
+	r1 := NewReaderPooled(bytes.NewReader(buf), pool)
+	r2 := NewReaderPooled(bytes.NewReader(buf), pool)
+	require.True(t, r1.buf != r2.buf, "live readers share a buffer")
+
+	for i := 0; i < 3; i++ {
+		require.True(t, r1.Next())
+		require.True(t, r2.Next())
+		require.Equal(t, data[i*100:(i+1)*100], r1.Record())
+		require.Equal(t, data[i*100:(i+1)*100], r2.Record())
+	}
+	require.False(t, r1.Next())
+	require.NoError(t, r1.Err())
+
+	// Closing returns the buffer and stops the reader.
+	rec := r2.Record()
+	require.NoError(t, r2.Close())
+	require.Nil(t, r2.buf)
+	require.False(t, r2.Next())
+	require.NoError(t, r2.Close())
+
+	// Records stay valid since they aren't held in the pooled buffer.
+	r3 := NewReaderPooled(bytes.NewReader(encodedRecord(recFull, data[500:600])), pool)
+	require.True(t, r3.Next())
+	require.Equal(t, data[200:300], rec)
+	require.NoError(t, r3.Close())
+	require.NoError(t, r1.Close())
+}
+
+func BenchmarkReader_Churn(b *testing.B) {
+	var buf []byte
+	for i := 0; i < 10; i++ {
+		buf = append(buf, encodedRecord(recFull, data[i*100:(i+1)*100])...)
+	}
+
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			pool := NewReaderPool()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var r *Reader
+					if pooled {
+						r = NewReaderPooled(bytes.NewReader(buf), pool)
+					} else {
+						r = NewReader(bytes.NewReader(buf))
+					}
+					for r.Next() {
+					}
+					if err := r.Err(); err != nil {
+						b.Fatal(err)
+					}
+					if err := r.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
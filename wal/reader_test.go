@@ -17,15 +17,21 @@ package wal
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 
@@ -48,6 +54,9 @@ var readerConstructors = map[string]func(io.Reader) reader{
 	"Reader": func(r io.Reader) reader {
 		return NewReader(r)
 	},
+	"LazyChecksumReader": func(r io.Reader) reader {
+		return NewReader(r, WithLazyChecksum(true))
+	},
 }
 
 var data = make([]byte, 100000)
@@ -89,8 +98,8 @@ var testReaderCases = []struct {
 			data[:pageSize-recordHeaderSize],
 		},
 	},
-	// More than a full page, this exceeds our buffer and can never happen
-	// when written by the WAL.
+	// More than a full page, this can never happen when written by the WAL
+	// and fails unless allowed with WithAllowOversizedFull.
 	{
 		t: []rec{
 			{recFull, data[0 : pageSize+1]},
@@ -187,6 +196,467 @@ func TestReader(t *testing.T) {
 	}
 }
 
+func TestReader_LazyChecksum(t *testing.T) {
+	corrupted := encodedRecord(recFull, data[100:200])
+	corrupted[recordHeaderSize] ^= 0xff
+
+	var buf []byte
+	buf = append(buf, encodedRecord(recFull, data[:100])...)
+	buf = append(buf, corrupted...)
+	buf = append(buf, encodedRecord(recFull, data[200:300])...)
+
+	// Skipping the corrupted record goes unnoticed.
+	r := NewReader(bytes.NewReader(buf), WithLazyChecksum(true))
+	assert.True(t, r.Next())
+	assert.True(t, r.Next())
+	assert.True(t, r.Next())
+	assert.Equal(t, data[200:300], r.Record())
+	assert.False(t, r.Next())
+	assert.NoError(t, r.Err())
+
+	// Accessing it fails and stops the reader.
+	r = NewReader(bytes.NewReader(buf), WithLazyChecksum(true))
+	assert.True(t, r.Next())
+	assert.Equal(t, data[:100], r.Record())
+	assert.True(t, r.Next())
+	assert.Nil(t, r.Record())
+	assert.Error(t, r.Err())
+	assert.False(t, r.Next())
+}
+
+func TestReader_RawRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader_raw_record")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Zeroes get compressed while short random records are stored as is.
+	recs := [][]byte{make([]byte, 3*pageSize), data[:10], make([]byte, 100)}
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, true)
+	assert.NoError(t, err)
+	_, err = w.Log(recs...)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	for _, lazy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lazy=%t", lazy), func(t *testing.T) {
+			sr, err := allSegments(dir)
+			assert.NoError(t, err)
+			defer sr.Close()
+
+			r := NewReader(sr, WithLazyChecksum(lazy))
+			for i, rec := range recs {
+				assert.True(t, r.Next())
+				assert.Equal(t, i != 1, r.Compressed())
+				if r.Compressed() {
+					assert.Equal(t, snappy.Encode(nil, rec), r.RawRecord())
+				} else {
+					assert.Equal(t, rec, r.RawRecord())
+				}
+				assert.Equal(t, rec, r.Record())
+			}
+			assert.False(t, r.Next())
+			assert.NoError(t, r.Err())
+		})
+	}
+
+	// Corrupted records aren't returned in either form.
+	corrupted := encodedRecord(recFull, data[:100])
+	corrupted[recordHeaderSize] ^= 0xff
+	r := NewReader(bytes.NewReader(corrupted), WithLazyChecksum(true))
+	assert.True(t, r.Next())
+	assert.Nil(t, r.RawRecord())
+	assert.Nil(t, r.Record())
+	assert.Error(t, r.Err())
+}
+
+func TestReader_Decompressor(t *testing.T) {
+	// The test codec stores records reversed.
+	reverse := func(b []byte) ([]byte, error) {
+		res := make([]byte, len(b))
+		for i, c := range b {
+			res[len(b)-1-i] = c
+		}
+		return res, nil
+	}
+	encode := func(flag uint8, b []byte) []byte {
+		enc, _ := reverse(b)
+		return encodedRecord(recFull|recType(flag<<compressionShift), enc)
+	}
+	recs := [][]byte{[]byte("plain"), []byte("reversed"), []byte("snappy"), []byte("unknown")}
+
+	var buf []byte
+	buf = append(buf, encodedRecord(recFull, recs[0])...)
+	buf = append(buf, encode(2, recs[1])...)
+	buf = append(buf, encodedRecord(recFull|snappyMask, snappy.Encode(nil, recs[2]))...)
+	buf = append(buf, encode(3, recs[3])...)
+
+	for _, lazy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lazy=%t", lazy), func(t *testing.T) {
+			r := NewReader(bytes.NewReader(buf), WithLazyChecksum(lazy), WithDecompressor(2, reverse))
+			for _, rec := range recs[:3] {
+				assert.True(t, r.Next())
+				assert.Equal(t, rec, r.Record())
+			}
+			// Flag 3 has no decompressor.
+			if r.Next() {
+				assert.Nil(t, r.Record())
+			}
+			assert.Error(t, r.Err())
+			assert.Contains(t, r.Err().Error(), "no decompressor for compression flag 3")
+		})
+	}
+
+	// Decompressors replace built-in codecs.
+	r := NewReader(bytes.NewReader(encode(compressionSnappy, recs[1])), WithDecompressor(compressionSnappy, reverse))
+	assert.True(t, r.Next())
+	assert.Equal(t, recs[1], r.Record())
+}
+
+func TestReader_CompressedLen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_compressed_len")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Mix well compressible records with random ones, which aren't worth
+	// compressing and are stored as is.
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, true)
+	assert.NoError(t, err)
+	var recs [][]byte
+	for i := 0; i < 20; i++ {
+		rec := bytes.Repeat([]byte(fmt.Sprintf("record %d ", i)), rand.Intn(pageSize/2))
+		if i%2 == 1 {
+			rec = make([]byte, rand.Intn(2*pageSize))
+			_, err := rand.Read(rec)
+			assert.NoError(t, err)
+		}
+		recs = append(recs, rec)
+	}
+	_, err = w.Log(recs...)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	for _, lazy := range []bool{false, true} {
+		sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+		assert.NoError(t, err)
+		r := NewReader(sr, WithLazyChecksum(lazy))
+
+		// Compute the compression ratio of the WAL.
+		var compressed, uncompressed int
+		for i := 0; r.Next(); i++ {
+			assert.Equal(t, len(recs[i]), r.UncompressedLen())
+			if r.Compressed() {
+				assert.Equal(t, len(r.RawRecord()), r.CompressedLen())
+				assert.Less(t, r.CompressedLen(), r.UncompressedLen())
+			} else {
+				assert.Equal(t, r.UncompressedLen(), r.CompressedLen())
+			}
+			assert.Equal(t, recs[i], r.Record())
+			compressed += r.CompressedLen()
+			uncompressed += r.UncompressedLen()
+		}
+		assert.NoError(t, r.Err())
+		assert.NoError(t, sr.Close())
+
+		ratio := float64(uncompressed) / float64(compressed)
+		assert.Greater(t, ratio, 1.5)
+		t.Logf("lazy=%t: %d bytes compressed to %d, ratio %.2f", lazy, uncompressed, compressed, ratio)
+	}
+}
+
+func TestReader_SetDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Send a record followed by the beginning of one that never completes.
+	go func() {
+		server.Write(encodedRecord(recFull, data[:100]))
+		server.Write(encodedRecord(recFirst, data[100:200]))
+	}()
+
+	r := NewReader(client)
+	r.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	assert.True(t, r.Next())
+	assert.Equal(t, data[:100], r.Record())
+	assert.False(t, r.Next())
+	assert.True(t, errors.Is(r.Err(), os.ErrDeadlineExceeded))
+
+	// Readers without deadline support ignore it.
+	r = NewReader(bytes.NewReader(encodedRecord(recFull, data[:100])))
+	r.SetDeadline(time.Now().Add(-time.Second))
+	assert.True(t, r.Next())
+	assert.False(t, r.Next())
+	assert.NoError(t, r.Err())
+}
+
+func TestReader_Metrics(t *testing.T) {
+	corrupted := encodedRecord(recFull, data[100:200])
+	corrupted[recordHeaderSize] ^= 0xff
+
+	var buf []byte
+	buf = append(buf, encodedRecord(recFull, data[:100])...)
+	buf = append(buf, corrupted...)
+	buf = append(buf, make([]byte, pageSize-len(buf))...)
+	buf = append(buf, encodedRecord(recFull, data[200:300])...)
+
+	reg := prometheus.NewRegistry()
+	for i := 0; i < 2; i++ {
+		// Readers share metrics of the same registerer.
+		r := NewReader(bytes.NewReader(buf), WithReaderMetrics(reg), WithSkipCorrupt(true))
+		for r.Next() {
+		}
+		assert.NoError(t, r.Err())
+	}
+	m := newReaderMetrics(reg)
+	assert.Equal(t, 4.0, client_testutil.ToFloat64(m.recordsRead))
+	assert.Equal(t, 2.0, client_testutil.ToFloat64(m.checksumFailures))
+	assert.Equal(t, 2.0, client_testutil.ToFloat64(m.corruptionsSkipped))
+	assert.Equal(t, 0.0, client_testutil.ToFloat64(m.bytesDecompressed))
+
+	compressed := encodedRecord(recFull, snappy.Encode(nil, data[:1000]))
+	compressed[0] |= snappyMask
+	r := NewReader(bytes.NewReader(compressed), WithReaderMetrics(reg))
+	assert.True(t, r.Next())
+	assert.Equal(t, 1000.0, client_testutil.ToFloat64(m.bytesDecompressed))
+
+	// Disabled metrics.
+	r = NewReader(bytes.NewReader(buf), WithReaderMetrics(nil))
+	assert.True(t, r.Next())
+	assert.Nil(t, r.metrics)
+}
+
+func TestReader_ReadUntil(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_read_until")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	assert.NoError(t, err)
+	var recs [][]byte
+	for i := 0; i < 20; i++ {
+		recs = append(recs, data[i*1000:i*1000+1+(i*3000)%(pageSize+100)])
+	}
+	locs, err := w.Log(recs...)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	read := func(end LogLocation) [][]byte {
+		sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+		assert.NoError(t, err)
+		defer sr.Close()
+
+		got := [][]byte{}
+		r := NewReader(sr, WithReadUntil(end))
+		for r.Next() {
+			got = append(got, append([]byte{}, r.Record()...))
+		}
+		assert.NoError(t, r.Err())
+		return got
+	}
+	for _, k := range []int{0, 1, 7, 19} {
+		// End at a record boundary excludes the record.
+		assert.Equal(t, recs[:k], read(locs[k]), "end at record %d", k)
+		// End within a record includes it.
+		assert.Equal(t, recs[:k+1], read(LogLocation{Segment: locs[k].Segment, Offset: locs[k].Offset + 1}), "end within record %d", k)
+	}
+	// End beyond the data reads everything.
+	assert.Equal(t, recs, read(LogLocation{Segment: 100}))
+
+	// Data past the end isn't read.
+	buf := encodedRecord(recFull, data[:100])
+	buf = append(buf, 0xff, 0xff)
+	r := NewReader(bytes.NewReader(buf), WithReadUntil(LogLocation{Offset: len(buf) - 2}))
+	assert.True(t, r.Next())
+	assert.False(t, r.Next())
+	assert.NoError(t, r.Err())
+}
+
+func TestReader_SegmentHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_segment_header")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Write version 1 segments followed by version 2 ones.
+	var recs [][]byte
+	for _, header := range []bool{false, true} {
+		w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, WithSegmentHeader(header))
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			rec := data[i*1000 : i*1000+1+pageSize/2]
+			locs, err := w.Log(rec)
+			assert.NoError(t, err)
+			if i == 0 && header {
+				assert.Equal(t, segmentHeaderSize, locs[0].Offset)
+			}
+			recs = append(recs, rec)
+		}
+		assert.NoError(t, w.Close())
+	}
+	first, last, err := Segments(dir)
+	assert.NoError(t, err)
+
+	for i := first; i <= last; i++ {
+		s, err := OpenReadSegment(SegmentName(dir, i))
+		assert.NoError(t, err)
+		r := NewReader(NewSegmentBufReader(zerolog.Nop(), s))
+		for r.Next() {
+			expected := formatV1
+			if i > first+1 {
+				expected = formatV2
+			}
+			assert.Equal(t, expected, r.FormatVersion(), "segment %d", i)
+		}
+		assert.NoError(t, r.Err())
+		assert.NoError(t, s.Close())
+	}
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	assert.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr)
+	var got [][]byte
+	for r.Next() {
+		got = append(got, append([]byte{}, r.Record()...))
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, recs, got)
+
+	// Unknown versions are rejected.
+	buf := make([]byte, pageSize)
+	buf = buf[:encodeSegmentHeader(buf, formatVersion+1, segmentFields{})]
+	buf = append(buf, encodedRecord(recFull, data[:100])...)
+	r = NewReader(bytes.NewReader(buf))
+	assert.False(t, r.Next())
+	assert.Contains(t, r.Err().Error(), "unsupported format version")
+}
+
+func TestReader_CurrentLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader_current_location")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, WithPackedRecords(100))
+	assert.NoError(t, err)
+	var locs []LogLocation
+	for i := 0; i < 20; i++ {
+		l, err := w.Log(make([]byte, i*1000), []byte{byte(i)}, []byte{byte(i)})
+		assert.NoError(t, err)
+		locs = append(locs, l...)
+	}
+	assert.NoError(t, w.Close())
+	assert.NotEqual(t, locs[0].Segment, locs[len(locs)-1].Segment)
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	assert.NoError(t, err)
+	defer sr.Close()
+
+	var got []LogLocation
+	r := NewReader(sr)
+	for r.Next() {
+		got = append(got, r.CurrentLocation())
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, locs, got)
+
+	// Without segments, offsets are those within the stream.
+	buf := append(encodedRecord(recFull, data[:100]), encodedRecord(recFull, data[:10])...)
+	r = NewReader(bytes.NewReader(buf))
+	for _, want := range []LogLocation{{Segment: -1}, {Segment: -1, Offset: recordHeaderSize + 100}} {
+		assert.True(t, r.Next())
+		assert.Equal(t, want, r.CurrentLocation())
+	}
+	assert.False(t, r.Next())
+	assert.NoError(t, r.Err())
+}
+
+func TestReader_SpillThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_spill")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	spillDir := filepath.Join(dir, "spill")
+	assert.NoError(t, os.Mkdir(spillDir, 0777))
+
+	recs := [][]byte{data[:100], data[:3*pageSize], data[:pageSize], data[:pageSize+1], data[:10]}
+	var buf []byte
+	for _, rec := range recs {
+		buf = append(buf, encodedFragments(rec)...)
+	}
+
+	for _, lazy := range []bool{false, true} {
+		r := NewReader(bytes.NewReader(buf), WithSpillThreshold(pageSize, spillDir), WithLazyChecksum(lazy))
+		var spilled []string
+		for _, rec := range recs {
+			assert.True(t, r.Next(), "expected record: %v", r.Err())
+			assert.Equal(t, len(rec), r.UncompressedLen())
+			assert.Equal(t, len(rec), r.CompressedLen())
+			f, err := r.RecordFile()
+			assert.NoError(t, err)
+			if len(rec) <= pageSize {
+				assert.Nil(t, f)
+				assert.Equal(t, rec, r.Record())
+				continue
+			}
+			assert.Nil(t, r.Record())
+			b, err := ioutil.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, rec, b)
+			spilled = append(spilled, f.Name())
+
+			// Only the file of the current record remains.
+			files, err := ioutil.ReadDir(spillDir)
+			assert.NoError(t, err)
+			assert.Len(t, files, 1)
+		}
+		assert.Len(t, spilled, 2)
+		assert.NoError(t, r.Close())
+		files, err := ioutil.ReadDir(spillDir)
+		assert.NoError(t, err)
+		assert.Len(t, files, 0)
+	}
+
+	// Corruption in a spilled fragment is detected with lazy checksums.
+	corrupted := append([]byte{}, buf...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	r := NewReader(bytes.NewReader(corrupted), WithSpillThreshold(pageSize, spillDir), WithLazyChecksum(true))
+	for r.Next() {
+	}
+	assert.Error(t, r.Err())
+	assert.NoError(t, r.Close())
+}
+
+// encodedFragments encodes rec into page-sized fragments as the WAL would
+// without compression.
+func encodedFragments(rec []byte) []byte {
+	var buf []byte
+	for i := 0; i == 0 || len(rec) > 0; i++ {
+		l := min(len(rec), pageSize-recordHeaderSize)
+		typ := recMiddle
+		switch {
+		case i == 0 && l == len(rec):
+			typ = recFull
+		case l == len(rec):
+			typ = recLast
+		case i == 0:
+			typ = recFirst
+		}
+		buf = append(buf, encodedRecord(typ, rec[:l])...)
+		rec = rec[l:]
+	}
+	return buf
+}
+
 const fuzzLen = 500
 
 func generateRandomEntries(w *WAL, records chan []byte) error {
@@ -261,6 +731,37 @@ func allSegments(dir string) (io.ReadCloser, error) {
 	}, nil
 }
 
+func TestReader_RecordInto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_record_into")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	recs := [][]byte{data[:100], {}, data[:3*pageSize], data[:10]}
+	var buf []byte
+	for _, rec := range recs {
+		buf = append(buf, encodedFragments(rec)...)
+	}
+
+	for _, spill := range []int{0, pageSize} {
+		r := NewReader(bytes.NewReader(buf), WithSpillThreshold(spill, dir))
+		var got [][]byte
+		dst := make([]byte, 0, 200)
+		for r.Next() {
+			rec := r.RecordInto(dst)
+			if len(rec) <= cap(dst) {
+				// The buffer is reused if it's large enough.
+				assert.Equal(t, &dst[:1][0], &rec[:1][0])
+			}
+			got = append(got, append([]byte{}, rec...))
+		}
+		assert.NoError(t, r.Err())
+		assert.Equal(t, recs, got)
+		assert.NoError(t, r.Close())
+	}
+}
+
 func TestReaderFuzz(t *testing.T) {
 	for name, fn := range readerConstructors {
 		for _, compress := range []bool{false, true} {
@@ -322,3 +823,91 @@ func TestReaderData(t *testing.T) {
 		})
 	}
 }
+
+// BenchmarkReader_RecordInto compares keeping records by copying each one into
+// a new slice with recycling buffers through RecordInto.
+func BenchmarkReader_RecordInto(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench_record_into")
+	assert.NoError(b, err)
+	defer func() {
+		assert.NoError(b, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false)
+	assert.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		_, err := w.Log(make([]byte, 100))
+		assert.NoError(b, err)
+	}
+	assert.NoError(b, w.Close())
+
+	for _, into := range []bool{false, true} {
+		b.Run(fmt.Sprintf("into=%t", into), func(b *testing.B) {
+			b.ReportAllocs()
+			// A window of records kept by the caller, e.g. for batching.
+			kept := make([][]byte, 64)
+			for i := 0; i < b.N; i++ {
+				sr, err := allSegments(dir)
+				assert.NoError(b, err)
+				r := NewReader(sr)
+				for k := 0; r.Next(); k = (k + 1) % len(kept) {
+					if into {
+						kept[k] = r.RecordInto(kept[k])
+					} else {
+						kept[k] = append([]byte(nil), r.Record()...)
+					}
+				}
+				assert.NoError(b, r.Err())
+				assert.NoError(b, sr.Close())
+			}
+		})
+	}
+}
+
+// BenchmarkReader_Replication compares forwarding records as they're stored
+// with decompressing and compressing them again.
+func BenchmarkReader_Replication(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench_replication")
+	assert.NoError(b, err)
+	defer func() {
+		assert.NoError(b, os.RemoveAll(dir))
+	}()
+
+	rec := make([]byte, 2048)
+	for i := range rec {
+		rec[i] = byte(i % 7)
+	}
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, true)
+	assert.NoError(b, err)
+	for i := 0; i < 1000; i++ {
+		_, err := w.Log(rec)
+		assert.NoError(b, err)
+	}
+	assert.NoError(b, w.Close())
+
+	for _, raw := range []bool{true, false} {
+		b.Run(fmt.Sprintf("raw=%t", raw), func(b *testing.B) {
+			var out bytes.Buffer
+			b.SetBytes(int64(len(rec)) * 1000)
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				sr, err := allSegments(dir)
+				assert.NoError(b, err)
+				r := NewReader(sr, WithLazyChecksum(true))
+				var enc []byte
+				for r.Next() {
+					if raw {
+						out.Write(r.RawRecord())
+					} else {
+						enc = snappy.Encode(enc[:cap(enc)], r.Record())
+						out.Write(enc)
+					}
+				}
+				assert.NoError(b, r.Err())
+				assert.NoError(b, sr.Close())
+				out.Reset()
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ReadOnlyWAL gives access to the segments of a WAL for inspection, see
+// OpenReadOnly.
+type ReadOnlyWAL struct {
+	dir string
+}
+
+// OpenReadOnly opens the WAL in dir for inspection, e.g. by debugging tools.
+// Unlike NewSize and Open, it never creates or modifies files: it fails if dir
+// doesn't exist, doesn't recover interrupted compactions or mark the WAL as
+// open, and only opens segments for reading. It may be used while a writer
+// has the WAL open, though records being written may show as torn.
+//
+// Gaps between segments aren't an error, so a damaged WAL can be inspected,
+// see Segments and Verify.
+func OpenReadOnly(dir string) (*ReadOnlyWAL, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "open WAL")
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("open WAL: %s is not a directory", dir)
+	}
+	return &ReadOnlyWAL{dir: dir}, nil
+}
+
+// Dir returns the directory of the WAL.
+func (w *ReadOnlyWAL) Dir() string {
+	return w.dir
+}
+
+// Segments returns the indices of the segments present in ascending order,
+// see WAL.Segments.
+func (w *ReadOnlyWAL) Segments() ([]int, error) {
+	refs, err := readSegmentRefs(w.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	indices := make([]int, len(refs))
+	for i, r := range refs {
+		indices[i] = r.index
+	}
+	return indices, nil
+}
+
+// SegmentReader returns a reader over the records of the given segment, see
+// NewSegmentReader.
+func (w *ReadOnlyWAL) SegmentReader(segment int, opts ...ReaderOption) (*Reader, error) {
+	return NewSegmentReader(w.dir, segment, opts...)
+}
+
+// Size returns the total size of the segment files in bytes.
+func (w *ReadOnlyWAL) Size() (int64, error) {
+	refs, err := readSegmentRefs(w.dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "list segments")
+	}
+	var size int64
+	for _, r := range refs {
+		fi, err := os.Stat(filepath.Join(w.dir, r.name))
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// Verify reports the integrity of the segments, see VerifyDir.
+func (w *ReadOnlyWAL) Verify() (VerifyReport, error) {
+	return VerifyDir(w.dir)
+}
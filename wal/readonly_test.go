@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_read_only")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Missing directories aren't created.
+	missing := filepath.Join(dir, "missing")
+	_, err = OpenReadOnly(missing)
+	require.Error(t, err)
+	_, err = os.Stat(missing)
+	require.True(t, os.IsNotExist(err))
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := w.Log(make([]byte, pageSize))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, os.Remove(SegmentName(dir, 1)))
+
+	// files returns the names, sizes and modification times of the files in
+	// dir.
+	files := func() map[string]os.FileInfo {
+		infos := map[string]os.FileInfo{}
+		require.NoError(t, filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			infos[path] = fi
+			return err
+		}))
+		return infos
+	}
+	before := files()
+
+	ro, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	segs, err := ro.Segments()
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 2, 3, 4}, segs)
+
+	var want int64
+	for _, i := range segs {
+		fi, err := os.Stat(SegmentName(dir, i))
+		require.NoError(t, err)
+		want += fi.Size()
+	}
+	size, err := ro.Size()
+	require.NoError(t, err)
+	require.Equal(t, want, size)
+
+	r, err := ro.SegmentReader(2)
+	require.NoError(t, err)
+	require.True(t, r.Next())
+	require.Equal(t, LogLocation{Segment: 2}, r.CurrentLocation())
+	require.False(t, r.Next())
+	require.NoError(t, r.Err())
+	require.NoError(t, r.Close())
+
+	report, err := ro.Verify()
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, report.Gaps)
+	require.Equal(t, 4, report.Records)
+	require.Nil(t, report.Corruption)
+
+	after := files()
+	require.Equal(t, len(before), len(after))
+	for path, fi := range before {
+		require.Equal(t, fi.Size(), after[path].Size(), path)
+		require.Equal(t, fi.ModTime(), after[path].ModTime(), path)
+	}
+}
@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"hash/crc32"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// WithReadRepair makes the reader heal record fragments failing their checksum
+// with the bytes fetched from a replica. fetch is called with the location of
+// the record and must return the bytes the replica's copy of the segment holds
+// at that location, at least up to the end of the record. It may return more,
+// e.g. the rest of the page. Replicas must thus be byte-identical copies of the
+// segments, such as those shipped with SegmentWriterTo, not WALs the same
+// records were logged to independently.
+//
+// A fragment is only repaired if the fetched fragment has the same header,
+// and thus type, size and checksum, and its payload matches the checksum.
+// Otherwise, or if fetch fails, the checksum failure is returned as usual.
+// Reading continues with the repaired fragment. If the reader reads from
+// segment files, e.g. via NewSegmentsReader, and the segment file can be
+// opened for writing, the fetched payload is also written back to it and
+// synced. Segments that aren't writable are only healed for this read.
+//
+// Only the payload of the corrupted fragment is written, with a single write
+// of at most a page, while the record headers and all other bytes stay as they
+// are. A write interrupted by a crash thus leaves a fragment that fails its
+// checksum again and is repaired by the next read, so a record is never
+// replaced partially by valid looking bytes. Corruption of the record headers
+// themselves, which changes the size or type of fragments, can't be repaired.
+//
+// Read repair verifies checksums while reading, disabling WithLazyChecksum. A
+// nil fetch disables read repair, which is the default.
+func WithReadRepair(fetch func(loc LogLocation) ([]byte, error)) ReaderOption {
+	return func(r *Reader) {
+		r.readRepair = fetch
+	}
+}
+
+// repairFragment replaces the payload of the fragment just read, whose header
+// starts with typ, with the one fetched from the replica. got is the checksum
+// of the corrupted payload and want the one of the header.
+func (r *Reader) repairFragment(typ byte, payload []byte, got, want uint32) error {
+	cerr := r.checksumFailure(got, want)
+
+	loc := r.recStart
+	start := r.Offset() - int64(len(payload)+recordHeaderSize) // Start of the fragment.
+	b, err := r.readRepair(loc)
+	if err != nil {
+		return errors.Wrapf(err, "fetch record for read repair of %v", cerr)
+	}
+	off := int(start) - loc.Offset
+	if off < 0 || len(b) < off+recordHeaderSize+len(payload) {
+		return errors.Wrapf(cerr, "fetched %d bytes too short for read repair", len(b))
+	}
+	b = b[off : off+recordHeaderSize+len(payload)]
+	length, crc, err := decodeRecordHeader(r.version, b)
+	if err != nil {
+		return err
+	}
+	if b[0] != typ || int(length) != len(payload) || crc != want {
+		return errors.Wrap(cerr, "fetched record doesn't match for read repair")
+	}
+	if c := crc32.Checksum(b[recordHeaderSize:], castagnoliTable); c != want {
+		return errors.Wrap(cerr, "fetched record is corrupted as well")
+	}
+	copy(payload, b[recordHeaderSize:])
+
+	if err := r.writeRepair(start+recordHeaderSize, payload); err != nil {
+		return errors.Wrap(err, "write read repair")
+	}
+	if r.metrics != nil {
+		r.metrics.readRepairs.Inc()
+	}
+	return nil
+}
+
+// writeRepair writes the repaired payload at off of the segment being read,
+// if it's read from a writable segment file.
+func (r *Reader) writeRepair(off int64, payload []byte) error {
+	sr, ok := r.rdr.(*segmentBufReader)
+	if !ok {
+		return nil
+	}
+	seg := sr.segs[sr.cur]
+	f, err := os.OpenFile(seg.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := f.WriteAt(payload, off); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,108 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithReadRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_read_repair")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	primary, replica := filepath.Join(dir, "primary"), filepath.Join(dir, "replica")
+
+	w, err := NewSize(zerolog.Nop(), nil, primary, 4*pageSize, false)
+	require.NoError(t, err)
+	var recs [][]byte
+	for i := 0; i < 10; i++ {
+		rec := make([]byte, (i%3)*pageSize+100)
+		for j := range rec {
+			rec[j] = byte(i + j)
+		}
+		recs = append(recs, rec)
+	}
+	locs, err := w.Log(recs...)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.NoError(t, os.Mkdir(replica, 0777))
+	first, last, err := Segments(primary)
+	require.NoError(t, err)
+	for i := first; i <= last; i++ {
+		b, err := ioutil.ReadFile(SegmentName(primary, i))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(SegmentName(replica, i), b, 0666))
+	}
+
+	corrupt := func(dir string, loc LogLocation, off int) {
+		fn := SegmentName(dir, loc.Segment)
+		b, err := ioutil.ReadFile(fn)
+		require.NoError(t, err)
+		b[loc.Offset+off] ^= 0xff
+		require.NoError(t, ioutil.WriteFile(fn, b, 0666))
+	}
+	read := func(opts ...ReaderOption) ([][]byte, error) {
+		sr, err := NewSegmentsReader(zerolog.Nop(), primary)
+		require.NoError(t, err)
+		defer sr.Close()
+		r := NewReader(sr, opts...)
+		var got [][]byte
+		for r.Next() {
+			got = append(got, append([]byte(nil), r.Record()...))
+		}
+		return got, r.Err()
+	}
+	var fetched []LogLocation
+	fetch := func(loc LogLocation) ([]byte, error) {
+		fetched = append(fetched, loc)
+		b, err := ioutil.ReadFile(SegmentName(replica, loc.Segment))
+		if err != nil {
+			return nil, err
+		}
+		return b[loc.Offset:], nil
+	}
+
+	// Corrupt the payload of a single-page record and of the second fragment
+	// of a record spanning pages.
+	corrupt(primary, locs[3], recordHeaderSize+10)
+	corrupt(primary, locs[5], pageSize+recordHeaderSize+10)
+	_, err = read()
+	require.Error(t, err)
+
+	for _, lazy := range []bool{false, true} {
+		fetched = nil
+		got, err := read(WithReadRepair(fetch), WithLazyChecksum(lazy))
+		require.NoError(t, err)
+		require.Equal(t, recs, got)
+		if lazy {
+			// The first pass wrote the repairs back.
+			require.Empty(t, fetched)
+		} else {
+			require.Equal(t, []LogLocation{locs[3], locs[5]}, fetched)
+		}
+	}
+	got, err := read()
+	require.NoError(t, err)
+	require.Equal(t, recs, got)
+
+	// Records corrupted on the replica as well and corrupted headers can't be
+	// repaired.
+	corrupt(primary, locs[7], recordHeaderSize+1)
+	corrupt(replica, locs[7], recordHeaderSize+1)
+	_, err = read(WithReadRepair(fetch))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupted as well")
+
+	corrupt(replica, locs[7], recordHeaderSize+1)
+	corrupt(primary, locs[7], 4)
+	_, err = read(WithReadRepair(fetch))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match")
+}
@@ -0,0 +1,54 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Records returns an iterator over all records in dir in log order, for use
+// with range-over-func in Go 1.23 and later:
+//
+//	for rec, loc, err := range wal.Records(dir) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Each good record is yielded along with its location and a nil error. If
+// reading fails, the iterator yields a nil record, the location at which the
+// failure was detected and the error, a CorruptionErr for corrupted segments,
+// and then stops. Thus errors surface at the point they occur and there's no
+// separate Err to check. A record is only valid until the next iteration.
+//
+// Segments are opened when iteration starts and closed when it ends, also if
+// the loop is left early. The iterator can be used repeatedly.
+func Records(dir string) func(yield func([]byte, LogLocation, error) bool) {
+	return func(yield func([]byte, LogLocation, error) bool) {
+		if _, err := listSegments(dir); err != nil {
+			yield(nil, LogLocation{}, errors.Wrap(err, "list segments"))
+			return
+		}
+		sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+		if err != nil {
+			yield(nil, LogLocation{}, err)
+			return
+		}
+		defer sr.Close()
+
+		r := NewReader(sr)
+		for r.Next() {
+			if !yield(r.Record(), r.recStart, nil) {
+				return
+			}
+		}
+		if err := r.Err(); err != nil {
+			loc := r.recStart
+			var cerr *CorruptionErr
+			if errors.As(err, &cerr) && cerr.Segment >= 0 {
+				loc = LogLocation{Segment: cerr.Segment, Offset: int(cerr.Offset)}
+			}
+			yield(nil, loc, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_records")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	var want [][]byte
+	var wantLocs []LogLocation
+	for i := 0; i < 20; i++ {
+		rec := make([]byte, i*500)
+		rec = append(rec, byte(i))
+		locs, err := w.Log(rec)
+		require.NoError(t, err)
+		want = append(want, rec)
+		wantLocs = append(wantLocs, locs[0])
+	}
+	require.NoError(t, w.Close())
+	require.NotEqual(t, wantLocs[0].Segment, wantLocs[19].Segment)
+
+	var got [][]byte
+	var gotLocs []LogLocation
+	Records(dir)(func(rec []byte, loc LogLocation, err error) bool {
+		require.NoError(t, err)
+		got = append(got, append([]byte(nil), rec...))
+		gotLocs = append(gotLocs, loc)
+		return true
+	})
+	require.Equal(t, want, got)
+	require.Equal(t, wantLocs, gotLocs)
+
+	// Stopping early.
+	n := 0
+	Records(dir)(func(rec []byte, loc LogLocation, err error) bool {
+		require.NoError(t, err)
+		n++
+		return n < 5
+	})
+	require.Equal(t, 5, n)
+
+	// A corruption mid-stream is yielded after the records before it.
+	corrupt := wantLocs[12]
+	fn := SegmentName(dir, corrupt.Segment)
+	b, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	b[corrupt.Offset+recordHeaderSize] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(fn, b, 0666))
+
+	got, gotLocs = nil, nil
+	var errs []error
+	var errLoc LogLocation
+	Records(dir)(func(rec []byte, loc LogLocation, err error) bool {
+		if err != nil {
+			require.Nil(t, rec)
+			errs = append(errs, err)
+			errLoc = loc
+			return true
+		}
+		require.Empty(t, errs, "record after error")
+		got = append(got, append([]byte(nil), rec...))
+		gotLocs = append(gotLocs, loc)
+		return true
+	})
+	require.Equal(t, want[:12], got)
+	require.Equal(t, wantLocs[:12], gotLocs)
+	require.Len(t, errs, 1)
+	var cerr *CorruptionErr
+	require.True(t, errors.As(errs[0], &cerr), "unexpected error %v", errs[0])
+	require.Equal(t, corrupt.Segment, cerr.Segment)
+	require.Equal(t, corrupt.Segment, errLoc.Segment)
+	require.GreaterOrEqual(t, errLoc.Offset, corrupt.Offset)
+
+	// Missing directories are reported, too.
+	errs = nil
+	Records(dir + "/missing")(func(rec []byte, loc LogLocation, err error) bool {
+		errs = append(errs, err)
+		return true
+	})
+	require.Len(t, errs, 1)
+	require.Error(t, errs[0])
+}
+
+func ExampleRecords() {
+	dir, err := ioutil.TempDir("", "wal_records_example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := New(zerolog.Nop(), nil, dir, false)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := w.Log([]byte("a"), []byte("b"), []byte("c")); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	// With Go 1.23 or later, this is: for rec, _, err := range Records(dir) {...}
+	Records(dir)(func(rec []byte, _ LogLocation, err error) bool {
+		if err != nil {
+			fmt.Println("error:", err)
+			return false
+		}
+		fmt.Println(string(rec))
+		return true
+	})
+	// Output:
+	// a
+	// b
+	// c
+}
@@ -0,0 +1,291 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRecordWriterDone is returned by the methods of a RecordWriter after it
+// was committed or aborted.
+var ErrRecordWriterDone = errors.New("record writer committed or aborted")
+
+// RecordWriter writes a single record to the WAL as its data streams in, see
+// NewRecordWriter.
+type RecordWriter struct {
+	w     *WAL
+	st    writeState  // Write position before the record, to roll it back.
+	start LogLocation // Location of the record.
+	ext   []byte      // Extension header of the record.
+	first bool        // Whether the fragment being filled is the first one.
+	hdr   int         // Offset of the header of the fragment being filled in the active page.
+	n     int64       // Bytes written.
+	err   error       // Set once the writer is done.
+}
+
+// NewRecordWriter returns a writer for a single record whose data is passed
+// to Write in pieces, e.g. to log a large payload without holding it in
+// memory as a whole. Commit completes the record. Only the active page is
+// buffered: data is split into fragments like Log does and written to the
+// active segment as pages fill up.
+//
+// The writer holds the WAL exclusively, so other writes to it block until the
+// record is committed or aborted, which callers must do eventually.
+//
+// Records never cross segments. If the record outgrows the rest of the active
+// segment, the part written so far is turned into padding and copied to the
+// start of the next segment, so it can't be larger than a segment. Records
+// written this way aren't compressed and aren't verified by WithWriteVerify.
+// Encrypted WALs aren't supported, as records are sealed as a whole.
+func (w *WAL) NewRecordWriter() (*RecordWriter, error) {
+	w.mtx.Lock()
+
+	if w.closed {
+		w.mtx.Unlock()
+		return nil, ErrWALClosed
+	}
+	if w.aead != nil {
+		w.mtx.Unlock()
+		return nil, errors.New("record writers don't support encryption")
+	}
+	rw := &RecordWriter{w: w, st: w.writeState(), first: true}
+	if err := rw.begin(); err != nil {
+		rw.fail(err)
+		return nil, err
+	}
+	return rw, nil
+}
+
+// begin places the record and starts its first fragment.
+func (rw *RecordWriter) begin() error {
+	w := rw.w
+	ext, err := w.extFor(nil, false)
+	if err != nil {
+		return err
+	}
+	rw.ext = ext
+	if rw.start, err = w.place(0, len(ext), 0); err != nil {
+		return err
+	}
+	rw.startFragment()
+	return nil
+}
+
+// startFragment reserves the header of the next fragment in the active page,
+// which must have room for it.
+func (rw *RecordWriter) startFragment() {
+	p := rw.w.page
+	rw.hdr = p.alloc
+	p.alloc += recordHeaderSize
+	if rw.first && len(rw.ext) > 0 {
+		p.alloc += copy(p.buf[p.alloc:], rw.ext)
+	}
+}
+
+// finishFragment completes the header of the fragment being filled. last
+// tells whether it's the last fragment of the record.
+func (rw *RecordWriter) finishFragment(last bool) {
+	var typ recType
+	switch {
+	case rw.first && last:
+		typ = recFull
+	case last:
+		typ = recLast
+	case rw.first:
+		typ = recFirst
+	default:
+		typ = recMiddle
+	}
+	if rw.first && len(rw.ext) > 0 {
+		typ |= extMask
+	}
+	p := rw.w.page
+	buf := p.buf[rw.hdr:p.alloc]
+	payload := buf[recordHeaderSize:]
+	buf[0] = byte(typ)
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(buf[3:], crc32.Checksum(payload, castagnoliTable))
+	rw.first = false
+}
+
+// nextFragment completes the active page with the fragment being filled and
+// starts the next fragment on a new page, moving the record to the next
+// segment if the active one is full.
+func (rw *RecordWriter) nextFragment() error {
+	w := rw.w
+	rw.finishFragment(false)
+	if w.maxTotalSize > 0 && w.size+int64(w.pageSize-w.page.flushed) > w.maxTotalSize {
+		return ErrWALFull
+	}
+	if err := w.flushPage(true); err != nil {
+		return err
+	}
+	if w.donePages < w.pagesPerSegment() {
+		rw.startFragment()
+		return nil
+	}
+	if rw.start.Segment != w.segment.Index() || rw.start.Offset == w.segmentStart().alloc {
+		return errors.Errorf("record of more than %d bytes doesn't fit into a segment", rw.n)
+	}
+	return rw.moveToNextSegment()
+}
+
+// moveToNextSegment turns the fragments written to the full active segment
+// into padding and writes them again at the start of the next segment.
+func (rw *RecordWriter) moveToNextSegment() error {
+	w := rw.w
+	f, err := os.OpenFile(w.segment.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, "open segment")
+	}
+	defer f.Close()
+
+	var (
+		off   = int64(rw.start.Offset)
+		end   = int64(w.donePages * w.pageSize)
+		hdr   [recordHeaderSize]byte
+		frags [][2]int64 // Offset and length of the payload of each fragment.
+	)
+	for off < end {
+		if int(off%int64(w.pageSize)) > w.pageSize-recordHeaderSize {
+			off += int64(w.pageSize) - off%int64(w.pageSize)
+			continue
+		}
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			return errors.Wrap(err, "read fragment header")
+		}
+		if hdr[0] == 0 {
+			off += int64(w.pageSize) - off%int64(w.pageSize)
+			continue
+		}
+		// Readers skip padding, its checksum still matches the payload.
+		if _, err := f.WriteAt([]byte{byte(recPadding)}, off); err != nil {
+			return errors.Wrap(err, "turn fragment into padding")
+		}
+		n := int64(binary.BigEndian.Uint16(hdr[1:]))
+		frags = append(frags, [2]int64{off + recordHeaderSize, n})
+		off += recordHeaderSize + n
+	}
+	if err := w.nextSegment(); err != nil {
+		return err
+	}
+
+	rw.first = true
+	if err := rw.begin(); err != nil {
+		return err
+	}
+	n := rw.n
+	for i, frag := range frags {
+		if i == 0 {
+			// The extension header was written again.
+			frag[0] += int64(len(rw.ext))
+			frag[1] -= int64(len(rw.ext))
+		}
+		if _, err := io.Copy(rawWriter{rw}, io.NewSectionReader(f, frag[0], frag[1])); err != nil {
+			return err
+		}
+	}
+	rw.n = n
+	return nil
+}
+
+// rawWriter writes to the record of a RecordWriter while it holds w.mtx.
+type rawWriter struct {
+	rw *RecordWriter
+}
+
+func (r rawWriter) Write(b []byte) (int, error) {
+	return len(b), r.rw.write(b)
+}
+
+// write appends b to the record.
+func (rw *RecordWriter) write(b []byte) error {
+	p := rw.w.page
+	for len(b) > 0 {
+		if p.alloc == p.size {
+			if err := rw.nextFragment(); err != nil {
+				return err
+			}
+		}
+		n := copy(p.buf[p.alloc:], b)
+		p.alloc += n
+		rw.n += int64(n)
+		b = b[n:]
+	}
+	return nil
+}
+
+// Write implements io.Writer. An error aborts the record, removing the data
+// written so far.
+func (rw *RecordWriter) Write(b []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	if err := rw.write(b); err != nil {
+		rw.w.metrics.writesFailed.Inc()
+		rw.fail(err)
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Commit completes the record and returns its location, like Log does.
+// Afterwards, the writer can't be used anymore and the WAL accepts other
+// writes again. If completing the record fails, it's aborted. If only syncing
+// it fails under SyncOnLog, the error is returned along with the location, as
+// the record was written but may be lost on a crash.
+func (rw *RecordWriter) Commit() (LogLocation, error) {
+	if rw.err != nil {
+		return LogLocation{}, rw.err
+	}
+	w := rw.w
+	rw.finishFragment(true)
+
+	if err := w.flushPage(w.flushStrategy == FlushPerRecord); err != nil {
+		w.metrics.writesFailed.Inc()
+		rw.fail(err)
+		return LogLocation{}, err
+	}
+	if w.epochs {
+		w.nextEpoch++
+	}
+	w.metrics.recordsWritten.Inc()
+	rw.err = ErrRecordWriterDone
+	defer w.mtx.Unlock()
+
+	if w.syncPolicy.onLog() {
+		if err := w.sync(); err != nil {
+			return rw.start, err
+		}
+	}
+	if w.autoCheckpointBytes > 0 {
+		w.sinceCheckpoint += rw.n
+		w.maybeAutoCheckpoint()
+	}
+	return rw.start, nil
+}
+
+// Abort discards the record and releases the WAL. It's a no-op once the
+// record was committed or aborted.
+func (rw *RecordWriter) Abort() error {
+	if rw.err != nil {
+		return nil
+	}
+	return rw.fail(ErrRecordWriterDone)
+}
+
+// fail rolls back the record, marks the writer as done with err and
+// releases the WAL. It returns the error of the rollback.
+func (rw *RecordWriter) fail(err error) error {
+	rw.err = err
+	defer rw.w.mtx.Unlock()
+
+	if rerr := rw.w.rollback(rw.st); rerr != nil {
+		rw.w.logger.Error().Err(rerr).Msg("roll back record writer")
+		return rerr
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_RecordWriter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts []Option
+		// Size of the record logged before the streamed one.
+		before int
+		size   int
+	}{
+		"small":    {before: 100, size: 100},
+		"empty":    {before: 100, size: 0},
+		"pages":    {before: 100, size: 3 * pageSize},
+		"next_seg": {before: 2 * pageSize, size: 3 * pageSize},
+		"epochs":   {opts: []Option{WithEpochs(true)}, before: 2 * pageSize, size: 3 * pageSize},
+		"per_rec":  {opts: []Option{WithFlushStrategy(FlushPerRecord)}, before: 100, size: 2 * pageSize},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_record_writer")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, tc.opts...)
+			require.NoError(t, err)
+			defer w.Close()
+
+			recs := [][]byte{make([]byte, tc.before), make([]byte, tc.size), []byte("after")}
+			rand.New(rand.NewSource(1)).Read(recs[1])
+			locs, err := w.Log(recs[0])
+			require.NoError(t, err)
+
+			rw, err := w.NewRecordWriter()
+			require.NoError(t, err)
+			// Write in pieces not aligned to pages.
+			_, err = io.CopyBuffer(rw, bytes.NewReader(recs[1]), make([]byte, 1000))
+			require.NoError(t, err)
+			loc, err := rw.Commit()
+			require.NoError(t, err)
+			_, err = rw.Write([]byte("x"))
+			require.Equal(t, ErrRecordWriterDone, err)
+			locs = append(locs, loc)
+
+			// Other writes continue after the record.
+			l, err := w.Log(recs[2])
+			require.NoError(t, err)
+			locs = append(locs, l...)
+			require.NoError(t, w.Sync())
+
+			if name == "next_seg" || name == "epochs" {
+				require.Equal(t, locs[0].Segment+1, loc.Segment)
+			} else {
+				require.Equal(t, locs[0].Segment, loc.Segment)
+			}
+			for i, loc := range locs {
+				rec, err := w.ReadAt(loc)
+				require.NoError(t, err)
+				require.Equal(t, recs[i], rec)
+			}
+			require.NoError(t, w.Close())
+
+			report, err := VerifyDir(dir)
+			require.NoError(t, err)
+			require.Nil(t, report.Corruption)
+			require.Equal(t, 3, report.Records)
+			if name == "epochs" {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				require.NoError(t, err)
+				defer sr.Close()
+				r := NewReader(sr)
+				for i := uint64(0); r.Next(); i++ {
+					epoch, ok := r.Epoch()
+					require.True(t, ok)
+					require.Equal(t, i, epoch)
+				}
+				require.NoError(t, r.Err())
+			}
+		})
+	}
+}
+
+func TestWAL_RecordWriterAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_record_writer")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.Log([]byte("a"))
+	require.NoError(t, err)
+
+	// Aborted records are removed.
+	rw, err := w.NewRecordWriter()
+	require.NoError(t, err)
+	_, err = rw.Write(make([]byte, 2*pageSize))
+	require.NoError(t, err)
+	require.NoError(t, rw.Abort())
+	require.NoError(t, rw.Abort())
+	_, err = rw.Commit()
+	require.Equal(t, ErrRecordWriterDone, err)
+
+	// Records larger than a segment fail and are removed.
+	rw, err = w.NewRecordWriter()
+	require.NoError(t, err)
+	_, err = rw.Write(make([]byte, 3*pageSize))
+	require.NoError(t, err)
+	_, err = rw.Write(make([]byte, 2*pageSize))
+	require.Error(t, err)
+	_, err = rw.Commit()
+	require.Error(t, err)
+
+	_, err = w.Log([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, readAll(t, dir))
+
+	_, err = w.NewRecordWriter()
+	require.Equal(t, ErrWALClosed, err)
+}
+
+func TestWAL_RecordWriterSyncFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_record_writer")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	rw, err := w.NewRecordWriter()
+	require.NoError(t, err)
+	_, err = rw.Write([]byte("record"))
+	require.NoError(t, err)
+
+	errSync := errors.New("sync failed")
+	w.syncHook = func(*os.File) error { return errSync }
+	_, err = rw.Commit()
+	require.Equal(t, errSync, errors.Cause(err))
+
+	// The WAL was released.
+	w.syncHook = nil
+	_, err = w.Log([]byte("next"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,38 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// RepairFrom truncates the WAL at loc like Repair does at a corruption, for
+// callers validating records themselves that know where the valid data ends.
+// The records at and after loc are discarded, those before it are kept. All
+// segments after the one of loc are removed and that segment is rewritten with
+// its records before loc. Writing continues in a new segment after it. To keep
+// a last good record, pass the location following it, e.g. as returned by
+// NewReaderFrom for the next record, or the end of its segment.
+//
+// loc must point to the start of a record as returned by Log, including Sub
+// for packed records, to a page terminator or to the end of a segment,
+// otherwise an error wrapping ErrNoRecordAt is returned. If its segment was
+// removed, an error wrapping ErrLocationGone is returned. Records rewritten
+// are logged again, which re-encodes them with the WAL's current options.
+func (w *WAL) RepairFrom(loc LogLocation) error {
+	if w.IsClosed() {
+		return ErrWALClosed
+	}
+	// Validate loc the same way as for resuming a reader there.
+	r, err := NewReaderFrom(w.logger, w.Dir(), loc, w.readerOptions()...)
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return errors.Wrapf(err, "close segment %d", loc.Segment)
+	}
+	w.logger.Warn().Int("segment", loc.Segment).Int("offset", loc.Offset).Int("sub", loc.Sub).Msg("Starting repair from location")
+
+	return w.truncateSegment(loc.Segment, func(r *Reader) bool {
+		rloc := r.CurrentLocation()
+		return rloc.Offset < loc.Offset || (rloc.Offset == loc.Offset && rloc.Sub < loc.Sub)
+	})
+}
@@ -0,0 +1,105 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_RepairFrom(t *testing.T) {
+	configs := map[string][]Option{
+		"default": nil,
+		"packed":  {WithPackedRecords(100)},
+	}
+	for name, opts := range configs {
+		for _, cut := range []int{0, 7, 20, 44} {
+			t.Run(fmt.Sprintf("%s/cut=%d", name, cut), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_repair_from")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+				require.NoError(t, err)
+				defer w.Close()
+
+				var (
+					recs [][]byte
+					locs []LogLocation
+				)
+				for i := 0; i < 15; i++ {
+					batch := [][]byte{make([]byte, i*700+1), {byte(i)}, {byte(i), 1}}
+					l, err := w.Log(batch...)
+					require.NoError(t, err)
+					recs = append(recs, batch...)
+					locs = append(locs, l...)
+				}
+				require.NotEqual(t, locs[0].Segment, locs[len(locs)-1].Segment)
+
+				loc := locs[cut]
+				require.NoError(t, w.RepairFrom(loc))
+				require.Equal(t, recs[:cut], readAllOrEmpty(t, dir))
+
+				// Writing continues after the repaired segment.
+				l, err := w.Log([]byte("after"))
+				require.NoError(t, err)
+				require.Equal(t, LogLocation{Segment: loc.Segment + 1}, l[0])
+				require.Equal(t, append(recs[:cut:cut], []byte("after")), readAll(t, dir))
+			})
+		}
+	}
+}
+
+// readAllOrEmpty is readAll returning an empty slice rather than nil.
+func readAllOrEmpty(t *testing.T, dir string) [][]byte {
+	recs := readAll(t, dir)
+	if recs == nil {
+		return [][]byte{}
+	}
+	return recs
+}
+
+func TestWAL_RepairFrom_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_repair_from")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	var locs []LogLocation
+	for i := 0; i < 10; i++ {
+		l, err := w.Log(make([]byte, 10000))
+		require.NoError(t, err)
+		locs = append(locs, l...)
+	}
+	last := locs[len(locs)-1]
+	for _, loc := range []LogLocation{
+		{Segment: last.Segment, Offset: last.Offset + 1},
+		{Segment: last.Segment, Offset: last.Offset, Sub: 1},
+		{Segment: -1},
+	} {
+		err := w.RepairFrom(loc)
+		require.True(t, errors.Is(err, ErrNoRecordAt), "location %+v: %v", loc, err)
+	}
+	require.NoError(t, w.Truncate(last.Segment))
+	err = w.RepairFrom(locs[0])
+	require.True(t, errors.Is(err, ErrLocationGone), "unexpected error %v", err)
+	kept := 0
+	for _, loc := range locs {
+		if loc.Segment >= last.Segment {
+			kept++
+		}
+	}
+	require.Len(t, readAll(t, dir), kept)
+
+	require.NoError(t, w.Close())
+	require.Equal(t, ErrWALClosed, w.RepairFrom(last))
+}
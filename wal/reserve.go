@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrReservationInvalid is returned by WriteReserved when the reservation
+// doesn't exist anymore or doesn't match the record.
+var ErrReservationInvalid = errors.New("reservation invalid")
+
+// reservation is a location reserved by Reserve along with the write position
+// it was made at.
+type reservation struct {
+	loc  LogLocation
+	size int
+	st   writeState
+}
+
+// Reserve returns the location at which a record of size bytes will be
+// written by a subsequent call to WriteReserved. This allows storing the
+// location, e.g. in an index, before the record is written.
+//
+// Only one reservation exists at a time and the latest call to Reserve
+// replaces the previous one. A reservation is invalidated by any write to the
+// active segment after it was made, such as by Log or NextSegment, which makes
+// WriteReserved fail. Callers must thus serialize Reserve and WriteReserved
+// with other writes themselves.
+//
+// Reserve may pad the active page or start a new segment to make room for the
+// record, just like writing it would.
+func (w *WAL) Reserve(size int) (LogLocation, error) {
+	if size < 0 {
+		return LogLocation{}, errors.Errorf("invalid record size %d", size)
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return LogLocation{}, ErrWALClosed
+	}
+	w.reserved = nil
+
+	loc, err := w.place(size+w.sealOverhead(), w.extLenFor(nil, false), 0)
+	if err != nil {
+		return LogLocation{}, err
+	}
+	w.reserved = &reservation{loc: loc, size: size, st: w.writeState()}
+	return loc, nil
+}
+
+// WriteReserved writes rec at the location loc returned by the latest call to
+// Reserve, which is consumed in the process. The record must have the size
+// passed to Reserve. If the reservation was invalidated by another write or
+// the record doesn't match it, ErrReservationInvalid is returned and nothing
+// is written. Otherwise it behaves like Log with a single record.
+func (w *WAL) WriteReserved(loc LogLocation, rec []byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	res := w.reserved
+	w.reserved = nil
+
+	switch {
+	case res == nil:
+		return errors.Wrap(ErrReservationInvalid, "no reservation")
+	case res.loc != loc:
+		return errors.Wrapf(ErrReservationInvalid, "reserved %+v, got %+v", res.loc, loc)
+	case res.size != len(rec):
+		return errors.Wrapf(ErrReservationInvalid, "reserved %d bytes, got %d", res.size, len(rec))
+	case res.st != w.writeState():
+		return errors.Wrap(ErrReservationInvalid, "WAL written to since reservation")
+	}
+	_, err := w.writeRecords([][]byte{rec}, nil, 0)
+	return err
+}
@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserve(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segment_header=%t", header), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_reserve")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSegmentHeader(header))
+			require.NoError(t, err)
+
+			// Reserved locations match where records land, including ones
+			// that don't fit into the active page or segment.
+			var locs []LogLocation
+			for _, size := range []int{10, pageSize, pageSize - 100, 2 * pageSize, 0, 3 * pageSize} {
+				loc, err := w.Reserve(size)
+				require.NoError(t, err)
+				require.NoError(t, w.WriteReserved(loc, make([]byte, size)))
+				locs = append(locs, loc)
+			}
+			require.Equal(t, 1, locs[len(locs)-1].Segment)
+
+			// Reservations are invalidated by other writes.
+			loc, err := w.Reserve(10)
+			require.NoError(t, err)
+			_, err = w.Log([]byte{1})
+			require.NoError(t, err)
+			err = w.WriteReserved(loc, make([]byte, 10))
+			require.True(t, errors.Is(err, ErrReservationInvalid))
+
+			loc, err = w.Reserve(10)
+			require.NoError(t, err)
+			require.NoError(t, w.NextSegment())
+			require.True(t, errors.Is(w.WriteReserved(loc, make([]byte, 10)), ErrReservationInvalid))
+
+			// Reservations must be used as made and only once.
+			loc, err = w.Reserve(10)
+			require.NoError(t, err)
+			require.True(t, errors.Is(w.WriteReserved(loc, make([]byte, 11)), ErrReservationInvalid))
+			loc, err = w.Reserve(10)
+			require.NoError(t, err)
+			_, err = w.Reserve(20)
+			require.NoError(t, err)
+			require.True(t, errors.Is(w.WriteReserved(loc, make([]byte, 10)), ErrReservationInvalid))
+			loc, err = w.Reserve(10)
+			require.NoError(t, err)
+			require.NoError(t, w.WriteReserved(loc, make([]byte, 10)))
+			require.True(t, errors.Is(w.WriteReserved(loc, make([]byte, 10)), ErrReservationInvalid))
+			locs = append(locs, loc)
+			require.NoError(t, w.Close())
+
+			// Only written records are in the WAL, at their reserved locations.
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(t, err)
+			defer sr.Close()
+			r := NewReader(sr)
+			var read []LogLocation
+			for r.Next() {
+				if len(r.Record()) != 1 {
+					read = append(read, r.recStart)
+				}
+			}
+			require.NoError(t, r.Err())
+			require.Equal(t, locs, read)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package wal
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Rollback discards the records logged at and after to, as returned by Log,
+// e.g. to drop records of a transaction that was never committed. Writing
+// continues at to, so the next record logged gets the location to, and
+// readers see exactly the records before it. The truncation is synced before
+// Rollback returns, so discarded records don't reappear after a crash.
+// Readers that already read discarded records aren't notified.
+//
+// If to is in a segment before the active one, the newer segments are
+// removed and writing continues in the segment of to. That's only possible
+// under the conditions of ContinueFrom: the segment must have been written in
+// the format the WAL writes, without encryption, and mustn't have been
+// finalized. Like ContinueFrom, this modifies a complete segment, so callers
+// shipping segments, e.g. with Seal, must not have shipped it yet. Rolling
+// back into segments already reported to WithSegmentFinalized isn't
+// supported, as they're never written to again. If Rollback fails after it
+// started removing segments, the WAL has to be reopened.
+//
+// to must point to the start of a record or to the end of the data of its
+// segment, otherwise an error wrapping ErrNoRecordAt is returned. Packed
+// records are rolled back as a whole, see WithPackedRecords.
+//
+// Unlike Repair, Rollback discards valid records, and unlike Truncate, it
+// discards the newest rather than the oldest ones.
+func (w *WAL) Rollback(to LogLocation) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	if to.Segment < 0 || to.Offset < 0 || to.Sub != 0 {
+		return errors.Wrapf(ErrNoRecordAt, "invalid location %+v", to)
+	}
+	if w.page.alloc > w.page.flushed {
+		if err := w.flushPage(false); err != nil {
+			return errors.Wrap(err, "flush page")
+		}
+	}
+	var err error
+	switch active := w.segment.Index(); {
+	case to.Segment > active:
+		return errors.Wrapf(ErrNoRecordAt, "location %+v is after the active segment %d", to, active)
+	case to.Segment == active:
+		err = w.rollbackActive(to)
+	default:
+		err = w.rollbackSegments(to)
+	}
+	if err != nil {
+		return err
+	}
+	if w.epochs {
+		if w.nextEpoch, err = recoverEpoch(w.Dir(), w.readerOptions()); err != nil {
+			return errors.Wrap(err, "recover epoch")
+		}
+	}
+	return nil
+}
+
+// rollbackActive does the work of Rollback for a location in the active
+// segment.
+func (w *WAL) rollbackActive(to LogLocation) error {
+	end := w.donePages*w.pageSize + w.page.flushed
+	if err := w.checkRollbackTarget(to, w.segmentStart().alloc, end); err != nil {
+		return err
+	}
+	stat, err := w.segment.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat active segment")
+	}
+	if err := w.segment.Truncate(int64(to.Offset)); err != nil {
+		return errors.Wrap(err, "truncate active segment")
+	}
+	w.size -= stat.Size() - int64(to.Offset)
+
+	p := w.page
+	w.donePages = to.Offset / w.pageSize
+	p.alloc = to.Offset % w.pageSize
+	p.flushed = p.alloc
+	for i := p.alloc; i < p.size; i++ {
+		p.buf[i] = 0
+	}
+	if err := w.fsync(w.segment); err != nil {
+		return errors.Wrap(err, "sync active segment")
+	}
+	w.synced = to
+	w.broadcast()
+	return nil
+}
+
+// rollbackSegments does the work of Rollback for a location in a segment
+// before the active one.
+func (w *WAL) rollbackSegments(to LogLocation) error {
+	if w.onFinalized != nil {
+		return errors.Errorf("segment %d was reported as finalized", to.Segment)
+	}
+	fn := segmentFile(w.Dir(), to.Segment)
+	if strings.HasSuffix(fn, finalSegmentSuffix) {
+		return errors.Errorf("segment %d was finalized", to.Segment)
+	}
+	end, hdr, ok, err := w.lastRecordEnd(to.Segment, fn)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("segment %d was written in another format", to.Segment)
+	}
+	if err := w.checkRollbackTarget(to, hdr, int(end)); err != nil {
+		return err
+	}
+
+	// Remove the newest segments first, so a crash leaves no gaps.
+	active := w.segment
+	if err := active.Close(); err != nil {
+		return errors.Wrap(err, "close active segment")
+	}
+	for i := active.Index(); i > to.Segment; i-- {
+		sfn := segmentFile(w.Dir(), i)
+		if err := os.Remove(sfn); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove segment %d", i)
+		}
+		removeEmptyDir(w.Dir(), sfn)
+	}
+	if err := syncDir(w.Dir()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "open segment %d", to.Segment)
+	}
+	s := &Segment{File: f, i: to.Segment, dir: w.Dir()}
+	if err := f.Truncate(int64(to.Offset)); err != nil {
+		s.Close()
+		return errors.Wrapf(err, "truncate segment %d", to.Segment)
+	}
+	if err := w.fsync(s); err != nil {
+		s.Close()
+		return errors.Wrapf(err, "sync segment %d", to.Segment)
+	}
+	w.page.reset()
+	if _, err := w.continueSegment(s, int64(to.Offset), hdr); err != nil {
+		return err
+	}
+	if w.size, err = segmentsSize(w.Dir()); err != nil {
+		return errors.Wrap(err, "get segments size")
+	}
+	return nil
+}
+
+// checkRollbackTarget returns an error wrapping ErrNoRecordAt unless to is
+// the start of a record of its segment or end, the end of its data. Records
+// start at start or after.
+func (w *WAL) checkRollbackTarget(to LogLocation, start, end int) error {
+	if to.Offset < start || to.Offset > end {
+		return errors.Wrapf(ErrNoRecordAt, "location %+v is outside of the records of its segment", to)
+	}
+	if to.Offset == end {
+		return nil
+	}
+	return w.findRecord(to, LogLocation{Segment: to.Segment, Offset: end}, nil)
+}
@@ -0,0 +1,166 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_Rollback(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts []Option
+		// Index of the first record rolled back.
+		to int
+	}{
+		"active":           {to: 8},
+		"active_start":     {to: 7},
+		"earlier":          {to: 3},
+		"earlier_start":    {to: 4},
+		"first":            {to: 0},
+		"epochs":           {opts: []Option{WithEpochs(true)}, to: 3},
+		"segment_header":   {opts: []Option{WithSegmentIDs(true)}, to: 4},
+		"flush_per_record": {opts: []Option{WithFlushStrategy(FlushPerRecord)}, to: 9},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_rollback")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, append(tc.opts, WithSyncPolicy(SyncNever))...)
+			require.NoError(t, err)
+
+			var (
+				recs [][]byte
+				locs []LogLocation
+			)
+			for i := 0; i < 10; i++ {
+				rec := make([]byte, 100+i%3*pageSize)
+				rec[0] = byte(i)
+				l, err := w.Log(rec)
+				require.NoError(t, err)
+				recs = append(recs, rec)
+				locs = append(locs, l...)
+			}
+			active := locs[len(locs)-1].Segment
+			if strings.HasPrefix(name, "active") || name == "flush_per_record" {
+				require.Equal(t, active, locs[tc.to].Segment)
+			} else {
+				require.Less(t, locs[tc.to].Segment, active)
+			}
+			if strings.HasSuffix(name, "_start") {
+				require.Less(t, locs[tc.to-1].Segment, locs[tc.to].Segment)
+			}
+
+			to := locs[tc.to]
+			require.NoError(t, w.Rollback(to))
+			var kept [][]byte
+			kept = append(kept, recs[:tc.to]...)
+			require.Equal(t, kept, readAll(t, dir))
+			last, err := w.Segments()
+			require.NoError(t, err)
+			require.Equal(t, to.Segment, last[len(last)-1])
+
+			// Writing continues at the location rolled back to.
+			if name == "epochs" {
+				// Epochs continue from the first record rolled back.
+				l, epochs, err := w.LogWithEpochs([]byte("new"))
+				require.NoError(t, err)
+				require.Equal(t, to, l[0])
+				require.Equal(t, []uint64{uint64(tc.to)}, epochs)
+			} else {
+				l, err := w.Log([]byte("new"))
+				require.NoError(t, err)
+				require.Equal(t, to, l[0])
+			}
+			size, err := w.Size()
+			require.NoError(t, err)
+			want, err := segmentsSize(dir)
+			require.NoError(t, err)
+			require.Equal(t, want, size)
+			require.NoError(t, w.Close())
+
+			require.Equal(t, append(kept, []byte("new")), readAll(t, dir))
+			report, err := VerifyDir(dir)
+			require.NoError(t, err)
+			require.Nil(t, report.Corruption)
+		})
+	}
+}
+
+func TestWAL_RollbackInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_rollback")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+
+	locs, err := w.Log([]byte("a"), make([]byte, 2*pageSize), []byte("c"))
+	require.NoError(t, err)
+	end := LogLocation{Segment: locs[2].Segment, Offset: locs[2].Offset + recordHeaderSize + 1}
+
+	for _, to := range []LogLocation{
+		{Segment: locs[1].Segment, Offset: locs[1].Offset + 1},
+		{Segment: locs[1].Segment, Offset: locs[1].Offset + pageSize},
+		{Segment: end.Segment, Offset: end.Offset + 1},
+		{Segment: end.Segment + 1},
+		{Segment: locs[0].Segment, Offset: locs[0].Offset, Sub: 1},
+		{Segment: -1},
+	} {
+		err := w.Rollback(to)
+		require.True(t, errors.Is(err, ErrNoRecordAt), "%+v: %v", to, err)
+	}
+	// Rolling back to the end discards nothing.
+	require.NoError(t, w.Rollback(end))
+	l, err := w.Log([]byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, end, l[0])
+
+	require.NoError(t, w.Finalize(true))
+	require.Equal(t, ErrWALClosed, w.Rollback(locs[0]))
+
+	// Finalized segments aren't continued.
+	w, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	err = w.Rollback(locs[2])
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrNoRecordAt))
+	require.NoError(t, w.Close())
+	require.Equal(t, [][]byte{[]byte("a"), make([]byte, 2*pageSize), []byte("c"), []byte("d")}, readAll(t, dir))
+}
+
+func TestWAL_RollbackMidRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_rollback")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Payload bytes that look like the header of a full record.
+	rec := make([]byte, 100)
+	for i := range rec {
+		rec[i] = byte(recFull)
+	}
+	locs, err := w.Log([]byte("a"), rec)
+	require.NoError(t, err)
+
+	for off := locs[1].Offset + 1; off < locs[1].Offset+recordHeaderSize+len(rec); off++ {
+		to := LogLocation{Segment: locs[1].Segment, Offset: off}
+		err := w.Rollback(to)
+		require.True(t, errors.Is(err, ErrNoRecordAt), "%+v: %v", to, err)
+	}
+	require.Equal(t, [][]byte{[]byte("a"), rec}, readAll(t, dir))
+}
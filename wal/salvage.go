@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Salvage reads all segments in dir and returns every record that could be
+// recovered along with the locations at which data was lost.
+// Unlike a regular read it doesn't stop at the first corruption but skips
+// ahead to the next page and continues from there.
+// It is meant for emergency recovery and never modifies dir.
+func Salvage(dir string) (records [][]byte, corruptions []LogLocation, err error) {
+	corruptions, err = SalvageFunc(dir, func(rec []byte, _ LogLocation) error {
+		records = append(records, append([]byte(nil), rec...))
+		return nil
+	})
+	return records, corruptions, err
+}
+
+// SalvageFunc is like Salvage but passes each recovered record to fn instead
+// of collecting them, which bounds memory use for large WALs.
+// The record passed to fn is only valid until fn returns.
+// An error returned by fn stops the salvage and is returned as is.
+func SalvageFunc(dir string, fn func(rec []byte, loc LogLocation) error) ([]LogLocation, error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+
+	r := NewReader(sr, WithSkipCorrupt(true))
+	for r.Next() {
+		if err := fn(r.Record(), r.recStart); err != nil {
+			return r.CorruptRegions(), err
+		}
+	}
+	return r.CorruptRegions(), nil
+}
+
+// WithSkipCorrupt makes the reader skip corrupted data instead of stopping at
+// it, as Salvage does. When a record fails its checksum, has an invalid
+// fragment sequence or is otherwise malformed, the reader records the
+// location the record starts at, discards the rest of the page and resumes
+// with the next record starting after it, dropping the trailing fragments of
+// a record that started before. The skipped locations are returned by
+// CorruptRegions. Err then only reports errors that can't be skipped, such as
+// read failures, timeouts and exceeded memory budgets. With WithLazyChecksum,
+// checksum failures are only detected by Record, which returns nil for the
+// corrupted record, and the records after it aren't skipped.
+//
+// Unlike Repair, which truncates the WAL at the first corruption, this only
+// affects reading and never modifies the segments. Records of skipped pages
+// are lost, even if they are intact.
+func WithSkipCorrupt(skip bool) ReaderOption {
+	return func(r *Reader) {
+		r.skipCorrupt = skip
+	}
+}
+
+// CorruptRegions returns the locations of the corrupted records skipped so
+// far with WithSkipCorrupt, in log order. Each region extends from its
+// location to the end of its page, or to the end of the segment for a record
+// torn at the end of the log. It's meant to be called once Next returned
+// false, to decide whether the loss is acceptable.
+func (r *Reader) CorruptRegions() []LogLocation {
+	return r.corruptions
+}
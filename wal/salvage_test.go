@@ -0,0 +1,180 @@
+package wal
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSalvage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_salvage")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// 2 segments of 3 pages with 4 records per page.
+	w, err := NewSize(zerolog.Nop(), nil, dir, 3*pageSize, false)
+	require.NoError(t, err)
+
+	var (
+		records   [][]byte
+		locations []LogLocation
+	)
+	for i := 0; i < 24; i++ {
+		rec := make([]byte, pageSize/4-recordHeaderSize)
+		_, err := rand.Read(rec)
+		require.NoError(t, err)
+		records = append(records, rec)
+
+		loc, err := w.Log(rec)
+		require.NoError(t, err)
+		locations = append(locations, loc[0])
+	}
+	require.NoError(t, w.Close())
+
+	// Flip a payload byte of the 2nd record in the 2nd page.
+	f, err := os.OpenFile(SegmentName(dir, locations[5].Segment), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{^records[5][0]}, int64(locations[5].Offset+recordHeaderSize))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	salvaged, corruptions, err := Salvage(dir)
+	require.NoError(t, err)
+	require.Equal(t, []LogLocation{locations[5]}, corruptions)
+
+	// The rest of the page after the corrupted record is skipped.
+	expected := append(append([][]byte{}, records[:5]...), records[8:]...)
+	require.Equal(t, expected, salvaged)
+
+	var salvagedLocs []LogLocation
+	_, err = SalvageFunc(dir, func(_ []byte, loc LogLocation) error {
+		salvagedLocs = append(salvagedLocs, loc)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, append(append([]LogLocation{}, locations[:5]...), locations[8:]...), salvagedLocs)
+}
+
+func TestWithSkipCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_skip_corrupt")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// 2 segments of 3 pages with 4 records per page.
+	w, err := NewSize(zerolog.Nop(), nil, dir, 3*pageSize, false)
+	require.NoError(t, err)
+
+	var (
+		records   [][]byte
+		locations []LogLocation
+	)
+	for i := 0; i < 24; i++ {
+		rec := make([]byte, pageSize/4-recordHeaderSize)
+		_, err := rand.Read(rec)
+		require.NoError(t, err)
+		records = append(records, rec)
+
+		loc, err := w.Log(rec)
+		require.NoError(t, err)
+		locations = append(locations, loc[0])
+	}
+	require.NoError(t, w.Close())
+
+	// Flip a payload byte of the 2nd record in the 2nd page and turn the 3rd
+	// record of the 4th page into a last fragment, which is an invalid
+	// sequence but has a valid checksum.
+	f, err := os.OpenFile(SegmentName(dir, locations[5].Segment), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{^records[5][0]}, int64(locations[5].Offset+recordHeaderSize))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = os.OpenFile(SegmentName(dir, locations[14].Segment), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{byte(recLast)}, int64(locations[14].Offset))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for _, lazy := range []bool{false, true} {
+		sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+		require.NoError(t, err)
+
+		var got [][]byte
+		r := NewReader(sr, WithSkipCorrupt(true), WithLazyChecksum(lazy))
+		for r.Next() {
+			if rec := r.Record(); rec != nil {
+				got = append(got, append([]byte{}, rec...))
+			}
+		}
+		require.NoError(t, r.Err())
+		require.NoError(t, sr.Close())
+
+		// The rest of the pages after the corrupted records is skipped. With
+		// lazy checksums, records failing them are detected by Record, after
+		// Next returned them, and only they are dropped.
+		var want [][]byte
+		want = append(want, records[:5]...)
+		if lazy {
+			want = append(want, records[6:8]...)
+		}
+		want = append(want, records[8:14]...)
+		want = append(want, records[16:]...)
+		require.Equal(t, want, got, "lazy=%t", lazy)
+		require.Equal(t, []LogLocation{locations[5], locations[14]}, r.CorruptRegions(), "lazy=%t", lazy)
+	}
+
+	// Without it, the reader stops at the first corruption.
+	sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	defer sr.Close()
+	r := NewReader(sr)
+	n := 0
+	for ; r.Next(); n++ {
+	}
+	require.Equal(t, 5, n)
+	require.Error(t, r.Err())
+	require.Empty(t, r.CorruptRegions())
+}
+
+func TestSalvage_Empty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_salvage")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	records, corruptions, err := Salvage(dir)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Empty(t, corruptions)
+}
+
+// TestSalvage_Garbage ensures salvaging arbitrary bytes never panics.
+func TestSalvage_Garbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_salvage")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		b := make([]byte, rnd.Intn(4*pageSize))
+		rnd.Read(b)
+		// Make some of the data look like plausible headers.
+		for j := 0; j < len(b); j += rnd.Intn(pageSize/4) + 1 {
+			b[j] = byte(rnd.Intn(5))
+		}
+		require.NoError(t, ioutil.WriteFile(SegmentName(dir, 0), b, 0666))
+
+		_, _, err := Salvage(dir)
+		require.NoError(t, err)
+	}
+}
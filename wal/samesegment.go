@@ -0,0 +1,101 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// LogInSameSegment writes recs into the log like Log but keeps all of them in
+// a single segment, so that a reader can process the batch from one file. All
+// returned locations share the same Segment.
+//
+// If the batch doesn't fit into the remainder of the active segment, the WAL
+// first advances to a new segment and writes the batch there. If it doesn't
+// fit into an empty segment either, an error is returned without writing
+// anything. Forcing the rotation terminates the active page, which pads it
+// with up to a page (32KB) of zeros, and leaves the rest of the active segment
+// unused, so batches close to the segment size can leave segments mostly
+// empty and increase the number of segments.
+//
+// Whether the batch fits is determined from the uncompressed size of its
+// records, so compressed batches may start a new segment although they would
+// have fit.
+func (w *WAL) LogInSameSegment(recs ...[]byte) ([]LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	if len(recs) == 0 && !w.syncOnEmpty {
+		return []LogLocation{}, nil
+	}
+	if err := w.checkCapacity(recs); err != nil {
+		return nil, err
+	}
+	off := w.donePages*w.pageSize + w.page.alloc
+	if !w.fitsSegment(recs, off) {
+		start := w.segmentStart().alloc
+		if !w.fitsSegment(recs, start) {
+			return nil, errors.Errorf("batch of %d records doesn't fit into a segment of %d bytes", len(recs), w.segmentSize)
+		}
+		if off > start {
+			if err := w.nextSegment(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w.writeRecords(recs, nil, 0)
+}
+
+// fitsSegment returns whether Log would write recs into the active segment
+// when starting at offset off of it. It replays how writeRecords places and
+// splits the records, assuming they aren't compressed.
+func (w *WAL) fitsSegment(recs [][]byte, off int) bool {
+	pages := w.pagesPerSegment()
+	pg, alloc := off/w.pageSize, off%w.pageSize
+
+	for i := 0; i < len(recs); {
+		n := w.packRun(recs[i:])
+		size, extLen := len(recs[i]), w.extLenFor(nil, n > 1)
+		if n > 1 {
+			size = packedSize(recs[i : i+n])
+		}
+		size += w.sealOverhead()
+		i += n
+
+		// See place.
+		if w.pageSize-alloc < recordHeaderSize || w.pageSize-alloc-recordHeaderSize < extLen {
+			pg, alloc = pg+1, 0
+		}
+		left := w.pageSize - alloc - recordHeaderSize + (w.pageSize-recordHeaderSize)*(pages-pg-1)
+		if pg >= pages || extLen+size > left {
+			return false
+		}
+		// See log.
+		for k, rem := 0, extLen+size; k == 0 || rem > 0; k++ {
+			l := min(rem, w.pageSize-alloc-recordHeaderSize)
+			alloc += l + recordHeaderSize
+			rem -= l
+			if w.pageSize-alloc < recordHeaderSize {
+				pg, alloc = pg+1, 0
+			}
+		}
+		if w.flushStrategy == FlushPerRecord && alloc > 0 {
+			pg, alloc = pg+1, 0
+		}
+	}
+	return true
+}
+
+// packedSize returns the size of the payload of a packed record holding recs,
+// see pack.
+func packedSize(recs [][]byte) int {
+	size := 0
+	for _, rec := range recs {
+		size += len(rec) + 1
+		for l := len(rec); l >= 0x80; l >>= 7 {
+			size++
+		}
+	}
+	return size
+}
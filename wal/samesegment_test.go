@@ -0,0 +1,110 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogInSameSegment(t *testing.T) {
+	configs := map[string]func(t *testing.T) []Option{
+		"default":        func(*testing.T) []Option { return nil },
+		"segment_header": func(*testing.T) []Option { return []Option{WithSegmentHeader(true)} },
+		"packed":         func(*testing.T) []Option { return []Option{WithPackedRecords(200)} },
+		"per_record":     func(*testing.T) []Option { return []Option{WithFlushStrategy(FlushPerRecord)} },
+		"encrypted":      func(t *testing.T) []Option { return []Option{WithEncryption(newTestAEAD(t))} },
+	}
+	for name, opts := range configs {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/compress=%t", name, compress), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_same_segment")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+				w, err := NewSize(zerolog.Nop(), nil, dir, 8*pageSize, compress, opts(t)...)
+				require.NoError(t, err)
+
+				rnd := rand.New(rand.NewSource(1))
+				var want [][]byte
+				for i := 0; i < 200; i++ {
+					batch := make([][]byte, 1+rnd.Intn(6))
+					for j := range batch {
+						batch[j] = make([]byte, rnd.Intn(1<<uint(rnd.Intn(14))))
+						rnd.Read(batch[j])
+					}
+					locs, err := w.LogInSameSegment(batch...)
+					require.NoError(t, err)
+					require.Len(t, locs, len(batch))
+					for _, loc := range locs {
+						require.Equal(t, locs[0].Segment, loc.Segment)
+					}
+					want = append(want, batch...)
+				}
+
+				// Batches larger than a segment are rejected without writing them.
+				_, err = w.LogInSameSegment(make([]byte, 4*pageSize), make([]byte, 4*pageSize))
+				require.Error(t, err)
+				require.NoError(t, w.Close())
+
+				var got [][]byte
+				var ropts []ReaderOption
+				if name == "encrypted" {
+					ropts = append(ropts, WithDecryption(w.aead))
+				}
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				require.NoError(t, err)
+				defer sr.Close()
+				r := NewReader(sr, ropts...)
+				for r.Next() {
+					got = append(got, append([]byte{}, r.Record()...))
+				}
+				require.NoError(t, r.Err())
+				require.Equal(t, want, got)
+			})
+		}
+	}
+}
+
+// TestWAL_fitsSegment checks that fitsSegment predicts whether Log keeps a
+// batch of uncompressed records in the active segment.
+func TestWAL_fitsSegment(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithPackedRecords(200)}, {WithFlushStrategy(FlushPerRecord)}} {
+		dir, err := ioutil.TempDir("", "wal_fits_segment")
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, os.RemoveAll(dir))
+		}()
+		w, err := NewSize(zerolog.Nop(), nil, dir, 8*pageSize, false, opts...)
+		require.NoError(t, err)
+
+		rnd := rand.New(rand.NewSource(2))
+		fits := 0
+		for i := 0; i < 500; i++ {
+			batch := make([][]byte, 1+rnd.Intn(6))
+			for j := range batch {
+				batch[j] = make([]byte, rnd.Intn(1<<uint(rnd.Intn(14))))
+			}
+			seg := w.segment.Index()
+			want := w.fitsSegment(batch, w.donePages*pageSize+w.page.alloc)
+			locs, err := w.Log(batch...)
+			require.NoError(t, err)
+			got := true
+			for _, loc := range locs {
+				got = got && loc.Segment == seg
+			}
+			require.Equal(t, want, got, "batch %d", i)
+			if got {
+				fits++
+			}
+		}
+		require.Greater(t, fits, 50)
+		require.Less(t, fits, 500)
+		require.NoError(t, w.Close())
+	}
+}
@@ -0,0 +1,29 @@
+package wal
+
+// Seal starts a new segment so that all records written so far are in
+// complete segments before it, which are never written to again, and returns
+// the location at which the new active segment begins. Everything before that
+// location can then be shipped elsewhere, e.g. with SegmentsSince, without
+// racing with concurrent writes. If no records were written to the active
+// segment yet, it isn't replaced and its start is returned.
+//
+// Sealing is about which segments are immutable rather than durability:
+// records are synced by the writes that logged them. Like NextSegment, Seal
+// terminates the active page and syncs and closes the sealed segment in the
+// background, and reports it to the callback set with WithSegmentFinalized,
+// if any. Automatic checkpoints, which cover all segments before the active
+// one, include the sealed segments from then on.
+func (w *WAL) Seal() (LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return LogLocation{}, ErrWALClosed
+	}
+	if w.donePages*w.pageSize+w.page.alloc > w.segmentStart().alloc {
+		if err := w.nextSegment(); err != nil {
+			return LogLocation{}, err
+		}
+	}
+	return LogLocation{Segment: w.segment.Index()}, nil
+}
@@ -0,0 +1,61 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeal(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "wal_seal")
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, os.RemoveAll(dir))
+		}()
+
+		w, err := NewSize(zerolog.Nop(), nil, dir, 8*pageSize, false, WithSegmentHeader(header))
+		require.NoError(t, err)
+
+		// Nothing to seal in an empty segment.
+		loc, err := w.Seal()
+		require.NoError(t, err)
+		require.Equal(t, LogLocation{Segment: 0}, loc)
+
+		locs, err := w.Log([]byte("a"), []byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, 0, locs[1].Segment)
+		loc, err = w.Seal()
+		require.NoError(t, err)
+		require.Equal(t, LogLocation{Segment: 1}, loc)
+
+		// The sealed segment isn't written to anymore.
+		segs, err := w.SegmentsSince(-1)
+		require.NoError(t, err)
+		require.Len(t, segs, 2)
+		sealed := segs[0]
+		locs, err = w.Log([]byte("c"))
+		require.NoError(t, err)
+		require.Equal(t, 1, locs[0].Segment)
+		require.NoError(t, w.Close())
+
+		stat, err := os.Stat(SegmentName(dir, 0))
+		require.NoError(t, err)
+		require.Equal(t, sealed.Size, stat.Size())
+		_, err = w.Seal()
+		require.Equal(t, ErrWALClosed, err)
+
+		var got []string
+		err = EachSegmentRecords(dir, func(seg int, records func() ([]byte, bool)) error {
+			for rec, ok := records(); ok; rec, ok = records() {
+				got = append(got, string(rec))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b", "c"}, got)
+	}
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// ErrLocationGone is returned by NewReaderFrom if the segment of the location
+// was removed, e.g. by a checkpoint, or truncated before the location, e.g. by
+// Repair.
+var ErrLocationGone = errors.New("location no longer in the log")
+
+// NewReaderFrom returns a reader over the segments in dir starting at loc, so
+// that reading can resume at a known location without scanning the segments
+// before it. Like Consume, the first record returned by Next is the one at loc,
+// and records are returned with the same locations Log returned for them. To
+// resume after the last processed record, call Next once to skip it. The reader
+// must be closed to release the segments. The options configure the reader,
+// e.g. WithDecryption for an encrypted WAL.
+//
+// loc must point to the start of a record as returned by Log, to a page
+// terminator, i.e. the padding after the last record of a page, or to the end
+// of a segment, otherwise an error wrapping ErrNoRecordAt is returned. If the
+// segment of loc is missing or shorter than loc.Offset, an error wrapping
+// ErrLocationGone is returned.
+func NewReaderFrom(logger zerolog.Logger, dir string, loc LogLocation, opts ...ReaderOption) (*Reader, error) {
+	if loc.Segment < 0 || loc.Offset < 0 || loc.Sub < 0 {
+		return nil, errors.Wrapf(ErrNoRecordAt, "invalid location %+v", loc)
+	}
+	if err := checkResumeLocation(dir, loc); err != nil {
+		return nil, err
+	}
+	sr, err := NewSegmentsRangeReader(logger, SegmentRange{Dir: dir, First: loc.Segment, Last: -1})
+	if err != nil {
+		return nil, err
+	}
+	b := sr.(*segmentBufReader)
+	if b.segs[0].Index() != loc.Segment {
+		// Removed after checking loc.
+		b.Close()
+		return nil, errors.Wrapf(ErrLocationGone, "segment %d not found", loc.Segment)
+	}
+	if _, err := b.segs[0].Seek(int64(loc.Offset), io.SeekStart); err != nil {
+		b.Close()
+		return nil, errors.Wrapf(err, "seek segment %d", loc.Segment)
+	}
+	b.off = loc.Offset
+
+	r := NewReader(b, opts...)
+	r.closer = b
+	r.total = int64(loc.Offset)
+	if loc.Offset > 0 {
+		if err := r.readSegmentHeaderAt(b.segs[0]); err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "read segment %d", loc.Segment)
+		}
+	}
+	// Skip the packed records before loc.Sub, see scan.
+	for i := 0; i < loc.Sub; i++ {
+		if !r.Next() {
+			err := r.Err()
+			if err == nil {
+				err = errors.Wrapf(ErrNoRecordAt, "location %+v is past the end of the log", loc)
+			}
+			r.Close()
+			return nil, err
+		}
+		if r.recStart.Offset != loc.Offset || len(r.packed) == 0 {
+			r.Close()
+			return nil, errors.Wrapf(ErrNoRecordAt, "location %+v is past the records packed at its offset", loc)
+		}
+	}
+	return r, nil
+}
+
+// checkResumeLocation returns an error if the reader can't start at loc, see
+// NewReaderFrom.
+func checkResumeLocation(dir string, loc LogLocation) error {
+	f, err := os.Open(segmentFile(dir, loc.Segment))
+	if os.IsNotExist(err) {
+		return errors.Wrapf(ErrLocationGone, "segment %d not found", loc.Segment)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "open segment %d", loc.Segment)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat segment %d", loc.Segment)
+	}
+	if int64(loc.Offset) > fi.Size() {
+		return errors.Wrapf(ErrLocationGone, "segment %d has %d bytes, location %+v is past its end", loc.Segment, fi.Size(), loc)
+	}
+	if int64(loc.Offset) == fi.Size() {
+		if loc.Sub > 0 {
+			return errors.Wrapf(ErrNoRecordAt, "location %+v is past the end of its segment", loc)
+		}
+		return nil
+	}
+	var hdr [recordHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:1], int64(loc.Offset)); err != nil {
+		return errors.Wrapf(err, "read segment %d", loc.Segment)
+	}
+	switch typ := recTypeFromHeader(hdr[0]); {
+	case typ == recFull || typ == recFirst:
+		// The header byte alone may be part of another fragment's header or
+		// payload, so the fragment's checksum is verified as well.
+		if _, err := f.ReadAt(hdr[:], int64(loc.Offset)); err != nil && err != io.EOF {
+			return errors.Wrapf(err, "read segment %d", loc.Segment)
+		}
+		length := binary.BigEndian.Uint16(hdr[1:])
+		payload := make([]byte, length)
+		if _, err := f.ReadAt(payload, int64(loc.Offset+recordHeaderSize)); err != nil && err != io.EOF {
+			return errors.Wrapf(err, "read segment %d", loc.Segment)
+		}
+		if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(hdr[3:]) {
+			return errors.Wrapf(ErrNoRecordAt, "location %+v doesn't point to an intact %s fragment", loc, typ)
+		}
+		return nil
+	case typ == recPageTerm && loc.Sub == 0:
+		// Only padding may follow a terminator up to the end of the page.
+		size, err := segmentPageSize(f)
+		if err != nil {
+			return errors.Wrapf(err, "segment %d", loc.Segment)
+		}
+		pad := make([]byte, size-loc.Offset%size)
+		n, err := f.ReadAt(pad, int64(loc.Offset))
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "read segment %d", loc.Segment)
+		}
+		for _, c := range pad[:n] {
+			if c != 0 {
+				return errors.Wrapf(ErrNoRecordAt, "location %+v doesn't point to a record or a page terminator", loc)
+			}
+		}
+		return nil
+	default:
+		return errors.Wrapf(ErrNoRecordAt, "location %+v points to a %s fragment", loc, typ)
+	}
+}
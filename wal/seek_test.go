@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReaderFrom(t *testing.T) {
+	configs := map[string][]Option{
+		"default":        nil,
+		"packed":         {WithPackedRecords(100)},
+		"segment_header": {WithSegmentHeader(true)},
+	}
+	for name, opts := range configs {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/compress=%t", name, compress), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_reader_from")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, compress, opts...)
+				require.NoError(t, err)
+
+				rnd := rand.New(rand.NewSource(1))
+				var (
+					recs [][]byte
+					locs []LogLocation
+				)
+				for i := 0; i < 30; i++ {
+					batch := [][]byte{{}, make([]byte, rnd.Intn(3*pageSize)), []byte(fmt.Sprintf("record %d", i))}
+					rnd.Read(batch[1])
+					l, err := w.Log(batch...)
+					require.NoError(t, err)
+					recs = append(recs, batch...)
+					locs = append(locs, l...)
+				}
+				require.NoError(t, w.Close())
+
+				readFrom := func(loc LogLocation) ([][]byte, []LogLocation) {
+					r, err := NewReaderFrom(zerolog.Nop(), dir, loc)
+					require.NoError(t, err, "location %+v", loc)
+					defer r.Close()
+
+					var (
+						got     [][]byte
+						gotLocs []LogLocation
+					)
+					for r.Next() {
+						got = append(got, append([]byte{}, r.Record()...))
+						gotLocs = append(gotLocs, r.CurrentLocation())
+					}
+					require.NoError(t, r.Err(), "location %+v", loc)
+					return got, gotLocs
+				}
+				for i := 0; i < len(locs); i += 5 {
+					got, gotLocs := readFrom(locs[i])
+					require.Equal(t, recs[i:], got, "location %+v", locs[i])
+					require.Equal(t, locs[i:], gotLocs, "location %+v", locs[i])
+				}
+
+				// Locations not pointing to the start of a record.
+				last := locs[len(locs)-1]
+				for _, loc := range []LogLocation{
+					{Segment: last.Segment, Offset: last.Offset + 1},
+					{Segment: last.Segment, Offset: last.Offset, Sub: 1000},
+					{Segment: -1},
+				} {
+					_, err := NewReaderFrom(zerolog.Nop(), dir, loc)
+					require.True(t, errors.Is(err, ErrNoRecordAt), "location %+v: %v", loc, err)
+				}
+
+				// Truncated and removed segments.
+				fn := segmentFile(dir, last.Segment)
+				fi, err := os.Stat(fn)
+				require.NoError(t, err)
+				for _, loc := range []LogLocation{
+					{Segment: last.Segment, Offset: int(fi.Size()) + 1},
+					{Segment: last.Segment + 1},
+				} {
+					_, err := NewReaderFrom(zerolog.Nop(), dir, loc)
+					require.True(t, errors.Is(err, ErrLocationGone), "location %+v: %v", loc, err)
+				}
+				require.NoError(t, os.Remove(segmentFile(dir, locs[0].Segment)))
+				_, err = NewReaderFrom(zerolog.Nop(), dir, locs[0])
+				require.True(t, errors.Is(err, ErrLocationGone), "unexpected error %v", err)
+			})
+		}
+	}
+}
+
+func TestNewReaderFrom_pageTerminator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_reader_from_term")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	// The first record leaves less than a header in the page, which is
+	// terminated before the next record.
+	first := make([]byte, pageSize-recordHeaderSize-3)
+	locs, err := w.Log(first, []byte("next"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, LogLocation{Segment: locs[0].Segment, Offset: pageSize}, locs[1])
+
+	term := LogLocation{Segment: locs[0].Segment, Offset: pageSize - 3}
+	r, err := NewReaderFrom(zerolog.Nop(), dir, term)
+	require.NoError(t, err)
+	defer r.Close()
+	require.True(t, r.Next())
+	require.Equal(t, []byte("next"), r.Record())
+	require.Equal(t, locs[1], r.CurrentLocation())
+	require.False(t, r.Next())
+	require.NoError(t, r.Err())
+
+	// The end of the segment.
+	fi, err := os.Stat(segmentFile(dir, term.Segment))
+	require.NoError(t, err)
+	r, err = NewReaderFrom(zerolog.Nop(), dir, LogLocation{Segment: term.Segment, Offset: int(fi.Size())})
+	require.NoError(t, err)
+	defer r.Close()
+	require.False(t, r.Next())
+	require.NoError(t, r.Err())
+}
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// EachSegmentRecords calls fn for each segment in dir in order, passing the
+// segment's index and a function yielding its records. records returns the
+// next record of the segment and true, or nil and false once all records of
+// the segment were read. The returned record is only valid until the next
+// call. Records never cross segments, so each record belongs to exactly one
+// call of fn, and the return of fn marks the boundary to the next segment.
+//
+// Only one segment is open at a time. fn doesn't need to read all records of
+// its segment. If fn returns an error, iteration stops and the error is
+// returned. If reading a segment fails, records stops yielding and the
+// failure is returned as a CorruptionErr once fn returned, without iterating
+// further segments. The options configure the readers of the segments.
+func EachSegmentRecords(dir string, fn func(segIndex int, records func() ([]byte, bool)) error, opts ...ReaderOption) error {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return errors.Wrap(err, "list segments")
+	}
+	for _, ref := range refs {
+		if err := eachRecordOfSegment(dir, ref.index, fn, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachRecordOfSegment calls fn for the segment with the given index in dir,
+// see EachSegmentRecords.
+func eachRecordOfSegment(dir string, index int, fn func(int, func() ([]byte, bool)) error, opts []ReaderOption) error {
+	s, err := openReadSegmentIn(dir, segmentFile(dir, index))
+	if err != nil {
+		return errors.Wrapf(err, "open segment %d", index)
+	}
+	sr := NewSegmentBufReader(zerolog.Nop(), s)
+	defer sr.Close()
+
+	r := NewReader(sr, opts...)
+	done := false
+	records := func() ([]byte, bool) {
+		if done {
+			return nil, false
+		}
+		if r.Next() {
+			// Records failing lazy verification are reported by Err.
+			if rec := r.Record(); rec != nil || r.Err() == nil {
+				return rec, true
+			}
+		}
+		done = true
+		return nil, false
+	}
+	if err := fn(index, records); err != nil {
+		return err
+	}
+	return r.Err()
+}
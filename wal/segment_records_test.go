@@ -0,0 +1,88 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEachSegmentRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_each_segment")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	want := map[int][][]byte{}
+	for i := 0; i < 30; i++ {
+		rec := make([]byte, i*1000)
+		rec = append(rec, byte(i))
+		locs, err := w.Log(rec)
+		require.NoError(t, err)
+		want[locs[0].Segment] = append(want[locs[0].Segment], rec)
+	}
+	require.NoError(t, w.Close())
+	first, last, err := Segments(dir)
+	require.NoError(t, err)
+	require.Greater(t, last-first, 5)
+
+	var segs []int
+	got := map[int][][]byte{}
+	err = EachSegmentRecords(dir, func(seg int, records func() ([]byte, bool)) error {
+		segs = append(segs, seg)
+		for rec, ok := records(); ok; rec, ok = records() {
+			got[seg] = append(got[seg], append([]byte(nil), rec...))
+		}
+		// Exhausted segments stay exhausted.
+		_, ok := records()
+		require.False(t, ok)
+		return nil
+	}, WithLazyChecksum(true))
+	require.NoError(t, err)
+	require.Equal(t, first, segs[0])
+	require.Equal(t, last, segs[len(segs)-1])
+	require.Len(t, segs, last-first+1)
+	for seg, recs := range got {
+		require.Equal(t, want[seg], recs, "segment %d", seg)
+	}
+	require.Len(t, got, len(want))
+
+	// Stopping early and failing.
+	errStop := errors.New("stop")
+	segs = nil
+	err = EachSegmentRecords(dir, func(seg int, records func() ([]byte, bool)) error {
+		segs = append(segs, seg)
+		if len(segs) == 3 {
+			return errStop
+		}
+		_, ok := records()
+		require.True(t, ok)
+		return nil
+	})
+	require.Equal(t, errStop, err)
+	require.Len(t, segs, 3)
+
+	// Corruption ends the iteration after the corrupted segment.
+	fn := SegmentName(dir, first+2)
+	b, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	b[recordHeaderSize+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(fn, b, 0666))
+	segs = nil
+	err = EachSegmentRecords(dir, func(seg int, records func() ([]byte, bool)) error {
+		segs = append(segs, seg)
+		for _, ok := records(); ok; _, ok = records() {
+		}
+		return nil
+	})
+	var cerr *CorruptionErr
+	require.True(t, errors.As(err, &cerr), "unexpected error %v", err)
+	require.Equal(t, first+2, cerr.Segment)
+	require.Equal(t, []int{first, first + 1, first + 2}, segs)
+}
@@ -0,0 +1,105 @@
+package wal
+
+import "sync"
+
+// WithSegmentFinalized makes the WAL call fn with the index and path of every
+// segment it moves on from, e.g. to upload complete segments to object storage
+// without polling the directory. This happens when the active segment is full
+// and on NextSegment and Seal. The segment is synced and closed before fn is
+// called, and never written to again, though syncing it may have failed, which
+// is logged. The segment that's active when the WAL is closed isn't reported,
+// as it may be continued when the WAL is reopened, see OpenAppend.
+//
+// fn is called in order of the segments on a dedicated goroutine, so it may
+// block or call methods of the WAL without stalling or deadlocking the writer.
+// Segments finalized while fn is running are queued, without a limit. Close
+// waits for fn to be called for all finalized segments.
+func WithSegmentFinalized(fn func(segment int, path string)) Option {
+	return func(w *WAL) {
+		w.onFinalized = fn
+	}
+}
+
+// finalizedSegment is a segment queued for the callback set with
+// WithSegmentFinalized.
+type finalizedSegment struct {
+	index int
+	path  string
+}
+
+// segmentNotifier calls the callback set with WithSegmentFinalized.
+type segmentNotifier struct {
+	fn     func(segment int, path string)
+	mtx    sync.Mutex
+	queue  []finalizedSegment
+	closed bool
+	wake   chan struct{} // Signals changes to queue or closed.
+	done   sync.WaitGroup
+}
+
+// startSegmentNotifier starts the goroutine calling w.onFinalized.
+func (w *WAL) startSegmentNotifier() {
+	n := &segmentNotifier{fn: w.onFinalized, wake: make(chan struct{}, 1)}
+	n.done.Add(1)
+	go n.run()
+	w.finalized = n
+}
+
+// notify queues a finalized segment.
+func (n *segmentNotifier) notify(index int, path string) {
+	n.mtx.Lock()
+	n.queue = append(n.queue, finalizedSegment{index: index, path: path})
+	n.mtx.Unlock()
+	n.signal()
+}
+
+// stop makes the notifier exit once the queued segments were reported. It's
+// called with w.mtx held, so it doesn't wait for the callback, which may be
+// waiting for w.mtx. Callers wait after releasing w.mtx instead.
+func (n *segmentNotifier) stop() {
+	if n == nil {
+		return
+	}
+	n.mtx.Lock()
+	n.closed = true
+	n.mtx.Unlock()
+	n.signal()
+}
+
+// wait waits for the notifier to exit if it was stopped.
+func (n *segmentNotifier) wait() {
+	if n == nil {
+		return
+	}
+	n.mtx.Lock()
+	closed := n.closed
+	n.mtx.Unlock()
+	if closed {
+		n.done.Wait()
+	}
+}
+
+func (n *segmentNotifier) signal() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *segmentNotifier) run() {
+	defer n.done.Done()
+
+	for range n.wake {
+		n.mtx.Lock()
+		queue, closed := n.queue, n.closed
+		n.queue = nil
+		n.mtx.Unlock()
+
+		for _, s := range queue {
+			n.fn(s.index, s.path)
+		}
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_SegmentFinalized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_segment_finalized")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	var (
+		mtx       sync.Mutex
+		finalized []int
+		w         *WAL
+	)
+	release := make(chan struct{})
+	w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, WithSegmentFinalized(func(segment int, path string) {
+		// The writer isn't stalled by the callback.
+		<-release
+		// The segment is complete.
+		fi, err := os.Stat(path)
+		if err != nil || fi.Size() != 2*pageSize || path != SegmentName(dir, segment) {
+			t.Errorf("unexpected segment %d at %s: %v", segment, path, err)
+		}
+		// Calling the WAL doesn't deadlock, even while it's closing.
+		w.Size()
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		finalized = append(finalized, segment)
+	}))
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := w.Log(make([]byte, pageSize))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.NextSegment())
+	close(release)
+
+	require.NoError(t, w.Close())
+	require.Equal(t, []int{0, 1, 2, 3}, finalized)
+}
@@ -0,0 +1,116 @@
+package wal
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// segmentIDSize is the size of segment IDs.
+const segmentIDSize = 16
+
+// ErrNoSegmentID is returned by SegmentID for segments without an ID.
+var ErrNoSegmentID = errors.New("segment has no ID")
+
+// ErrSegmentIDNotFound is returned by FindSegmentByID if no segment has the ID.
+var ErrSegmentIDNotFound = errors.New("segment ID not found")
+
+// newSegmentID returns a random ID for a new segment, formatted as a version 4
+// UUID.
+func newSegmentID() ([]byte, error) {
+	id := make([]byte, segmentIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "generate segment ID")
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id, nil
+}
+
+// SegmentID returns the ID of the segment with the given index in dir, which
+// is a random UUID stored in its segment header when it was created by a WAL
+// with WithSegmentIDs. Unlike the index, the ID stays with the segment's
+// contents: it's kept by backups, restores and renames of the segment file,
+// so it can be used for references that must survive re-indexing.
+//
+// Compaction, Transform and checkpoints don't move segments but rewrite their
+// records into new segments, which get new IDs, while the IDs of the segments
+// they replace are retired along with them. ErrNoSegmentID is returned for
+// segments without an ID, such as those written before IDs were enabled.
+func SegmentID(dir string, index int) ([16]byte, error) {
+	var id [16]byte
+	f, ok, err := readSegmentFieldsOf(dir, index)
+	if err != nil {
+		return id, err
+	}
+	if !ok || f.id == nil {
+		return id, ErrNoSegmentID
+	}
+	copy(id[:], f.id)
+	return id, nil
+}
+
+// readSegmentFieldsOf returns the fields of the header of the segment with the
+// given index in dir and whether it has a header.
+func readSegmentFieldsOf(dir string, index int) (segmentFields, bool, error) {
+	file, err := os.Open(segmentFile(dir, index))
+	if err != nil {
+		return segmentFields{}, false, err
+	}
+	defer file.Close()
+
+	r := NewReader(file)
+	hdr := r.buf[:1]
+	if _, err := io.ReadFull(file, hdr); err != nil {
+		if err == io.EOF {
+			return segmentFields{}, false, nil
+		}
+		return segmentFields{}, false, errors.Wrap(err, "read segment header")
+	}
+	if recTypeFromHeader(hdr[0]) != recSegmentHeader {
+		return segmentFields{}, false, nil
+	}
+	v, fields, err := r.readSegmentHeaderRecord()
+	if err != nil {
+		return segmentFields{}, false, errors.Wrapf(err, "segment %d", index)
+	}
+	f, err := decodeSegmentFields(v, fields)
+	if err != nil {
+		return segmentFields{}, false, errors.Wrapf(err, "segment %d", index)
+	}
+	return f, true, nil
+}
+
+// FindSegmentByID returns the index of the segment in dir with the given ID,
+// see SegmentID. It reads the header of every segment, so callers looking up
+// many IDs should build their own mapping instead. ErrSegmentIDNotFound is
+// returned if no segment has the ID, e.g. because it was retired.
+func FindSegmentByID(dir string, id [16]byte) (int, error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range refs {
+		got, err := SegmentID(dir, ref.index)
+		if err == ErrNoSegmentID {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if got == id {
+			return ref.index, nil
+		}
+	}
+	return 0, ErrSegmentIDNotFound
+}
+
+// SegmentID returns the ID of the segment being read, if it has one, see
+// SegmentID.
+func (r *Reader) SegmentID() ([16]byte, bool) {
+	var id [16]byte
+	copy(id[:], r.segmentID)
+	return id, r.segmentID != nil
+}
@@ -0,0 +1,105 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentID(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypt=%t", encrypt), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_segment_id")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			// Segments written before IDs were enabled have none.
+			w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+			require.NoError(t, err)
+			_, err = w.Log([]byte("without ID"))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			_, err = SegmentID(dir, 0)
+			require.Equal(t, ErrNoSegmentID, err)
+
+			opts := []Option{WithSegmentIDs(true)}
+			var ropts []ReaderOption
+			if encrypt {
+				aead := newTestAEAD(t)
+				opts = append(opts, WithEncryption(aead))
+				ropts = append(ropts, WithDecryption(aead))
+			}
+			w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+			require.NoError(t, err)
+			require.Equal(t, formatV3, w.Config().FormatVersion)
+			recs := [][]byte{[]byte("without ID")}
+			for i := 0; i < 5; i++ {
+				rec := make([]byte, pageSize)
+				rec[0] = byte(i)
+				_, err := w.Log(rec)
+				require.NoError(t, err)
+				recs = append(recs, rec)
+			}
+			require.NoError(t, w.Close())
+
+			first, last, err := Segments(dir)
+			require.NoError(t, err)
+			ids := map[[16]byte]int{}
+			for i := first + 1; i <= last; i++ {
+				id, err := SegmentID(dir, i)
+				require.NoError(t, err)
+				require.Equal(t, byte(0x40), id[6]&0xf0, "UUID version")
+				ids[id] = i
+			}
+			require.Len(t, ids, last-first)
+
+			// IDs follow the segments when they are re-indexed.
+			for i := last; i >= first; i-- {
+				require.NoError(t, os.Rename(SegmentName(dir, i), SegmentName(dir, i+10)))
+			}
+			for id, i := range ids {
+				index, err := FindSegmentByID(dir, id)
+				require.NoError(t, err)
+				require.Equal(t, i+10, index)
+			}
+			_, err = FindSegmentByID(dir, [16]byte{1})
+			require.Equal(t, ErrSegmentIDNotFound, err)
+
+			// Readers report the ID of the segment being read.
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(t, err)
+			defer sr.Close()
+			r := NewReader(sr, ropts...)
+			for i := range recs {
+				require.True(t, r.Next(), r.Err())
+				require.Equal(t, recs[i], r.Record())
+				id, ok := r.SegmentID()
+				if i == 0 {
+					require.False(t, ok)
+					continue
+				}
+				require.True(t, ok)
+				require.Contains(t, ids, id)
+			}
+			require.False(t, r.Next())
+			require.NoError(t, r.Err())
+
+			// Rewriting the records retires the old IDs.
+			w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, opts...)
+			require.NoError(t, err)
+			defer w.Close()
+			_, err = w.Transform(func(rec []byte) ([]byte, bool, error) { return rec, true, nil })
+			require.NoError(t, err)
+			for id := range ids {
+				_, err := FindSegmentByID(dir, id)
+				require.Equal(t, ErrSegmentIDNotFound, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SegmentNamer returns the path of the file of segment i relative to the WAL
+// directory, see WithSegmentNamer.
+type SegmentNamer func(i int) string
+
+// WithSegmentNamer sets where the WAL creates segment files, e.g. to spread
+// them over subdirectories with BucketSegmentNamer so that directories don't
+// grow too large to list quickly. By default segments are created in the WAL
+// directory itself, named by SegmentName.
+//
+// The file name of a segment must still be its index as formatted by
+// SegmentName, and the directories it's in must be named by digits only. That
+// way readers, which only know the WAL directory, find the segments of any
+// layout, as does a WAL opened with a different namer, so the namer of an
+// existing WAL can be changed.
+func WithSegmentNamer(namer SegmentNamer) Option {
+	return func(w *WAL) {
+		w.segmentNamer = namer
+	}
+}
+
+// BucketSegmentNamer returns a SegmentNamer placing every n consecutive
+// segments into a subdirectory named after the index of the first of them,
+// e.g. segment 1234 into 00001000/00001234 for n = 1000.
+func BucketSegmentNamer(n int) SegmentNamer {
+	return func(i int) string {
+		return filepath.Join(fmt.Sprintf("%08d", i/n*n), fmt.Sprintf("%08d", i))
+	}
+}
+
+// segmentPath returns the path at which the WAL creates segment i.
+func (w *WAL) segmentPath(i int) string {
+	if w.segmentNamer == nil {
+		return SegmentName(w.Dir(), i)
+	}
+	return filepath.Join(w.Dir(), w.segmentNamer(i))
+}
+
+// createSegment creates segment k at the path set by the WAL's namer.
+func (w *WAL) createSegment(k int) (*Segment, error) {
+	return createSegmentAt(w.Dir(), k, w.segmentPath(k))
+}
+
+// findSegment returns the path of segment i in a subdirectory of dir and
+// whether it exists, see WithSegmentNamer.
+func findSegment(dir string, i int) (string, bool) {
+	refs, err := readSegmentRefs(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, r := range refs {
+		if r.index == i {
+			return filepath.Join(dir, r.name), true
+		}
+	}
+	return "", false
+}
+
+// removeEmptyDir removes the directory of the segment file fn if it's a
+// subdirectory of dir that is empty now.
+func removeEmptyDir(dir, fn string) {
+	if d := filepath.Dir(fn); d != filepath.Clean(dir) {
+		// Fails if it isn't empty.
+		os.Remove(d)
+	}
+}
@@ -0,0 +1,71 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSegmentNamer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_segment_namer")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false, WithSegmentNamer(BucketSegmentNamer(3)))
+	require.NoError(t, err)
+
+	var (
+		recs [][]byte
+		locs []LogLocation
+	)
+	for i := 0; i < 20; i++ {
+		rec := make([]byte, 20000)
+		rec[0] = byte(i)
+		l, err := w.Log(rec)
+		require.NoError(t, err)
+		recs = append(recs, rec)
+		locs = append(locs, l...)
+	}
+	last := w.LastSegment()
+	require.Greater(t, last, 5)
+	for i := 0; i <= last; i++ {
+		require.FileExists(t, filepath.Join(dir, fmt.Sprintf("%08d", i/3*3), fmt.Sprintf("%08d", i)))
+	}
+	first, l, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, last}, []int{first, l})
+	require.Equal(t, recs, readAll(t, dir))
+	rec, err := w.ReadAt(locs[len(locs)-1])
+	require.NoError(t, err)
+	require.Equal(t, recs[len(recs)-1], rec)
+
+	// Buckets are removed once they're empty.
+	require.NoError(t, w.Truncate(4))
+	_, err = os.Stat(filepath.Join(dir, "00000000"))
+	require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+	require.DirExists(t, filepath.Join(dir, "00000003"))
+	require.NoError(t, w.Close())
+
+	// The layout of an existing WAL can be changed.
+	w, err = NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	l2, err := w.Log([]byte("flat"))
+	require.NoError(t, err)
+	require.FileExists(t, SegmentName(dir, l2[0].Segment))
+	require.NoError(t, w.Close())
+
+	var want [][]byte
+	for i, loc := range locs {
+		if loc.Segment >= 4 {
+			want = append(want, recs[i])
+		}
+	}
+	require.Equal(t, append(want, []byte("flat")), readAll(t, dir))
+}
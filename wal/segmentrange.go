@@ -0,0 +1,40 @@
+package wal
+
+import "github.com/pkg/errors"
+
+// FirstSegment returns the index of the oldest segment of the WAL, which is
+// the active one if all others were truncated.
+func (w *WAL) FirstSegment() (int, error) {
+	first, _, err := Segments(w.Dir())
+	return first, err
+}
+
+// LastSegment returns the index of the active segment, the newest one of the
+// WAL, which Log writes to. Segments from FirstSegment up to it are valid
+// arguments of Truncate. It's -1 for a WAL without an active segment, as
+// returned by Open.
+func (w *WAL) LastSegment() int {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	if w.segment == nil {
+		return -1
+	}
+	return w.segment.Index()
+}
+
+// Segments returns the indices of the segments present in the WAL's
+// directory in ascending order, including the active one. Unlike opening the
+// WAL, it doesn't fail on gaps between segments, which show as missing
+// indices, see DetectGaps.
+func (w *WAL) Segments() ([]int, error) {
+	refs, err := readSegmentRefs(w.Dir())
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	indices := make([]int, len(refs))
+	for i, r := range refs {
+		indices[i] = r.index
+	}
+	return indices, nil
+}
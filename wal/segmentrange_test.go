@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_TruncateSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_truncate_segments")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := w.Log(make([]byte, pageSize))
+		require.NoError(t, err)
+	}
+	first, err := w.FirstSegment()
+	require.NoError(t, err)
+	require.Equal(t, 0, first)
+	last := w.LastSegment()
+	require.Equal(t, w.segment.Index(), last)
+	require.Greater(t, last, 2)
+
+	// The active segment can't be dropped.
+	require.Error(t, w.Truncate(last+1))
+	first, err = w.FirstSegment()
+	require.NoError(t, err)
+	require.Equal(t, 0, first)
+
+	// Truncating concurrently with Log.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := w.Log(make([]byte, 100)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	require.NoError(t, w.Truncate(2))
+	wg.Wait()
+
+	first, err = w.FirstSegment()
+	require.NoError(t, err)
+	require.Equal(t, 2, first)
+	require.Len(t, readAll(t, dir), 3+20)
+
+	require.NoError(t, w.Truncate(w.LastSegment()))
+	first, err = w.FirstSegment()
+	require.NoError(t, err)
+	require.Equal(t, w.LastSegment(), first)
+}
+
+func TestWAL_Segments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_segments")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	segs, err := w.Segments()
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, segs)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, w.NextSegment())
+	}
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 4}, segs)
+
+	// Gaps are reported as missing indices.
+	require.NoError(t, os.Remove(SegmentName(dir, 2)))
+	segs, err = w.Segments()
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 3, 4}, segs)
+}
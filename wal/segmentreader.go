@@ -0,0 +1,29 @@
+package wal
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// NewSegmentReader returns a reader over the records of the segment with the
+// given index in dir only, e.g. to replay a segment that was just archived.
+// Records are located like Log returned them, see CurrentLocation, with
+// offsets relative to the start of the segment. If the segment doesn't exist,
+// an error wrapping ErrLocationGone is returned. The reader must be closed to
+// release the segment. The options configure the reader, e.g. WithDecryption
+// for an encrypted WAL.
+func NewSegmentReader(dir string, segment int, opts ...ReaderOption) (*Reader, error) {
+	s, err := openReadSegmentIn(dir, segmentFile(dir, segment))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrLocationGone, "segment %d not found", segment)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "open segment %d", segment)
+	}
+	sr := NewSegmentBufReader(zerolog.Nop(), s)
+	r := NewReader(sr, opts...)
+	r.closer = sr
+	return r, nil
+}
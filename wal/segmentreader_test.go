@@ -0,0 +1,51 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSegmentReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_segment_reader")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	recs := [][]byte{[]byte("a"), make([]byte, pageSize), []byte("b"), []byte("c"), make([]byte, pageSize), []byte("d")}
+	var locs []LogLocation
+	for i, rec := range recs {
+		if i > 0 && i%2 == 0 {
+			require.NoError(t, w.NextSegment())
+		}
+		l, err := w.Log(rec)
+		require.NoError(t, err)
+		locs = append(locs, l...)
+	}
+	require.NoError(t, w.Close())
+	require.Equal(t, []int{0, 0, 1, 1, 2, 2}, segmentsOf(locs))
+
+	for segment := 0; segment <= 2; segment++ {
+		r, err := NewSegmentReader(dir, segment)
+		require.NoError(t, err)
+		var got [][]byte
+		for r.Next() {
+			loc := r.CurrentLocation()
+			require.Equal(t, locs[2*segment+len(got)], loc)
+			got = append(got, append([]byte{}, r.Record()...))
+		}
+		require.NoError(t, r.Err())
+		require.NoError(t, r.Close())
+		require.Equal(t, recs[2*segment:2*segment+2], got)
+	}
+
+	_, err = NewSegmentReader(dir, 4)
+	require.True(t, errors.Is(err, ErrLocationGone), "%v", err)
+}
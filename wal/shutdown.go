@@ -0,0 +1,59 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// cleanShutdownFile is the name of the file marking a WAL directory as closed
+// cleanly. It's empty.
+const cleanShutdownFile = "CLEAN_SHUTDOWN"
+
+// WasCleanShutdown returns whether the WAL in dir was closed cleanly the last
+// time it was written to, i.e. with Close or Finalize after all writes were
+// synced. Otherwise the process writing it likely crashed, and callers may
+// want to check the WAL with Verify and repair it before writing to it.
+// Directories without segments count as closed cleanly, as there's nothing to
+// recover.
+//
+// Close and Finalize atomically write a marker file, which opening the WAL
+// removes again, so WasCleanShutdown must be called before opening the WAL.
+// The marker is only written if syncing and closing the active segment
+// succeeded.
+func WasCleanShutdown(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, cleanShutdownFile))
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "stat clean shutdown marker")
+	}
+	refs, err := readSegmentRefs(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(refs) == 0, nil
+}
+
+// markCleanShutdown atomically writes the clean shutdown marker to dir.
+func markCleanShutdown(dir string) error {
+	return errors.Wrap(writeFileAtomic(dir, cleanShutdownFile, nil), "write clean shutdown marker")
+}
+
+// clearCleanShutdown removes the clean shutdown marker from dir, if any, and
+// syncs the removal before the WAL is written to.
+func clearCleanShutdown(dir string) error {
+	err := os.Remove(filepath.Join(dir, cleanShutdownFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "remove clean shutdown marker")
+	}
+	return errors.Wrap(syncDir(dir), "sync removal of clean shutdown marker")
+}
@@ -0,0 +1,56 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWasCleanShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_clean_shutdown")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	requireClean := func(want bool) {
+		t.Helper()
+		clean, err := WasCleanShutdown(dir)
+		require.NoError(t, err)
+		require.Equal(t, want, clean)
+	}
+
+	// There's nothing to recover without segments.
+	clean, err := WasCleanShutdown(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	require.True(t, clean)
+	requireClean(true)
+
+	// An open WAL looks crashed.
+	w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false)
+	require.NoError(t, err)
+	_, err = w.Log([]byte("record"))
+	require.NoError(t, err)
+	requireClean(false)
+	require.NoError(t, w.Close())
+	requireClean(true)
+
+	// Opening clears the marker.
+	w, err = NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false)
+	require.NoError(t, err)
+	requireClean(false)
+	require.NoError(t, w.Finalize(true))
+	requireClean(true)
+
+	// Without a marker, e.g. after a crash, the WAL isn't clean until it's
+	// closed again.
+	require.NoError(t, os.Remove(filepath.Join(dir, cleanShutdownFile)))
+	requireClean(false)
+	w, err = NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	requireClean(true)
+}
@@ -0,0 +1,45 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Size returns the total size of the WAL's segment files in bytes, e.g. to
+// decide when to checkpoint and truncate the WAL to stay within a disk budget.
+// It's tracked as records are written and segments are truncated, repaired or
+// compacted, so it doesn't stat the files, except for a WAL returned by Open,
+// which doesn't write. The page being filled is only included once it's
+// flushed, which Log does before returning.
+func (w *WAL) Size() (int64, error) {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	if w.segment == nil {
+		return segmentsSize(w.Dir())
+	}
+	return w.size, nil
+}
+
+// SegmentSizes returns the size of each segment file in bytes by index, as
+// determined from the files for diagnostics. Segments failing to be listed or
+// to be stated are left out, and the failure is logged.
+func (w *WAL) SegmentSizes() map[int]int64 {
+	refs, err := readSegmentRefs(w.Dir())
+	if err != nil {
+		w.logger.Error().Err(err).Msg("list segments")
+		return nil
+	}
+	sizes := make(map[int]int64, len(refs))
+	for _, r := range refs {
+		fi, err := os.Stat(filepath.Join(w.Dir(), r.name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				w.logger.Error().Err(err).Int("segment", r.index).Msg("stat segment")
+			}
+			continue
+		}
+		sizes[r.index] = fi.Size()
+	}
+	return sizes
+}
@@ -0,0 +1,53 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_Size(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_size")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+
+	total := func(sizes map[int]int64) (n int64) {
+		for _, s := range sizes {
+			n += s
+		}
+		return n
+	}
+	for i := 0; i < 20; i++ {
+		_, err := w.Log(make([]byte, 10000))
+		require.NoError(t, err)
+
+		size, err := w.Size()
+		require.NoError(t, err)
+		require.Equal(t, total(w.SegmentSizes()), size)
+	}
+	sizes := w.SegmentSizes()
+	require.Len(t, sizes, w.LastSegment()+1)
+
+	require.NoError(t, w.Truncate(2))
+	size, err := w.Size()
+	require.NoError(t, err)
+	require.Equal(t, total(sizes)-sizes[0]-sizes[1], size)
+	require.Equal(t, total(w.SegmentSizes()), size)
+	require.NoError(t, w.Close())
+
+	// Sizes of a WAL that doesn't write are determined from the files.
+	sizes = w.SegmentSizes()
+	w, err = Open(zerolog.Nop(), dir)
+	require.NoError(t, err)
+	size, err = w.Size()
+	require.NoError(t, err)
+	require.Equal(t, total(sizes), size)
+}
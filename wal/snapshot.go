@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotSegment is a segment captured by Checkpoint along with the number of
+// bytes to copy.
+type snapshotSegment struct {
+	index int
+	f     *os.File
+	size  int64
+}
+
+// Checkpoint copies the segments of w up to and including that of upTo into
+// destDir, ending the copy at upTo, so that it holds the records logged before
+// upTo as a point-in-time snapshot, e.g. for archiving it before truncating
+// the WAL. The last segment is cut at upTo and its last page padded with
+// zeros, as if the WAL had been closed at upTo. destDir is created if it
+// doesn't exist and must be empty otherwise. The copies are synced before
+// Checkpoint returns.
+//
+// upTo must point to the start of a record as returned by Log, not to one of
+// the records packed after it, or to the end of the log, otherwise an error
+// wrapping ErrNoRecordAt is returned. If its segment was removed, an error
+// wrapping ErrLocationGone is returned. The segments are captured while no
+// records are being written, and copied while w remains writable.
+func Checkpoint(w *WAL, destDir string, upTo LogLocation) error {
+	if upTo.Sub > 0 {
+		return errors.Wrapf(ErrNoRecordAt, "can't cut segment %d between packed records at %+v", upTo.Segment, upTo)
+	}
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	existing, err := ioutil.ReadDir(destDir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return errors.Errorf("checkpoint into non-empty dir %s", destDir)
+	}
+
+	segs, err := w.captureSnapshot(upTo)
+	defer func() {
+		for _, s := range segs {
+			s.f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if err := copySnapshotSegment(destDir, s); err != nil {
+			return errors.Wrapf(err, "copy segment %d", s.index)
+		}
+	}
+	return syncDir(destDir)
+}
+
+// captureSnapshot opens the segments to copy for Checkpoint.
+func (w *WAL) captureSnapshot(upTo LogLocation) (segs []snapshotSegment, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	if upTo.Segment < 0 || upTo.Offset < 0 {
+		return nil, errors.Wrapf(ErrNoRecordAt, "invalid location %+v", upTo)
+	}
+	if err := checkResumeLocation(w.Dir(), upTo); err != nil {
+		return nil, err
+	}
+	refs, err := listSegments(w.Dir())
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	for _, r := range refs {
+		if r.index > upTo.Segment {
+			break
+		}
+		f, err := os.Open(segmentFile(w.Dir(), r.index))
+		if err != nil {
+			return segs, errors.Wrapf(err, "open segment %d", r.index)
+		}
+		segs = append(segs, snapshotSegment{index: r.index, f: f, size: int64(upTo.Offset)})
+		if r.index == upTo.Segment {
+			break
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return segs, errors.Wrapf(err, "stat segment %d", r.index)
+		}
+		segs[len(segs)-1].size = fi.Size()
+	}
+	return segs, nil
+}
+
+// copySnapshotSegment copies the captured bytes of s into a new segment in dir,
+// pads its last page with zeros and syncs it.
+func copySnapshotSegment(dir string, s snapshotSegment) error {
+	out, err := os.OpenFile(SegmentName(dir, s.index), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.NewSectionReader(s.f, 0, s.size))
+	if err == nil && n < s.size {
+		err = errors.Errorf("segment shrank below %d bytes", s.size)
+	}
+	if err == nil && n%pageSize != 0 {
+		_, err = out.Write(make([]byte, pageSize-n%pageSize))
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
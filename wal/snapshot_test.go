@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_checkpoint_snapshot")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 2*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	var (
+		recs [][]byte
+		locs []LogLocation
+	)
+	for i := 0; i < 20; i++ {
+		rec := make([]byte, i*1000+1)
+		rec[0] = byte(i)
+		l, err := w.Log(rec)
+		require.NoError(t, err)
+		recs = append(recs, rec)
+		locs = append(locs, l...)
+	}
+	require.NotEqual(t, locs[0].Segment, locs[15].Segment)
+
+	for _, cut := range []int{0, 9, 15} {
+		dest := filepath.Join(dir, "snapshot", string(rune('a'+cut)))
+		require.NoError(t, Checkpoint(w, dest, locs[cut]))
+		require.Equal(t, recs[:cut], readAllOrEmpty(t, dest))
+
+		// The WAL remains writable.
+		_, err := w.Log([]byte("more"))
+		require.NoError(t, err)
+
+		// The snapshot is a complete WAL.
+		_, last, err := Segments(dest)
+		require.NoError(t, err)
+		require.Equal(t, locs[cut].Segment, last)
+		for i := 0; i <= last; i++ {
+			fi, err := os.Stat(SegmentName(dest, i))
+			require.NoError(t, err)
+			require.Zero(t, fi.Size()%pageSize)
+		}
+		sw, err := NewSize(zerolog.Nop(), nil, dest, 2*pageSize, false)
+		require.NoError(t, err)
+		_, err = sw.Log([]byte("snapshot"))
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		require.Equal(t, append(recs[:cut:cut], []byte("snapshot")), readAll(t, dest))
+	}
+
+	err = Checkpoint(w, filepath.Join(dir, "snapshot", "a"), locs[1])
+	require.EqualError(t, err, "checkpoint into non-empty dir "+filepath.Join(dir, "snapshot", "a"))
+	for _, loc := range []LogLocation{
+		{Segment: locs[3].Segment, Offset: locs[3].Offset + 1},
+		{Segment: locs[3].Segment, Offset: locs[3].Offset, Sub: 1},
+	} {
+		err := Checkpoint(w, filepath.Join(dir, "snapshot", "invalid"), loc)
+		require.True(t, errors.Is(err, ErrNoRecordAt), "location %+v: %v", loc, err)
+	}
+	require.NoError(t, w.Close())
+	require.Equal(t, ErrWALClosed, Checkpoint(w, filepath.Join(dir, "snapshot", "closed"), locs[1]))
+}
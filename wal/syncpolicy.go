@@ -0,0 +1,150 @@
+package wal
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SyncPolicy determines when the active segment is synced to durable storage,
+// see WithSyncPolicy.
+type SyncPolicy struct {
+	never    bool
+	interval time.Duration
+}
+
+var (
+	// SyncOnLog syncs the active segment at the end of every Log call, so
+	// records are durable once Log returns. If the sync fails, Log returns
+	// its error, and the records written may be lost on a crash. It's the
+	// zero SyncPolicy.
+	SyncOnLog = SyncPolicy{}
+	// SyncNever leaves syncing to explicit calls of Sync and to the operating
+	// system. Segments are still synced when the WAL moves on from them and
+	// when it's closed.
+	SyncNever = SyncPolicy{never: true}
+)
+
+// SyncInterval syncs the active segment every d on a background goroutine, if
+// anything was written since the last sync. Records logged in between may be
+// lost on a crash. A d <= 0 is SyncOnLog.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncOnLog
+	}
+	return SyncPolicy{never: true, interval: d}
+}
+
+// onLog returns whether Log syncs the active segment.
+func (p SyncPolicy) onLog() bool {
+	return !p.never
+}
+
+// WithSyncPolicy sets when the active segment is synced, trading durability
+// for the latency and throughput of Log. Only synced records are delivered by
+// Consume and read by ReadAt, so with policies other than SyncOnLog they only
+// see records once a sync covered them. The default is SyncOnLog.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(w *WAL) {
+		w.syncPolicy = p
+	}
+}
+
+// Sync writes the records buffered in the active page to the active segment
+// and syncs it, so all records logged before are on durable storage when it
+// returns. Segments the WAL moved on from are synced in the background, see
+// NextSegment, so only the active one is synced.
+func (w *WAL) Sync() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	return w.flushAndSync()
+}
+
+// flushAndSync does the work of Sync. It must be called with w.mtx held.
+func (w *WAL) flushAndSync() error {
+	if w.page.alloc > w.page.flushed {
+		if err := w.flushPage(false); err != nil {
+			return errors.Wrap(err, "flush page")
+		}
+	}
+	return w.sync()
+}
+
+// sync syncs the active segment and advances w.synced to its end. It must be
+// called with w.mtx held.
+func (w *WAL) sync() error {
+	if err := w.fsync(w.segment); err != nil {
+		return errors.Wrap(err, "sync active segment")
+	}
+	w.synced = w.writeEnd()
+	w.broadcast()
+	return nil
+}
+
+// writeEnd returns the end of the data written to the active segment. It must
+// be called with w.mtx held.
+func (w *WAL) writeEnd() LogLocation {
+	return LogLocation{
+		Segment: w.segment.Index(),
+		Offset:  w.donePages*w.pageSize + w.page.flushed,
+	}
+}
+
+// syncIfWritten syncs the active segment like Sync if anything was written
+// since the last sync.
+func (w *WAL) syncIfWritten() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	if w.page.alloc == w.page.flushed && w.writeEnd() == w.synced {
+		return nil
+	}
+	return w.flushAndSync()
+}
+
+// startSyncLoop starts the goroutine syncing the active segment for
+// SyncInterval.
+func (w *WAL) startSyncLoop() {
+	w.syncStop = make(chan struct{})
+	w.syncLoop.Add(1)
+	go w.runSyncLoop(w.syncPolicy.interval, w.syncStop)
+}
+
+// runSyncLoop syncs the active segment every d until stop is closed.
+func (w *WAL) runSyncLoop(d time.Duration, stop chan struct{}) {
+	defer w.syncLoop.Done()
+
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if err := w.syncIfWritten(); err == ErrWALClosed {
+			return
+		} else if err != nil {
+			w.logger.Error().Err(err).Msg("periodic sync")
+		}
+	}
+}
+
+// stopSyncLoop tells the sync loop, if any, to stop once the WAL is closed.
+// It must be called with w.mtx held, so it can't wait for the loop, which
+// may be waiting for w.mtx. Callers wait for w.syncLoop after
+// releasing w.mtx instead.
+func (w *WAL) stopSyncLoop() {
+	if w.syncStop == nil {
+		return
+	}
+	close(w.syncStop)
+	w.syncStop = nil
+}
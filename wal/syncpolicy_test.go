@@ -0,0 +1,139 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fsyncCount returns the number of fsyncs recorded in reg.
+func fsyncCount(t *testing.T, reg *prometheus.Registry) uint64 {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "prometheus_tsdb_wal_fsync_duration_seconds" {
+			return mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestWithSyncPolicy(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy SyncPolicy
+		onLog  bool
+	}{
+		"on_log":        {SyncOnLog, true},
+		"never":         {SyncNever, false},
+		"interval":      {SyncInterval(time.Hour), false},
+		"zero_interval": {SyncInterval(0), true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_sync_policy")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			reg := prometheus.NewRegistry()
+			w, err := NewSize(zerolog.Nop(), reg, dir, 4*pageSize, false, WithSyncPolicy(tc.policy))
+			require.NoError(t, err)
+
+			n := fsyncCount(t, reg)
+			locs, err := w.Log([]byte("a"), []byte("b"))
+			require.NoError(t, err)
+			if tc.onLog {
+				n++
+				require.Equal(t, n, fsyncCount(t, reg))
+				require.Equal(t, locs[1].Segment, w.synced.Segment)
+				require.Greater(t, w.synced.Offset, locs[1].Offset)
+			} else {
+				require.Equal(t, n, fsyncCount(t, reg))
+				require.Equal(t, LogLocation{Segment: locs[0].Segment}, w.synced)
+			}
+
+			// Sync always syncs and makes the records visible to ReadAt.
+			require.NoError(t, w.Sync())
+			require.Equal(t, n+1, fsyncCount(t, reg))
+			rec, err := w.ReadAt(locs[1])
+			require.NoError(t, err)
+			require.Equal(t, []byte("b"), rec)
+
+			require.NoError(t, w.Close())
+			require.Equal(t, ErrWALClosed, w.Sync())
+			require.Len(t, readAll(t, dir), 2)
+		})
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_sync_interval")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	reg := prometheus.NewRegistry()
+	w, err := NewSize(zerolog.Nop(), reg, dir, 4*pageSize, false, WithSyncPolicy(SyncInterval(10*time.Millisecond)))
+	require.NoError(t, err)
+
+	synced := func() LogLocation {
+		w.mtx.RLock()
+		defer w.mtx.RUnlock()
+		return w.synced
+	}
+	locs, err := w.Log(make([]byte, 3*pageSize))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		s := synced()
+		return s.Segment == locs[0].Segment && s.Offset > 3*pageSize
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Nothing is synced while nothing is written.
+	n := fsyncCount(t, reg)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, n, fsyncCount(t, reg))
+
+	// Close stops the loop while it may be waiting to sync.
+	_, err = w.Log([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Nil(t, w.syncStop)
+	require.Len(t, readAll(t, dir), 2)
+
+	w, err = NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithSyncPolicy(SyncInterval(time.Millisecond)))
+	require.NoError(t, err)
+	require.NoError(t, w.Finalize(false))
+	require.Nil(t, w.syncStop)
+}
+
+func TestSyncOnLogFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_sync_fail")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.Log([]byte{1})
+	require.NoError(t, err)
+
+	// Records aren't durable if the sync fails, so Log fails.
+	errSync := errors.New("sync failed")
+	w.syncHook = func(*os.File) error { return errSync }
+	_, err = w.Log([]byte{2})
+	require.Equal(t, errSync, errors.Cause(err))
+
+	w.syncHook = nil
+	_, err = w.Log([]byte{3})
+	require.NoError(t, err)
+}
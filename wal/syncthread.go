@@ -0,0 +1,58 @@
+package wal
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/onflow/wal/fileutil"
+)
+
+// syncRequest asks the sync thread to sync a file and report the result.
+type syncRequest struct {
+	f    *os.File
+	errc chan error
+}
+
+// startSyncThread starts the goroutine syncing segments for WithLockedSyncThread.
+func (w *WAL) startSyncThread() {
+	w.syncc = make(chan syncRequest)
+	w.syncDone = make(chan struct{})
+	go w.runSyncThread()
+}
+
+// runSyncThread syncs files on a goroutine locked to its OS thread until
+// w.syncc is closed.
+func (w *WAL) runSyncThread() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(w.syncDone)
+
+	for req := range w.syncc {
+		req.errc <- fileutil.Fdatasync(req.f)
+	}
+}
+
+// stopSyncThread stops the sync thread, if any, once the WAL is closed. Later
+// syncs run on the calling goroutine.
+func (w *WAL) stopSyncThread() {
+	if w.syncc == nil {
+		return
+	}
+	close(w.syncc)
+	<-w.syncDone
+	w.syncc = nil
+}
+
+// fdatasync syncs f on the sync thread if there is one, see
+// WithLockedSyncThread.
+func (w *WAL) fdatasync(f *os.File) error {
+	if w.syncHook != nil {
+		return w.syncHook(f)
+	}
+	if w.syncc == nil {
+		return fileutil.Fdatasync(f)
+	}
+	errc := make(chan error, 1)
+	w.syncc <- syncRequest{f: f, errc: errc}
+	return <-errc
+}
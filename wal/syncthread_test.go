@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithLockedSyncThread(t *testing.T) {
+	for _, finalize := range []bool{false, true} {
+		t.Run(fmt.Sprintf("finalize=%t", finalize), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_sync_thread")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithLockedSyncThread(true))
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						if _, err := w.Log(make([]byte, 1000*j), []byte{byte(i)}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			require.Greater(t, w.synced.Segment, 0)
+
+			// Closing stops the sync thread, see TestMain.
+			if finalize {
+				require.NoError(t, w.Finalize(false))
+			} else {
+				require.NoError(t, w.Close())
+			}
+			require.Nil(t, w.syncc)
+			require.Len(t, readAll(t, dir), 4*50*2)
+		})
+	}
+}
+
+// BenchmarkWAL_LogLockedSyncThread reports the p99 latency of Log under
+// concurrency with and without WithLockedSyncThread.
+func BenchmarkWAL_LogLockedSyncThread(b *testing.B) {
+	rec := make([]byte, 256)
+	for _, locked := range []bool{false, true} {
+		b.Run(fmt.Sprintf("locked=%t", locked), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench_sync_thread")
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, os.RemoveAll(dir))
+			}()
+			w, err := NewSize(zerolog.Nop(), nil, dir, DefaultSegmentSize, false, WithLockedSyncThread(locked))
+			require.NoError(b, err)
+			defer w.Close()
+
+			var (
+				mtx       sync.Mutex
+				latencies []time.Duration
+			)
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var lat []time.Duration
+				for pb.Next() {
+					start := time.Now()
+					if _, err := w.Log(rec); err != nil {
+						b.Error(err)
+						return
+					}
+					lat = append(lat, time.Since(start))
+				}
+				mtx.Lock()
+				latencies = append(latencies, lat...)
+				mtx.Unlock()
+			})
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			if len(latencies) > 0 {
+				b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+			}
+		})
+	}
+}
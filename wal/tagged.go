@@ -0,0 +1,23 @@
+package wal
+
+// LogTagged writes recs into the log like Log and tags each of them with tag,
+// which readers get from Reader.RecordTag, e.g. to tell apart several logical
+// streams multiplexed into one WAL without decoding the payloads. The tag is
+// stored in the header of each record's first fragment, apart from the
+// payload. Records written with Log have tag 0, so tag 0 is written like Log
+// does, without the extra header byte.
+//
+// Tagged records aren't packed, see WithPackedRecords.
+func (w *WAL) LogTagged(tag uint8, recs ...[]byte) ([]LogLocation, error) {
+	if tag == 0 {
+		return w.Log(recs...)
+	}
+	ext := recordExt{flags: extTag, tag: tag}
+	return w.logRecords(recs, ext.encode(nil), 0)
+}
+
+// RecordTag returns the tag the current record was logged with using
+// LogTagged. It is 0 for other records.
+func (r *Reader) RecordTag() uint8 {
+	return r.ext.tag
+}
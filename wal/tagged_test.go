@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogTagged(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"default": nil,
+		"packed":  {WithPackedRecords(1000)},
+		"epochs":  {WithEpochs(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_tagged")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, true, opts...)
+			require.NoError(t, err)
+			defer w.Close()
+
+			var (
+				recs [][]byte
+				tags []uint8
+			)
+			for i := 0; i < 20; i++ {
+				// Mix untagged and tagged batches of small and multi-page records.
+				batch := [][]byte{[]byte(fmt.Sprintf("rec %d", i)), make([]byte, i*pageSize/5)}
+				tag := uint8(i % 4 * 80)
+				if i%5 == 0 {
+					_, err = w.Log(batch...)
+					tag = 0
+				} else {
+					_, err = w.LogTagged(tag, batch...)
+				}
+				require.NoError(t, err)
+				recs = append(recs, batch...)
+				tags = append(tags, tag, tag)
+			}
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			require.NoError(t, err)
+			defer sr.Close()
+			r := NewReader(sr)
+			for i := range recs {
+				require.True(t, r.Next(), "expected record: %v", r.Err())
+				require.Equal(t, recs[i], r.Record())
+				require.Equal(t, tags[i], r.RecordTag(), "record %d", i)
+			}
+			require.False(t, r.Next())
+			require.NoError(t, r.Err())
+		})
+	}
+}
+
+func TestRecordExt_Tag(t *testing.T) {
+	for _, e := range []recordExt{
+		{flags: extTag, tag: 7},
+		{flags: extVersion | extEpoch | extTag, version: 3, epoch: 1 << 40, tag: 255},
+	} {
+		b := e.encode(nil)
+		got, n, err := decodeRecordExt(b)
+		require.NoError(t, err)
+		require.Equal(t, len(b), n)
+		require.Equal(t, e, got)
+
+		_, _, err = decodeRecordExt(b[:len(b)-1])
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,151 @@
+package wal
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TailRecords returns the last n records of the log in the order they were
+// logged, or all of them if there are fewer, without reading the log from its
+// start. Records logged while it runs may or may not be included.
+//
+// Segments are read from the last one backwards and each segment page by page
+// from its end. Since records are framed forwards, the fragment headers of a
+// page are scanned for the first record starting in it, and the records
+// starting in the page are then read forwards from there, following records
+// that span into later pages up to their last fragment. Pages holding only
+// middle or last fragments of a record are skipped until the page it starts
+// in is reached. Only the pages holding the returned records are verified, so
+// corruption further back in the log goes undetected.
+func (w *WAL) TailRecords(n int) ([][]byte, error) {
+	if n < 0 {
+		return nil, errors.Errorf("invalid number of records %d", n)
+	}
+	w.mtx.RLock()
+	if w.closed {
+		w.mtx.RUnlock()
+		return nil, ErrWALClosed
+	}
+	end := LogLocation{Segment: w.segment.Index(), Offset: w.donePages*w.pageSize + w.page.flushed}
+	w.mtx.RUnlock()
+
+	return tailRecords(w.Dir(), n, end, w.readerOptions())
+}
+
+// tailRecords returns the last n records of the segments in dir ending at end,
+// see TailRecords.
+func tailRecords(dir string, n int, end LogLocation, opts []ReaderOption) ([][]byte, error) {
+	if n == 0 {
+		return [][]byte{}, nil
+	}
+	refs, err := listSegments(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	var recs [][]byte
+	for i := len(refs) - 1; i >= 0 && len(recs) < n; i-- {
+		if refs[i].index > end.Segment {
+			continue
+		}
+		limit := int64(-1)
+		if refs[i].index == end.Segment {
+			limit = int64(end.Offset)
+		}
+		segRecs, err := tailSegment(dir, refs[i].index, n-len(recs), limit, opts)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(segRecs, recs...)
+	}
+	if recs == nil {
+		recs = [][]byte{}
+	}
+	return recs, nil
+}
+
+// tailSegment returns the last n records of the segment with the given index
+// in dir, reading it up to limit bytes, or the whole segment if limit < 0.
+func tailSegment(dir string, index, n int, limit int64, opts []ReaderOption) ([][]byte, error) {
+	f, err := os.Open(segmentFile(dir, index))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open segment %d", index)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat segment %d", index)
+	}
+	size := fi.Size()
+	if limit >= 0 && limit < size {
+		size = limit
+	}
+	ps, err := segmentPageSize(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read segment %d", index)
+	}
+	page := make([]byte, ps)
+
+	var recs [][]byte
+	for start := (size - 1) / int64(ps) * int64(ps); start >= 0 && len(recs) < n; start -= int64(ps) {
+		k, err := f.ReadAt(page[:min(ps, int(size-start))], start)
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "read segment %d", index)
+		}
+		off, ok := firstRecordStart(page[:k])
+		if !ok {
+			continue
+		}
+		pageRecs, err := readPageRecords(dir, index, f, start+int64(off), start+int64(ps), size, opts)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(pageRecs, recs...)
+	}
+	if len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	return recs, nil
+}
+
+// firstRecordStart returns the offset of the first full or first fragment in
+// page, found by following the fragment headers from the start of the page.
+func firstRecordStart(page []byte) (int, bool) {
+	for off := 0; off+recordHeaderSize <= len(page); {
+		switch recTypeFromHeader(page[off]) {
+		case recPageTerm:
+			return 0, false
+		case recFull, recFirst:
+			return off, true
+		}
+		off += recordHeaderSize + int(binary.BigEndian.Uint16(page[off+1:]))
+	}
+	return 0, false
+}
+
+// readPageRecords returns the records of the segment f starting between from
+// and pageEnd, reading no further than size.
+func readPageRecords(dir string, index int, f *os.File, from, pageEnd, size int64, opts []ReaderOption) ([][]byte, error) {
+	r := NewReader(io.NewSectionReader(f, from, size-from), append(opts, WithReadUntil(LogLocation{Offset: int(pageEnd)}))...)
+	defer r.Close()
+	r.total = from
+	if err := r.readSegmentHeaderAt(f); err != nil {
+		return nil, errors.Wrapf(err, "read segment %d", index)
+	}
+	var recs [][]byte
+	for r.Next() {
+		recs = append(recs, append([]byte{}, r.Record()...))
+	}
+	if err := r.Err(); err != nil {
+		var cerr *CorruptionErr
+		if errors.As(err, &cerr) {
+			// The reader doesn't know the segment it reads.
+			cerr.Dir, cerr.Segment = dir, index
+		}
+		return nil, err
+	}
+	return recs, nil
+}
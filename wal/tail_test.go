@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_TailRecords(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"default":    nil,
+		"page_size":  {WithPageSize(1024)},
+		"packed":     {WithPackedRecords(64)},
+		"compressed": {WithCompression(CompressionSnappy)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_tail_records")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, opts...)
+			require.NoError(t, err)
+			defer w.Close()
+
+			recs, err := w.TailRecords(3)
+			require.NoError(t, err)
+			require.Empty(t, recs)
+
+			// Small records sharing pages and records spanning up to three
+			// pages, spread over several segments.
+			var logged [][]byte
+			for i := 0; i < 60; i++ {
+				size := 1 + rand.Intn(50)
+				if i%7 == 0 {
+					size = rand.Intn(2*pageSize + 100)
+				}
+				batch := make([][]byte, 1+rand.Intn(3))
+				for j := range batch {
+					batch[j] = make([]byte, size)
+					rand.Read(batch[j])
+				}
+				_, err := w.Log(batch...)
+				require.NoError(t, err)
+				logged = append(logged, batch...)
+			}
+			_, last, err := Segments(dir)
+			require.NoError(t, err)
+			require.Greater(t, last, 1)
+
+			for _, n := range []int{0, 1, 2, 5, 17, 40, len(logged) - 1, len(logged), len(logged) + 10} {
+				recs, err := w.TailRecords(n)
+				require.NoError(t, err)
+				want := logged
+				if n < len(want) {
+					want = want[len(want)-n:]
+				}
+				require.Equal(t, len(want), len(recs), "n=%d", n)
+				for i := range want {
+					require.Equal(t, want[i], recs[i], "n=%d, record %d", n, i)
+				}
+			}
+
+			_, err = w.TailRecords(-1)
+			require.Error(t, err)
+			require.NoError(t, w.Close())
+			_, err = w.TailRecords(1)
+			require.Equal(t, ErrWALClosed, err)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// tmpfsDir is the directory of the memory backed file system in which
+// NewTmpfs places WALs if it exists.
+const tmpfsDir = "/dev/shm"
+
+// NewTmpfs returns a WAL for tests in a new temporary directory on the memory
+// backed file system at /dev/shm, so it's written to memory rather than disk.
+// If there is no /dev/shm, the directory is created in the default directory
+// for temporary files instead, which is usually on disk. It behaves like a WAL
+// created with NewSize, including segment rollover and Repair, and writes the
+// same format, except that segments are never synced.
+//
+// Close removes the directory, so the segments must be read before closing
+// the WAL, e.g. by passing a reader from NewSegmentsReader on its Dir to
+// NewReader. If the WAL isn't closed, e.g. as the process crashes, the
+// directory remains.
+func NewTmpfs(log zerolog.Logger, segmentSize int, compress bool) (*WAL, error) {
+	parent := ""
+	if fi, err := os.Stat(tmpfsDir); err == nil && fi.IsDir() {
+		parent = tmpfsDir
+	}
+	dir, err := ioutil.TempDir(parent, "wal_in_memory")
+	if err != nil {
+		return nil, errors.Wrap(err, "create tmpfs directory")
+	}
+	w, err := NewSize(log, nil, dir, segmentSize, compress, func(w *WAL) {
+		w.tmpfs = true
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return w, nil
+}
+
+// removeTmpfs removes the directory of a WAL created with NewTmpfs.
+func (w *WAL) removeTmpfs() {
+	if err := os.RemoveAll(w.Dir()); err != nil {
+		w.logger.Error().Err(err).Str("dir", w.Dir()).Msg("remove tmpfs WAL")
+	}
+}
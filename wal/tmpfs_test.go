@@ -0,0 +1,69 @@
+package wal
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTmpfs(t *testing.T) {
+	w, err := NewTmpfs(zerolog.Nop(), 2*pageSize, true)
+	require.NoError(t, err)
+	if _, err := os.Stat(tmpfsDir); err == nil {
+		require.Equal(t, tmpfsDir, filepath.Dir(w.Dir()))
+	}
+
+	var recs [][]byte
+	for i := 0; i < 20; i++ {
+		rec := make([]byte, 10000)
+		rand.Read(rec)
+		_, err := w.Log(rec)
+		require.NoError(t, err)
+		recs = append(recs, rec)
+	}
+	require.Greater(t, w.LastSegment(), 2)
+
+	sr, err := NewSegmentsReader(zerolog.Nop(), w.Dir())
+	require.NoError(t, err)
+	r := NewReader(sr)
+	var got [][]byte
+	for r.Next() {
+		got = append(got, append([]byte{}, r.Record()...))
+	}
+	require.NoError(t, r.Err())
+	require.NoError(t, sr.Close())
+	require.Equal(t, recs, got)
+
+	// Repair works as on disk.
+	f, err := os.OpenFile(SegmentName(w.Dir(), 2), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 100)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, 100)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	sr, err = NewSegmentsReader(zerolog.Nop(), w.Dir())
+	require.NoError(t, err)
+	r = NewReader(sr)
+	n := 0
+	for r.Next() {
+		n++
+	}
+	require.Error(t, r.Err())
+	require.NoError(t, sr.Close())
+	require.NoError(t, w.Repair(r.Err()))
+	require.Equal(t, recs[:n], readAll(t, w.Dir()))
+
+	dir := w.Dir()
+	require.NoError(t, w.Close())
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+	require.Equal(t, ErrWALClosed, w.Close())
+}
@@ -0,0 +1,58 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// verifyRecords reads the records written to locs back from their segment
+// files and checks that they match recs. It must be called with w.mtx held
+// after the records were flushed.
+func (w *WAL) verifyRecords(recs [][]byte, locs []LogLocation) error {
+	var (
+		f   *os.File
+		seg = -1
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for i, loc := range locs {
+		if loc.Segment != seg {
+			if f != nil {
+				f.Close()
+			}
+			var err error
+			if f, err = os.Open(segmentFile(w.Dir(), loc.Segment)); err != nil {
+				return errors.Wrapf(err, "open segment %d", loc.Segment)
+			}
+			seg = loc.Segment
+		}
+		// The reader starts mid-segment, so it's set up with the offset and
+		// segment header it would have reached reading from the start.
+		r := NewReader(io.NewSectionReader(f, int64(loc.Offset), int64(w.segmentSize-loc.Offset)), w.readerOptions()...)
+		r.total = int64(loc.Offset)
+		if err := r.readSegmentHeaderAt(f); err != nil {
+			return errors.Wrapf(err, "read back record at %+v", loc)
+		}
+
+		// Packed records are read up to the one at loc.
+		for k := 0; k <= loc.Sub; k++ {
+			if !r.Next() {
+				if err := r.Err(); err != nil {
+					return errors.Wrapf(err, "read back record at %+v", loc)
+				}
+				return errors.Errorf("record at %+v not found", loc)
+			}
+		}
+		if !bytes.Equal(r.Record(), recs[i]) {
+			return errors.Errorf("record at %+v differs from the one written", loc)
+		}
+	}
+	return nil
+}
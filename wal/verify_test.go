@@ -0,0 +1,42 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteVerify(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		for _, header := range []bool{false, true} {
+			t.Run(fmt.Sprintf("compress=%t,segment_header=%t", compress, header), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_write_verify")
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, os.RemoveAll(dir))
+				}()
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, 128*pageSize, compress, WithWriteVerify(true), WithSegmentHeader(header))
+				require.NoError(t, err)
+
+				input := make(chan []byte, fuzzLen)
+				require.NoError(t, generateRandomEntries(w, input))
+				close(input)
+
+				// Corrupting the data on its way to disk is detected.
+				w.writeHook = func(s *Segment, b []byte) (int, error) {
+					c := append([]byte{}, b...)
+					c[len(c)-1] ^= 0xff
+					return s.Write(c)
+				}
+				_, err = w.Log(make([]byte, 100))
+				require.Error(t, err)
+				require.NoError(t, w.Close())
+			})
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDir(t *testing.T) {
+	// Four pages per segment, the large records span three pages.
+	sizes := []int{100, 2 * pageSize, 100, 100, 2 * pageSize, 100, 2 * pageSize}
+
+	for name, tc := range map[string]struct {
+		corrupt  func(t *testing.T, dir string, locs []LogLocation)
+		records  int
+		kind     CorruptionKind
+		gaps     []int
+		segments int
+	}{
+		"intact": {
+			corrupt:  func(*testing.T, string, []LogLocation) {},
+			records:  len(sizes),
+			segments: 3,
+		},
+		"checksum": {
+			corrupt: func(t *testing.T, dir string, locs []LogLocation) {
+				writeSegmentAt(t, dir, locs[3].Segment, int64(locs[3].Offset+recordHeaderSize+10), 0xff)
+			},
+			records:  3,
+			kind:     CorruptionChecksum,
+			segments: 3,
+		},
+		"type_transition": {
+			corrupt: func(t *testing.T, dir string, locs []LogLocation) {
+				writeSegmentAt(t, dir, locs[2].Segment, int64(locs[2].Offset), byte(recMiddle))
+			},
+			records:  2,
+			kind:     CorruptionTypeTransition,
+			segments: 3,
+		},
+		"non_zero_padding": {
+			corrupt: func(t *testing.T, dir string, locs []LogLocation) {
+				writeSegmentAt(t, dir, locs[3].Segment, int64(locs[3].Offset/pageSize*pageSize+pageSize-1), 1)
+			},
+			records:  4,
+			kind:     CorruptionNonZeroPadding,
+			segments: 3,
+		},
+		"torn": {
+			corrupt: func(t *testing.T, dir string, locs []LogLocation) {
+				last := locs[len(locs)-1]
+				require.NoError(t, os.Truncate(SegmentName(dir, last.Segment), int64(last.Offset/pageSize*pageSize+pageSize)))
+			},
+			records:  len(sizes) - 1,
+			kind:     CorruptionTorn,
+			segments: 3,
+		},
+		"gap": {
+			corrupt: func(t *testing.T, dir string, locs []LogLocation) {
+				require.NoError(t, os.Remove(SegmentName(dir, locs[4].Segment)))
+			},
+			records:  len(sizes) - 2,
+			gaps:     []int{1},
+			segments: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_verify_dir")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+			require.NoError(t, err)
+			var locs []LogLocation
+			for _, size := range sizes {
+				l, err := w.Log(make([]byte, size))
+				require.NoError(t, err)
+				locs = append(locs, l...)
+			}
+			require.NoError(t, w.Close())
+			require.Equal(t, []int{0, 0, 0, 0, 1, 1, 2}, segmentsOf(locs))
+			tc.corrupt(t, dir, locs)
+
+			for vname, verify := range map[string]func(string) (VerifyReport, error){
+				"serial": VerifyDir,
+				"parallel": func(dir string) (VerifyReport, error) {
+					return ParallelVerify(dir, 2)
+				},
+			} {
+				report, err := verify(dir)
+				require.NoError(t, err)
+				require.Equal(t, tc.segments, report.Segments)
+				require.Equal(t, tc.gaps, report.Gaps)
+				require.Equal(t, tc.records, report.Records, vname)
+				require.Equal(t, tc.kind, report.CorruptionKind, "%s: %v", vname, report.Corruption)
+				if tc.kind == CorruptionNone {
+					require.Nil(t, report.Corruption)
+					require.Equal(t, locs[len(locs)-1], report.LastValid)
+				}
+				if name == "intact" {
+					require.Equal(t, 4, report.FragmentCounts["full"])
+					require.Equal(t, 3, report.FragmentCounts["first"])
+					require.GreaterOrEqual(t, report.FragmentCounts["middle"], 3)
+					require.Equal(t, 3, report.FragmentCounts["last"])
+					require.Greater(t, report.FragmentCounts["zero"], 0)
+				}
+				if tc.kind != CorruptionNone {
+					require.NotNil(t, report.Corruption)
+					if tc.kind != CorruptionTorn {
+						require.Equal(t, locs[tc.records-1], report.LastValid)
+					}
+				}
+			}
+		})
+	}
+}
+
+// writeSegmentAt overwrites the byte at off in segment i of dir with b.
+func writeSegmentAt(t *testing.T, dir string, i int, off int64, b byte) {
+	f, err := os.OpenFile(SegmentName(dir, i), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b}, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// segmentsOf returns the segments of locs.
+func segmentsOf(locs []LogLocation) []int {
+	segs := make([]int, len(locs))
+	for i, loc := range locs {
+		segs[i] = loc.Segment
+	}
+	return segs
+}
@@ -0,0 +1,20 @@
+package wal
+
+// LogVersioned writes rec into the log along with the schema version of its
+// payload, which readers get from Reader.Version to pick the right decoder.
+// The version is stored in the header of the record's first fragment, apart
+// from the payload. Records written with Log have version 0.
+func (w *WAL) LogVersioned(version uint8, rec []byte) (LogLocation, error) {
+	ext := recordExt{flags: extVersion, version: version}
+	locs, err := w.logRecords([][]byte{rec}, ext.encode(nil), 0)
+	if err != nil {
+		return LogLocation{}, err
+	}
+	return locs[0], nil
+}
+
+// Version returns the schema version the current record was logged with using
+// LogVersioned. It is 0 for other records.
+func (r *Reader) Version() uint8 {
+	return r.ext.version
+}
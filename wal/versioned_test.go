@@ -0,0 +1,82 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogVersioned(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_versioned")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, compress)
+			require.NoError(t, err)
+			defer w.Close()
+
+			type versioned struct {
+				version uint8
+				rec     []byte
+			}
+			var recs []versioned
+			for i := 0; i < 30; i++ {
+				// Mix small and multi-page records across versions, including
+				// unversioned ones and version 0.
+				rec := make([]byte, rand.Intn(3*pageSize))
+				_, err := rand.Read(rec[:len(rec)/2])
+				require.NoError(t, err)
+
+				v := versioned{rec: rec}
+				if i%4 == 0 {
+					_, err = w.Log(rec)
+				} else {
+					v.version = uint8(i % 3 * 100)
+					_, err = w.LogVersioned(v.version, rec)
+				}
+				require.NoError(t, err)
+				recs = append(recs, v)
+			}
+
+			for _, lazy := range []bool{false, true} {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				require.NoError(t, err)
+				r := NewReader(sr, WithLazyChecksum(lazy))
+				for _, v := range recs {
+					require.True(t, r.Next(), "expected record: %v", r.Err())
+					require.Equal(t, v.version, r.Version())
+					require.Equal(t, v.rec, r.Record())
+					require.Equal(t, [8]byte{}, r.Key())
+				}
+				require.False(t, r.Next())
+				require.NoError(t, r.Err())
+				require.NoError(t, sr.Close())
+			}
+		})
+	}
+}
+
+func TestRecordExt_Version(t *testing.T) {
+	for _, e := range []recordExt{
+		{flags: extVersion, version: 7},
+		{flags: extKey | extVersion, key: [8]byte{1, 2, 3}, version: 255},
+	} {
+		b := e.encode(nil)
+		got, n, err := decodeRecordExt(b)
+		require.NoError(t, err)
+		require.Equal(t, len(b), n)
+		require.Equal(t, e, got)
+
+		_, _, err = decodeRecordExt(b[:len(b)-1])
+		require.Error(t, err)
+	}
+}
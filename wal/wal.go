@@ -16,16 +16,21 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -38,6 +43,15 @@ import (
 	"github.com/onflow/wal/fileutil"
 )
 
+var (
+	// ErrWALFull is returned when a write would exceed the size limit of the WAL.
+	ErrWALFull = errors.New("wal is full")
+	// ErrWALClosed is returned when operating on a WAL after Close was called.
+	ErrWALClosed = errors.New("wal already closed")
+	// ErrDiskFull is returned when a write failed because the disk is out of space.
+	ErrDiskFull = errors.New("disk full")
+)
+
 const (
 	DefaultSegmentSize = 128 * 1024 * 1024 // 128 MB
 	pageSize           = 32 * 1024         // 32KB
@@ -56,15 +70,16 @@ var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
 type page struct {
 	alloc   int
 	flushed int
+	size    int // Size of the page, at most pageSize, see WithPageSize.
 	buf     [pageSize]byte
 }
 
 func (p *page) remaining() int {
-	return pageSize - p.alloc
+	return p.size - p.alloc
 }
 
 func (p *page) full() bool {
-	return pageSize-p.alloc < recordHeaderSize
+	return p.size-p.alloc < recordHeaderSize
 }
 
 func (p *page) reset() {
@@ -93,11 +108,15 @@ func (s *Segment) Dir() string {
 }
 
 // CorruptionErr is an error that's returned when corruption is encountered.
+// Kind tells e.g. a torn record at the end of the log, which is expected after
+// a crash, from a checksum failure in the middle of it, which hints at failing
+// hardware.
 type CorruptionErr struct {
 	Dir     string
 	Segment int
 	Offset  int64
 	Err     error
+	Kind    CorruptionKind
 }
 
 func (e *CorruptionErr) Error() string {
@@ -107,6 +126,74 @@ func (e *CorruptionErr) Error() string {
 	return fmt.Sprintf("corruption in segment %s at %d: %s", SegmentName(e.Dir, e.Segment), e.Offset, e.Err)
 }
 
+// Location returns the location of the corruption. The segment is -1 if the
+// reader wasn't reading segments.
+func (e *CorruptionErr) Location() LogLocation {
+	return LogLocation{Segment: e.Segment, Offset: int(e.Offset)}
+}
+
+// CorruptionKind classifies a corruption found by a Reader.
+type CorruptionKind int
+
+const (
+	// CorruptionNone means no corruption was found.
+	CorruptionNone CorruptionKind = iota
+	// CorruptionChecksum is a fragment not matching its checksum.
+	CorruptionChecksum
+	// CorruptionTypeTransition is a fragment type that can't follow the
+	// previous one, e.g. a middle fragment without a preceding first one.
+	CorruptionTypeTransition
+	// CorruptionNonZeroPadding is a non-zero byte after a page terminator.
+	CorruptionNonZeroPadding
+	// CorruptionTorn is a record missing its last fragments at the end of
+	// the log, e.g. after a crash.
+	CorruptionTorn
+	// CorruptionOther is any other corruption, e.g. an invalid header.
+	CorruptionOther
+)
+
+func (k CorruptionKind) String() string {
+	switch k {
+	case CorruptionNone:
+		return "none"
+	case CorruptionChecksum:
+		return "checksum"
+	case CorruptionTypeTransition:
+		return "type transition"
+	case CorruptionNonZeroPadding:
+		return "non-zero padding"
+	case CorruptionTorn:
+		return "torn record"
+	case CorruptionOther:
+		return "other"
+	default:
+		return fmt.Sprintf("CorruptionKind(%d)", int(k))
+	}
+}
+
+// kindError is an error of the reader detecting a corruption of a known kind.
+type kindError struct {
+	kind CorruptionKind
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+// corruptionKindOf returns the kind of corruption err reports. Data ending in
+// the middle of a fragment is a torn record.
+func corruptionKindOf(err error) CorruptionKind {
+	var kerr *kindError
+	if errors.As(err, &kerr) {
+		return kerr.kind
+	}
+	if errors.Cause(err) == io.ErrUnexpectedEOF {
+		return CorruptionTorn
+	}
+	return CorruptionOther
+}
+
 // OpenWriteSegment opens segment k in dir. The returned segment is ready for new appends.
 func OpenWriteSegment(logger log.Logger, dir string, k int) (*Segment, error) {
 	segName := SegmentName(dir, k)
@@ -136,7 +223,18 @@ func OpenWriteSegment(logger log.Logger, dir string, k int) (*Segment, error) {
 
 // CreateSegment creates a new segment k in dir.
 func CreateSegment(dir string, k int) (*Segment, error) {
-	f, err := os.OpenFile(SegmentName(dir, k), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	return createSegmentAt(dir, k, SegmentName(dir, k))
+}
+
+// createSegmentAt creates segment k of the WAL in dir in the file fn, creating
+// its directory if needed.
+func createSegmentAt(dir string, k int, fn string) (*Segment, error) {
+	if d := filepath.Dir(fn); d != filepath.Clean(dir) {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			return nil, errors.Wrap(err, "create segment dir")
+		}
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +243,13 @@ func CreateSegment(dir string, k int) (*Segment, error) {
 
 // OpenReadSegment opens the segment with the given filename.
 func OpenReadSegment(fn string) (*Segment, error) {
-	k, err := strconv.Atoi(filepath.Base(fn))
+	return openReadSegmentIn(filepath.Dir(fn), fn)
+}
+
+// openReadSegmentIn opens the segment of the WAL in dir with the given
+// filename, which may be in a subdirectory of dir, see WithSegmentNamer.
+func openReadSegmentIn(dir, fn string) (*Segment, error) {
+	k, err := parseSegmentName(filepath.Base(fn))
 	if err != nil {
 		return nil, errors.New("not a valid filename")
 	}
@@ -153,7 +257,7 @@ func OpenReadSegment(fn string) (*Segment, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Segment{File: f, i: k, dir: filepath.Dir(fn)}, nil
+	return &Segment{File: f, i: k, dir: dir}, nil
 }
 
 // WAL is a write ahead log that stores records in segment files.
@@ -161,8 +265,8 @@ func OpenReadSegment(fn string) (*Segment, error) {
 // If an error occurs during read, the repair procedure must be called
 // before it's safe to do further writes.
 //
-// Segments are written to in pages of 32KB, with records possibly split
-// across page boundaries.
+// Segments are written to in pages of 32KB by default, see WithPageSize, with
+// records possibly split across page boundaries.
 // Records are never split across segments to allow full segments to be
 // safely truncated. It also ensures that torn writes never corrupt records
 // beyond the most recent segment.
@@ -170,6 +274,7 @@ type WAL struct {
 	dir         string
 	logger      zerolog.Logger
 	segmentSize int
+	pageSize    int // Size of the pages of new segments, see WithPageSize.
 	mtx         sync.RWMutex
 	segment     *Segment // Active segment.
 	donePages   int      // Pages written to the segment.
@@ -178,35 +283,112 @@ type WAL struct {
 	actorc      chan func()
 	closed      bool // To allow calling Close() more than once without blocking.
 	compress    bool
+	compression Compression // Codec records are compressed with.
+	codec       Codec       // Registered codec of compression, unless built in.
 	snappyBuf   []byte
 
+	maxTotalSize  int64 // Limit for the on-disk size of all segments, disabled if <= 0.
+	size          int64 // Bytes written to all segments.
+	flushStrategy FlushStrategy
+	segmentHeader bool         // Whether new segments start with a segment header.
+	magicCheck    bool         // Whether to validate the directory marker on open.
+	syncOnEmpty   bool         // Whether Log without records syncs the active segment.
+	writeVerify   bool         // Whether Log reads back the records it wrote.
+	trimOnClose   bool         // Whether Close removes the active segment if it's empty.
+	segmentIDs    bool         // Whether new segments get an ID, see SegmentID.
+	reserved      *reservation // Pending reservation made by Reserve, if any.
+
+	epochs    bool   // Whether records are tagged with epochs, see WithEpochs.
+	nextEpoch uint64 // Epoch of the next record logged.
+
+	aead         cipher.AEAD // Encrypts records if set.
+	headerSize   int         // Size of the segment header of the active segment.
+	nonceBase    []byte      // Nonce base of the active segment if it's encrypted.
+	nonceCounter uint64      // Counter of the last nonce used in the active segment.
+	sealBuf      []byte
+
+	packMax int    // Maximum size of records packed together, 0 if disabled.
+	packBuf []byte // Payload of the packed record being written.
+
+	lockedSyncThread bool             // Whether segments are synced on the sync thread.
+	syncc            chan syncRequest // Requests to the sync thread, if running.
+	syncDone         chan struct{}    // Closed once the sync thread exited.
+
+	slowLogThreshold time.Duration
+	slowLogFn        func(d time.Duration, recs int) // Called for slow Log calls if set.
+
+	autoCheckpointBytes int64             // Bytes between automatic checkpoints, disabled if <= 0.
+	autoCheckpointKeep  func([]byte) bool // Filter of automatic checkpoints.
+	sinceCheckpoint     int64             // Bytes logged since the last automatic checkpoint.
+	autoCheckpointSeg   int               // Segment the last automatic checkpoint ended at.
+	checkpointing       bool              // Whether an automatic checkpoint is running.
+	checkpoints         sync.WaitGroup    // Running automatic checkpoints.
+	lastCheckpoint      LogLocation       // End of the last checkpoint, see LastCheckpoint.
+	lastCheckpointTime  time.Time         // Time the last checkpoint completed.
+
+	syncPolicy SyncPolicy     // When the active segment is synced.
+	syncStop   chan struct{}  // Closed to stop the sync loop, if running.
+	syncLoop   sync.WaitGroup // Running sync loop, see SyncInterval.
+
+	tmpfs bool // Whether segments are never synced and removed by Close, see NewTmpfs.
+
+	segmentNamer SegmentNamer // Path of segment files relative to dir, if set.
+
+	openMode      OpenMode // Where writing continues in an existing directory.
+	openedVersion int      // Format version read from the header of the segment continued on opening, if any.
+	openedPage    int      // Page size read from the header of the segment continued on opening, if any.
+
+	onFinalized func(segment int, path string) // Called for finalized segments if set.
+	finalized   *segmentNotifier               // Calls onFinalized, if set.
+
+	abandonedMtx sync.Mutex
+	abandoned    *abandonedWrite // Write abandoned by LogContext that is still pending.
+
+	synced LogLocation   // End of the data synced so far.
+	notify chan struct{} // Closed and replaced whenever synced advances.
+
+	unsyncedMtx sync.Mutex
+	unsynced    map[int]struct{} // Segments moved on from that weren't synced yet, see IsDurable.
+
+	writeHook      func(*Segment, []byte) (int, error) // Replaces segment writes to inject faults in tests.
+	checkpointHook func(step string) error             // Called after checkpoint steps to inject crashes in tests.
+	syncHook       func(*os.File) error                // Replaces fsyncs to inject faults in tests.
+
 	metrics *walMetrics
 }
 
 type walMetrics struct {
-	fsyncDuration   prometheus.Summary
+	fsyncDuration   prometheus.Histogram
 	pageFlushes     prometheus.Counter
 	pageCompletions prometheus.Counter
 	truncateFail    prometheus.Counter
 	truncateTotal   prometheus.Counter
 	currentSegment  prometheus.Gauge
 	writesFailed    prometheus.Counter
+	recordsWritten  prometheus.Counter
+	bytesWritten    prometheus.Counter
+	segmentsCreated prometheus.Counter
+	pageUtilization prometheus.Gauge
 }
 
 // LogLocation indicates where the log entry is placed
 // inside WAL - by segment number and it's offset in file, in bytes.
+// Records packed into one physical record, see WithPackedRecords, share the
+// segment and offset and are addressed by their index Sub within it. Sub is 0
+// for records that aren't packed.
 type LogLocation struct {
 	Segment int
 	Offset  int
+	Sub     int
 }
 
 func newWALMetrics(r prometheus.Registerer) *walMetrics {
 	m := &walMetrics{}
 
-	m.fsyncDuration = prometheus.NewSummary(prometheus.SummaryOpts{
-		Name:       "prometheus_tsdb_wal_fsync_duration_seconds",
-		Help:       "Duration of WAL fsync.",
-		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	m.fsyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "prometheus_tsdb_wal_fsync_duration_seconds",
+		Help:    "Duration of WAL fsync.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10), // 100µs to ~26s.
 	})
 	m.pageFlushes = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "prometheus_tsdb_wal_page_flushes_total",
@@ -232,6 +414,22 @@ func newWALMetrics(r prometheus.Registerer) *walMetrics {
 		Name: "prometheus_tsdb_wal_writes_failed_total",
 		Help: "Total number of WAL writes that failed.",
 	})
+	m.recordsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_records_written_total",
+		Help: "Total number of records written to the WAL.",
+	})
+	m.bytesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_written_bytes_total",
+		Help: "Total number of bytes written to WAL segments, including headers and padding.",
+	})
+	m.segmentsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_wal_segments_created_total",
+		Help: "Total number of WAL segments created.",
+	})
+	m.pageUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_tsdb_wal_page_utilization_ratio",
+		Help: "Fraction of the active WAL page that is filled.",
+	})
 
 	if r != nil {
 		r.MustRegister(
@@ -242,6 +440,10 @@ func newWALMetrics(r prometheus.Registerer) *walMetrics {
 			m.truncateTotal,
 			m.currentSegment,
 			m.writesFailed,
+			m.recordsWritten,
+			m.bytesWritten,
+			m.segmentsCreated,
+			m.pageUtilization,
 		)
 	}
 
@@ -249,27 +451,66 @@ func newWALMetrics(r prometheus.Registerer) *walMetrics {
 }
 
 // New returns a new WAL over the given directory.
-func New(logger zerolog.Logger, reg prometheus.Registerer, dir string, compress bool) (*WAL, error) {
-	return NewSize(logger, reg, dir, DefaultSegmentSize, compress)
+func New(logger zerolog.Logger, reg prometheus.Registerer, dir string, compress bool, opts ...Option) (*WAL, error) {
+	return NewSize(logger, reg, dir, DefaultSegmentSize, compress, opts...)
 }
 
 // NewSize returns a new WAL over the given directory.
 // New segments are created with the specified size.
-func NewSize(logger zerolog.Logger, reg prometheus.Registerer, dir string, segmentSize int, compress bool) (*WAL, error) {
-	if segmentSize%pageSize != 0 {
-		return nil, errors.New("invalid segment size")
-	}
-	if err := os.MkdirAll(dir, 0777); err != nil {
-		return nil, errors.Wrap(err, "create dir")
-	}
+// The WAL's metrics, such as the records and bytes written, segments created
+// and fsync latency, are registered with reg. If reg is nil, they are
+// collected but not exposed.
+func NewSize(logger zerolog.Logger, reg prometheus.Registerer, dir string, segmentSize int, compress bool, opts ...Option) (*WAL, error) {
 	w := &WAL{
 		dir:         dir,
 		logger:      logger,
 		segmentSize: segmentSize,
-		page:        &page{},
+		pageSize:    pageSize,
 		actorc:      make(chan func(), 100),
 		stopc:       make(chan chan struct{}),
 		compress:    compress,
+		notify:      make(chan struct{}),
+		magicCheck:  true,
+	}
+	if compress {
+		w.compression = CompressionSnappy
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if err := checkPageSize(w.pageSize); err != nil {
+		return nil, err
+	}
+	if segmentSize%w.pageSize != 0 {
+		return nil, errors.New("invalid segment size")
+	}
+	w.page = &page{size: w.pageSize}
+	if err := w.initCompression(); err != nil {
+		return nil, err
+	}
+	if w.aead != nil {
+		if n := w.aead.NonceSize(); n < nonceCounterSize || n > 255 {
+			return nil, errors.Errorf("unsupported nonce size %d for encryption", n)
+		}
+		// The nonce base of encrypted segments is stored in the segment header.
+		w.segmentHeader = true
+	}
+	if w.segmentIDs || w.epochs || w.pageSize != pageSize {
+		w.segmentHeader = true
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create dir")
+	}
+	if w.magicCheck {
+		if err := checkMarker(logger, dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := clearCleanShutdown(dir); err != nil {
+		return nil, err
+	}
+	if err := recoverCompaction(dir, w.segmentPath); err != nil {
+		return nil, errors.Wrap(err, "recover compaction")
 	}
 	w.metrics = newWALMetrics(reg)
 
@@ -277,23 +518,58 @@ func NewSize(logger zerolog.Logger, reg prometheus.Registerer, dir string, segme
 	if err != nil {
 		return nil, errors.Wrap(err, "get segment range")
 	}
+	if err := CheckVersions(w.Dir()); err != nil {
+		return nil, err
+	}
+	if w.size, err = segmentsSize(w.Dir()); err != nil {
+		return nil, errors.Wrap(err, "get segments size")
+	}
 
-	// Index of the Segment we want to open and write to.
-	writeSegmentIndex := 0
-	// If some segments already exist create one with a higher index than the last segment.
-	if last != -1 {
-		writeSegmentIndex = last + 1
+	if w.epochs {
+		if w.nextEpoch, err = recoverEpoch(w.Dir(), w.readerOptions()); err != nil {
+			return nil, errors.Wrap(err, "recover epoch")
+		}
 	}
 
-	segment, err := CreateSegment(w.Dir(), writeSegmentIndex)
-	if err != nil {
-		return nil, err
+	continued := false
+	if w.openMode == OpenAppend && last != -1 {
+		if continued, err = w.continueLast(last); err != nil {
+			return nil, errors.Wrap(err, "continue last segment")
+		}
+	}
+	if continued {
+		if err := w.readOpenedFormat(); err != nil {
+			return nil, errors.Wrap(err, "read format of continued segment")
+		}
 	}
+	if !continued {
+		// Index of the Segment we want to open and write to.
+		writeSegmentIndex := 0
+		// If some segments already exist create one with a higher index than the last segment.
+		if last != -1 {
+			writeSegmentIndex = last + 1
+		}
 
-	if err := w.setSegment(segment); err != nil {
-		return nil, err
+		segment, err := w.createSegment(writeSegmentIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := w.setSegment(segment); err != nil {
+			return nil, err
+		}
+		w.synced = LogLocation{Segment: segment.Index()}
 	}
 
+	if w.lockedSyncThread {
+		w.startSyncThread()
+	}
+	if w.syncPolicy.interval > 0 {
+		w.startSyncLoop()
+	}
+	if w.onFinalized != nil {
+		w.startSegmentNotifier()
+	}
 	go w.run()
 
 	return w, nil
@@ -319,6 +595,13 @@ func (w *WAL) Dir() string {
 	return w.dir
 }
 
+// IsClosed returns whether Close was called on the WAL.
+func (w *WAL) IsClosed() bool {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	return w.closed
+}
+
 func (w *WAL) run() {
 Loop:
 	for {
@@ -345,6 +628,9 @@ func (w *WAL) Repair(origErr error) error {
 	// But that's not generally applicable if the records have any kind of causality.
 	// Maybe as an extra mode in the future if mid-WAL corruptions become
 	// a frequent concern.
+	if w.IsClosed() {
+		return ErrWALClosed
+	}
 	err := errors.Cause(origErr) // So that we can pick up errors even if wrapped.
 
 	cerr, ok := err.(*CorruptionErr)
@@ -354,14 +640,30 @@ func (w *WAL) Repair(origErr error) error {
 	if cerr.Segment < 0 {
 		return errors.New("corruption error does not specify position")
 	}
-	w.logger.Warn().Int("segment", cerr.Segment).Int64("offset", cerr.Offset).Msg("Starting corruption repair")
+	switch cerr.Kind {
+	case CorruptionTorn:
+		// Expected after a crash.
+		w.logger.Info().Int("segment", cerr.Segment).Int64("offset", cerr.Offset).Msg("Discarding torn record")
+	default:
+		w.logger.Warn().Int("segment", cerr.Segment).Int64("offset", cerr.Offset).Stringer("kind", cerr.Kind).Msg("Starting corruption repair")
+	}
+
+	// Add records only up to the where the error was.
+	return w.truncateSegment(cerr.Segment, func(r *Reader) bool {
+		return r.Offset() < cerr.Offset
+	})
+}
 
+// truncateSegment removes all segments after segment i and rewrites segment i
+// with its records for which keep returns true, up to the first one for which
+// it returns false. Writing continues in a new segment after it.
+func (w *WAL) truncateSegment(i int, keep func(r *Reader) bool) error {
 	// All segments behind the corruption can no longer be used.
 	segs, err := listSegments(w.Dir())
 	if err != nil {
 		return errors.Wrap(err, "list segments")
 	}
-	w.logger.Warn().Int("segment", cerr.Segment).Msg("Deleting all segments newer than corrupted segment")
+	w.logger.Warn().Int("segment", i).Msg("Deleting all segments newer than corrupted segment")
 
 	for _, s := range segs {
 		if w.segment.i == s.index {
@@ -373,26 +675,33 @@ func (w *WAL) Repair(origErr error) error {
 				return errors.Wrap(err, "close active segment")
 			}
 		}
-		if s.index <= cerr.Segment {
+		if s.index <= i {
 			continue
 		}
-		if err := os.Remove(filepath.Join(w.Dir(), s.name)); err != nil {
+		fn := filepath.Join(w.Dir(), s.name)
+		if err := os.Remove(fn); err != nil {
 			return errors.Wrapf(err, "delete segment:%v", s.index)
 		}
+		removeEmptyDir(w.Dir(), fn)
 	}
 	// Regardless of the corruption offset, no record reaches into the previous segment.
 	// So we can safely repair the WAL by removing the segment and re-inserting all
 	// its records up to the corruption.
-	w.logger.Warn().Int("segment", cerr.Segment).Msg("Rewrite corrupted segment")
+	w.logger.Warn().Int("segment", i).Msg("Rewrite corrupted segment")
 
-	fn := SegmentName(w.Dir(), cerr.Segment)
-	tmpfn := fn + ".repair"
+	fn := segmentFile(w.Dir(), i)
+	tmpfn := strings.TrimSuffix(fn, finalSegmentSuffix) + ".repair"
 
 	if err := fileutil.Rename(fn, tmpfn); err != nil {
 		return err
 	}
+	// The records of the corrupted segment are re-inserted below, account for
+	// them from scratch.
+	if w.size, err = segmentsSize(w.Dir()); err != nil {
+		return errors.Wrap(err, "get segments size")
+	}
 	// Create a clean segment and make it the active one.
-	s, err := CreateSegment(w.Dir(), cerr.Segment)
+	s, err := w.createSegment(i)
 	if err != nil {
 		return err
 	}
@@ -406,11 +715,10 @@ func (w *WAL) Repair(origErr error) error {
 	}
 	defer f.Close()
 
-	r := NewReader(bufio.NewReader(f))
+	r := NewReader(bufio.NewReader(f), w.readerOptions()...)
 
 	for r.Next() {
-		// Add records only up to the where the error was.
-		if r.Offset() >= cerr.Offset {
+		if !keep(r) {
 			break
 		}
 		if loc, err := w.Log(r.Record()); err != nil {
@@ -440,13 +748,17 @@ func (w *WAL) Repair(origErr error) error {
 	// We always want to start writing to a new Segment rather than an existing
 	// Segment, which is handled by NewSize, but earlier in Repair we're deleting
 	// all segments that come after the corrupted Segment. Recreate a new Segment here.
-	s, err = CreateSegment(w.Dir(), cerr.Segment+1)
+	s, err = w.createSegment(i + 1)
 	if err != nil {
 		return err
 	}
 	if err := w.setSegment(s); err != nil {
 		return err
 	}
+	w.mtx.Lock()
+	w.synced = LogLocation{Segment: s.Index()}
+	w.broadcast()
+	w.mtx.Unlock()
 	return nil
 }
 
@@ -455,10 +767,36 @@ func SegmentName(dir string, i int) string {
 	return filepath.Join(dir, fmt.Sprintf("%08d", i))
 }
 
+// segmentFile returns the path of the existing segment i in dir, which has
+// the finalized name if the segment was finalized.
+func segmentFile(dir string, i int) string {
+	fn := SegmentName(dir, i)
+	if _, err := os.Stat(fn + finalSegmentSuffix); err == nil {
+		return fn + finalSegmentSuffix
+	}
+	// Bucket directories may have the name of a segment, see
+	// BucketSegmentNamer.
+	if fi, err := os.Stat(fn); os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		if sfn, ok := findSegment(dir, i); ok {
+			return sfn
+		}
+	}
+	return fn
+}
+
+// parseSegmentName returns the index of the segment with the given file name.
+func parseSegmentName(name string) (int, error) {
+	return strconv.Atoi(strings.TrimSuffix(name, finalSegmentSuffix))
+}
+
 // NextSegment creates the next segment and closes the previous one.
 func (w *WAL) NextSegment() error {
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
 	return w.nextSegment()
 }
 
@@ -470,7 +808,7 @@ func (w *WAL) nextSegment() error {
 			return err
 		}
 	}
-	next, err := CreateSegment(w.Dir(), w.segment.Index()+1)
+	next, err := w.createSegment(w.segment.Index() + 1)
 	if err != nil {
 		return errors.Wrap(err, "create new segment file")
 	}
@@ -480,13 +818,19 @@ func (w *WAL) nextSegment() error {
 	}
 
 	// Don't block further writes by fsyncing the last segment.
+	w.markUnsynced(prev.Index())
 	w.actorc <- func() {
 		if err := w.fsync(prev); err != nil {
 			w.logger.Error().Err(err).Msg("sync previous segment")
+		} else {
+			w.markSynced(prev.Index())
 		}
 		if err := prev.Close(); err != nil {
 			w.logger.Error().Err(err).Msg("close previous segment")
 		}
+		if w.finalized != nil {
+			w.finalized.notify(prev.Index(), prev.Name())
+		}
 	}
 	return nil
 }
@@ -499,11 +843,42 @@ func (w *WAL) setSegment(segment *Segment) error {
 	if err != nil {
 		return err
 	}
-	w.donePages = int(stat.Size() / pageSize)
+	w.donePages = int(stat.Size() / int64(w.pageSize))
 	w.metrics.currentSegment.Set(float64(segment.Index()))
+	if stat.Size() == 0 {
+		w.metrics.segmentsCreated.Inc()
+	}
+
+	if w.segmentHeader && stat.Size() == 0 {
+		if w.aead != nil {
+			if err := w.newNonceBase(); err != nil {
+				return err
+			}
+		}
+		f := segmentFields{nonceBase: w.nonceBase, epoch: w.nextEpoch, hasEpoch: w.epochs, pageSize: w.customPageSize()}
+		if w.segmentIDs {
+			if f.id, err = newSegmentID(); err != nil {
+				return err
+			}
+		}
+		w.headerSize = encodeSegmentHeader(w.page.buf[:], byte(w.formatVersion()), f)
+		w.page.alloc = w.headerSize
+		if err := w.flushPage(false); err != nil {
+			return errors.Wrap(err, "write segment header")
+		}
+	}
 	return nil
 }
 
+// segmentStart returns the write position at the start of the active segment.
+func (w *WAL) segmentStart() writeState {
+	st := writeState{segment: w.segment}
+	if w.segmentHeader {
+		st.alloc, st.flushed = w.headerSize, w.headerSize
+	}
+	return st
+}
+
 // flushPage writes the new contents of the page to disk. If no more records will fit into
 // the page, the remaining bytes will be set to zero and a new page will be started.
 // If clear is true, this is enforced regardless of how many bytes are left in the page.
@@ -516,9 +891,11 @@ func (w *WAL) flushPage(clear bool) error {
 	// No more data will fit into the page or an implicit clear.
 	// Enqueue and clear it.
 	if clear {
-		p.alloc = pageSize // Write till end of page.
+		p.alloc = p.size // Write till end of page.
 	}
-	n, err := w.segment.Write(p.buf[p.flushed:p.alloc])
+	n, err := w.write(p.buf[p.flushed:p.alloc])
+	w.size += int64(n)
+	w.metrics.bytesWritten.Add(float64(n))
 	if err != nil {
 		return err
 	}
@@ -530,16 +907,166 @@ func (w *WAL) flushPage(clear bool) error {
 		w.donePages++
 		w.metrics.pageCompletions.Inc()
 	}
+	w.metrics.pageUtilization.Set(float64(p.alloc) / float64(p.size))
+	return nil
+}
+
+func (w *WAL) write(b []byte) (int, error) {
+	if w.writeHook != nil {
+		return w.writeHook(w.segment, b)
+	}
+	return w.segment.Write(b)
+}
+
+// writeState captures the write position of the WAL.
+type writeState struct {
+	segment   *Segment
+	donePages int
+	alloc     int
+	flushed   int
+}
+
+func (w *WAL) writeState() writeState {
+	return writeState{
+		segment:   w.segment,
+		donePages: w.donePages,
+		alloc:     w.page.alloc,
+		flushed:   w.page.flushed,
+	}
+}
+
+// rollback discards everything written since st was captured, so a failed
+// write doesn't leave a torn record behind.
+// Data of previous records that was still buffered in the page is preserved.
+func (w *WAL) rollback(st writeState) error {
+	if w.segment != st.segment {
+		// The failed record was to be written to a new segment.
+		st = w.segmentStart()
+	}
+	p := w.page
+
+	end := st.donePages*w.pageSize + st.flushed
+	if w.donePages > st.donePages {
+		// The page the record started in was completed, so all data before
+		// the record was written.
+		st.flushed = st.alloc
+		end = st.donePages*w.pageSize + st.alloc
+	}
+	stat, err := w.segment.Stat()
+	if err != nil {
+		return err
+	}
+	if err := w.segment.Truncate(int64(end)); err != nil {
+		return err
+	}
+	w.size -= stat.Size() - int64(end)
+
+	w.donePages = st.donePages
+	p.alloc = st.alloc
+	p.flushed = st.flushed
+	for i := p.alloc; i < p.size; i++ {
+		p.buf[i] = 0
+	}
 	return nil
 }
 
 // First Byte of header format:
-// [ 4 bits unallocated] [1 bit snappy compression flag] [ 3 bit record type ]
+// [ 1 bit extension flag ] [ 4 bits compression flag ] [ 3 bit record type ]
+// The compression flag identifies the codec of a compressed record and is 0
+// for uncompressed ones. Snappy has flag 1, which makes its lowest bit the
+// snappy compression flag of earlier versions.
+const (
+	snappyMask       = 1 << 3
+	recTypeMask      = snappyMask - 1
+	compressionShift = 3
+	compressionMask  = 0xf << compressionShift
+	extMask          = 1 << 7
+)
+
+// compressionSnappy is the compression flag of snappy compressed records.
+const compressionSnappy = snappyMask >> compressionShift
+
+// The first fragment of a record with the extension flag set starts with an
+// extension header. It's a flags byte followed by the fields announced by the
+// flags, in the order of their flag bits. The extension header is neither
+// compressed nor part of the record returned to readers.
 const (
-	snappyMask  = 1 << 3
-	recTypeMask = snappyMask - 1
+	extKey     = 1 << 0 // 8 byte record key.
+	extPacked  = 1 << 1 // Record packs several records, see WithPackedRecords.
+	extVersion = 1 << 2 // 1 byte schema version of the record.
+	extEpoch   = 1 << 3 // 8 byte big-endian epoch of the record, see WithEpochs.
+	extTag     = 1 << 4 // 1 byte user-defined tag of the record, see LogTagged.
 )
 
+// recordExt holds the fields of a record extension header.
+type recordExt struct {
+	flags   byte
+	key     [8]byte
+	version uint8
+	epoch   uint64
+	tag     uint8
+}
+
+// encode appends the encoded extension header to b.
+func (e recordExt) encode(b []byte) []byte {
+	b = append(b, e.flags)
+	if e.flags&extKey != 0 {
+		b = append(b, e.key[:]...)
+	}
+	if e.flags&extVersion != 0 {
+		b = append(b, e.version)
+	}
+	if e.flags&extEpoch != 0 {
+		b = binary.BigEndian.AppendUint64(b, e.epoch)
+	}
+	if e.flags&extTag != 0 {
+		b = append(b, e.tag)
+	}
+	return b
+}
+
+// decodeRecordExt decodes the extension header at the start of b and returns
+// it along with its encoded size.
+func decodeRecordExt(b []byte) (e recordExt, n int, err error) {
+	if len(b) < 1 {
+		return e, 0, errors.New("truncated extension header")
+	}
+	e.flags = b[0]
+	n = 1
+
+	if e.flags&^(extKey|extPacked|extVersion|extEpoch|extTag) != 0 {
+		return e, 0, errors.Errorf("unknown extension header flags %x", e.flags)
+	}
+	if e.flags&extKey != 0 {
+		if len(b) < n+len(e.key) {
+			return e, 0, errors.New("truncated extension header")
+		}
+		n += copy(e.key[:], b[n:])
+	}
+	if e.flags&extVersion != 0 {
+		if len(b) < n+1 {
+			return e, 0, errors.New("truncated extension header")
+		}
+		e.version = b[n]
+		n++
+	}
+	if e.flags&extEpoch != 0 {
+		if len(b) < n+8 {
+			return e, 0, errors.New("truncated extension header")
+		}
+		e.epoch = binary.BigEndian.Uint64(b[n:])
+		n += 8
+	}
+	if e.flags&extTag != 0 {
+		if len(b) < n+1 {
+			return e, 0, errors.New("truncated extension header")
+		}
+		e.tag = b[n]
+		n++
+	}
+	return e, n, nil
+}
+
 type recType uint8
 
 const (
@@ -548,8 +1075,107 @@ const (
 	recFirst    recType = 2 // First fragment of a record.
 	recMiddle   recType = 3 // Middle fragments of a record.
 	recLast     recType = 4 // Final fragment of a record.
+
+	recSegmentHeader recType = 5 // Segment header, see formatV2.
+	recPadding       recType = 6 // Zeros skipped by readers, see padTo.
+)
+
+// Format versions of segments.
+const (
+	// formatV1 segments consist of records only.
+	formatV1 = 1
+	// formatV2 segments start with a segment header. It's framed like a full
+	// record of type recSegmentHeader in the version 1 record format, whatever
+	// the version of the segment, and holds segmentMagic followed by the
+	// version byte. Records use the version 1 format.
+	formatV2 = 2
+	// formatV3 segment headers additionally hold a flags byte. With
+	// segmentEncrypted set, it's followed by the length of the segment's nonce
+	// base and the nonce base, and records are encrypted, see sealRecord. With
+	// segmentHasID set, the segment's ID follows, see SegmentID. With
+	// segmentHasEpoch set, the epoch counter of the writer when it created the
+	// segment follows as an 8 byte big-endian integer, see WithEpochs. With
+	// segmentHasPageSize set, the base 2 logarithm of the segment's page size
+	// follows last as a single byte, see WithPageSize.
+	formatV3 = 3
+
+	// formatVersion is the newest format version that can be read and written.
+	formatVersion = formatV3
+)
+
+// Segment header flags of formatV3 segments.
+const (
+	segmentEncrypted   = 1 << 0 // Records are encrypted.
+	segmentHasID       = 1 << 1 // The header holds the segment's ID.
+	segmentHasEpoch    = 1 << 2 // The header holds the writer's epoch counter.
+	segmentHasPageSize = 1 << 3 // The header holds the page size of the segment.
 )
 
+// segmentFields holds the fields of a formatV3 segment header.
+type segmentFields struct {
+	nonceBase []byte // Nonce base of encrypted segments, nil otherwise.
+	id        []byte // ID of the segment, nil if it has none.
+	epoch     uint64 // Epoch counter of the writer, if hasEpoch is set.
+	hasEpoch  bool
+	pageSize  int // Page size of the segment, 0 if it's the default.
+}
+
+var segmentMagic = []byte("WALS")
+
+// segmentHeaderSize is the size of an encoded formatV2 segment header.
+var segmentHeaderSize = recordHeaderSize + len(segmentMagic) + 1
+
+// encodeSegmentHeader encodes the segment header for the given format version
+// into b and returns its size. The fields are only encoded for formatV3 and
+// omitted if unset. A nonce base marks the segment as encrypted.
+func encodeSegmentHeader(b []byte, version byte, f segmentFields) int {
+	payload := b[recordHeaderSize:]
+	n := copy(payload, segmentMagic)
+	payload[n] = version
+	n++
+	if version >= formatV3 {
+		flags := n
+		payload[flags] = 0
+		n++
+		if f.nonceBase != nil {
+			payload[flags] |= segmentEncrypted
+			payload[n] = byte(len(f.nonceBase))
+			n += 1 + copy(payload[n+1:], f.nonceBase)
+		}
+		if f.id != nil {
+			payload[flags] |= segmentHasID
+			n += copy(payload[n:], f.id)
+		}
+		if f.hasEpoch {
+			payload[flags] |= segmentHasEpoch
+			binary.BigEndian.PutUint64(payload[n:], f.epoch)
+			n += 8
+		}
+		if f.pageSize != 0 {
+			payload[flags] |= segmentHasPageSize
+			payload[n] = byte(bits.TrailingZeros(uint(f.pageSize)))
+			n++
+		}
+	}
+	payload = payload[:n]
+
+	b[0] = byte(recSegmentHeader)
+	binary.BigEndian.PutUint16(b[1:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(b[3:], crc32.Checksum(payload, castagnoliTable))
+	return recordHeaderSize + len(payload)
+}
+
+// decodeRecordHeader returns the length and checksum from a record header
+// in segments of the given format version.
+func decodeRecordHeader(version int, hdr []byte) (length uint16, crc uint32, err error) {
+	switch version {
+	case formatV1, formatV2, formatV3:
+		return binary.BigEndian.Uint16(hdr[1:]), binary.BigEndian.Uint32(hdr[3:]), nil
+	default:
+		return 0, 0, &UnsupportedVersionError{Segment: -1, Version: version}
+	}
+}
+
 func recTypeFromHeader(header byte) recType {
 	return recType(header & recTypeMask)
 }
@@ -566,81 +1192,449 @@ func (t recType) String() string {
 		return "middle"
 	case recLast:
 		return "last"
+	case recSegmentHeader:
+		return "segment header"
+	case recPadding:
+		return "padding"
 	default:
 		return "<invalid>"
 	}
 }
 
 func (w *WAL) pagesPerSegment() int {
-	return w.segmentSize / pageSize
+	return w.segmentSize / w.pageSize
+}
+
+// EncodedSize returns the number of bytes rec occupies in a segment when
+// written uncompressed from the start of a page of the default size, including
+// the headers of all its fragments.
+func EncodedSize(rec []byte) int {
+	return encodedSize(rec, pageSize)
+}
+
+// encodedSize is EncodedSize for pages of the given size.
+func encodedSize(rec []byte, size int) int {
+	fragments := (len(rec) + size - recordHeaderSize - 1) / (size - recordHeaderSize)
+	if fragments == 0 {
+		fragments = 1
+	}
+	return len(rec) + fragments*recordHeaderSize
+}
+
+// SegmentRemaining returns the number of bytes left in the active segment,
+// excluding the end of the active page if it's too short for another record
+// header, as such a page is padded. It's computed from the writer's state
+// without disk I/O.
+//
+// A record written with Log fits into the active segment without starting a
+// new one if EncodedSize(rec) <= SegmentRemaining(). This holds for records
+// that are written uncompressed, without a key and without encryption. When
+// sizing a batch, note that each record starting in the middle of a page may
+// need the header of one more fragment than EncodedSize accounts for.
+func (w *WAL) SegmentRemaining() int64 {
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+
+	offset := w.donePages*w.pageSize + w.page.alloc
+	if w.page.full() {
+		offset = (w.donePages + 1) * w.pageSize
+	}
+	size := w.pagesPerSegment() * w.pageSize
+	if offset >= size {
+		return 0
+	}
+	return int64(size - offset)
+}
+
+// CanLog returns ErrWALFull if logging recs would exceed the limit set with
+// WithMaxTotalSize. It returns nil if no limit is set.
+func (w *WAL) CanLog(recs ...[]byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	return w.checkCapacity(recs)
+}
+
+func (w *WAL) checkCapacity(recs [][]byte) error {
+	if w.maxTotalSize <= 0 {
+		return nil
+	}
+	// Bytes still buffered in the active page will be written along with recs.
+	need := w.size + int64(w.page.alloc-w.page.flushed)
+	for _, r := range recs {
+		need += int64(encodedSize(r, w.pageSize) + w.sealOverhead())
+	}
+	if need > w.maxTotalSize {
+		return ErrWALFull
+	}
+	return nil
 }
 
 // Log writes the records into the log.
 // Multiple records can be passed at once to reduce writes and increase throughput.
+// If a size limit is set, the whole batch is rejected with ErrWALFull before
+// any record is written when it doesn't fit.
+//
+// If writing a record fails, the partially written record is removed again,
+// so the WAL stays readable and can be written to once the cause is resolved.
+// Records of the batch before the failed one are kept. If the disk is full,
+// ErrDiskFull is returned.
+//
+// Calling Log without records is a no-op that returns an empty slice of
+// locations and doesn't touch the disk, unless WithSyncOnEmptyLog is set.
+//
+// Log doesn't retain recs. The records are copied into the WAL's own buffers
+// before it returns, even if it fails, so their buffers may be reused right
+// away, e.g. by returning them to a sync.Pool. The same holds for the other
+// methods writing records.
+//
+// Log is safe for concurrent use, also with the other methods writing records,
+// without external locking. Calls are serialized, so the records of one call
+// are contiguous in the log, in the order they were passed, and not interleaved
+// with those of other calls. Calls are ordered in the log as they acquired the
+// WAL's lock, and each call's locations are the on-disk positions of its
+// records. Callers needing a specific order across goroutines, e.g. that of
+// their own sequence numbers, must still order their calls themselves.
 func (w *WAL) Log(recs ...[]byte) ([]LogLocation, error) {
+	return w.logRecords(recs, nil, 0)
+}
+
+// LogAligned writes rec into the log like Log but starts it at the beginning
+// of a page, so readers scanning page starts can find it. The remainder of
+// the active page is padded with zeros first, which costs up to a page (32KB
+// by default) of disk space per record. The returned location's offset is a multiple of
+// the page size.
+func (w *WAL) LogAligned(rec []byte) (LogLocation, error) {
+	locs, err := w.logRecords([][]byte{rec}, nil, w.pageSize)
+	if err != nil {
+		return LogLocation{}, err
+	}
+	return locs[0], nil
+}
+
+// LogAlignedTo writes rec into the log like Log but starts it at an offset
+// within its segment that is a multiple of alignment, which must be a power of
+// two no larger than the segment size. The returned location's offset is that
+// of the record header, which is followed by the record itself, so the payload
+// of an uncompressed record starts recordHeaderSize bytes later.
+//
+// Alignments of at least the page size terminate the active page and add
+// zero pages as needed, just like LogAligned, which is LogAlignedTo with the
+// page size. Smaller alignments fill the gap within the active page with a
+// padding record that readers skip. A padding record takes at least 7 bytes,
+// so smaller gaps are widened by another alignment. If the padding doesn't fit
+// into the active page, the page is terminated instead, whose start is always
+// aligned. Either way, padding costs up to the alignment or a page, whichever
+// is smaller, plus the header of the padding record, while alignments above
+// the page size cost up to the alignment. If the record doesn't fit after the
+// padding, it's written to the next segment, and if it doesn't fit an aligned
+// offset of an empty segment either, an error is returned.
+//
+// Readers predating padding records fail to read segments with records
+// aligned to less than the page size.
+func (w *WAL) LogAlignedTo(rec []byte, alignment int) (LogLocation, error) {
+	if alignment <= 0 || alignment&(alignment-1) != 0 {
+		return LogLocation{}, errors.Errorf("alignment %d is not a power of two", alignment)
+	}
+	if alignment > w.segmentSize {
+		return LogLocation{}, errors.Errorf("alignment %d exceeds segment size %d", alignment, w.segmentSize)
+	}
+	locs, err := w.logRecords([][]byte{rec}, nil, alignment)
+	if err != nil {
+		return LogLocation{}, err
+	}
+	return locs[0], nil
+}
+
+// LogWithIndexUpdate writes rec into the log like Log and then calls update
+// with its location, e.g. to add it to an external index. If update returns an
+// error, the record is removed from the log again and the error is returned.
+// This keeps the log and the index consistent without callers implementing
+// the rollback themselves.
+//
+// The record is synced to disk before update is called, whatever the sync
+// policy, so the index never refers to a record that can be lost. If the sync
+// fails, its error is returned without calling update. update is called with the WAL locked
+// and must not call into the WAL. Readers following the WAL may see the record
+// before it's rolled back.
+//
+// If the process crashes after the record was written but before update
+// completed or the record was rolled back, the record remains in the log
+// without being indexed. On recovery, callers must compare the tail of the log
+// with the last indexed location and either index or discard the records
+// after it.
+func (w *WAL) LogWithIndexUpdate(rec []byte, update func(loc LogLocation) error) (LogLocation, error) {
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
 
+	if w.closed {
+		return LogLocation{}, ErrWALClosed
+	}
+	st := w.writeState()
+	locs, err := w.writeRecords([][]byte{rec}, nil, 0)
+	if err != nil {
+		return LogLocation{}, err
+	}
+	// writeRecords only syncs under SyncOnLog.
+	if err := w.sync(); err != nil {
+		return LogLocation{}, err
+	}
+	if err := update(locs[0]); err != nil {
+		if rerr := w.rollback(st); rerr != nil {
+			return LogLocation{}, errors.Wrapf(rerr, "roll back record after failed index update: %v", err)
+		}
+		if serr := w.fsync(w.segment); serr != nil {
+			return LogLocation{}, errors.Wrapf(serr, "sync rolled back record after failed index update: %v", err)
+		}
+		w.synced = LogLocation{
+			Segment: w.segment.Index(),
+			Offset:  w.donePages*w.pageSize + w.page.flushed,
+		}
+		return LogLocation{}, err
+	}
+	return locs[0], nil
+}
+
+// logRecords writes recs into the log, prepending ext to the first fragment
+// of each record. If align is positive, each record starts at an offset that is
+// a multiple of it.
+func (w *WAL) logRecords(recs [][]byte, ext []byte, align int) ([]LogLocation, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	if len(recs) == 0 && !w.syncOnEmpty {
+		return []LogLocation{}, nil
+	}
+	return w.writeRecords(recs, ext, align)
+}
+
+// writeRecords does the work of logRecords. It must be called with w.mtx held.
+func (w *WAL) writeRecords(recs [][]byte, ext []byte, align int) ([]LogLocation, error) {
+	if err := w.checkCapacity(recs); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
 	locations := make([]LogLocation, len(recs))
+	// Counted once per call, updating the metric per record dominates the
+	// cost of batches of small records.
+	written := 0
+	defer func() {
+		w.metrics.recordsWritten.Add(float64(written))
+	}()
 
 	// Callers could just implement their own list record format but adding
 	// a bit of extra logic here frees them from that overhead.
-	for i, r := range recs {
-		location, err := w.log(r, i == len(recs)-1)
+	for i := 0; i < len(recs); {
+		st := w.writeState()
+
+		n := 1
+		if ext == nil && align <= 0 {
+			n = w.packRun(recs[i:])
+		}
+		rext, err := w.extFor(ext, n > 1)
+		if err != nil {
+			return locations, err
+		}
+		var location LogLocation
+		if n > 1 {
+			location, err = w.log(w.pack(recs[i:i+n]), rext, i+n == len(recs), 0)
+		} else {
+			location, err = w.log(recs[i], rext, i == len(recs)-1, align)
+		}
 		if err != nil {
 			w.metrics.writesFailed.Inc()
+
+			if rerr := w.rollback(st); rerr != nil {
+				w.logger.Error().Err(rerr).Msg("roll back failed write")
+				return locations, err
+			}
+			if errors.Is(err, syscall.ENOSPC) {
+				return locations, ErrDiskFull
+			}
 			return locations, err
 		}
-		locations[i] = location
+		for k := 0; k < n; k++ {
+			locations[i+k] = location
+			if n > 1 {
+				locations[i+k].Sub = k
+			}
+		}
+		if w.epochs {
+			w.nextEpoch += uint64(n)
+		}
+		written += n
+		i += n
 	}
 
-	if err := w.fsync(w.segment); err != nil {
-		w.logger.Error().Err(err).Msg("sync previous segment")
+	// Empty batches are explicit requests to sync, see WithSyncOnEmptyLog.
+	if w.syncPolicy.onLog() || len(recs) == 0 {
+		if err := w.sync(); err != nil {
+			return locations, err
+		}
+	}
+	if w.autoCheckpointBytes > 0 {
+		for _, r := range recs {
+			w.sinceCheckpoint += int64(len(r))
+		}
+		w.maybeAutoCheckpoint()
+	}
+	if d := time.Since(start); w.slowLogFn != nil && d >= w.slowLogThreshold {
+		w.reportSlowLog(d, len(recs))
+	}
+	if w.writeVerify {
+		if err := w.verifyRecords(recs, locations); err != nil {
+			w.logger.Error().Err(err).Msg("verify written records")
+			return locations, err
+		}
 	}
 
 	return locations, nil
 }
 
-// log writes rec to the log and forces a flush of the current page if:
-// - the final record of a batch
-// - the record is bigger than the page size
-// - the current page is full.
-func (w *WAL) log(rec []byte, final bool) (LogLocation, error) {
+// reportSlowLog passes a slow Log call to the callback set with
+// WithSlowLogCallback on the actor goroutine. The report is dropped if the
+// actor is backed up, so a slow callback never blocks writes.
+func (w *WAL) reportSlowLog(d time.Duration, recs int) {
+	select {
+	case w.actorc <- func() { w.slowLogFn(d, recs) }:
+	default:
+		w.logger.Warn().Dur("duration", d).Int("records", recs).Msg("drop slow log report")
+	}
+}
+
+// broadcast wakes up everyone waiting for new data to be synced.
+// It must be called with w.mtx held.
+func (w *WAL) broadcast() {
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// place makes room for a record of n bytes with an extension header of extLen
+// bytes and returns the location it will start at. It flushes the active page
+// or advances to the next segment as needed. The location only depends on the
+// uncompressed size of the record, so it's the same whether it's compressed.
+// If align is positive, the record is placed at an offset that is a multiple
+// of it, see padTo.
+func (w *WAL) place(n, extLen, align int) (LogLocation, error) {
 	// When the last page flush failed the page will remain full.
 	// When the page is full, need to flush it before trying to add more records to it.
-	if w.page.full() {
+	// The extension header must fit into the first fragment as a whole.
+	if w.page.full() || w.page.remaining()-recordHeaderSize < extLen {
 		if err := w.flushPage(true); err != nil {
 			return LogLocation{}, err
 		}
 	}
-	// If the record is too big to fit within the active page in the current
-	// segment, terminate the active segment and advance to the next one.
-	// This ensures that records do not cross segment boundaries.
-	left := w.page.remaining() - recordHeaderSize                                   // Free space in the active page.
-	left += (pageSize - recordHeaderSize) * (w.pagesPerSegment() - w.donePages - 1) // Free pages in the active segment.
-
-	if len(rec) > left {
+	for fresh := false; ; fresh = true {
+		if align > 0 {
+			if err := w.padTo(align); err != nil {
+				return LogLocation{}, err
+			}
+		}
+		// If the record is too big to fit within the active page in the current
+		// segment, terminate the active segment and advance to the next one.
+		// This ensures that records do not cross segment boundaries.
+		left := w.page.remaining() - recordHeaderSize                                     // Free space in the active page.
+		left += (w.pageSize - recordHeaderSize) * (w.pagesPerSegment() - w.donePages - 1) // Free pages in the active segment.
+
+		// A segment without free pages has no room even for an empty record.
+		if extLen+n <= left && w.donePages < w.pagesPerSegment() {
+			break
+		}
+		if fresh {
+			return LogLocation{}, errors.Errorf("no room for record of %d bytes at an offset aligned to %d", n, align)
+		}
 		if err := w.nextSegment(); err != nil {
 			return LogLocation{}, err
 		}
+		if align <= 0 {
+			break
+		}
 	}
+	return LogLocation{
+		Segment: w.segment.i,
+		Offset:  (w.donePages * w.pageSize) + w.page.alloc,
+	}, nil
+}
 
-	compressed := false
+// padTo pads the active segment until the write offset is a multiple of
+// align, which must be a power of two. Up to a page, the gap is filled with a
+// padding record, which needs at least recordHeaderSize bytes, so smaller gaps
+// are widened by align. If the padding record doesn't fit into the active
+// page, or align is a multiple of the page size, the active page is terminated
+// and zero pages are written instead. The padding stops at the end of the
+// segment, leaving no room for records.
+func (w *WAL) padTo(align int) error {
+	p := w.page
+	off := w.donePages*w.pageSize + p.alloc
+	gap := -off & (align - 1)
+	if gap == 0 {
+		return nil
+	}
+	for gap < recordHeaderSize {
+		gap += align
+	}
+	if align < p.size && p.alloc+gap <= p.size-recordHeaderSize {
+		buf := p.buf[p.alloc : p.alloc+gap]
+		payload := buf[recordHeaderSize:]
+		for i := range payload {
+			payload[i] = 0
+		}
+		buf[0] = byte(recPadding)
+		binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+		binary.BigEndian.PutUint32(buf[3:], crc32.Checksum(payload, castagnoliTable))
+		p.alloc += gap
+		return nil
+	}
+	if p.alloc > 0 {
+		if err := w.flushPage(true); err != nil {
+			return err
+		}
+	}
+	for (w.donePages*w.pageSize)&(align-1) != 0 && w.donePages < w.pagesPerSegment() {
+		if err := w.flushPage(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// log writes rec to the log and forces a flush of the current page if:
+// - the final record of a batch
+// - the record is bigger than the page size
+// - the current page is full
+// - the flush strategy is FlushPerRecord.
+// If align is positive, the record starts at an offset that is a multiple of it.
+func (w *WAL) log(rec, ext []byte, final bool, align int) (LogLocation, error) {
+	location, err := w.place(len(rec)+w.sealOverhead(), len(ext), align)
+	if err != nil {
+		return LogLocation{}, err
+	}
+
+	compression := CompressionNone
 	if w.compress && len(rec) > 0 {
 		// The snappy library uses `len` to calculate if we need a new buffer.
 		// In order to allocate as few buffers as possible make the length
 		// equal to the capacity.
 		w.snappyBuf = w.snappyBuf[:cap(w.snappyBuf)]
-		w.snappyBuf = snappy.Encode(w.snappyBuf, rec)
+		if w.compression == CompressionSnappy {
+			w.snappyBuf = snappy.Encode(w.snappyBuf, rec)
+		} else {
+			w.snappyBuf = w.codec.Encode(w.snappyBuf, rec)
+		}
 		if len(w.snappyBuf) < len(rec) {
 			rec = w.snappyBuf
-			compressed = true
+			compression = w.compression
 		}
 	}
-
-	location := LogLocation{
-		Segment: w.segment.i,
-		Offset:  (w.donePages * pageSize) + w.page.alloc,
+	if w.aead != nil {
+		rec = w.sealRecord(rec, ext)
 	}
 
 	// Populate as many pages as necessary to fit the record.
@@ -648,9 +1642,12 @@ func (w *WAL) log(rec []byte, final bool) (LogLocation, error) {
 	for i := 0; i == 0 || len(rec) > 0; i++ {
 		p := w.page
 
+		if i > 0 {
+			ext = nil
+		}
 		// Find how much of the record we can fit into the page.
 		var (
-			l    = min(len(rec), (pageSize-p.alloc)-recordHeaderSize)
+			l    = min(len(rec), (p.size-p.alloc)-recordHeaderSize-len(ext))
 			part = rec[:l]
 			buf  = p.buf[p.alloc:]
 			typ  recType
@@ -666,17 +1663,21 @@ func (w *WAL) log(rec []byte, final bool) (LogLocation, error) {
 		default:
 			typ = recMiddle
 		}
-		if compressed {
-			typ |= snappyMask
+		typ |= recType(compression) << compressionShift
+		if len(ext) > 0 {
+			typ |= extMask
 		}
 
 		buf[0] = byte(typ)
-		crc := crc32.Checksum(part, castagnoliTable)
-		binary.BigEndian.PutUint16(buf[1:], uint16(len(part)))
+		copy(buf[recordHeaderSize:], ext)
+		copy(buf[recordHeaderSize+len(ext):], part)
+
+		n := len(ext) + len(part)
+		crc := crc32.Checksum(buf[recordHeaderSize:recordHeaderSize+n], castagnoliTable)
+		binary.BigEndian.PutUint16(buf[1:], uint16(n))
 		binary.BigEndian.PutUint32(buf[3:], crc)
 
-		copy(buf[recordHeaderSize:], part)
-		p.alloc += len(part) + recordHeaderSize
+		p.alloc += n + recordHeaderSize
 
 		if w.page.full() {
 			if err := w.flushPage(true); err != nil {
@@ -686,8 +1687,13 @@ func (w *WAL) log(rec []byte, final bool) (LogLocation, error) {
 		rec = rec[l:]
 	}
 
+	switch {
+	case w.flushStrategy == FlushPerRecord && w.page.alloc > 0:
+		if err := w.flushPage(true); err != nil {
+			return LogLocation{}, err
+		}
 	// If it's the final record of the batch and the page is not empty, flush it.
-	if final && w.page.alloc > 0 {
+	case final && w.page.alloc > 0:
 		if err := w.flushPage(false); err != nil {
 			return LogLocation{}, err
 		}
@@ -696,14 +1702,24 @@ func (w *WAL) log(rec []byte, final bool) (LogLocation, error) {
 	return location, nil
 }
 
-// Truncate drops all segments before i.
+// Truncate drops all segments before i, e.g. to reclaim disk space once their
+// records are covered by a snapshot. It's safe to call concurrently with Log,
+// which only writes to the active segment. i must not be after the active
+// segment, see LastSegment, as that would drop it.
 func (w *WAL) Truncate(i int) (err error) {
+	if w.IsClosed() {
+		return ErrWALClosed
+	}
+	active := w.LastSegment()
 	w.metrics.truncateTotal.Inc()
 	defer func() {
 		if err != nil {
 			w.metrics.truncateFail.Inc()
 		}
 	}()
+	if active >= 0 && i > active {
+		return errors.Errorf("can't truncate segments before %d, which would drop the active segment %d", i, active)
+	}
 	refs, err := listSegments(w.Dir())
 	if err != nil {
 		return err
@@ -712,33 +1728,59 @@ func (w *WAL) Truncate(i int) (err error) {
 		if r.index >= i {
 			break
 		}
-		if err = os.Remove(filepath.Join(w.Dir(), r.name)); err != nil {
+		fn := filepath.Join(w.Dir(), r.name)
+		stat, err := os.Stat(fn)
+		if err != nil {
 			return err
 		}
+		if err = os.Remove(fn); err != nil {
+			return err
+		}
+		removeEmptyDir(w.Dir(), fn)
+		w.mtx.Lock()
+		w.size -= stat.Size()
+		w.mtx.Unlock()
 	}
 	return nil
 }
 
 func (w *WAL) fsync(f *Segment) error {
+	if w.tmpfs {
+		return nil
+	}
 	start := time.Now()
-	err := fileutil.Fdatasync(f.File)
+	err := w.fdatasync(f.File)
 	w.metrics.fsyncDuration.Observe(time.Since(start).Seconds())
 	return err
 }
 
 // Close flushes all writes and closes active segment.
+// Any further operations on the WAL return ErrWALClosed.
 func (w *WAL) Close() (err error) {
+	if w.tmpfs {
+		defer w.removeTmpfs()
+	}
+	// Wait for automatic checkpoints once the WAL is closed, which makes
+	// them stop early.
+	defer w.checkpoints.Wait()
+	defer w.syncLoop.Wait()
+	defer w.finalized.wait()
+
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
 
 	if w.closed {
-		return errors.New("wal already closed")
+		return ErrWALClosed
 	}
 
 	if w.segment == nil {
 		w.closed = true
+		w.finalized.stop()
+		w.stopSyncLoop()
+		w.stopSyncThread()
 		return nil
 	}
+	empty := w.writeState() == w.segmentStart()
 
 	// Flush the last page and zero out all its remaining size.
 	// We must not flush an empty page as it would falsely signal
@@ -752,14 +1794,47 @@ func (w *WAL) Close() (err error) {
 	donec := make(chan struct{})
 	w.stopc <- donec
 	<-donec
+	w.finalized.stop()
 
+	clean := true
 	if err = w.fsync(w.segment); err != nil {
 		w.logger.Error().Err(err).Msg("sync previous segment")
+		clean = false
 	}
+	w.stopSyncThread()
 	if err := w.segment.Close(); err != nil {
 		w.logger.Error().Err(err).Msg("close previous segment")
+		clean = false
+	}
+	if w.trimOnClose && empty {
+		if err := w.trimSegment(); err != nil {
+			w.logger.Error().Err(err).Msg("remove empty segment")
+		}
 	}
 	w.closed = true
+	w.broadcast()
+	w.stopSyncLoop()
+	if clean {
+		return markCleanShutdown(w.Dir())
+	}
+	return nil
+}
+
+// trimSegment removes the closed active segment, which must be empty, unless
+// it's the only one. Keeping the only segment ensures the WAL continues at the
+// same index when it's reopened.
+func (w *WAL) trimSegment() error {
+	first, _, err := Segments(w.Dir())
+	if err != nil {
+		return err
+	}
+	if w.segment.Index() <= first {
+		return nil
+	}
+	if err := os.Remove(w.segment.Name()); err != nil {
+		return err
+	}
+	w.size -= int64(w.segmentStart().flushed)
 	return nil
 }
 
@@ -776,31 +1851,73 @@ func Segments(walDir string) (first, last int, err error) {
 	return refs[0].index, refs[len(refs)-1].index, nil
 }
 
+// segmentsSize returns the summed size of all segment files in dir.
+func segmentsSize(dir string) (int64, error) {
+	refs, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, r := range refs {
+		stat, err := os.Stat(filepath.Join(dir, r.name))
+		if err != nil {
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
 type segmentRef struct {
 	name  string
 	index int
 }
 
-func listSegments(dir string) (refs []segmentRef, err error) {
-	files, err := ioutil.ReadDir(dir)
+func listSegments(dir string) ([]segmentRef, error) {
+	refs, err := readSegmentRefs(dir)
 	if err != nil {
 		return nil, err
 	}
-	for _, f := range files {
-		fn := f.Name()
-		k, err := strconv.Atoi(fn)
-		if err != nil {
-			continue
+	for i := 0; i < len(refs)-1; i++ {
+		if refs[i].index+1 != refs[i+1].index {
+			return nil, errors.Wrapf(ErrSegmentGap, "segments are not sequential: %v + 1 != %v", refs[i].index, refs[i+1].index)
 		}
-		refs = append(refs, segmentRef{name: fn, index: k})
+	}
+	return refs, nil
+}
+
+// readSegmentRefs returns the segments in dir sorted by index, regardless of
+// whether they are sequential.
+func readSegmentRefs(dir string) (refs []segmentRef, err error) {
+	if refs, err = appendSegmentRefs(refs, dir, ""); err != nil {
+		return nil, err
 	}
 	sort.Slice(refs, func(i, j int) bool {
 		return refs[i].index < refs[j].index
 	})
-	for i := 0; i < len(refs)-1; i++ {
-		if refs[i].index+1 != refs[i+1].index {
-			return nil, fmt.Errorf("segments are not sequential: %v + 1 != %v", refs[i].index, refs[i+1].index)
+	return refs, nil
+}
+
+// appendSegmentRefs appends the segments in the subdirectory sub of dir and
+// its subdirectories named by digits, see WithSegmentNamer.
+func appendSegmentRefs(refs []segmentRef, dir, sub string) ([]segmentRef, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		fn := filepath.Join(sub, f.Name())
+		k, err := parseSegmentName(f.Name())
+		if err != nil {
+			continue
 		}
+		if f.IsDir() {
+			if refs, err = appendSegmentRefs(refs, dir, fn); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		refs = append(refs, segmentRef{name: fn, index: k})
 	}
 	return refs, nil
 }
@@ -812,8 +1929,37 @@ type SegmentRange struct {
 }
 
 // NewSegmentsReader returns a new reader over all segments in the directory.
-func NewSegmentsReader(logger zerolog.Logger, dir string) (io.ReadCloser, error) {
-	return NewSegmentsRangeReader(logger, SegmentRange{dir, -1, -1})
+// It fails if there are gaps between segments unless SkipSegmentGaps is passed.
+func NewSegmentsReader(logger zerolog.Logger, dir string, opts ...SegmentsReaderOption) (io.ReadCloser, error) {
+	var o segmentsReaderOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.skipGaps {
+		return NewSegmentsRangeReader(logger, SegmentRange{dir, -1, -1})
+	}
+	refs, err := readSegmentRefs(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list segment in dir:%v", dir)
+	}
+	if len(refs) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if gaps := segmentGaps(refs); len(gaps) > 0 {
+		logger.Warn().Ints("missing", gaps).Msg("Skipping gaps between segments")
+	}
+	var segs []*Segment
+	for _, r := range refs {
+		s, err := openReadSegmentIn(dir, filepath.Join(dir, r.name))
+		if err != nil {
+			for _, s := range segs {
+				s.Close()
+			}
+			return nil, errors.Wrapf(err, "open segment:%v in dir:%v", r.name, dir)
+		}
+		segs = append(segs, s)
+	}
+	return NewSegmentBufReader(logger, segs...), nil
 }
 
 // NewSegmentsRangeReader returns a new reader over the given WAL segment ranges.
@@ -834,7 +1980,7 @@ func NewSegmentsRangeReader(logger zerolog.Logger, sr ...SegmentRange) (io.ReadC
 			if sgmRange.Last >= 0 && r.index > sgmRange.Last {
 				break
 			}
-			s, err := OpenReadSegment(filepath.Join(sgmRange.Dir, r.name))
+			s, err := openReadSegmentIn(sgmRange.Dir, filepath.Join(sgmRange.Dir, r.name))
 			if err != nil {
 				return nil, errors.Wrapf(err, "open segment:%v in dir:%v", r.name, sgmRange.Dir)
 			}
@@ -912,12 +2058,6 @@ func (r *segmentBufReader) Read(b []byte) (n int, err error) {
 	return n, nil
 }
 
-// Computing size of the WAL.
-// We do this by adding the sizes of all the files under the WAL dir.
-func (w *WAL) Size() (int64, error) {
-	return fileutil.DirSize(w.Dir())
-}
-
 func min(i, j int) int {
 	if i < j {
 		return i
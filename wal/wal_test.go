@@ -16,13 +16,18 @@ package wal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -216,6 +221,64 @@ func TestWALRepair_ReadingError(t *testing.T) {
 	}
 }
 
+func TestCorruptionErr_Kind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_corruption_kind")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false)
+	assert.NoError(t, err)
+	locs, err := w.Log(make([]byte, 100), make([]byte, 2*pageSize))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	seg, err := ioutil.ReadFile(SegmentName(dir, 0))
+	assert.NoError(t, err)
+
+	for name, test := range map[string]struct {
+		corrupt func(b []byte) []byte
+		kind    CorruptionKind
+	}{
+		"checksum": {
+			func(b []byte) []byte {
+				b[recordHeaderSize+10] ^= 0xff
+				return b
+			},
+			CorruptionChecksum,
+		},
+		"type_transition": {
+			func(b []byte) []byte {
+				b[locs[1].Offset] = byte(recMiddle)
+				return b
+			},
+			CorruptionTypeTransition,
+		},
+		"torn_fragment": {
+			func(b []byte) []byte {
+				return b[:locs[1].Offset+100]
+			},
+			CorruptionTorn,
+		},
+		"torn_record": {
+			func(b []byte) []byte {
+				return b[:pageSize]
+			},
+			CorruptionTorn,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(test.corrupt(append([]byte{}, seg...))))
+			for r.Next() {
+			}
+			var cerr *CorruptionErr
+			assert.True(t, errors.As(r.Err(), &cerr))
+			assert.Equal(t, test.kind, cerr.Kind, "%v", cerr)
+			assert.Equal(t, LogLocation{Segment: -1, Offset: int(cerr.Offset)}, cerr.Location())
+		})
+	}
+}
+
 // TestCorruptAndCarryOn writes a multi-segment WAL; corrupts the first segment and
 // ensures that an error during reading that segment are correctly repaired before
 // moving to write more records to the WAL.
@@ -362,6 +425,727 @@ func TestClose(t *testing.T) {
 	assert.Error(t, w.Close())
 }
 
+// TestClosedWAL ensures that all operations fail cleanly after Close.
+func TestClosedWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_closed")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize, false)
+	assert.NoError(t, err)
+	assert.False(t, w.IsClosed())
+	assert.NoError(t, w.Close())
+	assert.True(t, w.IsClosed())
+
+	_, err = w.Log([]byte{1})
+	assert.Equal(t, ErrWALClosed, err)
+	assert.Equal(t, ErrWALClosed, w.CanLog([]byte{1}))
+	assert.Equal(t, ErrWALClosed, w.NextSegment())
+	assert.Equal(t, ErrWALClosed, w.Truncate(1))
+	assert.Equal(t, ErrWALClosed, w.Repair(&CorruptionErr{Segment: 0}))
+	assert.Equal(t, ErrWALClosed, w.Close())
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_max_size")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	rec := make([]byte, 100)
+	limit := int64(3 * EncodedSize(rec))
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithMaxTotalSize(limit))
+	assert.NoError(t, err)
+	defer w.Close()
+
+	// A batch exceeding the limit by a single record is rejected up front.
+	assert.Equal(t, ErrWALFull, w.CanLog(rec, rec, rec, rec))
+	_, err = w.Log(rec, rec, rec, rec)
+	assert.Equal(t, ErrWALFull, err)
+	assert.Equal(t, int64(0), w.size)
+
+	// Filling up to exactly the limit succeeds.
+	assert.NoError(t, w.CanLog(rec, rec))
+	_, err = w.Log(rec, rec)
+	assert.NoError(t, err)
+	assert.NoError(t, w.CanLog(rec))
+	_, err = w.Log(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, limit, w.size)
+
+	assert.Equal(t, ErrWALFull, w.CanLog(nil))
+	_, err = w.Log(nil)
+	assert.Equal(t, ErrWALFull, err)
+	assert.Equal(t, limit, w.size)
+}
+
+func TestEncodedSize(t *testing.T) {
+	assert.Equal(t, recordHeaderSize, EncodedSize(nil))
+	assert.Equal(t, pageSize, EncodedSize(make([]byte, pageSize-recordHeaderSize)))
+	assert.Equal(t, pageSize+recordHeaderSize+1, EncodedSize(make([]byte, pageSize-recordHeaderSize+1)))
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_config")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, true, WithMaxTotalSize(pageSize*100), WithFlushStrategy(FlushPerRecord))
+	assert.NoError(t, err)
+	defer w.Close()
+
+	assert.Equal(t, WALConfig{
+		PageSize:      pageSize,
+		SegmentSize:   pageSize * 4,
+		Compress:      true,
+		Compression:   CompressionSnappy,
+		MaxTotalSize:  pageSize * 100,
+		FlushStrategy: FlushPerRecord,
+		SyncPolicy:    SyncOnLog,
+		FormatVersion: formatV1,
+	}, w.Config())
+}
+
+func TestConfigReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_config")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSegmentHeader(true))
+	assert.NoError(t, err)
+	_, err = w.Log([]byte{1})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	// The continued segment keeps the format it was written in.
+	w, err = NewSize(zerolog.Nop(), nil, dir, pageSize*8, true, WithSegmentHeader(true), WithOpenMode(OpenAppend), WithSyncPolicy(SyncNever))
+	assert.NoError(t, err)
+	c := w.Config()
+	assert.Equal(t, 0, w.LastSegment())
+	assert.Equal(t, formatV2, w.openedVersion, "format not read from the segment header")
+	assert.Equal(t, formatV2, c.FormatVersion)
+	assert.Equal(t, pageSize, c.PageSize)
+	assert.Equal(t, pageSize*8, c.SegmentSize)
+	assert.True(t, c.Compress)
+	assert.Equal(t, SyncNever, c.SyncPolicy)
+	assert.NoError(t, w.Close())
+
+	// Segments written in another format aren't continued, so the new one
+	// has the format of the options.
+	w, err = NewSize(zerolog.Nop(), nil, dir, pageSize*8, false, WithPageSize(pageSize/2), WithOpenMode(OpenAppend))
+	assert.NoError(t, err)
+	c = w.Config()
+	assert.Equal(t, 1, w.LastSegment())
+	assert.Equal(t, formatV3, c.FormatVersion)
+	assert.Equal(t, pageSize/2, c.PageSize)
+	_, err = w.Log([]byte{2})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	// Nor is the one with the smaller page size with the default options.
+	w, err = NewSize(zerolog.Nop(), nil, dir, pageSize*8, false, WithOpenMode(OpenAppend))
+	assert.NoError(t, err)
+	defer w.Close()
+	c = w.Config()
+	assert.Equal(t, 2, w.LastSegment())
+	assert.Equal(t, formatV1, c.FormatVersion)
+	assert.Equal(t, pageSize, c.PageSize)
+}
+
+func TestLog_ReusedBuffers(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_log_reused")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			// The default flush strategy keeps partial pages buffered, so
+			// records that were merely copied into the active page are
+			// covered as well.
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, compress)
+			assert.NoError(t, err)
+
+			pool := sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+			var recs [][]byte
+			for i := 0; i < 100; i++ {
+				buf := pool.Get().(*bytes.Buffer)
+				buf.Reset()
+				for buf.Len() < rand.Intn(2*pageSize) {
+					fmt.Fprintf(buf, "record %d ", i)
+				}
+				recs = append(recs, append([]byte{}, buf.Bytes()...))
+
+				_, err := w.Log(buf.Bytes())
+				assert.NoError(t, err)
+				// Scribble over the buffer before handing it out again.
+				for j := range buf.Bytes() {
+					buf.Bytes()[j] = 0xff
+				}
+				pool.Put(buf)
+			}
+			assert.NoError(t, w.Close())
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			assert.NoError(t, err)
+			defer sr.Close()
+			r := NewReader(sr)
+			var got [][]byte
+			for r.Next() {
+				got = append(got, append([]byte{}, r.Record()...))
+			}
+			assert.NoError(t, r.Err())
+			assert.Equal(t, recs, got)
+		})
+	}
+}
+
+func TestSegmentRemaining(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segment_header=%t", header), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_segment_remaining")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSegmentHeader(header))
+			assert.NoError(t, err)
+			defer w.Close()
+
+			want := int64(4 * pageSize)
+			if header {
+				want -= int64(segmentHeaderSize)
+			}
+			assert.Equal(t, want, w.SegmentRemaining())
+
+			for i := 0; i < 300; i++ {
+				remaining := w.SegmentRemaining()
+				// Pick sizes around the exact fit as well as ones leaving
+				// less than a header at the end of a page.
+				var n int
+				switch i % 3 {
+				case 0:
+					n = rand.Intn(2 * pageSize)
+				case 1:
+					n = int(remaining) - recordHeaderSize*(int(remaining)/pageSize+1) + rand.Intn(3) - 1
+				default:
+					n = int(remaining)%pageSize - recordHeaderSize - rand.Intn(2*recordHeaderSize)
+				}
+				if n < 0 {
+					n = 0
+				}
+				rec := make([]byte, n)
+				fits := int64(EncodedSize(rec)) <= remaining
+
+				segment := w.segment.Index()
+				locs, err := w.Log(rec)
+				assert.NoError(t, err)
+				assert.Equal(t, fits, locs[0].Segment == segment, "record of %d bytes with %d remaining", n, remaining)
+			}
+		})
+	}
+}
+
+func TestLog_Empty(t *testing.T) {
+	for _, syncOnEmpty := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sync_on_empty=%t", syncOnEmpty), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_log_empty")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			reg := prometheus.NewRegistry()
+			w, err := NewSize(zerolog.Nop(), reg, dir, pageSize*4, false, WithSyncOnEmptyLog(syncOnEmpty))
+			assert.NoError(t, err)
+
+			fsyncs := func() uint64 {
+				mfs, err := reg.Gather()
+				assert.NoError(t, err)
+				for _, mf := range mfs {
+					if mf.GetName() == "prometheus_tsdb_wal_fsync_duration_seconds" {
+						return mf.GetMetric()[0].GetHistogram().GetSampleCount()
+					}
+				}
+				return 0
+			}
+
+			_, err = w.Log([]byte{1})
+			assert.NoError(t, err)
+			synced := fsyncs()
+
+			for _, recs := range [][][]byte{nil, {}} {
+				locs, err := w.Log(recs...)
+				assert.NoError(t, err)
+				assert.Equal(t, []LogLocation{}, locs)
+			}
+			if syncOnEmpty {
+				assert.Equal(t, synced+2, fsyncs())
+			} else {
+				assert.Equal(t, synced, fsyncs())
+			}
+
+			assert.NoError(t, w.Close())
+			_, err = w.Log()
+			assert.Equal(t, ErrWALClosed, err)
+		})
+	}
+}
+
+func TestTrimEmptyOnClose(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segment_header=%t", header), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_trim_empty")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			open := func() *WAL {
+				w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithTrimEmptyOnClose(true), WithSegmentHeader(header))
+				assert.NoError(t, err)
+				return w
+			}
+			segments := func() (int, int) {
+				first, last, err := Segments(dir)
+				assert.NoError(t, err)
+				return first, last
+			}
+
+			// The only segment is kept even if it's empty.
+			w := open()
+			assert.NoError(t, w.Close())
+			first, last := segments()
+			assert.Equal(t, 0, first)
+			assert.Equal(t, 0, last)
+
+			w = open()
+			_, err = w.Log([]byte{1})
+			assert.NoError(t, err)
+			assert.NoError(t, w.NextSegment())
+			assert.NoError(t, w.Close())
+			first, last = segments()
+			assert.Equal(t, 0, first)
+			assert.Equal(t, 1, last)
+
+			// Reopening creates the removed segment again.
+			w = open()
+			loc, err := w.Log([]byte{2})
+			assert.NoError(t, err)
+			assert.Equal(t, 2, loc[0].Segment)
+			assert.NoError(t, w.Close())
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			assert.NoError(t, err)
+			defer sr.Close()
+			r := NewReader(sr)
+			var recs []byte
+			for r.Next() {
+				recs = append(recs, r.Record()...)
+			}
+			assert.NoError(t, r.Err())
+			assert.Equal(t, []byte{1, 2}, recs)
+		})
+	}
+}
+
+func TestSlowLogCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_slow_log")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	type report struct {
+		d    time.Duration
+		recs int
+	}
+	reports := make(chan report, 10)
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSlowLogCallback(50*time.Millisecond, func(d time.Duration, recs int) {
+		reports <- report{d, recs}
+	}))
+	assert.NoError(t, err)
+
+	_, err = w.Log([]byte{1})
+	assert.NoError(t, err)
+
+	// Stall writes.
+	w.writeHook = func(s *Segment, b []byte) (int, error) {
+		time.Sleep(60 * time.Millisecond)
+		return s.Write(b)
+	}
+	_, err = w.Log([]byte{2}, []byte{3})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	// Only the slow call was reported.
+	close(reports)
+	var got []report
+	for r := range reports {
+		got = append(got, r)
+	}
+	assert.Len(t, got, 1)
+	assert.Equal(t, 2, got[0].recs)
+	assert.True(t, got[0].d >= 60*time.Millisecond, "unexpected duration %s", got[0].d)
+}
+
+func TestLogWithIndexUpdate(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segment_header=%t", header), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_index_update")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSegmentHeader(header))
+			assert.NoError(t, err)
+
+			index := map[LogLocation]byte{}
+			errIndex := errors.New("index failure")
+			add := func(rec []byte, fail bool) (LogLocation, error) {
+				return w.LogWithIndexUpdate(rec, func(loc LogLocation) error {
+					if fail {
+						return errIndex
+					}
+					index[loc] = rec[0]
+					return nil
+				})
+			}
+
+			loc, err := add([]byte{1}, false)
+			assert.NoError(t, err)
+			assert.Equal(t, byte(1), index[loc])
+
+			// Failed updates roll back the record, including ones that
+			// started a new segment.
+			_, err = add(append([]byte{2}, make([]byte, pageSize)...), true)
+			assert.Equal(t, errIndex, err)
+			_, err = add(append([]byte{3}, make([]byte, 3*pageSize)...), true)
+			assert.Equal(t, errIndex, err)
+
+			next, err := add(append([]byte{4}, make([]byte, 2*pageSize)...), false)
+			assert.NoError(t, err)
+			assert.Equal(t, byte(4), index[next])
+			assert.NoError(t, w.Close())
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			assert.NoError(t, err)
+			defer sr.Close()
+			r := NewReader(sr)
+			read := map[LogLocation]byte{}
+			for r.Next() {
+				read[r.recStart] = r.Record()[0]
+			}
+			assert.NoError(t, r.Err())
+			assert.Equal(t, index, read)
+		})
+	}
+}
+
+func TestLogWithIndexUpdateSyncNever(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_index_update")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSyncPolicy(SyncNever))
+	assert.NoError(t, err)
+	defer w.Close()
+
+	// The record is synced before update is called, although Log doesn't sync.
+	var synced LogLocation
+	loc, err := w.LogWithIndexUpdate([]byte{1}, func(loc LogLocation) error {
+		synced = w.synced
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, LogLocation{Segment: loc.Segment, Offset: loc.Offset + recordHeaderSize + 1}, synced)
+
+	// update isn't called if the record can't be synced.
+	errSync := errors.New("sync failed")
+	w.syncHook = func(*os.File) error { return errSync }
+	called := false
+	_, err = w.LogWithIndexUpdate([]byte{2}, func(LogLocation) error {
+		called = true
+		return nil
+	})
+	assert.True(t, errors.Is(err, errSync), "unexpected error %v", err)
+	assert.False(t, called)
+	w.syncHook = nil
+}
+
+func TestLogAligned(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segment_header=%t", header), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_log_aligned")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithSegmentHeader(header))
+			assert.NoError(t, err)
+
+			recs := [][]byte{make([]byte, 100), {1}, make([]byte, 100), {2}, make([]byte, 2*pageSize)}
+			_, err = w.Log(recs[0])
+			assert.NoError(t, err)
+			loc, err := w.LogAligned(recs[1])
+			assert.NoError(t, err)
+			assert.Equal(t, LogLocation{Segment: 0, Offset: pageSize}, loc)
+
+			// Records follow aligned ones directly.
+			locs, err := w.Log(recs[2])
+			assert.NoError(t, err)
+			assert.Equal(t, pageSize+recordHeaderSize+1, locs[0].Offset)
+
+			loc, err = w.LogAligned(recs[3])
+			assert.NoError(t, err)
+			assert.Equal(t, LogLocation{Segment: 0, Offset: 2 * pageSize}, loc)
+
+			// Aligned records starting a new segment skip the segment header.
+			loc, err = w.LogAligned(recs[4])
+			assert.NoError(t, err)
+			if header {
+				assert.Equal(t, LogLocation{Segment: 1, Offset: pageSize}, loc)
+			} else {
+				assert.Equal(t, LogLocation{Segment: 1, Offset: 0}, loc)
+			}
+			assert.NoError(t, w.Close())
+
+			sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+			assert.NoError(t, err)
+			defer sr.Close()
+
+			r := NewReader(sr)
+			for _, rec := range recs {
+				assert.True(t, r.Next(), "expected record: %v", r.Err())
+				assert.Equal(t, rec, r.Record())
+			}
+			assert.False(t, r.Next())
+			assert.NoError(t, r.Err())
+		})
+	}
+}
+
+func TestLogAlignedTo(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		t.Run(fmt.Sprintf("segment_header=%t", header), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_log_aligned_to")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*8, false, WithSegmentHeader(header))
+			assert.NoError(t, err)
+
+			for _, alignment := range []int{0, 3, 100, 16 * pageSize} {
+				_, err := w.LogAlignedTo([]byte{1}, alignment)
+				assert.Error(t, err, "alignment %d", alignment)
+			}
+
+			var (
+				recs [][]byte
+				locs []LogLocation
+			)
+			alignments := []int{1, 2, 8, 64, 512, 4096, pageSize, 2 * pageSize}
+			for i := 0; i < 200; i++ {
+				rec := make([]byte, rand.Intn(2*pageSize))
+				rand.Read(rec)
+				recs = append(recs, rec)
+				if i%3 == 0 {
+					l, err := w.Log(rec)
+					assert.NoError(t, err)
+					locs = append(locs, l[0])
+					continue
+				}
+				alignment := alignments[rand.Intn(len(alignments))]
+				loc, err := w.LogAlignedTo(rec, alignment)
+				assert.NoError(t, err)
+				assert.Zero(t, loc.Offset%alignment, "offset %d, alignment %d", loc.Offset, alignment)
+				locs = append(locs, loc)
+			}
+
+			// Behind a segment header, a segment has no aligned offset with room
+			// for the record.
+			rec := make([]byte, 5*pageSize)
+			loc, err := w.LogAlignedTo(rec, 4*pageSize)
+			if header {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Zero(t, loc.Offset)
+				recs = append(recs, rec)
+				locs = append(locs, loc)
+			}
+			assert.NoError(t, w.Close())
+
+			// Records can be accessed directly at their aligned offsets.
+			for i, loc := range locs {
+				b, err := ioutil.ReadFile(SegmentName(dir, loc.Segment))
+				assert.NoError(t, err)
+				n := min(len(recs[i]), pageSize-loc.Offset%pageSize-recordHeaderSize)
+				assert.Equal(t, recs[i][:n], b[loc.Offset+recordHeaderSize:loc.Offset+recordHeaderSize+n])
+			}
+
+			for _, lazy := range []bool{false, true} {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				assert.NoError(t, err)
+				r := NewReader(sr, WithLazyChecksum(lazy))
+				for i, rec := range recs {
+					assert.True(t, r.Next(), "expected record %d: %v", i, r.Err())
+					assert.Equal(t, rec, r.Record())
+					assert.Equal(t, locs[i], r.recStart)
+				}
+				assert.False(t, r.Next())
+				assert.NoError(t, r.Err())
+				assert.NoError(t, sr.Close())
+			}
+		})
+	}
+}
+
+func TestFlushStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy FlushStrategy
+		offsets  []int
+	}{
+		{FlushPerPage, []int{0, 107, 214}},
+		{FlushPerRecord, []int{0, pageSize, 2 * pageSize}},
+	} {
+		t.Run(fmt.Sprintf("strategy=%d", tc.strategy), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wal_flush_strategy")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(dir))
+			}()
+
+			w, err := NewSize(zerolog.Nop(), nil, dir, pageSize*4, false, WithFlushStrategy(tc.strategy))
+			assert.NoError(t, err)
+
+			recs := [][]byte{make([]byte, 100), make([]byte, 100), make([]byte, 100)}
+			locs, err := w.Log(recs...)
+			assert.NoError(t, err)
+			for i, loc := range locs {
+				assert.Equal(t, tc.offsets[i], loc.Offset)
+			}
+
+			read := func() {
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				assert.NoError(t, err)
+				defer sr.Close()
+
+				r := NewReader(sr)
+				var n int
+				for ; r.Next(); n++ {
+					assert.Equal(t, recs[n], r.Record())
+				}
+				assert.NoError(t, r.Err())
+				assert.Equal(t, len(recs), n)
+			}
+			// Nothing is left buffered once Log returns, the partial page is
+			// readable from the file before it's completed.
+			read()
+			assert.NoError(t, w.Close())
+			read()
+		})
+	}
+}
+
+// TestLogDiskFull ensures that running out of disk space while writing a
+// record doesn't leave a torn record behind.
+func TestLogDiskFull(t *testing.T) {
+	for name, tc := range map[string]struct {
+		before [][]byte // Records logged successfully beforehand.
+		rec    []byte   // Record that fails.
+		failAt int      // Write that fails.
+	}{
+		"small_record": {
+			before: [][]byte{make([]byte, 100)},
+			rec:    make([]byte, 100),
+			failAt: 0,
+		},
+		"multi_page_record": {
+			before: [][]byte{make([]byte, 100)},
+			rec:    make([]byte, 2*pageSize),
+			failAt: 1,
+		},
+		"after_page_completion": {
+			before: [][]byte{make([]byte, 100)},
+			rec:    make([]byte, 2*pageSize),
+			failAt: 2,
+		},
+		"new_segment": {
+			before: [][]byte{make([]byte, 3*pageSize)},
+			rec:    make([]byte, 2*pageSize),
+			failAt: 2,
+		},
+	} {
+		for _, header := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/segment_header=%t", name, header), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wal_disk_full")
+				assert.NoError(t, err)
+				defer func() {
+					assert.NoError(t, os.RemoveAll(dir))
+				}()
+
+				w, err := NewSize(zerolog.Nop(), nil, dir, 4*pageSize, false, WithSegmentHeader(header))
+				assert.NoError(t, err)
+
+				_, err = w.Log(tc.before...)
+				assert.NoError(t, err)
+
+				writes := 0
+				w.writeHook = func(s *Segment, b []byte) (int, error) {
+					if writes++; writes <= tc.failAt {
+						return s.Write(b)
+					}
+					n, err := s.Write(b[:len(b)/2])
+					if err != nil {
+						return n, err
+					}
+					return n, &os.PathError{Op: "write", Path: s.Name(), Err: syscall.ENOSPC}
+				}
+				_, err = w.Log(tc.rec)
+				assert.Equal(t, ErrDiskFull, err)
+				w.writeHook = nil
+
+				after := []byte{1, 2, 3}
+				_, err = w.Log(after)
+				assert.NoError(t, err)
+				assert.NoError(t, w.Close())
+
+				size, err := segmentsSize(dir)
+				assert.NoError(t, err)
+				assert.Equal(t, size, w.size)
+
+				sr, err := NewSegmentsReader(zerolog.Nop(), dir)
+				assert.NoError(t, err)
+				defer sr.Close()
+
+				r := NewReader(sr)
+				for _, rec := range append(tc.before, after) {
+					assert.True(t, r.Next(), "expected record: %v", r.Err())
+					assert.Equal(t, rec, r.Record())
+				}
+				assert.False(t, r.Next())
+				assert.NoError(t, r.Err())
+			})
+		}
+	}
+}
+
 func TestSegmentMetric(t *testing.T) {
 	var (
 		segmentSize = pageSize
@@ -391,6 +1175,48 @@ func TestSegmentMetric(t *testing.T) {
 	assert.NoError(t, w.Close())
 }
 
+func TestWALMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_metrics")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	reg := prometheus.NewRegistry()
+	w, err := NewSize(zerolog.Nop(), reg, dir, 2*pageSize, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, client_testutil.ToFloat64(w.metrics.segmentsCreated))
+
+	_, err = w.Log(make([]byte, pageSize/4-recordHeaderSize), []byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, client_testutil.ToFloat64(w.metrics.recordsWritten))
+	assert.Equal(t, float64(pageSize/4+recordHeaderSize+1), client_testutil.ToFloat64(w.metrics.bytesWritten))
+	assert.Equal(t, float64(pageSize/4+recordHeaderSize+1)/pageSize, client_testutil.ToFloat64(w.metrics.pageUtilization))
+
+	// Records filling the rest of the segment start another one.
+	_, err = w.Log(make([]byte, pageSize))
+	assert.NoError(t, err)
+	_, err = w.Log(make([]byte, pageSize))
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, client_testutil.ToFloat64(w.metrics.recordsWritten))
+	assert.Equal(t, 2.0, client_testutil.ToFloat64(w.metrics.segmentsCreated))
+	size, err := segmentsSize(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(size), client_testutil.ToFloat64(w.metrics.bytesWritten))
+	assert.NoError(t, w.Close())
+
+	// fsyncs are observed in a histogram.
+	var fsyncs uint64
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "prometheus_tsdb_wal_fsync_duration_seconds" {
+			fsyncs = mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	assert.GreaterOrEqual(t, fsyncs, uint64(3))
+}
+
 func TestCompression(t *testing.T) {
 	bootstrap := func(compressed bool) string {
 		const (
@@ -493,3 +1319,33 @@ func BenchmarkWAL_Log(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkLogManySmall(b *testing.B) {
+	for _, size := range []int{4, 32, 64} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench_logmanysmall")
+			assert.NoError(b, err)
+			defer func() {
+				assert.NoError(b, os.RemoveAll(dir))
+			}()
+
+			w, err := New(zerolog.Nop(), nil, dir, false, WithSyncPolicy(SyncNever))
+			assert.NoError(b, err)
+			defer w.Close()
+
+			recs := make([][]byte, 1000)
+			for i := range recs {
+				recs[i] = make([]byte, size)
+			}
+			b.SetBytes(int64(len(recs) * size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, err := w.Log(recs...)
+				assert.NoError(b, err)
+			}
+			b.StopTimer()
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package walgrpc
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+
+	"github.com/onflow/wal/wal"
+)
+
+// DefaultRetryInterval is the default time a client waits before reconnecting
+// after a stream failed.
+const DefaultRetryInterval = time.Second
+
+// Client replicates the records streamed by a Server into a local WAL.
+type Client struct {
+	logger        zerolog.Logger
+	conn          grpc.ClientConnInterface
+	retryInterval time.Duration
+}
+
+// ClientOption configures optional behavior of a Client.
+type ClientOption func(*Client)
+
+// WithRetryInterval sets the time the client waits before reconnecting after
+// a stream failed, DefaultRetryInterval by default.
+func WithRetryInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retryInterval = d
+	}
+}
+
+// NewClient returns a client replicating from the server at the other end of
+// conn.
+func NewClient(logger zerolog.Logger, conn grpc.ClientConnInterface, opts ...ClientOption) *Client {
+	c := &Client{logger: logger, conn: conn, retryInterval: DefaultRetryInterval}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// localErr wraps failures to write to the local WAL, which aren't retried.
+type localErr struct {
+	err error
+}
+
+func (e localErr) Error() string {
+	return e.err.Error()
+}
+
+// Replicate logs the records of the source WAL at and after start to dst in
+// order and keeps following the source until ctx is done or logging to dst
+// fails. If the stream fails, e.g. because the connection was lost or the
+// server restarted, the client reconnects after the retry interval and
+// resumes after the last record it received, so no record is logged twice.
+//
+// It returns the location in the source WAL of the last record logged to dst,
+// or start if there was none, along with the error that stopped it. To resume
+// later without logging that record again, pass it to ReplicateAfter.
+func (c *Client) Replicate(ctx context.Context, dst *wal.WAL, start wal.LogLocation) (wal.LogLocation, error) {
+	return c.replicate(ctx, dst, start, false)
+}
+
+// ReplicateAfter is like Replicate but starts after the record at last, as
+// returned by Replicate.
+func (c *Client) ReplicateAfter(ctx context.Context, dst *wal.WAL, last wal.LogLocation) (wal.LogLocation, error) {
+	return c.replicate(ctx, dst, last, true)
+}
+
+func (c *Client) replicate(ctx context.Context, dst *wal.WAL, from wal.LogLocation, skip bool) (wal.LogLocation, error) {
+	for {
+		last, received, err := c.stream(ctx, dst, from, skip)
+		if received {
+			from, skip = last, true
+		}
+		if ctx.Err() != nil {
+			return from, ctx.Err()
+		}
+		var lerr localErr
+		if errors.As(err, &lerr) {
+			return from, lerr.err
+		}
+		c.logger.Warn().Err(err).Msgf("replication stream failed, resuming from %+v in %s", from, c.retryInterval)
+
+		t := time.NewTimer(c.retryInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return from, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// stream logs the records of a single stream starting at from to dst, skipping
+// the record at from if skip is set. It returns the location of the last
+// record logged and whether there was any.
+func (c *Client) stream(ctx context.Context, dst *wal.WAL, from wal.LogLocation, skip bool) (last wal.LogLocation, received bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], streamPath, grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return last, false, errors.Wrap(err, "open stream")
+	}
+	if err := s.SendMsg(&streamRequest{start: from}); err != nil {
+		return last, false, errors.Wrap(err, "send request")
+	}
+	if err := s.CloseSend(); err != nil {
+		return last, false, errors.Wrap(err, "close send")
+	}
+
+	var m streamRecord
+	for {
+		if err := s.RecvMsg(&m); err != nil {
+			if err == io.EOF {
+				err = errors.New("stream ended")
+			}
+			return last, received, errors.Wrap(err, "receive record")
+		}
+		if skip && m.loc == from {
+			// Received before reconnecting.
+			skip = false
+			continue
+		}
+		skip = false
+		if _, err := dst.Log(m.rec); err != nil {
+			return last, received, localErr{errors.Wrapf(err, "log record from %+v", m.loc)}
+		}
+		last, received = m.loc, true
+	}
+}
@@ -0,0 +1,74 @@
+package walgrpc
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/encoding"
+
+	"github.com/onflow/wal/wal"
+)
+
+// codecName is the content subtype of the replication service's messages.
+const codecName = "walgrpc"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// streamRequest asks the server to stream records at and after start.
+type streamRequest struct {
+	start wal.LogLocation
+}
+
+// streamRecord is a record streamed by the server along with its location in
+// the source WAL.
+type streamRecord struct {
+	loc wal.LogLocation
+	rec []byte
+}
+
+// codec encodes the messages of the replication service, which are simple
+// enough to do without protobuf. Requests are encoded locations, see
+// wal.LogLocation.MarshalBinary. Records are the size of the encoded location
+// as a byte, the location and the record.
+type codec struct{}
+
+func (codec) Name() string {
+	return codecName
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case *streamRequest:
+		return m.start.MarshalBinary()
+	case *streamRecord:
+		loc, err := m.loc.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, 0, 1+len(loc)+len(m.rec))
+		b = append(b, byte(len(loc)))
+		b = append(b, loc...)
+		return append(b, m.rec...), nil
+	default:
+		return nil, errors.Errorf("unexpected message type %T", v)
+	}
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case *streamRequest:
+		return m.start.UnmarshalBinary(data)
+	case *streamRecord:
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return errors.New("truncated record message")
+		}
+		n := 1 + int(data[0])
+		if err := m.loc.UnmarshalBinary(data[1:n]); err != nil {
+			return err
+		}
+		m.rec = append(m.rec[:0], data[n:]...)
+		return nil
+	default:
+		return errors.Errorf("unexpected message type %T", v)
+	}
+}
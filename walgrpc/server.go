@@ -0,0 +1,88 @@
+// Package walgrpc streams the records of a WAL to remote replicas over gRPC.
+// It's a separate module so that the WAL itself doesn't depend on gRPC.
+package walgrpc
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/onflow/wal/wal"
+)
+
+// Full name of the replication service and its only method, which streams
+// records from a location on.
+const (
+	serviceName = "wal.Replication"
+	streamName  = "Stream"
+	streamPath  = "/" + serviceName + "/" + streamName
+)
+
+// replicationServer is implemented by Server.
+type replicationServer interface {
+	stream(start wal.LogLocation, stream grpc.ServerStream) error
+}
+
+// serviceDesc describes the replication service to gRPC. Its messages are
+// encoded by codec, which clients select by its content subtype.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*replicationServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    streamName,
+		Handler:       streamHandler,
+		ServerStreams: true,
+	}},
+	Metadata: "walgrpc",
+}
+
+func streamHandler(srv interface{}, stream grpc.ServerStream) error {
+	var req streamRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	return srv.(replicationServer).stream(req.start, stream)
+}
+
+// Server streams the records of a WAL to clients, see Client.
+type Server struct {
+	logger zerolog.Logger
+	w      *wal.WAL
+}
+
+// NewServer returns a server streaming the records of w.
+func NewServer(logger zerolog.Logger, w *wal.WAL) *Server {
+	return &Server{logger: logger, w: w}
+}
+
+// Register registers the replication service with g.
+func (s *Server) Register(g *grpc.Server) {
+	g.RegisterService(&serviceDesc, s)
+}
+
+// stream sends the records at and after start to the client and keeps
+// following the WAL until the client goes away or the WAL is closed, see
+// wal.WAL.Consume. Records are sent once they are synced.
+func (s *Server) stream(start wal.LogLocation, stream grpc.ServerStream) error {
+	s.logger.Debug().Msgf("streaming records from %+v", start)
+	err := s.w.Consume(stream.Context(), start, func(rec []byte, loc wal.LogLocation) error {
+		return stream.SendMsg(&streamRecord{loc: loc, rec: rec})
+	})
+	switch {
+	case errors.Is(err, wal.ErrWALClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case err != nil:
+		if _, ok := status.FromError(err); ok {
+			return err // Failed to send.
+		}
+		s.logger.Error().Err(err).Msgf("stream records from %+v", start)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
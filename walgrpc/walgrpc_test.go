@@ -0,0 +1,159 @@
+package walgrpc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/onflow/wal/wal"
+)
+
+// testServer serves the replication service of a WAL over an in-process
+// connection that can be restarted.
+type testServer struct {
+	src *wal.WAL
+
+	mtx sync.Mutex
+	lis *bufconn.Listener
+	g   *grpc.Server
+}
+
+func (s *testServer) start() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lis = bufconn.Listen(1 << 20)
+	s.g = grpc.NewServer()
+	NewServer(zerolog.Nop(), s.src).Register(s.g)
+	go s.g.Serve(s.lis)
+}
+
+func (s *testServer) stop() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.g.Stop()
+}
+
+func (s *testServer) dial(ctx context.Context, _ string) (net.Conn, error) {
+	s.mtx.Lock()
+	lis := s.lis
+	s.mtx.Unlock()
+	return lis.DialContext(ctx)
+}
+
+// readAll returns the records in dir. Records being written while dir is read
+// may not be complete yet, so the records before a failure are returned along
+// with it.
+func readAll(dir string) ([][]byte, error) {
+	var recs [][]byte
+	var rerr error
+	wal.Records(dir)(func(rec []byte, _ wal.LogLocation, err error) bool {
+		if err != nil {
+			rerr = err
+			return false
+		}
+		recs = append(recs, append([]byte(nil), rec...))
+		return true
+	})
+	return recs, rerr
+}
+
+func TestReplicate(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "walgrpc_src")
+	require.NoError(t, err)
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "walgrpc_dst")
+	require.NoError(t, err)
+	defer os.RemoveAll(dstDir)
+
+	src, err := wal.NewSize(zerolog.Nop(), nil, srcDir, 4*32*1024, false)
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := wal.New(zerolog.Nop(), nil, dstDir, false)
+	require.NoError(t, err)
+
+	var want [][]byte
+	logRecords := func(n int) {
+		for i := 0; i < n; i++ {
+			rec := []byte(fmt.Sprintf("record %d", len(want)))
+			_, err := src.Log(rec)
+			require.NoError(t, err)
+			want = append(want, rec)
+		}
+	}
+	logRecords(100)
+
+	s := &testServer{src: src}
+	s.start()
+	defer s.stop()
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(s.dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		last wal.LogLocation
+		err  error
+	}
+	resc := make(chan result, 1)
+	c := NewClient(zerolog.Nop(), conn, WithRetryInterval(10*time.Millisecond))
+	go func() {
+		last, err := c.Replicate(ctx, dst, wal.LogLocation{})
+		resc <- result{last, err}
+	}()
+	replicated := func() bool {
+		recs, _ := readAll(dstDir)
+		return len(recs) == len(want)
+	}
+
+	// Existing records are replicated and the source is followed.
+	require.Eventually(t, replicated, 10*time.Second, 10*time.Millisecond)
+	logRecords(100)
+	require.Eventually(t, replicated, 10*time.Second, 10*time.Millisecond)
+
+	// The client resumes after the last record it received when the server
+	// restarts.
+	s.stop()
+	logRecords(100)
+	s.start()
+	require.Eventually(t, replicated, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	res := <-resc
+	require.Equal(t, context.Canceled, res.err)
+	locs, err := src.Log([]byte("last"))
+	require.NoError(t, err)
+
+	// Resuming later skips the last record replicated before.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		last, err := c.ReplicateAfter(ctx, dst, res.last)
+		resc <- result{last, err}
+	}()
+	want = append(want, []byte("last"))
+	require.Eventually(t, replicated, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	res = <-resc
+	require.Equal(t, context.Canceled, res.err)
+	require.Equal(t, locs[0], res.last)
+
+	require.NoError(t, dst.Close())
+	recs, err := readAll(dstDir)
+	require.NoError(t, err)
+	require.Equal(t, want, recs)
+}